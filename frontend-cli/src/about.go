@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const REPORT_SECRET = "********"
+
+// # Report setting
+//
+// This struct is a setting of the startup report, with where its value came from: "flag", "env" or "file".
+type ReportSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// # Startup report
+//
+// This struct is what a running instance is actually using, resolved at startup, for the operators:
+// the settings not left to their defaults, the backend and the model, the chat template, the frontends,
+// the optional subsystems enabled, and the files the bot reads and writes. It's printed once at boot, and shown by `/about`.
+type StartupReport struct {
+	StartedAt    time.Time
+	Settings     []ReportSetting // Settings not left to their defaults, secrets masked.
+	Backend      []string        // The backend, and how the generations reach it.
+	Model        string          // Model requested from the backend, empty for the loaded model.
+	ChatTemplate string
+	Frontends    []string
+	Plugins      []string
+	Storage      []ReportSetting // Files and directories, with the setting naming them.
+}
+
+// # New startup report
+//
+// This function reports the settings of the flags, with the sources returned by `LoadConfiguration`,
+// and the files and directories they name.
+func NewStartupReport(flags *flag.FlagSet, sources map[string]string) *StartupReport {
+	report := &StartupReport{StartedAt: time.Now()}
+	flags.VisitAll(func(f *flag.Flag) {
+		value := reportValue(f.Name, f.Value.String())
+		if source, found := sources[f.Name]; found {
+			report.Settings = append(report.Settings, ReportSetting{Name: f.Name, Value: value, Source: source})
+		}
+		if value != "" && (strings.HasPrefix(f.Usage, "path of") || strings.HasPrefix(f.Usage, "directory")) {
+			source := sources[f.Name]
+			if source == "" {
+				source = "default"
+			}
+			report.Storage = append(report.Storage, ReportSetting{Name: f.Name, Value: value, Source: source})
+		}
+	})
+	return report
+}
+
+// # Report value
+//
+// This function masks the passwords and API keys of the settings, and the credentials of the URLs.
+func reportValue(name string, value string) string {
+	if value != "" && (strings.HasSuffix(name, "password") || strings.HasSuffix(name, "api-key")) {
+		return REPORT_SECRET
+	}
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return value
+}
+
+// # Plugins
+//
+// This function returns the names of the optional subsystems of the bot which are enabled.
+func (bot *Bot) Plugins() []string {
+	enabled := map[string]bool{
+		"memory":           bot.Memory != nil,
+		"gifs":             bot.Gifs != nil,
+		"image generation": bot.Images != nil,
+		"meme templates":   bot.MemeMaker != nil,
+		"transcription":    bot.Transcriber != nil,
+		"speech":           bot.Speech != nil,
+		"personas":         bot.Personas != nil,
+		"triggers":         bot.Triggers != nil,
+		"experiment":       bot.Experiment != nil,
+		"translation":      bot.Translator != nil,
+		"prompt cache":     bot.PromptCache != nil,
+		"link previews":    bot.Unfurler != nil,
+		"circuit breaker":  bot.Breaker != nil,
+		"fast path":        bot.FastPath != nil,
+		"profanity filter": bot.Profanity != nil,
+		"audit log":        bot.Audit != nil,
+		"feedback":         bot.Feedback != nil,
+		"journal":          bot.Journal != nil,
+		"search":           bot.Search != nil,
+		"session archive":  bot.SessionArchive != nil,
+		"burst cooldown":   bot.Burst != nil,
+		"retention":        bot.Retention.Enabled(),
+	}
+	var plugins []string
+	for name, on := range enabled {
+		if on {
+			plugins = append(plugins, name)
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
+
+// # Report text
+//
+// This function formats the report, one section per line or list.
+func (report *StartupReport) String() string {
+	var builder strings.Builder
+	list := func(items []string) string {
+		if len(items) == 0 {
+			return "none"
+		}
+		return strings.Join(items, ", ")
+	}
+	settings := func(title string, settings []ReportSetting) {
+		fmt.Fprintf(&builder, "%s:", title)
+		if len(settings) == 0 {
+			builder.WriteString(" none")
+		}
+		builder.WriteString("\n")
+		for _, setting := range settings {
+			fmt.Fprintf(&builder, "  %s = %s (%s)\n", setting.Name, setting.Value, setting.Source)
+		}
+	}
+
+	model := report.Model
+	if model == "" {
+		model = "the model loaded by the backend"
+	}
+	fmt.Fprintf(&builder, "Started: %s\n", report.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&builder, "Backend: %s\n", list(report.Backend))
+	fmt.Fprintf(&builder, "Model: %s\n", model)
+	fmt.Fprintf(&builder, "Chat template: %s\n", report.ChatTemplate)
+	fmt.Fprintf(&builder, "Frontends: %s\n", list(report.Frontends))
+	fmt.Fprintf(&builder, "Plugins: %s\n", list(report.Plugins))
+	settings("Settings", report.Settings)
+	settings("Storage", report.Storage)
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// # About
+//
+// This function handles the `/about` command, showing the startup report, and the model if it was switched since.
+func (bot *Bot) about(message Message, _ string) Reply {
+	if bot.About == nil {
+		return Reply{Text: bot.T(message, "No startup report.")}
+	}
+	text := bot.About.String()
+	if model_name := bot.Params().ModelName; model_name != bot.About.Model {
+		text += "\n" + bot.T(message, "Model switched since startup to %q.", model_name)
+	}
+	return Reply{Text: text}
+}
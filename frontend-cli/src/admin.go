@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// # Permission
+//
+// This type is the level of rights of a user, each level holding the rights of the levels below it.
+type Permission int
+
+const (
+	PERMISSION_USER      Permission = iota // Everyone.
+	PERMISSION_MODERATOR                   // Keeps the channels tidy, e.g. clears their sessions.
+	PERMISSION_ADMIN                       // Changes the settings and the model, sees the prompts.
+	PERMISSION_OWNER                       // Runs the bot, e.g. shuts it down.
+)
+
+var permission_names = []string{"user", "moderator", "admin", "owner"}
+
+const (
+	OWNER_ROLE     = "owner"     // Platform role granting the owner permission by default.
+	ADMIN_ROLE     = "admin"     // Platform role granting the admin permission by default.
+	MODERATOR_ROLE = "moderator" // Platform role granting the moderator permission by default.
+)
+
+func (permission Permission) String() string {
+	if permission < 0 || int(permission) >= len(permission_names) {
+		return fmt.Sprintf("permission(%d)", int(permission))
+	}
+	return permission_names[permission]
+}
+
+// # Permission policy
+//
+// This struct maps users to permissions: from lists of user IDs in the configuration, and from the roles the users hold
+// on their platform. A user gets the highest permission they are granted, whichever frontend their message comes from.
+type PermissionPolicy struct {
+	Users map[string]Permission
+	Roles map[string]Permission
+}
+
+func NewPermissionPolicy() *PermissionPolicy {
+	return &PermissionPolicy{Users: map[string]Permission{}, Roles: map[string]Permission{}}
+}
+
+// # Grant permission
+//
+// This function grants the permission to comma-separated lists of user IDs and role names.
+// A user or role granted several permissions keeps the highest.
+func (policy *PermissionPolicy) Grant(permission Permission, users string, roles string) {
+	grant := func(granted map[string]Permission, list string) {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" && granted[name] < permission {
+				granted[name] = permission
+			}
+		}
+	}
+	grant(policy.Users, users)
+	grant(policy.Roles, roles)
+}
+
+// # Permission of
+//
+// This function returns the permission of the sender of the message. Everyone is a user with a nil policy.
+func (policy *PermissionPolicy) Of(message Message) Permission {
+	if policy == nil {
+		return PERMISSION_USER
+	}
+	permission := policy.Users[message.User]
+	for _, role := range message.Roles {
+		permission = max(permission, policy.Roles[role])
+	}
+	return permission
+}
+
+// # Permits
+//
+// This function reports whether the sender of the message holds the permission.
+func (policy *PermissionPolicy) Permits(message Message, permission Permission) bool {
+	return policy.Of(message) >= permission
+}
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Channel string    `json:"channel"`
+	User    string    `json:"user"`
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+	Allowed bool      `json:"allowed"`
+}
+
+// # Audit log
+//
+// This struct appends audit entries to a JSON lines file.
+// A nil audit log drops the entries.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// # Open audit log
+//
+// This function opens the audit log at `path` for appending.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// # Record
+//
+// This function writes an entry to the audit log. Failures are logged, never returned:
+// a full disk shouldn't stop the bot from answering.
+func (audit *AuditLog) Record(entry AuditEntry) {
+	if audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if _, err := audit.file.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Record admin action
+//
+// This function writes an admin action, allowed or denied, to the audit log.
+func (audit *AuditLog) RecordAdmin(message Message, action string, detail string, allowed bool) {
+	audit.Record(AuditEntry{Kind: "admin", Channel: message.Channel, User: message.User, Action: action, Detail: detail, Allowed: allowed})
+}
+
+// # Admin command
+//
+// This function handles the `/admin` command. The command framework checks the permission of each action.
+//
+// Usage:
+//
+// - /admin model <name>: switch the model requested from the backend (admin)
+// - /admin reload: reload personas and channel settings (admin)
+// - /admin clear <channel>: clear the session of a channel (moderator)
+// - /admin shutdown: stop the bot (owner)
+func (bot *Bot) admin(message Message, args string) Reply {
+	action, detail, _ := strings.Cut(args, " ")
+	detail = strings.TrimSpace(detail)
+
+	switch action {
+	case "model":
+		if detail == "" {
+			return Reply{Text: bot.T(message, "Current model: %q", bot.Params().ModelName)}
+		}
+		bot.SetModel(detail)
+		return Reply{Text: bot.T(message, "Switched to model %q.", detail)}
+	case "reload":
+		if bot.Reload == nil {
+			return Reply{Text: bot.T(message, "Nothing to reload.")}
+		}
+		if err := bot.Reload(); err != nil {
+			log.Println(err)
+			return Reply{Text: bot.T(message, "Reload failed: %s", err)}
+		}
+		return Reply{Text: bot.T(message, "Configuration reloaded.")}
+	case "clear":
+		if detail == "" {
+			detail = message.Channel
+		}
+		bot.Sessions.Delete(detail)
+		return Reply{Text: bot.T(message, "Session of %s cleared.", detail)}
+	case "shutdown":
+		bot.Stop()
+		return Reply{Text: bot.T(message, "Bye!")}
+	default:
+		return Reply{Text: bot.T(message, "Usage: /admin model [name] | reload | clear [channel] | shutdown")}
+	}
+}
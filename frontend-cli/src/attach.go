@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ATTACH_AFTER_PARTS    = 3   // Messages a reply would be split into past which it's attached instead.
+	ATTACH_SUMMARY_RUNES  = 280 // Runes of the reply kept inline as its summary.
+	ATTACHMENT_FILE_NAME  = "reply.txt"
+	PASTE_TIMEOUT         = 30 * time.Second
+	PASTE_MAX_LINK_LENGTH = 2048 // Bytes of the paste service response read as the link.
+)
+
+// # Paste client
+//
+// This struct uploads long replies to a pastebin-style service and returns their link. The text is posted as the request body,
+// like paste.rs expects, or as a file in the multipart form field `Field`, like 0x0.st expects.
+// The service answers with the link of the paste as the response body.
+type PasteClient struct {
+	Url   string
+	Field string // Multipart form field of the text, empty to post it as the body.
+
+	http_client http.Client
+}
+
+func NewPasteClient(url string, field string) *PasteClient {
+	return &PasteClient{Url: url, Field: field, http_client: http.Client{Timeout: PASTE_TIMEOUT}}
+}
+
+// # Paste
+//
+// This function uploads the text and returns the link of the paste.
+func (client *PasteClient) Paste(text string) (string, error) {
+	body, content_type := io.Reader(strings.NewReader(text)), "text/plain; charset=utf-8"
+	if client.Field != "" {
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		part, err := writer.CreateFormFile(client.Field, ATTACHMENT_FILE_NAME)
+		if err != nil {
+			return "", err
+		}
+		if _, err := part.Write([]byte(text)); err != nil {
+			return "", err
+		}
+		if err := writer.Close(); err != nil {
+			return "", err
+		}
+		body, content_type = &form, writer.FormDataContentType()
+	}
+
+	resp, err := client.http_client.Post(client.Url, content_type, body)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	link, err := io.ReadAll(io.LimitReader(resp.Body, PASTE_MAX_LINK_LENGTH))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("paste failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(link)))
+	}
+	if !strings.HasPrefix(string(link), "http") {
+		return "", fmt.Errorf("paste service answered %q instead of a link", strings.TrimSpace(string(link)))
+	}
+	return strings.TrimSpace(string(link)), nil
+}
+
+// # Summarize reply
+//
+// This function returns the start of a long reply, its first paragraph at most, cut to `limit` runes.
+func summarizeReply(text string, limit int) string {
+	summary, _, _ := strings.Cut(strings.TrimSpace(text), "\n\n")
+	if strings.HasPrefix(summary, CODE_FENCE) {
+		return "" // A code block cut short is no summary.
+	}
+	return cutRunes(summary, limit)
+}
+
+// # Attach long reply
+//
+// This function moves the text of a reply that would be split into more than `ATTACH_AFTER_PARTS` messages
+// out of the message: to a paste when a paste service is set, or to a text file attached to the reply otherwise,
+// leaving its start inline as a summary. When the paste fails, the text is attached.
+func (bot *Bot) attachLongReply(message Message, reply Reply) Reply {
+	if !bot.AttachLongReplies || bot.MessageLimit <= 0 || utf8.RuneCountInString(reply.Text) <= bot.MessageLimit*ATTACH_AFTER_PARTS {
+		return reply
+	}
+
+	summary := summarizeReply(reply.Text, min(ATTACH_SUMMARY_RUNES, bot.MessageLimit/2)) // Half a message, the rest is for the link.
+	if bot.Paste != nil {
+		link, err := bot.Paste.Paste(reply.Text)
+		if err == nil {
+			reply.Text = strings.TrimSpace(summary + "\n\n" + bot.T(message, "Full reply: %s", link))
+			return reply
+		}
+		log.Println(err)
+	}
+	reply.File, reply.FileName = []byte(reply.Text), ATTACHMENT_FILE_NAME
+	reply.Text = strings.TrimSpace(summary + "\n\n" + bot.T(message, "(Full reply attached.)"))
+	return reply
+}
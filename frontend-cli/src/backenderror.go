@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const CONTEXT_LENGTH_EXCEEDED = "context_length_exceeded"
+
+// # Backend error
+//
+// This struct is an error reported by the backend, parsed from the OpenAI-style payload of llama-cpp-python:
+//
+//	{"error": {"message": "...", "type": "invalid_request_error", "param": "messages", "code": "context_length_exceeded"}}
+type BackendError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Param      string
+	Message    string
+}
+
+func (err *BackendError) Error() string {
+	kind := err.Type
+	if err.Code != "" {
+		kind = err.Code
+	}
+	if kind == "" {
+		return fmt.Sprintf("backend error (status %d): %s", err.StatusCode, err.Message)
+	}
+	return fmt.Sprintf("backend error (status %d, %s): %s", err.StatusCode, kind, err.Message)
+}
+
+// # Is context length exceeded
+//
+// This function reports whether the prompt didn't fit in the context window of the model.
+// Older llama-cpp-python versions don't set the code, so the message is checked too.
+func (err *BackendError) IsContextLengthExceeded() bool {
+	message := strings.ToLower(err.Message)
+	return err.Code == CONTEXT_LENGTH_EXCEEDED || strings.Contains(message, "context window") || strings.Contains(message, "context length")
+}
+
+// # Is retryable
+//
+// This function reports whether the same request may succeed later: server errors and rate limiting.
+// Bad requests fail the same way every time.
+func (err *BackendError) IsRetryable() bool {
+	return err.StatusCode >= 500 || err.StatusCode == http.StatusTooManyRequests
+}
+
+// # Parse backend error
+//
+// This function extracts the error of a backend response. It returns nil for successful responses without error payload.
+// Besides the OpenAI-style payload, the `{"detail": ...}` validation errors of FastAPI and plain text bodies are understood.
+func ParseBackendError(status_code int, body []byte) error {
+	var payload struct {
+		Error  json.RawMessage `json:"error"`
+		Detail json.RawMessage `json:"detail"`
+	}
+	json_err := json.Unmarshal(body, &payload)
+
+	backend_err := &BackendError{StatusCode: status_code}
+	switch {
+	case json_err == nil && len(payload.Error) > 0 && string(payload.Error) != "null":
+		var details struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Param   interface{} `json:"param"`
+			Code    interface{} `json:"code"`
+		}
+		if json.Unmarshal(payload.Error, &details) == nil {
+			backend_err.Message = details.Message
+			backend_err.Type = details.Type
+			if details.Param != nil {
+				backend_err.Param = fmt.Sprint(details.Param)
+			}
+			if details.Code != nil {
+				backend_err.Code = fmt.Sprint(details.Code)
+			}
+		} else {
+			// Some servers send the error as a bare string.
+			json.Unmarshal(payload.Error, &backend_err.Message)
+		}
+	case json_err == nil && len(payload.Detail) > 0 && status_code != http.StatusOK:
+		backend_err.Type = "invalid_request_error"
+		backend_err.Message = string(payload.Detail)
+	case status_code != http.StatusOK:
+		backend_err.Message = strings.TrimSpace(string(body))
+	default:
+		return nil
+	}
+
+	if backend_err.Message == "" {
+		backend_err.Message = http.StatusText(status_code)
+	}
+	return backend_err
+}
+
+// # User error message
+//
+// This function explains a generation error to the user, in the locale of the message.
+func (bot *Bot) userErrorMessage(message Message, err error) string {
+	var backend_err *BackendError
+	var empty_err *EmptyCompletionError
+	if errors.As(err, &empty_err) {
+		return bot.T(message, "I drew a blank, twice. Try asking another way?")
+	}
+	if !errors.As(err, &backend_err) {
+		return bot.T(message, GENERATION_ERROR_REPLY)
+	}
+	switch {
+	case backend_err.IsContextLengthExceeded():
+		return bot.T(message, "That's too much text for me to read at once (context length exceeded). Try something shorter.")
+	case backend_err.IsRetryable():
+		return bot.T(message, GENERATION_ERROR_REPLY)
+	default:
+		return bot.T(message, "The model refused that request: %s", backend_err.Message)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseBackendError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status_code int
+		body        string
+		want        *BackendError // Nil for no error.
+	}{
+		{"success", 200, `{"choices": [{"text": "hi"}]}`, nil},
+		{"OpenAI-style", 400, `{"error": {"message": "too long", "type": "invalid_request_error", "param": "messages", "code": "context_length_exceeded"}}`,
+			&BackendError{StatusCode: 400, Type: "invalid_request_error", Code: CONTEXT_LENGTH_EXCEEDED, Param: "messages", Message: "too long"}},
+		{"numeric code", 429, `{"error": {"message": "slow down", "code": 429}}`,
+			&BackendError{StatusCode: 429, Code: "429", Message: "slow down"}},
+		{"bare string", 400, `{"error": "plain string"}`, &BackendError{StatusCode: 400, Message: "plain string"}},
+		{"error in a successful response", 200, `{"error": {"message": "model not loaded"}}`, &BackendError{StatusCode: 200, Message: "model not loaded"}},
+		{"FastAPI validation", 422, `{"detail": [{"loc": ["body", "max_tokens"], "msg": "bad"}]}`,
+			&BackendError{StatusCode: 422, Type: "invalid_request_error", Message: `[{"loc": ["body", "max_tokens"], "msg": "bad"}]`}},
+		{"plain text", 500, "Internal Server Error\n", &BackendError{StatusCode: 500, Message: "Internal Server Error"}},
+		{"no body", 503, "", &BackendError{StatusCode: 503, Message: "Service Unavailable"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ParseBackendError(test.status_code, []byte(test.body))
+			if test.want == nil {
+				if err != nil {
+					t.Errorf("ParseBackendError = %v, want nil", err)
+				}
+				return
+			}
+			var backend_err *BackendError
+			if !errors.As(err, &backend_err) || !reflect.DeepEqual(backend_err, test.want) {
+				t.Errorf("ParseBackendError = %#v, want %#v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBackendErrorKinds(t *testing.T) {
+	tests := []struct {
+		err                     BackendError
+		context_length_exceeded bool
+		retryable               bool
+	}{
+		{BackendError{StatusCode: 400, Code: CONTEXT_LENGTH_EXCEEDED}, true, false},
+		{BackendError{StatusCode: 400, Message: "Requested tokens exceed context window of 2048"}, true, false},
+		{BackendError{StatusCode: 400, Message: "invalid temperature"}, false, false},
+		{BackendError{StatusCode: 429}, false, true},
+		{BackendError{StatusCode: 502}, false, true},
+	}
+	for _, test := range tests {
+		if got := test.err.IsContextLengthExceeded(); got != test.context_length_exceeded {
+			t.Errorf("%v: IsContextLengthExceeded = %v", &test.err, got)
+		}
+		if got := test.err.IsRetryable(); got != test.retryable {
+			t.Errorf("%v: IsRetryable = %v", &test.err, got)
+		}
+	}
+}
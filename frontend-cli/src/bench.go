@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const BENCH_DEFAULT_PROMPT = "Tell me a joke about programmers."
+
+// # Benchmark result
+//
+// This struct is the outcome of one benchmark request.
+type BenchResult struct {
+	Latency          time.Duration
+	CompletionTokens int
+	Err              error
+}
+
+// # Benchmark
+//
+// This function sends `requests` prompts to the completions endpoint, `concurrency` at a time,
+// and returns the result of every request.
+func Benchmark(server string, port int, endpoint string, params LlmGenerationParameters, requests int, concurrency int) []BenchResult {
+	results := make([]BenchResult, requests)
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				response, err := SendPrompt(server, port, endpoint, params)
+				result := BenchResult{Latency: time.Since(start), Err: err}
+				if err == nil {
+					parsed := ParseResponse(response)
+					if len(parsed.Choices) == 0 {
+						result.Err = fmt.Errorf("no completion in response: %.200s", response)
+					} else if parsed.Usage != nil {
+						result.CompletionTokens = parsed.Usage.CompletionTokens
+					}
+				}
+				results[i] = result
+			}
+		}()
+	}
+
+	for i := 0; i < requests; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// # Percentile
+//
+// This function returns the p-th percentile (0 to 100) of sorted durations, nearest-rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// # Bench subcommand
+//
+// This function handles `bench [-n requests] [-c concurrency] [-prompt text]`,
+// reporting the latency percentiles, the throughput and the error rate of the backend.
+// The sampling parameters are those of the bot flags.
+func runBenchCommand(server string, port int, endpoint string, param_template LlmGenerationParameters, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	requests := flags.Int("n", 20, "number of requests")
+	concurrency := flags.Int("c", 4, "number of concurrent requests")
+	prompt := flags.String("prompt", BENCH_DEFAULT_PROMPT, "prompt sent, formatted with the default chat template")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *requests <= 0 || *concurrency <= 0 {
+		return fmt.Errorf("-n and -c must be positive")
+	}
+	if *concurrency > *requests {
+		*concurrency = *requests
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending %d requests to %s:%d, %d at a time...\n", *requests, server, port, *concurrency)
+	start := time.Now()
+	results := Benchmark(server, port, endpoint, param_template.SetPrompt(FormatPrompt(*prompt)), *requests, *concurrency)
+	elapsed := time.Since(start)
+
+	var latencies []time.Duration
+	tokens := 0
+	failures := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failures++
+			fmt.Fprintln(os.Stderr, "error:", result.Err)
+			continue
+		}
+		latencies = append(latencies, result.Latency)
+		tokens += result.CompletionTokens
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Requests\t%d (%d failed, %.1f%% error rate)\n", len(results), failures, 100*float64(failures)/float64(len(results)))
+	fmt.Fprintf(table, "Duration\t%s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(table, "Requests/s\t%.2f\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Fprintf(table, "Tokens/s\t%.2f (%d completion tokens)\n", float64(tokens)/elapsed.Seconds(), tokens)
+	if len(latencies) > 0 {
+		for _, p := range []float64{50, 90, 95, 99} {
+			fmt.Fprintf(table, "Latency p%g\t%s\n", p, percentile(latencies, p).Round(time.Millisecond))
+		}
+		fmt.Fprintf(table, "Latency max\t%s\n", latencies[len(latencies)-1].Round(time.Millisecond))
+	}
+	return table.Flush()
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CONTEXT_WINDOW = 10 // Recent messages kept per channel.
+
+const DEFAULT_HISTORY_TURNS = 6 // Exchanges with the bot kept per channel.
+
+const GENERATION_ERROR_REPLY = "Sorry, my brain is offline right now. Try again in a bit."
+
+// # Reply
+//
+// This struct is the answer of the bot to a message: text, and optionally an image.
+type Reply struct {
+	Text        string
+	Image       []byte // PNG-encoded image.
+	Audio       []byte // Voice message.
+	AudioFormat string // Audio format, e.g. `mp3`.
+	Reaction    string // Emoji to react to the message with.
+	Sticker     string // Platform sticker to send, by ID.
+	File        []byte // Text file attached to the reply, e.g. a long reply.
+	FileName    string
+}
+
+// # Message
+//
+// This struct is a message received by a frontend.
+type Message struct {
+	ID      string   `json:"id,omitempty"`    // Platform ID of the message, empty if the frontend has none.
+	Channel string   `json:"channel"`         // Conversation the message belongs to: a chat, a group, a guild channel...
+	User    string   `json:"user"`            // Platform ID of the sender.
+	Roles   []string `json:"roles,omitempty"` // Platform roles of the sender.
+	Text    string   `json:"text"`
+
+	// UserName is the display name of the sender, empty to show the platform ID, and UserMention the platform mention
+	// addressing them, e.g. `<@12345>`, empty if the platform has none.
+	UserName    string `json:"user_name,omitempty"`
+	UserMention string `json:"user_mention,omitempty"`
+
+	// Mentions maps the platform mentions in the text, e.g. `<@12345>`, to display names.
+	Mentions map[string]string `json:"mentions,omitempty"`
+
+	// Links are the pages linked in the text, fetched by the bot before answering.
+	Links []Link `json:"-"`
+
+	// ReplyTo is the message this one replies to, on platforms with threaded replies. Nil for plain messages.
+	ReplyTo *QuotedMessage `json:"reply_to,omitempty"`
+
+	// Overrides are the settings of this message over the session defaults, e.g. from `/with`.
+	Overrides *RequestOverrides `json:"overrides,omitempty"`
+
+	// Background marks unprompted work nobody is waiting for, like scheduled posts.
+	// Its generations wait for the live messages to be served.
+	Background bool `json:"background,omitempty"`
+
+	// OnPartialReply, when set, receives the reply text generated so far while the model writes it,
+	// so frontends can post a placeholder and edit it as the reply grows. The complete reply is still returned as usual.
+	OnPartialReply func(partial string) `json:"-"`
+}
+
+// # Bot
+//
+// This struct holds everything needed to answer a chat message: the generation parameters,
+// the optional subsystems, and the queues of the model I/O handler.
+type Bot struct {
+	Client        *LlmClient
+	ParamTemplate LlmGenerationParameters // Set before serving, read with `Params` and switched with `SetModel` after.
+	Memory        *LongTermMemory
+	Gifs          *GifResponder
+	Images        *ImageJobQueue
+	MemeMaker     MemeMaker // Makes the memes of `/meme`, locally or with Imgflip, nil to disable them.
+	Transcriber   *TranscriptionClient
+	Speech        *SpeechClient
+	Sessions      *SessionStore
+	Personas      *PersonaLibrary
+	Channels      *ChannelConfigStore
+	Triggers      *TriggerEngine
+	Experiment    *Experiment
+	Translator    Translator
+	Stickers      map[string]string // Platform sticker IDs, by reaction emoji.
+	PromptCache   *PromptCache      // Slots of the channels on the backend, nil to disable prompt caching.
+	Unfurler      *LinkUnfurler     // Fetches the linked pages, nil to leave links alone.
+	Breaker       *CircuitBreaker   // Fails the generations fast while the backend is down, nil to always try.
+	FastPath      *FastPath         // Tries the short messages on a small model first, nil to always use the bot's model.
+	CodeBlocks    bool              // Wraps the code of the replies in fenced code blocks, for the platforms rendering Markdown.
+
+	// Profanity finds the words not to say in the replies, nil to say anything, and ProfanitySeverity is what's done
+	// about them in the channels without a setting.
+	Profanity         *ProfanityFilter
+	ProfanitySeverity string
+
+	// FallbackReplies are the canned replies while the backend is down, when no cached reply fits.
+	FallbackReplies []string
+	Commands        *CommandRegistry
+	Catalog         *MessageCatalog
+	UserLocales     *UserLocales
+	Privacy         *PrivacyStore
+
+	Permissions *PermissionPolicy
+	Audit       *AuditLog
+	Feedback    *FeedbackStore
+	Journal     *MessageJournal
+	Dedup       *DuplicateFilter
+
+	SessionArchive *SessionArchive
+	Search         *MessageIndex
+
+	// ContextWindow is the number of recent messages kept per channel for chiming in.
+	ContextWindow int
+
+	// HistoryTurns is the number of previous exchanges given to the model as context.
+	HistoryTurns int
+
+	// GroupContext is the number of recent messages of the channel, from anyone, given to the model as context,
+	// in the channels that didn't opt out. 0 gives only the exchanges with the bot.
+	GroupContext int
+
+	// ContextSize is the context window of the model in tokens, 0 when unknown.
+	ContextSize int
+
+	// TokenFooter appends the token usage to the chat replies.
+	TokenFooter bool
+
+	// RepeatWindow is how many last replies of a channel a new reply must not repeat, 0 to allow repeats.
+	RepeatWindow int
+	// RepeatSimilarity is the share of common words past which a reply repeats an earlier one.
+	RepeatSimilarity float64
+
+	// QueueNoticeDepth is how many requests must wait ahead of a chat request for its sender to be told their place in line,
+	// 0 to never tell.
+	QueueNoticeDepth int
+
+	// About is what the instance uses, reported at startup, for the `/about` command.
+	About *StartupReport
+
+	// Burst cools the channels flooding the bot with messages down, nil to answer them all.
+	Burst *BurstGuard
+
+	// MessageLimit is the longest message of the platform in characters, 0 for no limit.
+	// With AttachLongReplies, the replies much longer are attached as a file, or pasted to Paste when set.
+	MessageLimit      int
+	AttachLongReplies bool
+	Paste             *PasteClient
+
+	// GenerationTimeout cuts the generations running longer, keeping what was generated, 0 to wait for the end.
+	GenerationTimeout time.Duration
+
+	// SessionIdleTimeout clears the sessions without message for that long, 0 to keep them forever.
+	SessionIdleTimeout time.Duration
+
+	// Retention deletes the stored messages, conversations and audit entries past their time, applied by the janitor.
+	Retention RetentionPolicy
+
+	// StreamTokens and StreamInterval space out the partial reply updates of streamed replies.
+	StreamTokens   int
+	StreamInterval time.Duration
+
+	// ModelLanguage is the language the model writes best, messages are translated to in channels with translation.
+	ModelLanguage string
+
+	// Locale is the locale of the bot strings in channels and for users without one.
+	Locale string
+
+	// DryRun replaces the model responses with the requests that would be sent, without sending them.
+	DryRun bool
+
+	// Name is the name of the bot in chat templates, when no persona is played.
+	Name string
+
+	// DefaultPersona is the name of the persona played in channels without a configured persona, empty for the plain bot.
+	DefaultPersona string
+
+	// Reload reloads the configuration files, for the `/admin reload` command.
+	Reload func() error
+
+	// Status is called with progress notices for slow operations, like image generation.
+	// A new notice of a channel replaces its previous one, where the platform can edit messages.
+	Status func(channel string, status string)
+	// ClearStatus, when set, is called once the reply of a message with a queue notice is ready, to delete the notice.
+	ClearStatus func(channel string)
+
+	// Post is called to send unprompted replies, like scheduled posts.
+	Post func(channel string, reply Reply)
+
+	requests     *RequestQueue
+	rate_limiter *RateLimiter
+	duels        sync.Map       // Channels with a running duel.
+	latencies    LatencyTracker // Generation times, queueing included.
+	generations  LatencyTracker // Generation times, without queueing.
+	responses    ResponseCache  // Recent replies, standing in while the backend is down.
+	stopped      chan struct{}
+	stop_once    sync.Once
+	params_mu    sync.RWMutex // Guards `ParamTemplate`, switched with `/admin model` while the frontends generate.
+}
+
+// # Generation parameters
+//
+// This function returns a copy of the parameter template, for a generation.
+func (bot *Bot) Params() LlmGenerationParameters {
+	bot.params_mu.RLock()
+	defer bot.params_mu.RUnlock()
+	return bot.ParamTemplate
+}
+
+// # Set model
+//
+// This function switches the model requested from the backend for the next generations.
+func (bot *Bot) SetModel(model_name string) {
+	bot.params_mu.Lock()
+	defer bot.params_mu.Unlock()
+	bot.ParamTemplate.ModelName = model_name
+}
+
+// # Create a new bot
+//
+// This function creates a bot talking to the model I/O handler through the given request queue.
+func NewBot(client *LlmClient, param_template LlmGenerationParameters, requests *RequestQueue) *Bot {
+	bot := &Bot{
+		Client:         client,
+		ParamTemplate:  param_template,
+		requests:       requests,
+		Sessions:       NewSessionStore(),
+		Channels:       &ChannelConfigStore{channels: map[string]ChannelConfig{}},
+		ContextWindow:  DEFAULT_CONTEXT_WINDOW,
+		HistoryTurns:   DEFAULT_HISTORY_TURNS,
+		ModelLanguage:  DEFAULT_MODEL_LANGUAGE,
+		StreamTokens:   DEFAULT_STREAM_TOKENS,
+		StreamInterval: DEFAULT_STREAM_INTERVAL,
+		Dedup:          NewDuplicateFilter(DEFAULT_DEDUP_WINDOW),
+		UserLocales:    &UserLocales{},
+		Privacy:        &PrivacyStore{opted_out: map[string]bool{}},
+		Locale:         DEFAULT_LOCALE,
+		Name:           DEFAULT_BOT_NAME,
+		rate_limiter:   NewRateLimiter(time.Minute),
+		stopped:        make(chan struct{}),
+		Status:         func(string, string) {},
+		Post:           func(string, Reply) {},
+		Commands:       NewCommandRegistry(),
+	}
+	bot.registerCommands()
+	return bot
+}
+
+// # Stop
+//
+// This function asks the bot to shut down; frontends watch `Stopped` to exit.
+func (bot *Bot) Stop() {
+	bot.stop_once.Do(func() { close(bot.stopped) })
+}
+
+// # Stopped
+//
+// This function returns a channel closed when the bot is asked to shut down.
+func (bot *Bot) Stopped() <-chan struct{} {
+	return bot.stopped
+}
+
+// # Generate
+//
+// This function formats the prompt, sends it to the model on behalf of the sender of the message, and waits for the response.
+// The output is not streamed to the sender, as helper prompts (GIF queries, drawing prompts...) aren't the reply.
+func (bot *Bot) Generate(message Message, prompt string) (string, error) {
+	message.OnPartialReply = nil
+	return bot.generate(message, bot.Params().SetPrompt(FormatPrompt(prompt)))
+}
+
+// # Generate with parameters
+//
+// This function sends a generation request, with its formatted prompt, to the model I/O handler and waits for the response.
+func (bot *Bot) generate(message Message, param_with_prompt LlmGenerationParameters) (string, error) {
+	result := bot.generateResult(message, param_with_prompt)
+	return result.Text, result.Err
+}
+
+// # Generate with result
+//
+// This function generates like `generate`, returning the whole result with its timings and token usage.
+func (bot *Bot) generateResult(message Message, param_with_prompt LlmGenerationParameters) *GenerationResult {
+	return bot.generateOn(nil, message, param_with_prompt)
+}
+
+// # Generate on a backend
+//
+// This function generates like `generateResult`, on another backend than the bot's, or the bot's when nil.
+// Only the bot's backend trips the circuit breaker.
+func (bot *Bot) generateOn(backend *LlmClient, message Message, param_with_prompt LlmGenerationParameters) *GenerationResult {
+	if bot.DryRun {
+		return &GenerationResult{Text: dryRunResponse(param_with_prompt)}
+	}
+
+	breaker := bot.Breaker
+	if backend != nil {
+		breaker = nil
+	}
+	if !breaker.Allow() {
+		return &GenerationResult{Err: ErrBackendUnavailable}
+	}
+
+	// Send the prompt to the model
+	request := NewGenerationRequest(message, param_with_prompt)
+	request.Backend = backend
+	request.Timeout = bot.GenerationTimeout
+	if message.OnPartialReply != nil {
+		throttle := &PartialReplyThrottle{Tokens: bot.StreamTokens, Interval: bot.StreamInterval, Callback: message.OnPartialReply}
+		request.OnToken = throttle.Add
+		request.OnRestart = throttle.Reset
+	}
+	bot.requests.Push(request)
+	noticed := bot.noticeQueuePosition(message, request)
+
+	// Get the model response
+	result := request.Wait()
+	breaker.Record(result.Err)
+	if result.Err == nil {
+		bot.latencies.Add(result.FinishedAt.Sub(result.SubmittedAt))
+		bot.generations.Add(result.GenerationTime())
+	}
+	if noticed && bot.ClearStatus != nil {
+		bot.ClearStatus(message.Channel)
+	}
+	return result
+}
+
+// # Handle message
+//
+// This function answers a message, running chat commands when the message is one.
+// An empty reply means the bot stays silent.
+//
+// Redeliveries of a message are ignored; with a journal, the message is also persisted until answered,
+// unless its sender opted out.
+func (bot *Bot) HandleMessage(message Message) Reply {
+	if bot.Dedup.IsDuplicate(message) {
+		log.Printf("ignoring redelivered message %s in %s\n", message.ID, message.Channel)
+		return Reply{}
+	}
+
+	journal := bot.Journal
+	if bot.Privacy.OptedOut(message.User) {
+		journal = nil
+	}
+	accepted, err := journal.Accept(message)
+	if err != nil {
+		log.Println(fmt.Errorf("journal: %w", err))
+	}
+	if !accepted {
+		log.Printf("ignoring redelivered message %s in %s\n", message.ID, message.Channel)
+		return Reply{}
+	}
+
+	reply := bot.respond(message)
+	if err := journal.Done(message.Key()); err != nil {
+		log.Println(fmt.Errorf("journal: %w", err))
+	}
+	return reply
+}
+
+// # Respond
+//
+// This function answers a message, voicing the reply when the session asks for it.
+// The members of the channel named in the reply are mentioned, after the reply is voiced with their names.
+func (bot *Bot) respond(message Message) Reply {
+	reply := bot.handleMessage(message)
+
+	// Index the conversation for `/search`, but not the commands, nor the messages of the users who opted out.
+	if !strings.HasPrefix(strings.TrimSpace(message.Text), "/") && !bot.Privacy.OptedOut(message.User) {
+		bot.Search.Record(message.Channel, message.User, message.DisplayName(), ResolveMentions(message.Text, message.Mentions))
+		bot.Search.Record(message.Channel, message.User, BOT_SPEAKER, reply.Text)
+	}
+
+	if bot.Speech != nil && bot.Sessions.Get(message.Channel).Settings().Voice && reply.Text != "" && reply.Image == nil {
+		audio, err := bot.Speech.Synthesize(reply.Text)
+		if err != nil {
+			log.Println(err)
+		} else {
+			reply.Audio = audio
+			reply.AudioFormat = bot.Speech.Format
+		}
+	}
+	reply.Text = RestoreMentions(reply.Text, bot.Sessions.Get(message.Channel).MemberMentions())
+	return bot.attachLongReply(message, reply)
+}
+
+func (bot *Bot) handleMessage(message Message) Reply {
+	channel := message.Channel
+	user_input := strings.TrimSpace(message.Text)
+	config := bot.Channels.Get(channel)
+	bot.Sessions.Touch(channel)
+
+	// Answer slash commands.
+	if command, args, found := bot.Commands.Find(user_input); found {
+		return bot.runCommand(message, command, args)
+	}
+
+	// Follow the conversation, to chime in with context, unless the sender opted out.
+	session := bot.Sessions.Get(channel)
+	private := bot.Privacy.OptedOut(message.User)
+	if !private {
+		session.LearnMembers(message)
+		session.Recent.Add(ChatLine{User: message.DisplayName(), Text: ResolveMentions(user_input, message.Mentions)}, bot.ContextWindow)
+	}
+
+	// In channels with a trigger prefix, only answer messages addressed to the bot,
+	// or matching a spontaneous reply trigger, or randomly chime in.
+	addressed := true
+	if config.TriggerPrefix != "" {
+		user_input, addressed = strings.CutPrefix(user_input, config.TriggerPrefix)
+		user_input = strings.TrimSpace(user_input)
+	}
+	user_input = ResolveMentions(user_input, message.Mentions)
+	if message.ReplyTo != nil {
+		quote := *message.ReplyTo
+		quote.Text = ResolveMentions(quote.Text, message.Mentions)
+		message.ReplyTo = &quote
+	}
+	trigger, triggered := bot.Triggers.Match(message)
+	if addressed || triggered {
+		if cooling, started := bot.Burst.Hit(channel, time.Now()); cooling {
+			return bot.holdBurst(message, user_input, addressed, started)
+		}
+	}
+	if triggered {
+		return bot.fireTrigger(trigger, message)
+	}
+	if !addressed {
+		if shouldChimeIn(config.ReplyProbability) && bot.rate_limiter.Allow(channel, config.RateLimit) {
+			return bot.chimeIn(message)
+		}
+		if shouldReact(config.ReactionProbability, user_input) && bot.rate_limiter.Allow(channel, config.RateLimit) {
+			return bot.react(message, user_input)
+		}
+		return Reply{}
+	}
+
+	if !bot.rate_limiter.Allow(channel, config.RateLimit) {
+		return Reply{Text: bot.T(message, "I'm getting too many messages here, give me a minute.")}
+	}
+	if shouldReact(config.ReactionProbability, user_input) {
+		return bot.react(message, user_input)
+	}
+
+	return bot.chat(message, user_input)
+}
+
+// # Chat
+//
+// This function answers the user input through the chat pipeline:
+// memory recall, persona, channel settings, history, generation, and memory update.
+//
+// When the prompt exceeds the context window of the model, the oldest half of the history is dropped,
+// then the recalled memories, and the generation is retried.
+//
+// In channels with translation, the model works in its own language: the input is translated to it, and the reply back.
+// In channels with rules, the reply is a draft the model reviews against them before it's posted.
+// With the profanity filter, the reply is masked, or generated again once and dropped if it still has profanity.
+// A reply repeating one of the last replies of the channel is generated again, see `avoidRepeats`.
+// Meme-speak effects are applied last, to the reply as posted; the history keeps the reply as generated.
+func (bot *Bot) chat(message Message, user_input string) Reply {
+	channel := message.Channel
+	session := bot.Sessions.Acquire(channel)
+	defer bot.Sessions.Release(session)
+
+	language := ""
+	if bot.translating(channel) {
+		user_input, language = bot.translateInput(user_input)
+		if asked := session.Settings().Language; asked != "" {
+			language = asked // Asked with `/lang`.
+		}
+		if languageBase(language) == languageBase(bot.ModelLanguage) {
+			language = ""
+		}
+		if language != "" {
+			message.OnPartialReply = nil // The partial replies would be in the model language.
+		}
+	}
+	rules := bot.Channels.Get(channel).Rules
+	if rules != "" || bot.profanitySeverity(channel) != PROFANITY_OFF {
+		message.OnPartialReply = nil // The draft must not show before it's reviewed and filtered.
+	}
+	meme_speak := bot.memeSpeak(message)
+	if meme_speak != "" && meme_speak != MEME_SPEAK_OFF {
+		message.OnPartialReply = nil // The partial replies would show without the effects.
+	}
+	memories := bot.recall(message, user_input)
+	message.Links = bot.Unfurler.UnfurlLinks(context.Background(), user_input)
+	history := session.History.Turns()
+
+	var params LlmGenerationParameters
+	var variant, response string
+	var usage *LlmUsage
+	for {
+		params, variant = bot.renderChat(message, user_input, memories, history)
+		result := bot.generateFast(message, user_input, params)
+		response, usage = result.Text, result.Usage
+		err := result.Err
+		if err == nil {
+			break
+		}
+
+		var backend_err *BackendError
+		if errors.As(err, &backend_err) && backend_err.IsContextLengthExceeded() {
+			switch {
+			case len(history) > 0:
+				history = history[(len(history)+1)/2:]
+				log.Printf("context length exceeded in %s, retrying with %d history turns\n", channel, len(history))
+				continue
+			case len(memories) > 0:
+				memories = nil
+				log.Printf("context length exceeded in %s, retrying without memories\n", channel)
+				continue
+			}
+		}
+		log.Println(err)
+		return Reply{Text: bot.fallbackReply(message, user_input, err)}
+	}
+
+	// Filter the profanity before the reply is kept anywhere.
+	response, usage = bot.avoidRepeats(message, params, response, usage)
+	response, clean := bot.filterProfanity(message, params, response)
+	if !clean {
+		return Reply{Text: bot.T(message, "I'd rather not say that.")}
+	}
+
+	// In channels with rules, drop the drafts breaking them.
+	if rules != "" && !bot.reviewReply(message, rules, response) {
+		return Reply{}
+	}
+
+	// Keep the reply to stand in while the backend is down, unless the sender opted out.
+	private := bot.Privacy.OptedOut(message.User)
+	if !private {
+		bot.responses.Add(channel, message.User, user_input, response)
+	}
+
+	// Keep the history that fit, so the next messages don't hit the limit again.
+	// The turns of the users who opted out aren't kept: the history is the context of everyone in the channel, and gets archived.
+	session.History.Trim(len(history))
+	if !private {
+		session.History.Add(ChatTurn{User: user_input, Model: response, Speaker: message.User}, bot.HistoryTurns)
+	}
+	session.Update(func(session *Session) {
+		session.LastExchange = NewExchange(user_input, params, variant, response)
+		session.LastUsage, session.LastHistory = usage, len(history)
+	})
+
+	// Remember the exchange.
+	if bot.Memory != nil && !bot.DryRun && !private {
+		if err := bot.Memory.RememberExchange(message.Channel, message.User, user_input, response); err != nil {
+			log.Println(err)
+		}
+	}
+
+	text := bot.translateReply(response, language)
+	if bot.CodeBlocks {
+		text = FormatCode(text)
+	}
+	text = ApplyMemeSpeak(text, meme_speak)
+	if !private {
+		session.Recent.Add(ChatLine{User: BOT_SPEAKER, Text: text}, bot.ContextWindow)
+	}
+	if bot.TokenFooter && usage != nil {
+		return Reply{Text: text + "\n\n" + bot.usageSummary(message, usage, len(history))}
+	}
+	return Reply{Text: text}
+}
+
+// # Chat request
+//
+// This function renders the generation request answering the user input in the channel,
+// with the recalled memories and the history, and returns it with its experiment variant.
+func (bot *Bot) chatRequest(message Message, user_input string) (LlmGenerationParameters, string) {
+	message.Links = bot.Unfurler.UnfurlLinks(context.Background(), user_input)
+	return bot.renderChat(message, user_input, bot.recall(message, user_input), bot.Sessions.Get(message.Channel).History.Turns())
+}
+
+// # Recall memories
+//
+// This function returns the memories of the channel and of the sender relevant to the user input, if long-term memory is enabled.
+func (bot *Bot) recall(message Message, user_input string) []string {
+	if bot.Memory == nil {
+		return nil
+	}
+	memories, err := bot.Memory.Recall(message.Channel, message.User, user_input)
+	if err != nil {
+		log.Println(err)
+	}
+	return memories
+}
+
+// # Render chat
+//
+// This function formats the conversation of the channel, with the quoted message, the linked pages, the memories
+// and the style instructions of the session injected in the user input, and the overrides of the message applied. In channels with translation,
+// the reply language is left to the translator. With prompt caching, the generation runs in the slot of the channel.
+func (bot *Bot) renderChat(message Message, user_input string, memories []string, history []ChatTurn) (LlmGenerationParameters, string) {
+	channel := message.Channel
+	chat_template, persona, params, variant := bot.chatSettings(channel)
+	variables := chat_template.Variables
+	variables.UserName = message.DisplayName()
+	if message.Overrides != nil {
+		if message.Overrides.Template != "" {
+			chat_template, _ = GetChatTemplate(message.Overrides.Template)
+		}
+		params = message.Overrides.Sampling.Apply(params)
+	}
+	chat_template = chat_template.With(variables)
+	session := bot.Sessions.Get(channel)
+	settings := session.Settings()
+	language := settings.Language
+	if bot.translating(channel) {
+		language = ""
+	}
+	prompt := InjectStyle(InjectMemories(InjectLinks(InjectQuote(user_input, message.ReplyTo), message.Links), memories), StyleInstructions(settings.Styles, language))
+	if !bot.Channels.Get(channel).GroupContextOptOut {
+		prompt = InjectGroupContext(prompt, session.Recent.Lines(), bot.GroupContext)
+	}
+	params = params.SetPrompt(FormatPersonaConversation(chat_template, persona, history, prompt))
+	return bot.PromptCache.Apply(channel, params), variant
+}
+
+// # Chat settings
+//
+// This function returns the chat template, the persona and the generation parameters of the channel,
+// and the experiment variant drawn for this generation, if any. The chat template is set with the variables of the channel.
+// Sampling parameters are layered: bot defaults, then persona, then channel settings, then experiment variant.
+func (bot *Bot) chatSettings(channel string) (ChatTemplate, *Persona, LlmGenerationParameters, string) {
+	config := bot.Channels.Get(channel)
+	persona := bot.persona(bot.Sessions.Get(channel), config)
+	chat_template, _ := GetChatTemplate(config.Template)
+	bot_name := bot.Name
+	params := bot.Params()
+	if persona != nil {
+		params = persona.Sampling.Apply(params)
+		bot_name = persona.Name
+	}
+	chat_template = chat_template.With(PromptVariables{BotName: bot_name, Channel: channel})
+	params = config.Sampling.Apply(params)
+
+	variant_name := ""
+	if variant := bot.Experiment.Pick(); variant != nil {
+		params = variant.Sampling.Apply(params)
+		variant_name = variant.Name
+	}
+	return chat_template, persona, params, variant_name
+}
+
+// # Fire trigger
+//
+// This function produces the spontaneous reply of a trigger.
+func (bot *Bot) fireTrigger(trigger *Trigger, message Message) Reply {
+	switch {
+	case trigger.GifQuery != "":
+		if !bot.Gifs.EnabledFor(message.Channel) {
+			return Reply{}
+		}
+		gif_url, err := bot.Gifs.Reply(trigger.expand(trigger.GifQuery, message))
+		if err != nil {
+			log.Println(err)
+			return Reply{}
+		}
+		return Reply{Text: gif_url}
+	case trigger.Prompt != "":
+		response, err := bot.Generate(message, trigger.expand(trigger.Prompt, message))
+		if err != nil {
+			log.Println(err)
+			return Reply{}
+		}
+		return Reply{Text: response}
+	default:
+		return Reply{Text: trigger.expand(trigger.Reply, message)}
+	}
+}
+
+// # Cut command
+//
+// This function reports whether the input is the given command, and returns its arguments.
+// `/voice on` is the `/voice` command, `/voiceover` isn't.
+func cutCommand(user_input string, command string) (string, bool) {
+	args, found := strings.CutPrefix(user_input, command)
+	if !found || (args != "" && args[0] != ' ') {
+		return "", false
+	}
+	return strings.TrimSpace(args), true
+}
+
+// # Resolve persona
+//
+// This function returns the persona played in the session: the one picked with `/persona`,
+// else the one configured for the channel, else the default persona.
+func (bot *Bot) persona(session *Session, config ChannelConfig) *Persona {
+	if persona := session.Settings().Persona; persona != nil {
+		return persona
+	}
+	if persona, found := bot.Personas.Find(config.Persona); found {
+		return persona
+	}
+	if persona, found := bot.Personas.Find(bot.DefaultPersona); found {
+		return persona
+	}
+	return nil
+}
+
+// # Configure channel
+//
+// This function handles the `/config` command. Changing the settings is reserved to admins by its registration.
+//
+// Usage:
+//
+// - /config: show the channel settings
+// - /config set <key> [value]: change a setting, or reset it without value
+// - /config reset: go back to the default settings
+func (bot *Bot) configure(message Message, args string) Reply {
+	channel := message.Channel
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return Reply{Text: bot.T(message, "Channel settings:\n%s", bot.T(message, bot.Channels.Get(channel).String()))}
+	}
+
+	switch {
+	case fields[0] == "reset" && len(fields) == 1:
+		if err := bot.Channels.Reset(channel); err != nil {
+			log.Println(err)
+			return Reply{Text: bot.T(message, "Sorry, I couldn't save the settings.")}
+		}
+		return Reply{Text: bot.T(message, "Channel settings reset.")}
+	case fields[0] == "set" && len(fields) >= 2:
+		key := fields[1]
+		value := strings.Join(fields[2:], " ")
+		// Keep the trailing space of prefixes like "!bot ".
+		if key == "trigger_prefix" {
+			_, value, _ = strings.Cut(args, key)
+			value = strings.TrimPrefix(value, " ")
+		}
+		if key == "persona" && value != "" {
+			if _, found := bot.Personas.Find(value); !found {
+				return Reply{Text: bot.T(message, "I don't know any persona named %q.", value)}
+			}
+		}
+		err := bot.Channels.Update(channel, func(config *ChannelConfig) error {
+			return config.Set(key, value)
+		})
+		if err != nil {
+			return Reply{Text: err.Error()}
+		}
+		return Reply{Text: bot.T(message, "%s updated.", key)}
+	default:
+		return Reply{Text: bot.T(message, "Usage: /config | /config set <key> [value] | /config reset\nKeys: %s", strings.Join(ChannelConfigKeys, ", "))}
+	}
+}
+
+// # Toggle voice
+//
+// This function handles the `/voice` command, turning voice replies on or off in the channel.
+func (bot *Bot) toggleVoice(message Message, setting string) Reply {
+	if bot.Speech == nil {
+		return Reply{Text: bot.T(message, "Voice replies are disabled.")}
+	}
+	switch setting {
+	case "on":
+		bot.Sessions.Get(message.Channel).Update(func(session *Session) { session.Voice = true })
+		return Reply{Text: bot.T(message, "Voice replies are on.")}
+	case "off":
+		bot.Sessions.Get(message.Channel).Update(func(session *Session) { session.Voice = false })
+		return Reply{Text: bot.T(message, "Voice replies are off.")}
+	default:
+		return Reply{Text: bot.T(message, "Usage: /voice on|off")}
+	}
+}
+
+// # Remember
+//
+// This function handles the `/remember` command, storing a user-provided fact in the long-term memory.
+func (bot *Bot) remember(message Message, fact string) Reply {
+	if bot.Memory == nil {
+		return Reply{Text: bot.T(message, "Long-term memory is disabled.")}
+	}
+	if err := bot.Memory.Remember(message.Channel, message.User, MEMORY_KIND_FACT, fact); err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't remember that.")}
+	}
+	return Reply{Text: bot.T(message, "Got it, I'll remember that.")}
+}
+
+// # GIF reply
+//
+// This function handles the `/gif` command, replying with a reaction GIF found from a query the model writes about the text.
+func (bot *Bot) gif(message Message, text string) Reply {
+	if !bot.Gifs.EnabledFor(message.Channel) {
+		return Reply{Text: bot.T(message, "GIF replies are disabled here.")}
+	}
+	query, err := bot.Generate(message, fmt.Sprintf(GIF_QUERY_PROMPT, text))
+	if err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't find a GIF for that.")}
+	}
+	gif_url, err := bot.Gifs.Reply(CleanGifQuery(query))
+	if err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't find a GIF for that.")}
+	}
+	return Reply{Text: gif_url}
+}
+
+// # Switch persona
+//
+// This function handles the `/persona` command: without a name it lists the personas,
+// `default` goes back to the default persona, and any other name switches the channel to that persona.
+func (bot *Bot) switchPersona(message Message, name string) Reply {
+	channel := message.Channel
+	session := bot.Sessions.Get(channel)
+
+	if name == "" {
+		current := bot.T(message, "none")
+		if persona := bot.persona(session, bot.Channels.Get(channel)); persona != nil {
+			current = persona.Name
+		}
+		names := bot.Personas.Names()
+		if len(names) == 0 {
+			return Reply{Text: bot.T(message, "Current persona: %s. No persona available.", current)}
+		}
+		return Reply{Text: bot.T(message, "Current persona: %s. Available: %s", current, strings.Join(names, ", "))}
+	}
+
+	if strings.EqualFold(name, "default") {
+		session.Update(func(session *Session) { session.Persona = nil })
+		return Reply{Text: bot.T(message, "Back to my usual self.")}
+	}
+
+	persona, found := bot.Personas.Find(name)
+	if !found {
+		return Reply{Text: bot.T(message, "I don't know any persona named %q.", name)}
+	}
+	session.Update(func(session *Session) { session.Persona = persona })
+	if persona.FirstMessage != "" {
+		return Reply{Text: persona.fill(persona.FirstMessage)}
+	}
+	return Reply{Text: bot.T(message, "I'm now %s.", persona.Name)}
+}
+
+// # Handle image
+//
+// This function answers an image attachment, with the message text as the question about it.
+// The image goes straight to the vision-capable backend, bypassing the completion queue, but like text messages,
+// redeliveries are ignored, the channel rate limit applies, and nothing is sent while the circuit breaker is open.
+func (bot *Bot) HandleImage(message Message, image_data []byte) Reply {
+	if bot.Dedup.IsDuplicate(message) {
+		log.Printf("ignoring redelivered image %s in %s\n", message.ID, message.Channel)
+		return Reply{}
+	}
+	if !bot.rate_limiter.Allow(message.Channel, bot.Channels.Get(message.Channel).RateLimit) {
+		return Reply{Text: bot.T(message, "I'm getting too many messages here, give me a minute.")}
+	}
+	user_input := message.Text
+	if strings.TrimSpace(user_input) == "" {
+		user_input = IMAGE_DEFAULT_PROMPT
+	}
+
+	// Attachments which aren't images fail before reaching the backend, and mustn't trip the circuit breaker.
+	if mime_type := http.DetectContentType(image_data); !strings.HasPrefix(mime_type, "image/") {
+		log.Printf("unsupported attachment type %s in %s\n", mime_type, message.Channel)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't look at that image.")}
+	}
+	if !bot.Breaker.Allow() {
+		return Reply{Text: bot.userErrorMessage(message, ErrBackendUnavailable)}
+	}
+	response, err := bot.Client.DescribeImage(bot.Params(), user_input, image_data)
+	bot.Breaker.Record(err)
+	if err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't look at that image.")}
+	}
+	return Reply{Text: response}
+}
+
+// # Handle voice message
+//
+// This function transcribes a voice message and answers it like a text message.
+// The transcription is quoted in the reply, so users can tell when the bot misheard them.
+func (bot *Bot) HandleVoice(message Message, audio []byte, file_name string) Reply {
+	if bot.Transcriber == nil {
+		return Reply{Text: bot.T(message, "Voice messages are disabled.")}
+	}
+
+	user_input, err := bot.Transcriber.Transcribe(audio, file_name)
+	if err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't understand that voice message.")}
+	}
+	if user_input == "" {
+		return Reply{Text: bot.T(message, "I didn't hear anything in that voice message.")}
+	}
+
+	message.Text = user_input
+	reply := bot.HandleMessage(message)
+	if reply.Text != "" {
+		reply.Text = fmt.Sprintf("> %s\n%s", user_input, reply.Text)
+	}
+	return reply
+}
+
+// # Draw
+//
+// This function turns a drawing request into a Stable Diffusion prompt and generates the picture,
+// reporting the queue position and the progress through the status callback.
+func (bot *Bot) draw(message Message, request string) Reply {
+	channel := message.Channel
+	if bot.Images == nil {
+		return Reply{Text: bot.T(message, "Image generation is disabled.")}
+	}
+
+	// Without the model, draw the request as is.
+	sd_prompt, err := bot.Generate(message, fmt.Sprintf(DRAW_PROMPT, request))
+	if err != nil {
+		log.Println(err)
+	}
+	sd_prompt = strings.TrimSpace(sd_prompt)
+	if sd_prompt == "" {
+		sd_prompt = request
+	}
+
+	last_status := ""
+	for update := range bot.Images.Submit(ImageGenerationParameters{Prompt: sd_prompt, NegativePrompt: IMAGE_NEGATIVE_PROMPT}) {
+		if update.Done {
+			if update.Err != nil {
+				log.Println(update.Err)
+				return Reply{Text: bot.T(message, "Sorry, I couldn't draw that.")}
+			}
+			return Reply{Text: sd_prompt, Image: update.Image}
+		}
+
+		var status string
+		if update.Position > 0 {
+			status = bot.T(message, "Waiting to draw, %d in line before you...", update.Position)
+		} else {
+			status = bot.T(message, "Drawing... %d%%", int(update.Progress*100))
+			if update.Eta > 0 {
+				status += bot.T(message, " (about %ds left)", int(update.Eta.Seconds()))
+			}
+		}
+		if status != last_status {
+			bot.Status(channel, status)
+			last_status = status
+		}
+	}
+	return Reply{Text: bot.T(message, "Sorry, I couldn't draw that.")}
+}
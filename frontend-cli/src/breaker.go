@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BREAKER_THRESHOLD = 3
+	DEFAULT_BREAKER_COOLDOWN  = 30 * time.Second
+)
+
+var ErrBackendUnavailable = errors.New("backend unavailable, circuit breaker open")
+
+// # Circuit breaker
+//
+// This struct stops sending generations to a backend that keeps failing: after `Threshold` generations failed in a row,
+// the circuit opens and the generations fail right away for `Cooldown`, instead of each user waiting through the retries.
+// After the cooldown, one generation is let through to try the backend again: it closes the circuit if it succeeds.
+// A nil circuit breaker never opens.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // Generations failed in a row.
+	opened_at time.Time // When the circuit last opened.
+	trying    bool      // A generation is trying the backend after the cooldown.
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// # Allow generation
+//
+// This function reports whether a generation may be sent to the backend.
+func (breaker *CircuitBreaker) Allow() bool {
+	if breaker == nil {
+		return true
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.failures < breaker.Threshold {
+		return true
+	}
+	if time.Since(breaker.opened_at) < breaker.Cooldown || breaker.trying {
+		return false
+	}
+	breaker.trying = true
+	return true
+}
+
+// # Record outcome
+//
+// This function records the outcome of an allowed generation. Only the failures telling the backend is down count:
+// a request the backend refuses would fail the same way on a healthy backend.
+func (breaker *CircuitBreaker) Record(err error) {
+	if breaker == nil {
+		return
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.trying = false
+	switch {
+	case err == nil:
+		if breaker.failures >= breaker.Threshold {
+			log.Println("backend answering again, circuit breaker closed")
+		}
+		breaker.failures = 0
+	case isBackendDown(err):
+		breaker.failures++
+		if breaker.failures >= breaker.Threshold {
+			if breaker.failures == breaker.Threshold {
+				log.Printf("%d generations failed in a row, circuit breaker open\n", breaker.failures)
+			}
+			breaker.opened_at = time.Now()
+		}
+	}
+}
+
+// # Is backend down
+//
+// This function reports whether a generation error means the backend is unreachable or failing,
+// rather than refusing the request. Empty completions come from a working backend.
+func isBackendDown(err error) bool {
+	var backend_err *BackendError
+	if errors.As(err, &backend_err) {
+		return backend_err.IsRetryable()
+	}
+	var empty_err *EmptyCompletionError
+	if errors.As(err, &empty_err) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BURST_BATCH  = "batch"  // Messages addressed to the bot during the cooldown are answered together after it.
+	BURST_IGNORE = "ignore" // Messages addressed to the bot during the cooldown are dropped.
+)
+
+const (
+	DEFAULT_BURST_LIMIT    = 10 // Messages triggering the bot per window past which a channel cools down.
+	DEFAULT_BURST_WINDOW   = 30 * time.Second
+	DEFAULT_BURST_COOLDOWN = 2 * time.Minute
+	BURST_MAX_BATCH        = 10 // Messages answered together after a cooldown, the last ones.
+)
+
+const BURST_BATCH_PROMPT = "Several messages came in at once while you were away. Answer them together, in one short reply:\n%s"
+
+// # Burst guard
+//
+// This struct protects the channels and the backend from reply storms: when more than `Limit` messages trigger the bot in
+// a channel within `Window`, e.g. a crowd mentioning it at once, the channel cools down for `Cooldown`. During the cooldown,
+// the bot stays silent, and in `batch` mode keeps the messages addressed to it, to answer them in one reply afterwards.
+type BurstGuard struct {
+	Limit    int
+	Window   time.Duration
+	Cooldown time.Duration
+	Mode     string
+
+	mu      sync.Mutex
+	limiter *RateLimiter
+	cooling map[string]time.Time // End of the cooldown, by channel.
+	held    map[string][]Message // Messages kept in `batch` mode, by channel.
+}
+
+// # New burst guard
+//
+// This function returns a guard cooling the channels down past `limit` triggers per `window`, nil when `limit` is 0 or less.
+func NewBurstGuard(limit int, window time.Duration, cooldown time.Duration, mode string) (*BurstGuard, error) {
+	if mode != BURST_BATCH && mode != BURST_IGNORE {
+		return nil, fmt.Errorf("unknown burst mode %q, expected %s or %s", mode, BURST_BATCH, BURST_IGNORE)
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	return &BurstGuard{Limit: limit, Window: window, Cooldown: cooldown, Mode: mode, limiter: NewRateLimiter(window),
+		cooling: map[string]time.Time{}, held: map[string][]Message{}}, nil
+}
+
+// # Hit
+//
+// This function records a message triggering the bot in the channel, and reports whether the channel is cooling down,
+// and whether this message started the cooldown.
+func (guard *BurstGuard) Hit(channel string, now time.Time) (cooling bool, started bool) {
+	if guard == nil {
+		return false, false
+	}
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	if now.Before(guard.cooling[channel]) {
+		return true, false
+	}
+	if guard.limiter.Allow(channel, guard.Limit) {
+		return false, false
+	}
+	guard.cooling[channel] = now.Add(guard.Cooldown)
+	return true, true
+}
+
+// # Hold
+//
+// This function keeps a message of a cooling channel for the batch reply, the last `BURST_MAX_BATCH` at most.
+func (guard *BurstGuard) Hold(message Message) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	held := append(guard.held[message.Channel], message)
+	guard.held[message.Channel] = held[max(0, len(held)-BURST_MAX_BATCH):]
+}
+
+// # Release
+//
+// This function returns the messages kept for the channel, and ends its cooldown with a fresh window.
+func (guard *BurstGuard) Release(channel string) []Message {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	held := guard.held[channel]
+	delete(guard.held, channel)
+	delete(guard.cooling, channel)
+	guard.limiter.Reset(channel)
+	return held
+}
+
+// # Hold burst
+//
+// This function answers a message triggering the bot in a cooling channel: the message starting the cooldown gets a notice,
+// the others nothing. In `batch` mode, the messages addressed to the bot are kept, and answered together when the cooldown ends.
+func (bot *Bot) holdBurst(message Message, user_input string, addressed bool, started bool) Reply {
+	guard := bot.Burst
+	if addressed && guard.Mode == BURST_BATCH {
+		message.Text = user_input
+		guard.Hold(message)
+	}
+	if !started {
+		return Reply{}
+	}
+
+	log.Printf("burst of messages in %s, cooling down for %s\n", message.Channel, guard.Cooldown)
+	if guard.Mode == BURST_IGNORE {
+		time.AfterFunc(guard.Cooldown, func() { guard.Release(message.Channel) })
+		return Reply{Text: bot.T(message, "Whoa, that's a lot of pings. I'm taking a %s break.", guard.Cooldown)}
+	}
+	time.AfterFunc(guard.Cooldown, func() { bot.answerBurst(message.Channel) })
+	return Reply{Text: bot.T(message, "Whoa, that's a lot of pings. I'll answer in one go in %s.", guard.Cooldown)}
+}
+
+// # Answer burst
+//
+// This function ends the cooldown of a channel, and posts one reply to the messages kept during it.
+func (bot *Bot) answerBurst(channel string) {
+	held := bot.Burst.Release(channel)
+	if len(held) == 0 || bot.Post == nil {
+		return
+	}
+	lines := make([]string, len(held))
+	for i, message := range held {
+		lines[i] = fmt.Sprintf("%s: %s", message.DisplayName(), message.Text)
+	}
+	last := held[len(held)-1]
+	last.OnPartialReply = nil
+	reply := bot.chat(last, fmt.Sprintf(BURST_BATCH_PROMPT, strings.Join(lines, "\n")))
+	reply.Text = RestoreMentions(reply.Text, bot.Sessions.Get(channel).MemberMentions())
+	if reply.Text != "" {
+		bot.Post(channel, reply)
+	}
+}
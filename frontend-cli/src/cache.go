@@ -0,0 +1,54 @@
+package main
+
+import "sync"
+
+// # Prompt cache
+//
+// This struct pins the channels to the slots of a llama.cpp backend, so each conversation comes back to the slot
+// holding its KV cache: with `cache_prompt`, the persona and history prefix shared by two turns isn't evaluated again,
+// only the new messages are. Channels are spread over the slots in turn; channels sharing a slot evict each other's cache.
+// A nil prompt cache sends neither `cache_prompt` nor slot IDs.
+type PromptCache struct {
+	Slots int // Slots of the backend, 0 to let the backend pick the slot.
+
+	mu       sync.Mutex
+	assigned map[string]int // Channel to slot ID.
+	next     int
+}
+
+func NewPromptCache(slots int) *PromptCache {
+	return &PromptCache{Slots: slots, assigned: map[string]int{}}
+}
+
+// # Slot
+//
+// This function returns the slot of the channel, assigning the next slot on first use.
+func (cache *PromptCache) Slot(channel string) (int, bool) {
+	if cache == nil || cache.Slots <= 0 {
+		return 0, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	slot, found := cache.assigned[channel]
+	if !found {
+		slot = cache.next
+		cache.assigned[channel] = slot
+		cache.next = (cache.next + 1) % cache.Slots
+	}
+	return slot, true
+}
+
+// # Apply prompt cache
+//
+// This function asks the backend to reuse the cached prompt prefix of the channel.
+func (cache *PromptCache) Apply(channel string, params LlmGenerationParameters) LlmGenerationParameters {
+	if cache == nil {
+		return params
+	}
+	params.CachePrompt = true
+	if slot, found := cache.Slot(channel); found {
+		params.SlotID = &slot
+	}
+	return params
+}
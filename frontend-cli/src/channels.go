@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// # Channel configuration
+//
+// This struct holds the settings of a channel (or guild, or group) that differ from the bot defaults.
+// Zero values mean "use the default".
+type ChannelConfig struct {
+	Persona       string            `json:"persona,omitempty"`
+	Template      string            `json:"template,omitempty"`
+	Sampling      SamplingOverrides `json:"sampling"`
+	RateLimit     int               `json:"rate_limit,omitempty"`     // Replies per minute in the channel.
+	TriggerPrefix string            `json:"trigger_prefix,omitempty"` // Only messages starting with it are answered.
+
+	// ReplyProbability is the chance, from 0 to 1, of chiming in on a message not addressed to the bot.
+	ReplyProbability float64 `json:"reply_probability,omitempty"`
+
+	// ReactionProbability is the chance, from 0 to 1, of answering a short remark with just an emoji reaction.
+	ReactionProbability float64 `json:"reaction_probability,omitempty"`
+
+	// Translate makes the bot translate the messages to the model language, and its replies back.
+	Translate bool `json:"translate,omitempty"`
+
+	// Locale is the locale of the bot strings in the channel, e.g. `zh`.
+	Locale string `json:"locale,omitempty"`
+
+	// Rules are the rules of the channel the replies are reviewed against before being posted, empty to post them unreviewed.
+	Rules string `json:"rules,omitempty"`
+
+	// Profanity is what the profanity filter does to the replies: off, mask or block, empty for the bot default.
+	Profanity string `json:"profanity,omitempty"`
+
+	// GroupContextOptOut keeps the other messages of the channel out of the prompts, for privacy.
+	GroupContextOptOut bool `json:"group_context_opt_out,omitempty"`
+
+	// MemeSpeak are the effects applied to the replies, e.g. `caps,emoji`, see `ApplyMemeSpeak`.
+	MemeSpeak string `json:"meme_speak,omitempty"`
+}
+
+// Keys accepted by `ChannelConfig.Set`.
+var ChannelConfigKeys = []string{"persona", "template", "temperature", "top_p", "top_k", "repeat_penalty", "max_tokens", "rate_limit", "trigger_prefix", "reply_probability", "reaction_probability", "translate", "locale", "rules", "profanity", "group_context_opt_out", "meme_speak"}
+
+// # Set configuration value
+//
+// This function sets a setting from its textual value, as typed in the `/config set` command.
+// An empty value resets the setting to the default.
+func (config *ChannelConfig) Set(key string, value string) error {
+	parse_int := func(target *int) error {
+		if value == "" {
+			*target = 0
+			return nil
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("%s must be a positive integer", key)
+		}
+		*target = parsed
+		return nil
+	}
+	parse_float := func(target *float64) error {
+		if value == "" {
+			*target = 0
+			return nil
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("%s must be a positive number", key)
+		}
+		*target = parsed
+		return nil
+	}
+
+	parse_bool := func(target *bool) error {
+		switch strings.ToLower(value) {
+		case "", "off", "false", "no":
+			*target = false
+		case "on", "true", "yes":
+			*target = true
+		default:
+			return fmt.Errorf("%s must be on or off", key)
+		}
+		return nil
+	}
+
+	switch key {
+	case "persona":
+		config.Persona = value
+	case "template":
+		if _, found := GetChatTemplate(value); !found {
+			return fmt.Errorf("unknown template %q", value)
+		}
+		config.Template = value
+	case "temperature":
+		return parse_float(&config.Sampling.Temperature)
+	case "top_p":
+		return parse_float(&config.Sampling.TopP)
+	case "top_k":
+		return parse_int(&config.Sampling.TopK)
+	case "repeat_penalty":
+		return parse_float(&config.Sampling.RepeatPenalty)
+	case "max_tokens":
+		return parse_int(&config.Sampling.MaxTokens)
+	case "rate_limit":
+		return parse_int(&config.RateLimit)
+	case "trigger_prefix":
+		config.TriggerPrefix = value
+	case "reply_probability":
+		if err := parse_float(&config.ReplyProbability); err != nil {
+			return err
+		}
+		if config.ReplyProbability > 1 {
+			config.ReplyProbability = 0
+			return fmt.Errorf("%s must be between 0 and 1", key)
+		}
+	case "reaction_probability":
+		if err := parse_float(&config.ReactionProbability); err != nil {
+			return err
+		}
+		if config.ReactionProbability > 1 {
+			config.ReactionProbability = 0
+			return fmt.Errorf("%s must be between 0 and 1", key)
+		}
+	case "translate":
+		return parse_bool(&config.Translate)
+	case "profanity":
+		severity, err := parseProfanitySeverity(value)
+		if err != nil {
+			return err
+		}
+		config.Profanity = severity
+	case "group_context_opt_out":
+		return parse_bool(&config.GroupContextOptOut)
+	case "meme_speak":
+		effects, err := parseMemeSpeak(value)
+		if err != nil {
+			return err
+		}
+		config.MemeSpeak = effects
+	case "locale":
+		config.Locale = normalizeLocale(value)
+	case "rules":
+		config.Rules = value
+	default:
+		return fmt.Errorf("unknown setting %q, expected one of %s", key, strings.Join(ChannelConfigKeys, ", "))
+	}
+	return nil
+}
+
+// # Describe configuration
+//
+// This function returns the non-default settings, one per line.
+func (config ChannelConfig) String() string {
+	data, _ := json.Marshal(config)
+	var settings map[string]interface{}
+	json.Unmarshal(data, &settings)
+
+	// Flatten the sampling overrides.
+	if sampling, ok := settings["sampling"].(map[string]interface{}); ok {
+		for key, value := range sampling {
+			settings[key] = value
+		}
+	}
+	delete(settings, "sampling")
+
+	if len(settings) == 0 {
+		return "default settings"
+	}
+	lines := make([]string, 0, len(settings))
+	for key, value := range settings {
+		lines = append(lines, fmt.Sprintf("%s = %v", key, value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// # Channel configuration store
+//
+// This struct keeps the configuration of every channel, persisted as a JSON object keyed by channel.
+// Without a path, the configuration lives in memory only.
+type ChannelConfigStore struct {
+	path string
+
+	mu       sync.Mutex
+	channels map[string]ChannelConfig
+}
+
+// # Open channel configuration store
+//
+// This function loads the store from `path`, starting empty if the file doesn't exist.
+func OpenChannelConfigStore(path string) (*ChannelConfigStore, error) {
+	store := &ChannelConfigStore{path: path, channels: map[string]ChannelConfig{}}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// # Reload channel configuration
+//
+// This function reads the store file again, picking up manual edits. On error, the current configuration is kept.
+func (store *ChannelConfigStore) Reload() error {
+	if store.path == "" {
+		return nil
+	}
+
+	channels := map[string]ChannelConfig{}
+	data, err := os.ReadFile(store.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &channels); err != nil {
+			return fmt.Errorf("invalid channel configuration %s: %w", store.path, err)
+		}
+	}
+
+	store.mu.Lock()
+	store.channels = channels
+	store.mu.Unlock()
+	return nil
+}
+
+// # Get channel configuration
+//
+// This function returns the configuration of the channel.
+func (store *ChannelConfigStore) Get(channel string) ChannelConfig {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.channels[channel]
+}
+
+// # Update channel configuration
+//
+// This function applies `update` to the configuration of the channel and saves the store.
+// The configuration is left unchanged if `update` fails.
+func (store *ChannelConfigStore) Update(channel string, update func(config *ChannelConfig) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	config := store.channels[channel]
+	if err := update(&config); err != nil {
+		return err
+	}
+	store.channels[channel] = config
+	return store.save()
+}
+
+// # Reset channel configuration
+//
+// This function drops the configuration of the channel and saves the store.
+func (store *ChannelConfigStore) Reset(channel string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.channels, channel)
+	return store.save()
+}
+
+// # Save
+//
+// This function writes the store to a temporary file and renames it over the store file,
+// so a crash never leaves a truncated store behind. The lock must be held.
+func (store *ChannelConfigStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(store.channels, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(store.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(store.path+".tmp", store.path)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const CHIME_IN_PROMPT = `Here is the recent conversation of a group chat you are part of:
+
+%s
+
+Chime in with one short, witty remark that fits the conversation. Reply with the remark only.`
+
+const BOT_SPEAKER = "you" // Speaker name of the bot's own messages in the recent conversation.
+
+const GROUP_CONTEXT_PROMPT_HEADER = `Recent messages in the channel ("you" is you):`
+
+// # Chat line
+//
+// This struct is a message of the recent conversation of a channel.
+type ChatLine struct {
+	User string `json:"user"`
+	Text string `json:"text"`
+}
+
+// # Recent messages
+//
+// This struct is the window of the last messages seen in a channel, oldest first.
+type RecentMessages struct {
+	mu    sync.Mutex
+	lines []ChatLine
+}
+
+// # Add message
+//
+// This function appends a message to the window, dropping the oldest ones beyond `limit`.
+func (recent *RecentMessages) Add(line ChatLine, limit int) {
+	if limit <= 0 || strings.TrimSpace(line.Text) == "" {
+		return
+	}
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	recent.lines = append(recent.lines, line)
+	if len(recent.lines) > limit {
+		recent.lines = append([]ChatLine(nil), recent.lines[len(recent.lines)-limit:]...)
+	}
+}
+
+// # Transcript
+//
+// This function returns the window as `user: text` lines.
+func (recent *RecentMessages) Transcript() string {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	lines := make([]string, len(recent.lines))
+	for i, line := range recent.lines {
+		lines[i] = fmt.Sprintf("%s: %s", line.User, line.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// # Lines
+//
+// This function returns a copy of the messages of the window.
+func (recent *RecentMessages) Lines() []ChatLine {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	return append([]ChatLine(nil), recent.lines...)
+}
+
+// # Forget speaker
+//
+// This function drops the messages of the speaker from the window, and returns how many were dropped.
+func (recent *RecentMessages) Forget(user string) int {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	var kept []ChatLine
+	for _, line := range recent.lines {
+		if line.User != user {
+			kept = append(kept, line)
+		}
+	}
+	forgotten := len(recent.lines) - len(kept)
+	recent.lines = kept
+	return forgotten
+}
+
+// # Inject group context
+//
+// This function prepends the last `limit` messages of the channel to the user prompt, so the reply follows the ongoing
+// conversation and not only the exchanges with the bot. The message being answered is the last of the window, it's left out.
+func InjectGroupContext(prompt string, lines []ChatLine, limit int) string {
+	if len(lines) > 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if limit <= 0 || len(lines) == 0 {
+		return prompt
+	}
+	lines = lines[max(len(lines)-limit, 0):]
+
+	var builder strings.Builder
+	builder.WriteString(GROUP_CONTEXT_PROMPT_HEADER)
+	builder.WriteString("\n")
+	for _, line := range lines {
+		builder.WriteString(fmt.Sprintf("%s: %s\n", line.User, line.Text))
+	}
+	builder.WriteString("\n")
+	builder.WriteString(prompt)
+	return builder.String()
+}
+
+// # Should chime in
+//
+// This function draws whether the bot joins the conversation, given the reply probability of the channel.
+func shouldChimeIn(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+// # Chime in
+//
+// This function generates a quip about the recent conversation of the channel, as the channel persona.
+// The quip joins the recent conversation, so the bot doesn't repeat itself.
+func (bot *Bot) chimeIn(message Message) Reply {
+	channel := message.Channel
+	message.Background = true // Nobody asked, live messages come first.
+	session := bot.Sessions.Acquire(channel)
+	defer bot.Sessions.Release(session)
+	transcript := session.Recent.Transcript()
+	if transcript == "" {
+		return Reply{}
+	}
+
+	chat_template, persona, params, variant := bot.chatSettings(channel)
+	params = params.SetPrompt(FormatPersonaConversation(chat_template, persona, nil, fmt.Sprintf(CHIME_IN_PROMPT, transcript)))
+	response, err := bot.generate(message, params)
+	if err != nil {
+		log.Println(err)
+		return Reply{}
+	}
+	response = strings.TrimSpace(response)
+	if response == "" {
+		log.Printf("empty chime-in in %s\n", channel)
+		return Reply{}
+	}
+	session.Recent.Add(ChatLine{User: BOT_SPEAKER, Text: response}, bot.ContextWindow)
+	session.Update(func(session *Session) { session.LastExchange = NewExchange(transcript, params, variant, response) })
+	return Reply{Text: response}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CLI_CHANNEL = "cli" // Channel of the messages typed in the terminal.
+
+// # CLI frontend
+//
+// This struct is the frontend of the terminal: the lines typed are messages of the `cli` channel, sent by the user running the bot,
+// and the replies are printed. Messages are answered one at a time, each before the next prompt.
+type CliFrontend struct {
+	Console   *Console
+	User      string   // Sender of the messages typed.
+	Roles     []string // Roles of the sender.
+	MediaDir  string   // Directory where the images, voice messages and files of the replies are saved.
+	Limit     int      // Longest message printed in one part, 0 for no limit.
+	Highlight bool     // Highlight the code of the replies.
+	Stream    bool     // Print the replies as they are generated.
+
+	mu         sync.Mutex // Replies to the `cli` channel and scheduled posts may be printed at once.
+	streamer   TerminalStreamer
+	last_reply string // Quoted by `/reply`.
+}
+
+// # Register CLI commands
+//
+// This function lists the commands the CLI handles itself in `/help`.
+func (cli *CliFrontend) RegisterCommands(commands *CommandRegistry, transcription func() bool) {
+	commands.Register(Command{
+		Name:        "/image",
+		Usage:       "<path> [question]",
+		Description: "Show me an image file.",
+	})
+	commands.Register(Command{
+		Name:         "/reply",
+		Usage:        "<text>",
+		Description:  "Reply to my last message, as if quoting it.",
+		RequiresArgs: true,
+	})
+	commands.Register(Command{
+		Name:        "/audio",
+		Usage:       "<path>",
+		Description: "Send me a voice message file.",
+		Enabled:     transcription,
+	})
+}
+
+// # Receive messages
+//
+// This function reads the lines typed until the end of the input. The terminal can't paste attachments,
+// so images and voice messages are given by path, with `/image` and `/audio`.
+func (cli *CliFrontend) ReceiveMessages(ctx context.Context, handle func(incoming Incoming)) error {
+	for ctx.Err() == nil {
+		fmt.Print("User: ")
+		line, err := cli.Console.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		user_input := strings.TrimSpace(line)
+		if user_input == "" {
+			continue
+		}
+
+		incoming := Incoming{Message: Message{Channel: CLI_CHANNEL, User: cli.User, Roles: cli.Roles, Text: user_input}}
+		if image_input, found := strings.CutPrefix(user_input, "/image "); found {
+			image_path, question, _ := strings.Cut(strings.TrimSpace(image_input), " ")
+			if incoming.Image, err = os.ReadFile(image_path); err != nil {
+				fmt.Println("Model:", err)
+				continue
+			}
+			incoming.Text = question
+		} else if audio_path, found := strings.CutPrefix(user_input, "/audio "); found {
+			audio_path = strings.TrimSpace(audio_path)
+			if incoming.Audio, err = os.ReadFile(audio_path); err != nil {
+				fmt.Println("Model:", err)
+				continue
+			}
+			incoming.Text, incoming.AudioName = "", filepath.Base(audio_path)
+		} else {
+			if text, found := strings.CutPrefix(user_input, "/reply "); found {
+				incoming.Text = strings.TrimSpace(text)
+				if last_reply := cli.lastReply(); last_reply != "" {
+					incoming.ReplyTo = &QuotedMessage{User: BOT_SPEAKER, Text: last_reply}
+				}
+			}
+			if cli.Stream {
+				incoming.OnPartialReply = cli.partial
+			}
+		}
+		handle(incoming)
+
+		// A streamed reply the bot dropped still ends its line.
+		cli.mu.Lock()
+		if cli.streamer.printed != "" {
+			fmt.Println()
+			cli.streamer.printed = ""
+		}
+		cli.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+func (cli *CliFrontend) lastReply() string {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	return cli.last_reply
+}
+
+func (cli *CliFrontend) partial(partial string) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	cli.streamer.Partial(partial)
+}
+
+// # Send reply
+//
+// This function prints a reply, after the channel name when it's posted to another channel than `cli`, like scheduled posts.
+// The terminal has no message IDs.
+func (cli *CliFrontend) SendReply(channel string, reply Reply) (string, error) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if channel != CLI_CHANNEL {
+		fmt.Printf("\n[%s]\n", channel)
+	} else {
+		if reply.Text != "" {
+			cli.last_reply = reply.Text
+		}
+		reply = cli.streamer.Finish(reply)
+	}
+	printReply(reply, cli.MediaDir, cli.Limit, cli.Highlight)
+	return "", nil
+}
+
+// # Typing
+//
+// This function does nothing: the prompt of the terminal only comes back with the reply.
+func (cli *CliFrontend) Typing(channel string) error {
+	return nil
+}
+
+// # Status
+//
+// This function prints a progress notice.
+func (cli *CliFrontend) Status(channel string, status string) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	fmt.Println("...", status)
+}
+
+// # Clear status
+//
+// This function does nothing: the notices printed stay in the scrollback.
+func (cli *CliFrontend) ClearStatus(channel string) {}
+
+// # Edit message
+//
+// This function prints the new text of a message, as the terminal can't change what it printed.
+func (cli *CliFrontend) EditMessage(channel string, message_id string, text string) error {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	fmt.Println("Model (edited):", text)
+	return nil
+}
+
+// # Print reply
+//
+// This function prints a reply in the terminal. Images, voice messages and files can't be shown,
+// so they are saved in `media_dir` and their path is printed instead. Texts longer than `limit` are printed in parts,
+// as the messages a platform would take, with their code highlighted when `highlight` is set.
+func printReply(reply Reply, media_dir string, limit int, highlight bool) {
+	if reply.Text != "" {
+		for _, part := range SplitMessage(reply.Text, limit) {
+			if highlight {
+				part = HighlightCode(part)
+			}
+			fmt.Println("Model:", part)
+		}
+	}
+	if reply.Reaction != "" {
+		fmt.Println("Model reacted:", reply.Reaction)
+	}
+	if reply.Sticker != "" {
+		fmt.Println("Sticker:", reply.Sticker)
+	}
+
+	if reply.Image != nil {
+		image_path := filepath.Join(media_dir, fmt.Sprintf("meme-chatbot-%d.png", time.Now().UnixNano()))
+		if err := os.WriteFile(image_path, reply.Image, 0644); err != nil {
+			log.Println(err)
+		} else {
+			fmt.Println("Image saved to", image_path)
+		}
+	}
+	if reply.File != nil {
+		file_path := filepath.Join(media_dir, fmt.Sprintf("meme-chatbot-%d-%s", time.Now().UnixNano(), reply.FileName))
+		if err := os.WriteFile(file_path, reply.File, 0644); err != nil {
+			log.Println(err)
+		} else {
+			fmt.Println("File saved to", file_path)
+		}
+	}
+	if reply.Audio != nil {
+		audio_path := filepath.Join(media_dir, fmt.Sprintf("meme-chatbot-%d.%s", time.Now().UnixNano(), reply.AudioFormat))
+		if err := os.WriteFile(audio_path, reply.Audio, 0644); err != nil {
+			log.Println(err)
+		} else {
+			fmt.Println("Voice message saved to", audio_path)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// # Command
+//
+// This struct declares a slash command: how it's invoked, what `/help` says about it, and what handles it.
+type Command struct {
+	Name        string // Command word, e.g. `/voice`.
+	Usage       string // Arguments, e.g. `on|off`, empty for none.
+	Description string // One-line description, in English; translated by the message catalog.
+
+	RequiresArgs bool // Without arguments, the usage is shown instead of calling the handler.
+
+	// Permission is needed to run the command, and to see it in `/help`. Running a command needing more than
+	// the user permission is audited, allowed or denied.
+	Permission Permission
+	// Actions raise the permission needed by some actions of the command, keyed by the first word of the arguments.
+	Actions map[string]Permission
+
+	// Enabled reports whether the command is listed in `/help`, e.g. only with the subsystem it needs. Nil means always.
+	// Disabled commands still answer, explaining that the feature is off.
+	Enabled func() bool
+
+	// Handle answers the command. Nil for commands handled by the frontend itself, like file attachments in the terminal,
+	// which are only registered to be listed in `/help`.
+	Handle func(message Message, args string) Reply
+}
+
+// # Command registry
+//
+// This struct keeps the slash commands of the bot, and the ones added by the frontend.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: map[string]Command{}}
+}
+
+// # Register command
+//
+// This function adds a command, replacing any command of the same name.
+func (registry *CommandRegistry) Register(command Command) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.commands[command.Name] = command
+}
+
+// # Find command
+//
+// This function returns the command invoked by the user input and its arguments.
+// Commands handled by the frontend are not found.
+func (registry *CommandRegistry) Find(user_input string) (Command, string, bool) {
+	name, _, _ := strings.Cut(user_input, " ")
+	registry.mu.RLock()
+	command, found := registry.commands[name]
+	registry.mu.RUnlock()
+
+	if !found || command.Handle == nil {
+		return Command{}, "", false
+	}
+	args, _ := cutCommand(user_input, command.Name)
+	return command, args, true
+}
+
+// # List commands
+//
+// This function returns the enabled commands, sorted by name.
+func (registry *CommandRegistry) List() []Command {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	commands := make([]Command, 0, len(registry.commands))
+	for _, command := range registry.commands {
+		if command.Enabled == nil || command.Enabled() {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// # Command synopsis
+//
+// This function returns the command with its arguments, e.g. `/voice on|off`.
+func (command Command) Synopsis() string {
+	if command.Usage == "" {
+		return command.Name
+	}
+	return command.Name + " " + command.Usage
+}
+
+// # Register bot commands
+//
+// This function registers the commands handled by the bot itself.
+func (bot *Bot) registerCommands() {
+	bot.Commands.Register(Command{
+		Name:        "/help",
+		Description: "List the commands.",
+		Handle:      func(message Message, _ string) Reply { return bot.help(message) },
+	})
+	bot.Commands.Register(Command{
+		Name:        "/voice",
+		Usage:       "on|off",
+		Description: "Turn voice replies on or off.",
+		Enabled:     func() bool { return bot.Speech != nil },
+		Handle:      bot.toggleVoice,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/remember",
+		Usage:        "<fact>",
+		Description:  "Store a fact in my long-term memory.",
+		RequiresArgs: true,
+		Enabled:      func() bool { return bot.Memory != nil },
+		Handle:       bot.remember,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/good",
+		Description: "Rate my last reply as good.",
+		Enabled:     func() bool { return bot.Feedback != nil },
+		Handle:      func(message Message, _ string) Reply { return bot.feedback(message, FEEDBACK_GOOD) },
+	})
+	bot.Commands.Register(Command{
+		Name:        "/bad",
+		Description: "Rate my last reply as bad.",
+		Enabled:     func() bool { return bot.Feedback != nil },
+		Handle:      func(message Message, _ string) Reply { return bot.feedback(message, FEEDBACK_BAD) },
+	})
+	bot.Commands.Register(Command{
+		Name:        "/locale",
+		Usage:       "[code|default]",
+		Description: "Show or pick the language of my messages.",
+		Handle:      bot.setLocale,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/forgetme",
+		Description: "Delete what I keep of you: our conversations, your messages, memories and ratings.",
+		Handle:      bot.forgetMe,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/optout",
+		Usage:       "[off]",
+		Description: "Delete what I keep of you, and stop keeping your messages.",
+		Handle:      bot.optOut,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/persona",
+		Usage:       "[name|default]",
+		Description: "Show the personas, or switch persona.",
+		Handle:      bot.switchPersona,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/duel",
+		Usage:        "<persona> <persona> [turns] <topic>",
+		Description:  "Make two personas talk to each other about a topic.",
+		RequiresArgs: true,
+		Enabled:      func() bool { return len(bot.Personas.Names()) >= 2 },
+		Handle:       bot.duel,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/style",
+		Usage:       "[style...|default]",
+		Description: "Show or pick the style of my replies, e.g. short or formal.",
+		Handle:      bot.setStyle,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/lang",
+		Usage:       "[code|default]",
+		Description: "Show or pick the language of my replies.",
+		Handle:      bot.setLanguage,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/with",
+		Usage:        "key=value... <text>",
+		Description:  "Answer with other settings for this message only, e.g. max_tokens=512.",
+		RequiresArgs: true,
+		Handle:       bot.chatWith,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/long",
+		Usage:        "<text>",
+		Description:  "Answer with a long reply.",
+		RequiresArgs: true,
+		Handle:       bot.longReply,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/meme",
+		Usage:        "[caps|spongebob|owo|emoji] <text>",
+		Description:  "Make a meme about the text, or answer in meme speak, e.g. /meme spongebob <text>.",
+		RequiresArgs: true,
+		Handle:       bot.memeReply,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/search",
+		Usage:        "<words>",
+		Description:  "Find past messages of this channel.",
+		RequiresArgs: true,
+		Enabled:      func() bool { return bot.Search != nil },
+		Handle:       bot.search,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/status",
+		Description: "Show how busy I am.",
+		Handle:      bot.status,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/tokens",
+		Description: "Show the tokens used by my last reply, and the context left.",
+		Handle:      bot.tokens,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/config",
+		Usage:       "[set <key> [value] | reset]",
+		Description: "Show or change the settings of the channel.",
+		Actions:     map[string]Permission{"set": PERMISSION_ADMIN, "reset": PERMISSION_ADMIN},
+		Handle:      bot.configure,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/about",
+		Description: "Show what I'm running with: backend, model, frontends, plugins and files.",
+		Permission:  PERMISSION_ADMIN,
+		Handle:      bot.about,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/debug",
+		Usage:       "prompt <text>",
+		Description: "Show the request a message would send to the model.",
+		Permission:  PERMISSION_ADMIN,
+		Handle:      bot.debug,
+	})
+	bot.Commands.Register(Command{
+		Name:        "/admin",
+		Usage:       "model [name] | reload | clear [channel] | shutdown",
+		Description: "Administer the bot.",
+		Permission:  PERMISSION_MODERATOR,
+		Actions:     map[string]Permission{"model": PERMISSION_ADMIN, "reload": PERMISSION_ADMIN, "shutdown": PERMISSION_OWNER},
+		Handle:      bot.admin,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/gif",
+		Usage:        "<text>",
+		Description:  "Reply with a reaction GIF.",
+		RequiresArgs: true,
+		Enabled:      func() bool { return bot.Gifs != nil },
+		Handle:       bot.gif,
+	})
+	bot.Commands.Register(Command{
+		Name:         "/draw",
+		Usage:        "<description>",
+		Description:  "Draw a picture.",
+		RequiresArgs: true,
+		Enabled:      func() bool { return bot.Images != nil },
+		Handle:       bot.draw,
+	})
+}
+
+// # Run command
+//
+// This function answers a command, or shows its usage when its arguments are missing.
+// Commands the sender lacks the permission for are refused, whichever frontend the message comes from.
+func (bot *Bot) runCommand(message Message, command Command, args string) Reply {
+	needed := command.Permission
+	action, _, _ := strings.Cut(args, " ")
+	needed = max(needed, command.Actions[strings.ToLower(action)])
+	if needed > PERMISSION_USER {
+		allowed := bot.Permissions.Permits(message, needed)
+		bot.Audit.RecordAdmin(message, strings.TrimPrefix(command.Name, "/"), args, allowed)
+		if !allowed {
+			return Reply{Text: bot.T(message, permission_denied[needed])}
+		}
+	}
+
+	if command.RequiresArgs && args == "" {
+		return Reply{Text: bot.T(message, "Usage: %s", command.Synopsis())}
+	}
+	return command.Handle(message, args)
+}
+
+// Refusals of the commands needing a permission.
+var permission_denied = map[Permission]string{
+	PERMISSION_MODERATOR: "Only moderators can do that.",
+	PERMISSION_ADMIN:     "Only admins can do that.",
+	PERMISSION_OWNER:     "Only owners can do that.",
+}
+
+// # Help
+//
+// This function handles the `/help` command: it lists the available commands, without the ones the user lacks the permission for.
+func (bot *Bot) help(message Message) Reply {
+	permission := bot.Permissions.Of(message)
+	lines := []string{bot.T(message, "Commands:")}
+	for _, command := range bot.Commands.List() {
+		if command.Permission > permission {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s", command.Synopsis(), bot.T(message, command.Description)))
+	}
+	return Reply{Text: strings.Join(lines, "\n")}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const ENV_PREFIX = "MEMEBOT_"
+
+const CONFIG_FLAG = "config"
+
+// # Environment variable name
+//
+// This function returns the environment variable of a flag: `memory-top-k` is `MEMEBOT_MEMORY_TOP_K`.
+func EnvName(flag_name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flag_name, "-", "_"))
+}
+
+// # Read configuration file
+//
+// This function reads the settings of a configuration file, by flag name. Numbers are kept as written, as `json.Number`:
+// decoded as float64, a large integer would print as e.g. `2e+06`, which no int flag parses.
+func ReadConfigurationFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid configuration file %s: data after the settings object", path)
+	}
+	return settings, nil
+}
+
+// # Load configuration
+//
+// This function parses the command line into the flags of `flags`, resolving every setting with the precedence:
+//
+//	command-line flags > MEMEBOT_* environment variables > configuration file > defaults
+//
+// The configuration file is a JSON object keyed by flag name (e.g. `{"memory-top-k": 5}`),
+// given with `-config` or `MEMEBOT_CONFIG`.
+//
+// It returns where each setting not left to its default came from ("file", "env" or "flag").
+func LoadConfiguration(flags *flag.FlagSet, args []string) (map[string]string, error) {
+	config_path := flags.String(CONFIG_FLAG, "", "path of the JSON configuration file, keyed by flag name")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Settings given on the command line win, the others are filled from the file, then from the environment.
+	sources := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	if sources[CONFIG_FLAG] == "" {
+		*config_path = os.Getenv(EnvName(CONFIG_FLAG))
+	}
+
+	settings := map[string]interface{}{}
+	if *config_path != "" {
+		var err error
+		if settings, err = ReadConfigurationFile(*config_path); err != nil {
+			return nil, err
+		}
+		for name := range settings {
+			if flags.Lookup(name) == nil {
+				return nil, fmt.Errorf("unknown setting %q in %s", name, *config_path)
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || sources[f.Name] == "flag" || f.Name == CONFIG_FLAG {
+			return
+		}
+		if value, found := os.LookupEnv(EnvName(f.Name)); found {
+			if set_err := flags.Set(f.Name, value); set_err != nil {
+				err = fmt.Errorf("invalid %s: %w", EnvName(f.Name), set_err)
+			}
+			sources[f.Name] = "env"
+		} else if value, found := settings[f.Name]; found {
+			if set_err := flags.Set(f.Name, fmt.Sprint(value)); set_err != nil {
+				err = fmt.Errorf("invalid setting %q in %s: %w", f.Name, *config_path, set_err)
+			}
+			sources[f.Name] = "file"
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
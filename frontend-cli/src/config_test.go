@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfiguration(t *testing.T) {
+	config_path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config_path, []byte(`{"port": 8000, "model": "file", "max-bytes": 2000000, "timeout": "30s"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		port    int
+		model   string
+		sources map[string]string
+	}{
+		{"defaults", nil, nil, 80, "default", map[string]string{}},
+		{"file", []string{"-config", config_path}, nil, 8000, "file",
+			map[string]string{"config": "flag", "port": "file", "model": "file", "max-bytes": "file", "timeout": "file"}},
+		{"file from the environment", nil, map[string]string{"MEMEBOT_CONFIG": config_path}, 8000, "file",
+			map[string]string{"port": "file", "model": "file", "max-bytes": "file", "timeout": "file"}},
+		{"environment over file", []string{"-config", config_path}, map[string]string{"MEMEBOT_MODEL": "env"}, 8000, "env",
+			map[string]string{"config": "flag", "port": "file", "model": "env", "max-bytes": "file", "timeout": "file"}},
+		{"flag over environment", []string{"-config", config_path, "-model", "flag"}, map[string]string{"MEMEBOT_MODEL": "env"}, 8000, "flag",
+			map[string]string{"config": "flag", "port": "file", "model": "flag", "max-bytes": "file", "timeout": "file"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			port := flags.Int("port", 80, "")
+			model := flags.String("model", "default", "")
+			max_bytes := flags.Int64("max-bytes", 1000, "")
+			timeout := flags.Duration("timeout", time.Second, "")
+
+			sources, err := LoadConfiguration(flags, test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *port != test.port || *model != test.model {
+				t.Errorf("port, model = %d, %q, want %d, %q", *port, *model, test.port, test.model)
+			}
+			if test.sources["max-bytes"] == "file" && (*max_bytes != 2000000 || *timeout != 30*time.Second) {
+				t.Errorf("max-bytes, timeout = %d, %v, want 2000000, 30s", *max_bytes, *timeout)
+			}
+			if !maps.Equal(sources, test.sources) {
+				t.Errorf("sources = %v, want %v", sources, test.sources)
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		error  string
+	}{
+		{"unknown setting", `{"colour": "blue"}`, `unknown setting "colour"`},
+		{"invalid value", `{"port": "eighty"}`, `invalid setting "port"`},
+		{"fraction for an int", `{"port": 80.5}`, `invalid setting "port"`},
+		{"not an object", `["port"]`, "invalid configuration file"},
+		{"data after the object", `{"port": 80} {"port": 81}`, "data after the settings object"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config_path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(config_path, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			flags.Int("port", 80, "")
+
+			_, err := LoadConfiguration(flags, []string{"-config", config_path})
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("LoadConfiguration(%s) = %v, want an error with %q", test.config, err, test.error)
+			}
+		})
+	}
+}
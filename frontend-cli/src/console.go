@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const UTF8_BOM = "\ufeff"
+
+// # Console
+//
+// This struct is the terminal of the CLI, set up for UTF-8 text and ANSI colors on every platform:
+// on Windows, the console code pages are switched to UTF-8, ANSI escape sequences are enabled,
+// and the keyboard input is read as UTF-16 so CJK text typed in the console comes through intact.
+type Console struct {
+	ANSI bool // The terminal understands ANSI escape sequences.
+
+	scanner *bufio.Scanner
+}
+
+// # Open console
+//
+// This function sets up the terminal of the standard input and output.
+func OpenConsole() *Console {
+	input, ansi := setupConsole()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &Console{ANSI: ansi, scanner: scanner}
+}
+
+// # Read line
+//
+// This function returns the next line typed or piped in, without its line ending, `\n` or `\r\n`,
+// and without the byte order mark Windows tools put at the start of UTF-8 files. It returns `io.EOF` at the end of the input.
+func (console *Console) ReadLine() (string, error) {
+	if !console.scanner.Scan() {
+		if err := console.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	line := strings.TrimPrefix(console.scanner.Text(), UTF8_BOM)
+	return strings.TrimRight(line, "\r"), nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// # Set up console
+//
+// This function returns the input of the console. Linux and macOS terminals take UTF-8 and ANSI escape sequences as they are.
+func setupConsole() (io.Reader, bool) {
+	return os.Stdin, true
+}
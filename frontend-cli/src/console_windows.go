@@ -0,0 +1,97 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	CP_UTF8                            = 65001
+	ENABLE_VIRTUAL_TERMINAL_PROCESSING = 0x0004
+)
+
+const CONSOLE_READ_UNITS = 4096 // UTF-16 code units read from the console at once.
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleCP       = kernel32.NewProc("SetConsoleCP")
+	procSetConsoleOutputCP = kernel32.NewProc("SetConsoleOutputCP")
+	procSetConsoleMode     = kernel32.NewProc("SetConsoleMode")
+)
+
+// # Set up console
+//
+// This function switches the console to UTF-8 and enables its ANSI escape sequences, which Windows 10 and later support.
+// It returns the input of the console: read as UTF-16 when it's the keyboard, since the UTF-8 code page
+// garbles the non-ASCII text typed in the console, or as is when it's piped.
+func setupConsole() (io.Reader, bool) {
+	procSetConsoleCP.Call(CP_UTF8)
+	procSetConsoleOutputCP.Call(CP_UTF8)
+
+	ansi := false
+	if output, err := syscall.GetStdHandle(syscall.STD_OUTPUT_HANDLE); err == nil {
+		var mode uint32
+		if syscall.GetConsoleMode(output, &mode) == nil {
+			ok, _, _ := procSetConsoleMode.Call(uintptr(output), uintptr(mode|ENABLE_VIRTUAL_TERMINAL_PROCESSING))
+			ansi = ok != 0
+		} else {
+			ansi = true // Redirected, the escape sequences are left to the reader.
+		}
+	}
+
+	input, err := syscall.GetStdHandle(syscall.STD_INPUT_HANDLE)
+	var mode uint32
+	if err != nil || syscall.GetConsoleMode(input, &mode) != nil {
+		return os.Stdin, ansi
+	}
+	return &consoleReader{handle: input}, ansi
+}
+
+// # Console reader
+//
+// This struct reads the keyboard input of a Windows console as UTF-16, and returns it as UTF-8.
+type consoleReader struct {
+	handle    syscall.Handle
+	pending   []byte // UTF-8 text read but not returned yet.
+	surrogate uint16 // High surrogate ending the last read, completed by the next one.
+	eof       bool   // Ctrl+Z was typed, ending the input.
+}
+
+func (reader *consoleReader) Read(buffer []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.eof {
+			return 0, io.EOF
+		}
+		units := make([]uint16, CONSOLE_READ_UNITS)
+		var read uint32
+		if err := syscall.ReadConsole(reader.handle, &units[0], uint32(len(units)), &read, nil); err != nil {
+			return 0, err
+		}
+		if read == 0 {
+			return 0, io.EOF
+		}
+		units = units[:read]
+		if reader.surrogate != 0 {
+			units = append([]uint16{reader.surrogate}, units...)
+			reader.surrogate = 0
+		}
+		if last := units[len(units)-1]; utf16.IsSurrogate(rune(last)) && last < 0xDC00 {
+			reader.surrogate, units = last, units[:len(units)-1]
+		}
+		for _, r := range utf16.Decode(units) {
+			if r == 0x1A { // Ctrl+Z, the end of the input in a Windows console.
+				reader.eof = true
+				break
+			}
+			reader.pending = utf8.AppendRune(reader.pending, r)
+		}
+	}
+	n := copy(buffer, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const DEFAULT_DATASET_CONTEXT = 6 // Messages before a rated reply kept as its conversation.
+
+const (
+	DATASET_ROLE_USER      = "user"
+	DATASET_ROLE_ASSISTANT = "assistant"
+)
+
+type DatasetTurn struct {
+	Role string
+	Text string
+}
+
+// # Scored exchange
+//
+// This struct is a rated reply with the sum of its ratings, one per user.
+type ScoredExchange struct {
+	Channel string
+	RatedAt time.Time // First rating, some time after the reply.
+	Score   int
+	Exchange
+}
+
+// # Score exchanges
+//
+// This function sums the ratings of each reply, in the order the replies were first rated.
+func ScoreExchanges(entries []FeedbackEntry) []*ScoredExchange {
+	type exchange_key struct{ channel, prompt, response string }
+	index := map[exchange_key]*ScoredExchange{}
+	var exchanges []*ScoredExchange
+	for _, entry := range entries {
+		key := exchange_key{entry.Channel, entry.Prompt, entry.Response}
+		scored, found := index[key]
+		if !found {
+			scored = &ScoredExchange{Channel: entry.Channel, RatedAt: entry.Time, Exchange: entry.Exchange}
+			index[key] = scored
+			exchanges = append(exchanges, scored)
+		}
+		scored.Score += entry.Rating
+		if entry.Time.Before(scored.RatedAt) {
+			scored.RatedAt = entry.Time
+		}
+	}
+	return exchanges
+}
+
+// # Conversation of an exchange
+//
+// This function rebuilds the conversation leading to a rated reply from the message log of its channel:
+// the reply, found as the last bot message with its text before the rating, and up to `context` messages before it.
+// Consecutive messages of the users are joined in a single turn. When the reply isn't in the log, e.g. in channels
+// with translation, the conversation is the rated exchange alone.
+func conversationOf(exchange *ScoredExchange, channel_messages []IndexedMessage, context int) []DatasetTurn {
+	reply := -1
+	for i := len(channel_messages) - 1; i >= 0; i-- {
+		message := channel_messages[i]
+		if message.User == BOT_SPEAKER && message.Text == exchange.Response && !message.Time.After(exchange.RatedAt) {
+			reply = i
+			break
+		}
+	}
+	if reply < 0 {
+		return []DatasetTurn{{DATASET_ROLE_USER, exchange.Input}, {DATASET_ROLE_ASSISTANT, exchange.Response}}
+	}
+
+	var turns []DatasetTurn
+	for _, message := range channel_messages[max(reply-context, 0) : reply+1] {
+		role := DATASET_ROLE_USER
+		if message.User == BOT_SPEAKER {
+			role = DATASET_ROLE_ASSISTANT
+		}
+		if len(turns) > 0 && turns[len(turns)-1].Role == role {
+			turns[len(turns)-1].Text += "\n" + message.Text
+			continue
+		}
+		if len(turns) == 0 && role == DATASET_ROLE_ASSISTANT {
+			continue // Conversations start with the user.
+		}
+		turns = append(turns, DatasetTurn{role, message.Text})
+	}
+	if len(turns) < 2 {
+		return []DatasetTurn{{DATASET_ROLE_USER, exchange.Input}, {DATASET_ROLE_ASSISTANT, exchange.Response}}
+	}
+	return turns
+}
+
+// # Write dataset
+//
+// This function writes the conversations as a JSON lines chat dataset, in one of these formats:
+//
+// - sharegpt: `{"conversations": [{"from": "human" | "gpt", "value"}]}`
+// - chatml: `{"messages": [{"role": "user" | "assistant", "content"}]}`, the OpenAI chat format
+func WriteDataset(conversations [][]DatasetTurn, format string, output io.Writer) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+
+	for _, turns := range conversations {
+		var line interface{}
+		switch format {
+		case "sharegpt":
+			messages := make([]map[string]string, len(turns))
+			for i, turn := range turns {
+				from := "human"
+				if turn.Role == DATASET_ROLE_ASSISTANT {
+					from = "gpt"
+				}
+				messages[i] = map[string]string{"from": from, "value": turn.Text}
+			}
+			line = map[string]interface{}{"conversations": messages}
+		case "chatml":
+			messages := make([]map[string]string, len(turns))
+			for i, turn := range turns {
+				messages[i] = map[string]string{"role": turn.Role, "content": turn.Text}
+			}
+			line = map[string]interface{}{"messages": messages}
+		default:
+			return fmt.Errorf("unknown dataset format %q, expected sharegpt or chatml", format)
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// # Dataset subcommand
+//
+// This function handles `export-dataset [-format sharegpt|chatml] [-min-score n] [-context n] [output]`:
+// it writes the replies rated at least `min-score` in total, with the conversation leading to them
+// when the message log of `-search-index` has it, as a chat dataset to fine-tune the model on the bot's best material.
+func runDatasetCommand(feedback_path string, messages_path string, args []string) error {
+	if feedback_path == "" {
+		return fmt.Errorf("no feedback store, set it with -feedback")
+	}
+	flags := flag.NewFlagSet("export-dataset", flag.ContinueOnError)
+	format := flags.String("format", "sharegpt", "dataset format: sharegpt or chatml")
+	min_score := flags.Int("min-score", 1, "lowest total rating of the exported replies")
+	context := flags.Int("context", DEFAULT_DATASET_CONTEXT, "messages before each reply kept as its conversation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	entries, err := ReadFeedback(feedback_path)
+	if err != nil {
+		return err
+	}
+	by_channel := map[string][]IndexedMessage{}
+	if messages_path != "" {
+		messages, err := ReadIndexedMessages(messages_path)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			by_channel[message.Channel] = append(by_channel[message.Channel], message)
+		}
+		for _, channel_messages := range by_channel {
+			sort.SliceStable(channel_messages, func(i, j int) bool { return channel_messages[i].Time.Before(channel_messages[j].Time) })
+		}
+	}
+
+	var conversations [][]DatasetTurn
+	exchanges := ScoreExchanges(entries)
+	for _, exchange := range exchanges {
+		if exchange.Score >= *min_score {
+			conversations = append(conversations, conversationOf(exchange, by_channel[exchange.Channel], *context))
+		}
+	}
+
+	output := os.Stdout
+	if flags.NArg() > 0 {
+		output, err = os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+	if err := WriteDataset(conversations, *format, output); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d conversations from %d rated replies\n", len(conversations), len(exchanges))
+	return nil
+}
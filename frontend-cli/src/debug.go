@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const CHARS_PER_TOKEN = 4 // Rough ratio for English text, good enough to spot prompts nearing the context size.
+
+// # Estimate tokens
+//
+// This function estimates the number of tokens of a text without calling the backend tokenizer.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
+
+// # Describe request
+//
+// This function describes the completion request sent for the parameters: the rendered prompt,
+// a token estimate and the JSON body.
+func DescribeRequest(params LlmGenerationParameters) string {
+	body := params.ToJSON()
+	return fmt.Sprintf("POST /%s\nPrompt: ~%d tokens, up to %d generated\n\nRendered prompt:\n```\n%s\n```\n\nJSON body:\n```json\n%s\n```",
+		COMPLETIONS_ENDPOINT, EstimateTokens(params.Prompt), params.MaxTokens, params.Prompt, body)
+}
+
+// # Debug command
+//
+// This function handles the `/debug` command, reserved to admins by its registration as it reveals the persona instructions.
+//
+// Usage:
+//
+// - /debug prompt <text>: show the request the text would produce in this channel, without sending it
+func (bot *Bot) debug(message Message, args string) Reply {
+	if text, found := cutCommand(args, "prompt"); found && text != "" {
+		params, variant := bot.chatRequest(message, text)
+		description := DescribeRequest(params)
+		if variant != "" {
+			description = fmt.Sprintf("Experiment variant: %s\n%s", variant, description)
+		}
+		return Reply{Text: description}
+	}
+	return Reply{Text: bot.T(message, "Usage: /debug prompt <text>")}
+}
+
+// # Dry-run response
+//
+// This function stands in for the model response in dry-run mode.
+func dryRunResponse(params LlmGenerationParameters) string {
+	return "[dry run, nothing sent]\n" + DescribeRequest(params)
+}
+
+// # Usage summary
+//
+// This function describes the token usage of a reply: prompt and reply tokens, the context left,
+// and the history turns that fit in the prompt.
+func (bot *Bot) usageSummary(message Message, usage *LlmUsage, history_turns int) string {
+	approximately := ""
+	if usage.Estimated {
+		approximately = "~"
+	}
+	summary := bot.T(message, "Tokens: %s%d prompt + %s%d reply", approximately, usage.PromptTokens, approximately, usage.CompletionTokens)
+	if bot.ContextSize > 0 {
+		left := bot.ContextSize - usage.PromptTokens - usage.CompletionTokens
+		summary += bot.T(message, ", %d of %d context left", max(left, 0), bot.ContextSize)
+	}
+	return summary + bot.T(message, ", %d of %d history turns kept.", history_turns, bot.HistoryTurns)
+}
+
+// # Tokens
+//
+// This function handles the `/tokens` command, showing the token usage of the last reply in the channel.
+func (bot *Bot) tokens(message Message, _ string) Reply {
+	_, usage, history := bot.Sessions.Get(message.Channel).LastReply()
+	if usage == nil {
+		return Reply{Text: bot.T(message, "I haven't replied here yet.")}
+	}
+	return Reply{Text: bot.usageSummary(message, usage, history)}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const DEFAULT_DEDUP_WINDOW = 10 * time.Minute
+
+// # Duplicate filter
+//
+// This struct is the idempotency layer of the frontends: it remembers the messages seen over the last `Window`,
+// so webhook redeliveries of a message are processed once. A window of 0 or less lets everything through.
+type DuplicateFilter struct {
+	Window time.Duration
+
+	mu          sync.Mutex
+	seen        map[string]time.Time
+	last_pruned time.Time
+}
+
+func NewDuplicateFilter(window time.Duration) *DuplicateFilter {
+	return &DuplicateFilter{Window: window, seen: map[string]time.Time{}}
+}
+
+// # Message key
+//
+// This function returns the key identifying a message across redeliveries, empty if the message has no ID.
+// Some platforms only number messages within a chat, so the channel is part of the key.
+func (message Message) Key() string {
+	if message.ID == "" {
+		return ""
+	}
+	return message.Channel + "\x00" + message.ID
+}
+
+// # Is duplicate
+//
+// This function records the message and reports whether it was already seen within the window.
+// Messages without ID are never duplicates.
+func (filter *DuplicateFilter) IsDuplicate(message Message) bool {
+	key := message.Key()
+	if filter == nil || filter.Window <= 0 || key == "" {
+		return false
+	}
+
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(filter.last_pruned) > filter.Window {
+		for seen_key, seen_at := range filter.seen {
+			if now.Sub(seen_at) >= filter.Window {
+				delete(filter.seen, seen_key)
+			}
+		}
+		filter.last_pruned = now
+	}
+
+	if seen_at, found := filter.seen[key]; found && now.Sub(seen_at) < filter.Window {
+		return true
+	}
+	filter.seen[key] = now
+	return false
+}
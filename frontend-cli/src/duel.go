@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const DUEL_PROMPT = "You're chatting with %s about: %s\nStay in character and keep it short."
+
+const (
+	DUEL_DEFAULT_TURNS = 6
+	DUEL_MAX_TURNS     = 12
+)
+
+const DUEL_TOKEN_BUDGET = 1024 // Completion tokens of a whole duel, past which it stops.
+
+// # Duel turns
+//
+// This function returns the conversation of a duel as seen by one of the two speakers, `0` for the opener:
+// the lines of the speaker are the model turns, the lines of the other one the user turns.
+// The opening prompt starts the conversation. The last line of the other speaker, or the opening, is the prompt.
+func duelTurns(opening string, lines []string, speaker int) ([]ChatTurn, string) {
+	var inputs, own []string
+	if speaker == 0 {
+		inputs = append(inputs, opening)
+	}
+	for i, line := range lines {
+		if i%2 == speaker {
+			own = append(own, line)
+		} else {
+			inputs = append(inputs, line)
+		}
+	}
+	if speaker == 1 {
+		inputs[0] = opening + "\n\n" + inputs[0]
+	}
+
+	turns := make([]ChatTurn, len(own))
+	for i := range own {
+		turns[i] = ChatTurn{User: inputs[i], Model: own[i]}
+	}
+	return turns, inputs[len(inputs)-1]
+}
+
+// # Duel
+//
+// This function handles the `/duel` command, e.g. `/duel pirate robot 6 best pizza topping`:
+// two personas talk to each other about the topic for a number of lines, posted to the channel as they come.
+// The duel stops at the turn limit, or when it has used its token budget. A channel runs one duel at a time.
+func (bot *Bot) duel(message Message, args string) Reply {
+	fields := strings.Fields(args)
+	if len(fields) < 3 {
+		return Reply{Text: bot.T(message, "Usage: %s", "/duel <persona> <persona> [turns] <topic>")}
+	}
+
+	var personas [2]*Persona
+	for i, name := range fields[:2] {
+		persona, found := bot.Personas.Find(name)
+		if !found {
+			return Reply{Text: bot.T(message, "I don't know any persona named %q.", name)}
+		}
+		personas[i] = persona
+	}
+	turns, topic := DUEL_DEFAULT_TURNS, strings.Join(fields[2:], " ")
+	if count, err := strconv.Atoi(fields[2]); err == nil && len(fields) > 3 {
+		turns, topic = min(max(count, 1), DUEL_MAX_TURNS), strings.Join(fields[3:], " ")
+	}
+
+	if _, running := bot.duels.LoadOrStore(message.Channel, true); running {
+		return Reply{Text: bot.T(message, "A duel is already running here.")}
+	}
+	go func() {
+		defer bot.duels.Delete(message.Channel)
+		bot.runDuel(message, personas, turns, topic)
+	}()
+	return Reply{Text: bot.T(message, "%s vs %s: %s", personas[0].Name, personas[1].Name, topic)}
+}
+
+// # Run duel
+//
+// This function generates the lines of a duel and posts them. The generations are background requests,
+// so the live messages are answered first.
+func (bot *Bot) runDuel(message Message, personas [2]*Persona, turns int, topic string) {
+	channel := message.Channel
+	config := bot.Channels.Get(channel)
+	chat_template, _ := GetChatTemplate(config.Template)
+	message.Background = true
+	message.OnPartialReply = nil
+
+	var lines []string
+	budget := DUEL_TOKEN_BUDGET
+	for i := 0; i < turns; i++ {
+		speaker, other := personas[i%2], personas[(i+1)%2]
+		history, prompt := duelTurns(fmt.Sprintf(DUEL_PROMPT, other.Name, topic), lines, i%2)
+		speaker_template := chat_template.With(PromptVariables{BotName: speaker.Name, UserName: other.Name, Channel: channel})
+		params := config.Sampling.Apply(speaker.Sampling.Apply(bot.Params()))
+		params = params.SetPrompt(FormatPersonaConversation(speaker_template, speaker, history, prompt))
+		params.MaxTokens = min(params.MaxTokens, budget)
+
+		result := bot.generateResult(message, params)
+		if result.Err != nil {
+			log.Println(fmt.Errorf("duel in %s: %w", channel, result.Err))
+			bot.Post(channel, Reply{Text: bot.userErrorMessage(message, result.Err)})
+			return
+		}
+		line := strings.TrimSpace(result.Text)
+		lines = append(lines, line)
+		bot.Post(channel, Reply{Text: fmt.Sprintf("%s: %s", speaker.Name, line)})
+
+		budget -= result.Usage.CompletionTokens
+		if budget <= 0 && i < turns-1 {
+			bot.Post(channel, Reply{Text: bot.T(message, "The duel ran out of breath.")})
+			return
+		}
+	}
+}
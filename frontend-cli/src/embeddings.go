@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const EMBEDDINGS_ENDPOINT = "v1/embeddings"
+
+// # LLM backend client
+//
+// This struct holds the address of the llama-cpp-python server, so callers
+// don't have to pass the server and port around for every request.
+type LlmClient struct {
+	Server string
+	Port   int
+}
+
+// # Create a new client
+//
+// This function creates a client for the server listening on `server:port`.
+func NewLlmClient(server string, port int) *LlmClient {
+	return &LlmClient{Server: server, Port: port}
+}
+
+// # Endpoint URL
+//
+// This function returns the full URL of the given endpoint on the server.
+func (client *LlmClient) Url(endpoint string) string {
+	return fmt.Sprintf("http://%s:%d/%s", client.Server, client.Port, endpoint)
+}
+
+type LlmEmbeddingRequest struct {
+	ModelName string   `json:"model"`
+	Input     []string `json:"input"`
+}
+
+type LlmEmbeddingResponse struct {
+	Object string `json:"object"`
+	Model  string `json:"model"`
+	Data   []struct {
+		Object    string    `json:"object"`
+		Embedding []float64 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Usage *LlmUsage `json:"usage"`
+}
+
+// # Embed texts
+//
+// This function sends the texts to the embeddings endpoint and returns one vector per text,
+// in the same order as the input.
+//
+// Note that the backend must be started with `--embedding` for this endpoint to work.
+func (client *LlmClient) Embed(texts ...string) ([][]float64, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	request_body, err := json.Marshal(LlmEmbeddingRequest{Input: texts})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(client.Url(EMBEDDINGS_ENDPOINT), "application/json", strings.NewReader(string(request_body)))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := ParseBackendError(resp.StatusCode, body); err != nil {
+		return nil, fmt.Errorf("embedding request failed: %w", err)
+	}
+
+	var embedding_response LlmEmbeddingResponse
+	if err := json.Unmarshal(body, &embedding_response); err != nil {
+		return nil, err
+	}
+	if len(embedding_response.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(embedding_response.Data))
+	}
+
+	// The backend reports the input position of each vector, don't rely on the array order.
+	vectors := make([][]float64, len(texts))
+	for _, data := range embedding_response.Data {
+		if data.Index < 0 || data.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	return vectors, nil
+}
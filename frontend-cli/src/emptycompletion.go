@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"unicode"
+)
+
+const (
+	FINISH_REASON_STOP   = "stop"   // The model ended the completion by itself.
+	FINISH_REASON_LENGTH = "length" // The completion hit the token limit.
+)
+
+const (
+	EMPTY_RETRY_TEMPERATURE_STEP    = 0.3 // Temperature added for the generation again, so the end of turn isn't the likeliest token.
+	EMPTY_RETRY_MIN_TEMPERATURE     = 0.7
+	EMPTY_RETRY_REPEAT_PENALTY_STEP = 0.15 // Repeat penalty added when the completion ran to the limit, looping on blanks.
+)
+
+// # Empty completion error
+//
+// This struct is the error of a completion without any text: the backend answered, but with nothing but blanks,
+// control characters or replacement characters.
+type EmptyCompletionError struct {
+	FinishReason string
+}
+
+func (err *EmptyCompletionError) Error() string {
+	if err.FinishReason == "" {
+		return "the model returned an empty completion"
+	}
+	return fmt.Sprintf("the model returned an empty completion (finish reason %s)", err.FinishReason)
+}
+
+// # Is empty completion
+//
+// This function reports whether the completion has nothing to show: no letter, digit, punctuation or symbol.
+// Emoji are symbols, so a reply of emoji alone isn't empty.
+func isEmptyCompletion(text string) bool {
+	for _, r := range text {
+		if r != unicode.ReplacementChar && (unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// # Check completion
+//
+// This function returns an `*EmptyCompletionError` when the completion, as it finished, is empty.
+func checkCompletion(text string, finish_reason string) error {
+	if isEmptyCompletion(text) {
+		return &EmptyCompletionError{FinishReason: finish_reason}
+	}
+	return nil
+}
+
+// # Empty retry sampling
+//
+// This function adjusts the sampling of a generation which came back empty, for its single retry: another seed and a higher
+// temperature, as the model likely sampled the end of turn first. When it ran to the token limit instead, it was looping on blanks,
+// and the repeat penalty is raised too.
+func emptyRetrySampling(params LlmGenerationParameters, finish_reason string) LlmGenerationParameters {
+	seed := rand.Intn(1 << 31)
+	params.Seed = &seed
+	params.Temperature = min(max(params.Temperature+EMPTY_RETRY_TEMPERATURE_STEP, EMPTY_RETRY_MIN_TEMPERATURE), REPEAT_MAX_TEMPERATURE)
+	if strings.EqualFold(finish_reason, FINISH_REASON_LENGTH) {
+		params.RepeatPenalty += EMPTY_RETRY_REPEAT_PENALTY_STEP
+	}
+	return params
+}
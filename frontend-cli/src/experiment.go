@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// # Experiment variant
+//
+// This struct is a named set of sampling parameters under test.
+// Variants are picked in proportion to their weight, 1 by default.
+type ExperimentVariant struct {
+	Name     string            `json:"name"`
+	Weight   float64           `json:"weight,omitempty"`
+	Sampling SamplingOverrides `json:"sampling"`
+}
+
+// # Experiment
+//
+// This struct runs an A/B test: every generation is randomly assigned to one of the variants,
+// and its reply is tagged with the variant so the ratings can be compared.
+// A nil experiment assigns no variant.
+type Experiment struct {
+	path string
+
+	mu       sync.Mutex
+	variants []ExperimentVariant
+}
+
+// # Load experiment
+//
+// This function loads the variants from the JSON array at `path`.
+func LoadExperiment(path string) (*Experiment, error) {
+	experiment := &Experiment{path: path}
+	if err := experiment.Reload(); err != nil {
+		return nil, err
+	}
+	return experiment, nil
+}
+
+// # Reload experiment
+//
+// This function reads the variants file again. On error, the current variants are kept.
+func (experiment *Experiment) Reload() error {
+	data, err := os.ReadFile(experiment.path)
+	if err != nil {
+		return err
+	}
+
+	var variants []ExperimentVariant
+	if err := json.Unmarshal(data, &variants); err != nil {
+		return fmt.Errorf("invalid experiment %s: %w", experiment.path, err)
+	}
+	names := map[string]bool{}
+	for i := range variants {
+		variant := &variants[i]
+		if variant.Name == "" || names[variant.Name] {
+			return fmt.Errorf("experiment %s: variant %d needs a unique name", experiment.path, i+1)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			return fmt.Errorf("experiment %s: variant %q has a negative weight", experiment.path, variant.Name)
+		}
+		if variant.Weight == 0 {
+			variant.Weight = 1
+		}
+	}
+
+	experiment.mu.Lock()
+	experiment.variants = variants
+	experiment.mu.Unlock()
+	return nil
+}
+
+// # Pick variant
+//
+// This function draws a variant, weighted. It returns nil without variants.
+func (experiment *Experiment) Pick() *ExperimentVariant {
+	if experiment == nil {
+		return nil
+	}
+	experiment.mu.Lock()
+	defer experiment.mu.Unlock()
+
+	total := 0.0
+	for _, variant := range experiment.variants {
+		total += variant.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	draw := rand.Float64() * total
+	for i := range experiment.variants {
+		draw -= experiment.variants[i].Weight
+		if draw < 0 {
+			variant := experiment.variants[i]
+			return &variant
+		}
+	}
+	variant := experiment.variants[len(experiment.variants)-1]
+	return &variant
+}
+
+// # Variant score
+//
+// This struct aggregates the ratings of the replies of a variant.
+type VariantScore struct {
+	Variant string
+	Good    int
+	Bad     int
+}
+
+// # Score
+//
+// This function returns the mean rating, from -1 (all bad) to 1 (all good).
+func (score VariantScore) Score() float64 {
+	if score.Good+score.Bad == 0 {
+		return 0
+	}
+	return float64(score.Good-score.Bad) / float64(score.Good+score.Bad)
+}
+
+// # Score variants
+//
+// This function aggregates the ratings per variant, best score first.
+// Replies generated outside of an experiment are grouped under an empty variant name.
+func ScoreVariants(entries []FeedbackEntry) []VariantScore {
+	scores := map[string]*VariantScore{}
+	for _, entry := range entries {
+		score, found := scores[entry.Variant]
+		if !found {
+			score = &VariantScore{Variant: entry.Variant}
+			scores[entry.Variant] = score
+		}
+		if entry.Rating > 0 {
+			score.Good++
+		} else {
+			score.Bad++
+		}
+	}
+
+	results := make([]VariantScore, 0, len(scores))
+	for _, score := range scores {
+		results = append(results, *score)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score() != results[j].Score() {
+			return results[i].Score() > results[j].Score()
+		}
+		return results[i].Variant < results[j].Variant
+	})
+	return results
+}
+
+// # Print variant scores
+//
+// This function prints the scores as a table.
+func PrintVariantScores(output io.Writer, scores []VariantScore) {
+	table := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "VARIANT\tRATINGS\tGOOD\tBAD\tSCORE")
+	for _, score := range scores {
+		name := score.Variant
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%+.2f\n", name, score.Good+score.Bad, score.Good, score.Bad, score.Score())
+	}
+	table.Flush()
+}
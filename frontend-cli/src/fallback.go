@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+const RESPONSE_CACHE_SIZE = 200 // Replies kept to stand in while the backend is down.
+
+const RESPONSE_CACHE_MIN_SIMILARITY = 0.5 // Share of common words for a cached reply to answer a message.
+
+// # Load fallback replies
+//
+// This function loads the canned replies used while the backend is down, as a JSON array of strings.
+func LoadFallbackReplies(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var replies []string
+	if err := json.Unmarshal(data, &replies); err != nil {
+		return nil, fmt.Errorf("invalid fallback replies %s: %w", path, err)
+	}
+	return replies, nil
+}
+
+type cached_response struct {
+	channel string
+	user    string // Sender of the message answered.
+	terms   []string
+	reply   string
+}
+
+// # Response cache
+//
+// This struct keeps the last replies of the bot with the words of the messages they answered,
+// so a similar message of the same channel can get one of them while the backend is down.
+type ResponseCache struct {
+	mu        sync.Mutex
+	responses []cached_response
+}
+
+// # Add response
+//
+// This function keeps a reply to the user in the channel, forgetting the oldest beyond `RESPONSE_CACHE_SIZE`.
+func (cache *ResponseCache) Add(channel string, user string, user_input string, reply string) {
+	terms := uniqueTerms(user_input, false)
+	if len(terms) == 0 || reply == "" {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.responses = append(cache.responses, cached_response{channel: channel, user: user, terms: terms, reply: reply})
+	if len(cache.responses) > RESPONSE_CACHE_SIZE {
+		cache.responses = cache.responses[len(cache.responses)-RESPONSE_CACHE_SIZE:]
+	}
+}
+
+// # Similar response
+//
+// This function returns the reply to the most similar message of the channel, measured by the share of words in common
+// (Jaccard index), if it's similar enough.
+func (cache *ResponseCache) Similar(channel string, user_input string) (string, bool) {
+	terms := uniqueTerms(user_input, false)
+	if len(terms) == 0 {
+		return "", false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	best, best_similarity := "", 0.0
+	for _, response := range cache.responses {
+		if response.channel != channel {
+			continue
+		}
+		similarity := jaccardSimilarity(terms, response.terms)
+		if similarity >= best_similarity {
+			best, best_similarity = response.reply, similarity // The newest of equally similar replies wins.
+		}
+	}
+	return best, best != "" && best_similarity >= RESPONSE_CACHE_MIN_SIMILARITY
+}
+
+// # Forget user
+//
+// This function drops the replies to the user. It returns how many were dropped.
+func (cache *ResponseCache) ForgetUser(user string) int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var kept []cached_response
+	for _, response := range cache.responses {
+		if response.user != user {
+			kept = append(kept, response)
+		}
+	}
+	forgotten := len(cache.responses) - len(kept)
+	cache.responses = kept
+	return forgotten
+}
+
+// # Fallback reply
+//
+// This function answers a message the model couldn't: while the backend is down, with the reply to a similar message
+// if there is one, or one of the canned fallback replies; otherwise, and for the other errors, by explaining the error.
+func (bot *Bot) fallbackReply(message Message, user_input string, err error) string {
+	if !isBackendDown(err) {
+		return bot.userErrorMessage(message, err)
+	}
+	if reply, found := bot.responses.Similar(message.Channel, user_input); found {
+		return reply
+	}
+	if len(bot.FallbackReplies) > 0 {
+		return bot.FallbackReplies[rand.Intn(len(bot.FallbackReplies))]
+	}
+	return bot.userErrorMessage(message, err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FAST_PATH_MAX_INPUT  = 80  // Runes of the longest message tried on the fast path.
+	FAST_PATH_MAX_TOKENS = 128 // Completion tokens of a fast answer, a longer one is escalated.
+)
+
+// Phrases of a model that doesn't know the answer, lower case.
+var fast_path_unsure = []string{
+	"i don't know",
+	"i do not know",
+	"i'm not sure",
+	"i am not sure",
+	"i cannot",
+	"i can't answer",
+	"as an ai",
+	"我不知道",
+	"我不確定",
+	"我不确定",
+}
+
+// # Fast path
+//
+// This struct sends the short messages to a small cheap model first, and escalates to the model of the bot
+// only when the small model's answer doesn't look right, so trivial messages don't take a slot of the big model.
+// A nil fast path sends everything to the model of the bot.
+type FastPath struct {
+	Backend *LlmClient // Backend of the small model, nil for the backend of the bot.
+	Model   string     // Small model requested from the backend, empty for the loaded model.
+}
+
+// # Accepts
+//
+// This function reports whether the user input is short enough to try on the fast path.
+func (fast *FastPath) Accepts(user_input string) bool {
+	return fast != nil && utf8.RuneCountInString(strings.TrimSpace(user_input)) <= FAST_PATH_MAX_INPUT
+}
+
+// # Confident
+//
+// This function reports whether a fast answer can be posted: it isn't empty, wasn't cut by its token limit or timeout,
+// and doesn't admit the model doesn't know.
+func (fast *FastPath) Confident(result *GenerationResult, params LlmGenerationParameters) bool {
+	text := strings.TrimSpace(result.Text)
+	if text == "" || strings.HasSuffix(text, TRUNCATION_MARKER) {
+		return false
+	}
+	if result.Usage != nil && result.Usage.CompletionTokens >= params.MaxTokens {
+		return false
+	}
+	lower := strings.ToLower(text)
+	for _, phrase := range fast_path_unsure {
+		if strings.Contains(lower, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+// # Generate on the fast path
+//
+// This function generates the answer to the user input with the small model when the fast path accepts it,
+// and with the model of the bot otherwise, or when the small model's answer isn't confident.
+// Messages with overrides skip the fast path, they were asked of the model of the bot.
+// The fast answer isn't streamed, since it may be replaced.
+func (bot *Bot) generateFast(message Message, user_input string, params LlmGenerationParameters) *GenerationResult {
+	fast := bot.FastPath
+	if !fast.Accepts(user_input) || message.Overrides != nil || bot.DryRun {
+		return bot.generateResult(message, params)
+	}
+
+	fast_message := message
+	fast_message.OnPartialReply = nil
+	fast_params := params
+	if fast.Model != "" {
+		fast_params.ModelName = fast.Model
+	}
+	if fast.Backend != nil {
+		fast_params.SlotID = nil // The slots of the bot's backend.
+	}
+	fast_params.MaxTokens = min(params.MaxTokens, FAST_PATH_MAX_TOKENS)
+
+	result := bot.generateOn(fast.Backend, fast_message, fast_params)
+	switch {
+	case result.Err != nil:
+		log.Printf("fast path in %s failed, escalating: %v\n", message.Channel, result.Err)
+	case !fast.Confident(result, fast_params):
+		log.Printf("fast path in %s not confident, escalating: %q\n", message.Channel, result.Text)
+	default:
+		return result
+	}
+	return bot.generateResult(message, params)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FEEDBACK_GOOD = 1
+	FEEDBACK_BAD  = -1
+)
+
+// Reactions counted as feedback on the replies of the bot.
+var FeedbackReactions = map[string]int{
+	"👍": FEEDBACK_GOOD, "+1": FEEDBACK_GOOD, "thumbsup": FEEDBACK_GOOD,
+	"👎": FEEDBACK_BAD, "-1": FEEDBACK_BAD, "thumbsdown": FEEDBACK_BAD,
+}
+
+// # Exchange
+//
+// This struct is a reply of the bot with what produced it, kept so users can rate it.
+type Exchange struct {
+	Input    string                  `json:"input"`  // Text of the user message.
+	Prompt   string                  `json:"prompt"` // Formatted prompt sent to the model.
+	Response string                  `json:"response"`
+	Params   LlmGenerationParameters `json:"params"`
+	Variant  string                  `json:"variant,omitempty"` // Experiment variant the parameters come from.
+}
+
+// # Create exchange
+//
+// This function records a generation. The prompt is kept apart from the parameters, to store it only once.
+func NewExchange(input string, params LlmGenerationParameters, variant string, response string) *Exchange {
+	prompt := params.Prompt
+	params.Prompt = ""
+	return &Exchange{Input: input, Prompt: prompt, Response: response, Params: params, Variant: variant}
+}
+
+type FeedbackEntry struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	User    string    `json:"user"`
+	Rating  int       `json:"rating"` // FEEDBACK_GOOD or FEEDBACK_BAD.
+	Exchange
+}
+
+// # Feedback store
+//
+// This struct appends the ratings of the replies to a JSON lines file.
+// A nil feedback store drops the ratings.
+type FeedbackStore struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// # Open feedback store
+//
+// This function opens the feedback store at `path` for appending.
+func OpenFeedbackStore(path string) (*FeedbackStore, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FeedbackStore{path: path, file: file}, nil
+}
+
+// # Record feedback
+//
+// This function writes a rating to the store.
+func (store *FeedbackStore) Record(entry FeedbackEntry) error {
+	if store == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, err = store.file.Write(append(line, '\n'))
+	return err
+}
+
+// # Forget user
+//
+// This function drops the ratings of the user and rewrites the store without them. It returns how many were dropped.
+func (store *FeedbackStore) ForgetUser(user string) (int, error) {
+	if store == nil {
+		return 0, nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return pruneAppendFile(&store.file, func(entry FeedbackEntry) bool { return entry.User != user })
+}
+
+// # Read feedback
+//
+// This function reads every rating of the store at `path`.
+// When a user rated the same reply several times, only the last rating is kept.
+func ReadFeedback(path string) ([]FeedbackEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type rating_key struct{ user, prompt, response string }
+	index := map[rating_key]int{}
+	var entries []FeedbackEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		var entry FeedbackEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line_number, err)
+		}
+		key := rating_key{entry.User, entry.Prompt, entry.Response}
+		if i, found := index[key]; found {
+			entries[i] = entry
+			continue
+		}
+		index[key] = len(entries)
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// # Rate the last reply
+//
+// This function records the rating of the last reply in the channel.
+func (bot *Bot) rate(message Message, rating int) error {
+	if bot.Privacy.OptedOut(message.User) {
+		return nil
+	}
+	exchange, _, _ := bot.Sessions.Get(message.Channel).LastReply()
+	if exchange == nil {
+		return fmt.Errorf("no reply to rate in %s", message.Channel)
+	}
+	return bot.Feedback.Record(FeedbackEntry{Channel: message.Channel, User: message.User, Rating: rating, Exchange: *exchange})
+}
+
+// # Handle reaction
+//
+// This function records a 👍 or 👎 reaction on the last reply of the bot as feedback.
+// Other reactions are ignored. Reactions are silent: the reply is always empty.
+func (bot *Bot) HandleReaction(message Message, reaction string) Reply {
+	rating, found := FeedbackReactions[reaction]
+	if !found || bot.Feedback == nil {
+		return Reply{}
+	}
+	if err := bot.rate(message, rating); err != nil {
+		log.Println(err)
+	}
+	return Reply{}
+}
+
+// # Feedback command
+//
+// This function handles the `/good` and `/bad` commands, the textual form of the reactions.
+func (bot *Bot) feedback(message Message, rating int) Reply {
+	if bot.Feedback == nil {
+		return Reply{Text: bot.T(message, "Feedback collection is disabled.")}
+	}
+	if err := bot.rate(message, rating); err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "There's no reply of mine to rate here.")}
+	}
+	return Reply{Text: bot.T(message, "Thanks for the feedback!")}
+}
+
+// # Export preference dataset
+//
+// This function writes the ratings as a JSON lines preference dataset, in one of these formats:
+//
+// - kto: one `{"prompt", "completion", "label"}` line per rating, good ratings labelled true;
+// - dpo: one `{"prompt", "chosen", "rejected"}` line per pair of good and bad replies to the same prompt.
+//
+// It returns the number of lines written.
+func ExportPreferences(entries []FeedbackEntry, format string, output io.Writer) (int, error) {
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+
+	switch format {
+	case "kto":
+		for i, entry := range entries {
+			err := encoder.Encode(map[string]interface{}{
+				"prompt":     entry.Prompt,
+				"completion": entry.Response,
+				"label":      entry.Rating > 0,
+			})
+			if err != nil {
+				return i, err
+			}
+		}
+		return len(entries), nil
+	case "dpo":
+		var prompts []string
+		chosen := map[string][]string{}
+		rejected := map[string][]string{}
+		for _, entry := range entries {
+			if len(chosen[entry.Prompt]) == 0 && len(rejected[entry.Prompt]) == 0 {
+				prompts = append(prompts, entry.Prompt)
+			}
+			if entry.Rating > 0 {
+				chosen[entry.Prompt] = append(chosen[entry.Prompt], entry.Response)
+			} else {
+				rejected[entry.Prompt] = append(rejected[entry.Prompt], entry.Response)
+			}
+		}
+
+		count := 0
+		for _, prompt := range prompts {
+			for _, good := range chosen[prompt] {
+				for _, bad := range rejected[prompt] {
+					if good == bad {
+						continue // Users disagreeing on a reply isn't a preference.
+					}
+					if err := encoder.Encode(map[string]string{"prompt": prompt, "chosen": good, "rejected": bad}); err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+		}
+		return count, nil
+	default:
+		return 0, fmt.Errorf("unknown dataset format %q, expected kto or dpo", format)
+	}
+}
+
+// # Feedback subcommand
+//
+// This function handles the feedback subcommands:
+//
+// - feedback export [-format kto|dpo] [output]: write the dataset, to stdout without output file
+// - feedback stats: print the ratings per experiment variant
+func runFeedbackCommand(feedback_path string, args []string) error {
+	usage := fmt.Errorf("usage: feedback export [-format kto|dpo] [output] | feedback stats")
+	if len(args) == 0 {
+		return usage
+	}
+	if feedback_path == "" {
+		return fmt.Errorf("no feedback store, set it with -feedback")
+	}
+
+	switch args[0] {
+	case "export":
+	case "stats":
+		entries, err := ReadFeedback(feedback_path)
+		if err != nil {
+			return err
+		}
+		PrintVariantScores(os.Stdout, ScoreVariants(entries))
+		return nil
+	default:
+		return usage
+	}
+
+	flags := flag.NewFlagSet("feedback export", flag.ContinueOnError)
+	format := flags.String("format", "kto", "dataset format: kto (unpaired ratings) or dpo (chosen/rejected pairs)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	entries, err := ReadFeedback(feedback_path)
+	if err != nil {
+		return err
+	}
+
+	output := os.Stdout
+	if flags.NArg() > 0 {
+		output, err = os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+
+	count, err := ExportPreferences(entries, *format, output)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d examples from %d ratings\n", count, len(entries))
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+const CODE_MIN_LINES = 2 // Lines of code in a row that make a code block, fewer are left in the text.
+
+// Lines that look like code rather than prose.
+var code_line_patterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(    |\t)\S`),     // Indented.
+	regexp.MustCompile(`[;{}]\s*$`),        // End of a statement or block.
+	regexp.MustCompile(`^\s*[{}()\]]+;?$`), // Lone brackets.
+	regexp.MustCompile(`^\s*(func|def|class|import|package|return|const|let|var|fn|elif|#include|#!/)\b`),
+	regexp.MustCompile(`^\s*(SELECT|INSERT|UPDATE|DELETE|CREATE)\s`),
+	regexp.MustCompile(`^\s*[\w.]+\(.*\)\s*$`),             // Call.
+	regexp.MustCompile(`^\s*[\w.\[\]]+\s*(:=|=|\+=)\s*\S`), // Assignment.
+}
+
+// Markers of the languages, by preference when several match as often.
+var language_markers = []struct {
+	language string
+	pattern  *regexp.Regexp
+}{
+	{"go", regexp.MustCompile(`\bfunc\b|:=|^package\s|\bfmt\.`)},
+	{"rust", regexp.MustCompile(`\bfn\s|\blet mut\b|println!`)},
+	{"python", regexp.MustCompile(`^\s*def\s.*:\s*$|^\s*(import|from)\s\w+|\bprint\(|^\s*elif\b|\bself\.`)},
+	{"javascript", regexp.MustCompile(`\bconst\b|\blet\b|=>|console\.log|\bfunction\b`)},
+	{"c", regexp.MustCompile(`^\s*#include\b|\bprintf\(|\bint main\(`)},
+	{"sql", regexp.MustCompile(`(?i)^\s*(select|insert|update|delete|create)\s`)},
+	{"bash", regexp.MustCompile(`^#!/bin/|^\s*\$ |\becho\b`)},
+}
+
+// # Looks like code
+//
+// This function reports whether a line of the reply looks like code.
+func looksLikeCode(line string) bool {
+	for _, pattern := range code_line_patterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// # Guess language
+//
+// This function returns the language whose markers match most lines of the code, empty when none match.
+func guessLanguage(code []string) string {
+	best, best_count := "", 0
+	for _, marker := range language_markers {
+		count := 0
+		for _, line := range code {
+			if marker.pattern.MatchString(line) {
+				count++
+			}
+		}
+		if count > best_count {
+			best, best_count = marker.language, count
+		}
+	}
+	return best
+}
+
+// # Format code
+//
+// This function wraps the code the model wrote in the middle of its reply in fenced code blocks, tagged with
+// their language, so the platforms rendering Markdown show it as code. Fenced blocks without a language get one.
+// Code is runs of at least `CODE_MIN_LINES` lines looking like code; the blank lines inside a run are part of it.
+func FormatCode(text string) string {
+	lines := strings.Split(text, "\n")
+	var formatted []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		// Fenced blocks are kept, with their language guessed when missing.
+		if strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE) {
+			end := i + 1
+			for end < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[end]), CODE_FENCE) {
+				end++
+			}
+			if strings.TrimSpace(line) == CODE_FENCE {
+				if language := guessLanguage(lines[i+1 : end]); language != "" {
+					line = strings.TrimRight(line, " ") + language
+				}
+			}
+			formatted = append(formatted, line)
+			formatted = append(formatted, lines[i+1:min(end+1, len(lines))]...)
+			i = end
+			continue
+		}
+
+		// Runs of code are fenced.
+		end, last_code := i, -1
+		for end < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[end]), CODE_FENCE) {
+			if looksLikeCode(lines[end]) {
+				last_code = end
+			} else if strings.TrimSpace(lines[end]) != "" {
+				break
+			}
+			end++
+		}
+		if last_code < 0 || last_code-i+1 < CODE_MIN_LINES || !looksLikeCode(line) {
+			formatted = append(formatted, line)
+			continue
+		}
+		code := lines[i : last_code+1]
+		formatted = append(formatted, CODE_FENCE+guessLanguage(code))
+		formatted = append(formatted, code...)
+		formatted = append(formatted, CODE_FENCE)
+		i = last_code
+	}
+	return strings.Join(formatted, "\n")
+}
+
+const (
+	ANSI_RESET   = "\x1b[0m"
+	ANSI_DIM     = "\x1b[2m"
+	ANSI_GREY    = "\x1b[90m"
+	ANSI_GREEN   = "\x1b[32m"
+	ANSI_MAGENTA = "\x1b[35m"
+	ANSI_YELLOW  = "\x1b[33m"
+)
+
+const code_keywords = `break|case|catch|class|const|continue|def|defer|elif|else|except|fn|for|from|func|function|go|if|import|in|let|match|mut|new|package|pass|pub|return|select|struct|switch|throw|try|type|use|var|while|with|yield|true|false|nil|null|None|True|False`
+
+var (
+	// Comments, strings, keywords and numbers, in the languages with `//` comments...
+	slash_code_token = regexp.MustCompile("(//.*$)|(\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*'|`[^`]*`)|\\b(" + code_keywords + ")\\b|\\b(\\d+(?:\\.\\d+)?)\\b")
+	// ... and in the languages with `#` comments.
+	hash_code_token = regexp.MustCompile("(#.*$)|(\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*')|\\b(" + code_keywords + ")\\b|\\b(\\d+(?:\\.\\d+)?)\\b")
+)
+
+// # Color terminal
+//
+// This function reports whether the standard output is a terminal that may be colored, see https://no-color.org.
+func colorTerminal() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// # Highlight code
+//
+// This function colors the fenced code blocks of the text for the terminal: comments, strings, keywords and numbers.
+// The fences are dimmed, the rest of the text is left alone.
+func HighlightCode(text string) string {
+	lines := strings.Split(text, "\n")
+	var token *regexp.Regexp // Tokens of the code block the line is in, nil outside code.
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE) {
+			if token == nil {
+				token = slash_code_token
+				switch strings.TrimPrefix(strings.TrimSpace(line), CODE_FENCE) {
+				case "python", "py", "bash", "sh", "shell", "ruby", "yaml", "toml":
+					token = hash_code_token
+				}
+			} else {
+				token = nil
+			}
+			lines[i] = ANSI_DIM + line + ANSI_RESET
+			continue
+		}
+		if token == nil {
+			continue
+		}
+		lines[i] = token.ReplaceAllStringFunc(line, func(match string) string {
+			groups := token.FindStringSubmatch(match)
+			for group, color := range []string{1: ANSI_GREY, 2: ANSI_GREEN, 3: ANSI_MAGENTA, 4: ANSI_YELLOW} {
+				if group > 0 && groups[group] != "" {
+					return color + match + ANSI_RESET
+				}
+			}
+			return match
+		})
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+)
+
+// # Frontend
+//
+// This interface is a chat platform adapter: the terminal, Telegram, Discord, LINE, a web UI...
+// Adapters only translate between their platform and the messages and replies of the bot, see `Bot.Serve`,
+// so several of them can share one bot, its sessions and its backend.
+type Frontend interface {
+	// ReceiveMessages calls `handle` with every message received, until the context is done or the platform closes,
+	// and returns why it stopped. `handle` returns once the message is answered: adapters call it from goroutines
+	// of their own to answer several messages at once.
+	ReceiveMessages(ctx context.Context, handle func(incoming Incoming)) error
+
+	// SendReply posts a reply in the channel, and returns the platform ID of the message posted, for `EditMessage`.
+	SendReply(channel string, reply Reply) (string, error)
+
+	// Typing shows the bot is writing in the channel, until its next message.
+	Typing(channel string) error
+
+	// EditMessage replaces the text of a message posted by the bot.
+	EditMessage(channel string, message_id string, text string) error
+}
+
+// # Incoming message
+//
+// This struct is a message received by a frontend, with its attachment if it has one.
+type Incoming struct {
+	Message
+
+	Image     []byte // Picture attached to the message, answered by `HandleImage`.
+	Audio     []byte // Voice message, answered by `HandleVoice`.
+	AudioName string // File name of the voice message, telling its format.
+
+	// Stream posts the reply as it is generated, editing it as it grows, when the frontend doesn't stream it itself
+	// with `OnPartialReply`.
+	Stream bool
+}
+
+// # Serve frontend
+//
+// This function answers the messages of a frontend until it stops, the context is done, or the bot is shut down
+// with `/admin shutdown`. It returns the error the frontend stopped with.
+func (bot *Bot) Serve(ctx context.Context, frontend Frontend) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-bot.Stopped():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := frontend.ReceiveMessages(ctx, func(incoming Incoming) {
+		bot.answer(frontend, incoming)
+
+		// Stop right away on shutdown, before the frontend takes another message.
+		select {
+		case <-bot.Stopped():
+			cancel()
+		default:
+		}
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// # Answer
+//
+// This function answers a message received by a frontend, and posts the reply.
+func (bot *Bot) answer(frontend Frontend, incoming Incoming) {
+	message := incoming.Message
+	if err := frontend.Typing(message.Channel); err != nil {
+		log.Println(err)
+	}
+	var streamer *EditStreamer
+	if incoming.Stream && message.OnPartialReply == nil {
+		streamer = &EditStreamer{Frontend: frontend, Channel: message.Channel}
+		message.OnPartialReply = streamer.Partial
+	}
+
+	var reply Reply
+	switch {
+	case incoming.Image != nil:
+		reply = bot.HandleImage(message, incoming.Image)
+	case incoming.Audio != nil:
+		reply = bot.HandleVoice(message, incoming.Audio, incoming.AudioName)
+	default:
+		reply = bot.HandleMessage(message)
+	}
+	if streamer != nil {
+		reply = streamer.Finish(reply)
+	}
+	if isEmptyReply(reply) {
+		return
+	}
+	if _, err := frontend.SendReply(message.Channel, reply); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Is empty reply
+//
+// This function reports whether the bot stays silent: nothing to post, nor to react with.
+func isEmptyReply(reply Reply) bool {
+	return reply.Text == "" && reply.Image == nil && reply.Audio == nil && reply.Reaction == "" && reply.Sticker == "" && reply.File == nil
+}
+
+// # Edit streamer
+//
+// This struct streams a reply on platforms that can edit messages: the first partial reply is posted,
+// and the message is edited as the reply grows.
+type EditStreamer struct {
+	Frontend Frontend
+	Channel  string
+
+	mu         sync.Mutex
+	message_id string
+	posted     string
+}
+
+// # Post partial reply
+//
+// This function posts the partial reply, or edits the message posted with it. Failures are logged, the final reply still comes.
+func (streamer *EditStreamer) Partial(partial string) {
+	streamer.mu.Lock()
+	defer streamer.mu.Unlock()
+
+	if strings.TrimSpace(partial) == "" || partial == streamer.posted {
+		return
+	}
+	var err error
+	if streamer.posted == "" {
+		streamer.message_id, err = streamer.Frontend.SendReply(streamer.Channel, Reply{Text: partial})
+	} else {
+		err = streamer.Frontend.EditMessage(streamer.Channel, streamer.message_id, partial)
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	streamer.posted = partial
+}
+
+// # Finish
+//
+// This function edits the streamed message into the final reply text, and returns the rest of the reply still to post.
+func (streamer *EditStreamer) Finish(reply Reply) Reply {
+	streamer.mu.Lock()
+	defer streamer.mu.Unlock()
+
+	if streamer.posted == "" {
+		return reply
+	}
+	if reply.Text != streamer.posted {
+		if err := streamer.Frontend.EditMessage(streamer.Channel, streamer.message_id, reply.Text); err != nil {
+			log.Println(err)
+			return reply
+		}
+	}
+	streamer.posted = ""
+	reply.Text = ""
+	return reply
+}
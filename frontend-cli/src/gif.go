@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const GIF_QUERY_PROMPT = `Suggest a search query for a reaction GIF answering the message below.
+Reply with the query only, 2 to 4 words, no punctuation.
+
+Message: %s`
+
+const GIF_SEARCH_LIMIT = 8 // Number of results the reaction GIF is picked from.
+
+// # GIF searcher
+//
+// This interface abstracts the GIF search providers.
+// Searches return the URLs of the matching GIFs, best match first.
+type GifSearcher interface {
+	SearchGifs(query string, limit int) ([]string, error)
+}
+
+// # Create a new GIF searcher
+//
+// This function creates the searcher of the given provider, `giphy` or `tenor`.
+func NewGifSearcher(provider string, api_key string) (GifSearcher, error) {
+	if api_key == "" {
+		return nil, fmt.Errorf("the %s provider needs an API key", provider)
+	}
+
+	http_client := http.Client{Timeout: 10 * time.Second}
+	switch provider {
+	case "giphy":
+		return &GiphyClient{ApiKey: api_key, Rating: "pg-13", http_client: http_client}, nil
+	case "tenor":
+		return &TenorClient{ApiKey: api_key, ContentFilter: "medium", http_client: http_client}, nil
+	default:
+		return nil, fmt.Errorf("unknown GIF provider %q", provider)
+	}
+}
+
+// # Get JSON
+//
+// This function sends a GET request and decodes the JSON response.
+func getJSON(http_client *http.Client, request_url string, data interface{}) error {
+	resp, err := http_client.Get(request_url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, data)
+}
+
+// # Giphy client
+//
+// This struct searches GIFs with the Giphy API (https://developers.giphy.com).
+type GiphyClient struct {
+	ApiKey string
+	Rating string
+
+	http_client http.Client
+}
+
+func (client *GiphyClient) SearchGifs(query string, limit int) ([]string, error) {
+	params := url.Values{}
+	params.Set("api_key", client.ApiKey)
+	params.Set("q", query)
+	params.Set("limit", fmt.Sprint(limit))
+	params.Set("rating", client.Rating)
+
+	var data struct {
+		Data []struct {
+			Url    string `json:"url"`
+			Images struct {
+				Original struct {
+					Url string `json:"url"`
+				} `json:"original"`
+			} `json:"images"`
+		} `json:"data"`
+	}
+	if err := getJSON(&client.http_client, "https://api.giphy.com/v1/gifs/search?"+params.Encode(), &data); err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, gif := range data.Data {
+		if gif.Images.Original.Url != "" {
+			urls = append(urls, gif.Images.Original.Url)
+		} else if gif.Url != "" {
+			urls = append(urls, gif.Url)
+		}
+	}
+	return urls, nil
+}
+
+// # Tenor client
+//
+// This struct searches GIFs with the Tenor v2 API (https://developers.google.com/tenor).
+type TenorClient struct {
+	ApiKey        string
+	ContentFilter string
+
+	http_client http.Client
+}
+
+func (client *TenorClient) SearchGifs(query string, limit int) ([]string, error) {
+	params := url.Values{}
+	params.Set("key", client.ApiKey)
+	params.Set("client_key", "meme-chatbot")
+	params.Set("q", query)
+	params.Set("limit", fmt.Sprint(limit))
+	params.Set("contentfilter", client.ContentFilter)
+	params.Set("media_filter", "gif")
+
+	var data struct {
+		Results []struct {
+			ItemUrl      string `json:"itemurl"`
+			MediaFormats map[string]struct {
+				Url string `json:"url"`
+			} `json:"media_formats"`
+		} `json:"results"`
+	}
+	if err := getJSON(&client.http_client, "https://tenor.googleapis.com/v2/search?"+params.Encode(), &data); err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, gif := range data.Results {
+		if media, found := gif.MediaFormats["gif"]; found && media.Url != "" {
+			urls = append(urls, media.Url)
+		} else if gif.ItemUrl != "" {
+			urls = append(urls, gif.ItemUrl)
+		}
+	}
+	return urls, nil
+}
+
+// # GIF responder
+//
+// This struct replies to messages with reaction GIFs.
+// The model picks the search query, and a GIF is picked at random among the top results
+// so the same message doesn't always get the same GIF.
+type GifResponder struct {
+	Searcher GifSearcher
+	Channels map[string]bool // Channels allowed to use GIF replies, all channels if empty.
+}
+
+// # Enabled for channel
+//
+// This function reports whether GIF replies are enabled in the channel.
+func (responder *GifResponder) EnabledFor(channel string) bool {
+	if responder == nil {
+		return false
+	}
+	return len(responder.Channels) == 0 || responder.Channels[channel]
+}
+
+// # Clean GIF query
+//
+// This function turns the model output into a search query: first line, no quotes or punctuation around.
+func CleanGifQuery(model_output string) string {
+	query, _, _ := strings.Cut(strings.TrimSpace(model_output), "\n")
+	return strings.Trim(strings.TrimSpace(query), "\"'`.!?,;:")
+}
+
+// # Reply with a GIF
+//
+// This function searches GIFs for the query and returns the URL of one of them.
+func (responder *GifResponder) Reply(query string) (string, error) {
+	urls, err := responder.Searcher.SearchGifs(query, GIF_SEARCH_LIMIT)
+	if err != nil {
+		return "", err
+	}
+	if len(urls) == 0 {
+		return "", fmt.Errorf("no GIF found for %q", query)
+	}
+	return urls[rand.Intn(len(urls))], nil
+}
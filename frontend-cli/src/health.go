@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const MODELS_ENDPOINT = "v1/models"
+
+const READINESS_CACHE = 5 * time.Second // Probes within this interval reuse the last backend check.
+
+// # Ping backend
+//
+// This function checks that the backend answers, by listing its models.
+func (client *LlmClient) Ping(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url(MODELS_ENDPOINT), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // Close the response body
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// # Health server
+//
+// This struct serves the probes of container orchestrators:
+//
+// - `/healthz` answers as long as the process is alive
+// - `/readyz` answers only while the backend is reachable
+type HealthServer struct {
+	Client *LlmClient
+
+	mu         sync.Mutex
+	checked_at time.Time
+	last_err   error
+}
+
+// # Check readiness
+//
+// This function pings the backend, reusing recent results so aggressive probes don't load the backend.
+func (health *HealthServer) checkReady(ctx context.Context) error {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	if time.Since(health.checked_at) < READINESS_CACHE {
+		return health.last_err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	health.last_err = health.Client.Ping(ctx)
+	health.checked_at = time.Now()
+	return health.last_err
+}
+
+// # Handler
+//
+// This function returns the HTTP handler of the probes.
+func (health *HealthServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := health.checkReady(r.Context()); err != nil {
+			http.Error(w, "backend unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// # Serve
+//
+// This function serves the probes on `addr` in the background.
+func (health *HealthServer) Serve(addr string) {
+	go func() {
+		if err := http.ListenAndServe(addr, health.Handler()); err != nil {
+			log.Println("health server stopped:", err)
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// # Hedge
+//
+// This struct is the second backend the generations are raced against, to cut the tail latency
+// when the main backend is occasionally busy.
+type Hedge struct {
+	Backend *LlmClient
+	Delay   time.Duration // Delay before the hedge request, 0 to send both at once.
+}
+
+// # Parse backend address
+//
+// This function returns a client for a `host:port` backend address.
+func ParseBackendAddress(address string) (*LlmClient, error) {
+	host, port_text, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend address %q: %w", address, err)
+	}
+	port, err := strconv.Atoi(port_text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend port %q: %w", address, err)
+	}
+	return NewLlmClient(host, port), nil
+}
+
+type hedgeResult struct {
+	backend int
+	text    string
+	usage   *LlmUsage
+	err     error
+}
+
+// # Hedged request
+//
+// This function sends the request to every backend, the later ones `delay` after each other,
+// and returns the first successful response, canceling the other requests.
+//
+// Streamed requests are won by the first backend to send a token: the tokens of the other backends are dropped,
+// and their requests canceled. If every backend fails, the error of the winner, else the first error, is returned.
+func hedgedRequest(ctx context.Context, backends []*LlmClient, delay time.Duration, endpoint string, request *GenerationRequest) (string, *LlmUsage, error) {
+	ctx, cancel_all := context.WithCancel(ctx)
+	defer cancel_all()
+
+	winner := int32(-1)
+	cancels := make([]context.CancelFunc, len(backends))
+	contexts := make([]context.Context, len(backends))
+	for i := range backends {
+		contexts[i], cancels[i] = context.WithCancel(ctx)
+	}
+	// Cancel the requests of the other backends.
+	claim := func(backend int) bool {
+		if atomic.CompareAndSwapInt32(&winner, -1, int32(backend)) {
+			for i, cancel := range cancels {
+				if i != backend {
+					cancel()
+				}
+			}
+		}
+		return atomic.LoadInt32(&winner) == int32(backend)
+	}
+
+	results := make(chan hedgeResult, len(backends))
+	for i, backend := range backends {
+		go func(i int, backend *LlmClient) {
+			defer cancels[i]()
+			if i > 0 && delay > 0 {
+				select {
+				case <-time.After(time.Duration(i) * delay):
+				case <-contexts[i].Done():
+					results <- hedgeResult{backend: i, err: contexts[i].Err()}
+					return
+				}
+			}
+
+			backend_request := *request
+			if request.OnToken != nil {
+				backend_request.OnToken = func(token string) {
+					if claim(i) {
+						request.OnToken(token)
+					}
+				}
+			}
+			text, usage, err := sendRequest(contexts[i], backend.Server, backend.Port, endpoint, &backend_request)
+			results <- hedgeResult{backend: i, text: text, usage: usage, err: err}
+		}(i, backend)
+	}
+
+	var last hedgeResult
+	for range backends {
+		result := <-results
+		if result.err == nil && claim(result.backend) {
+			if result.backend > 0 {
+				log.Printf("request %s answered by hedge backend %s:%d\n", request.ID, backends[result.backend].Server, backends[result.backend].Port)
+			}
+			return result.text, result.usage, nil
+		}
+		if int32(result.backend) == atomic.LoadInt32(&winner) || last.err == nil {
+			last = result
+		}
+	}
+	return "", nil, last.err
+}
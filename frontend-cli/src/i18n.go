@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const DEFAULT_LOCALE = "en" // Locale of the source strings.
+
+// Built-in translations of the bot strings, keyed by locale then by English source string.
+// Catalog files of the locales directory override and extend them.
+var BuiltinCatalogs = map[string]map[string]string{
+	"zh": {
+		// Errors.
+		"Sorry, my brain is offline right now. Try again in a bit.":                                     "抱歉，我的腦袋現在當機了，等一下再試試。",
+		"I drew a blank, twice. Try asking another way?":                                                "我腦袋一片空白，兩次了。換個方式問問看？",
+		"That's too much text for me to read at once (context length exceeded). Try something shorter.": "一次太多字了，我讀不完（超過上下文長度）。請試試短一點的內容。",
+		"The model refused that request: %s":                                                            "模型拒絕了這個請求：%s",
+		"Whoa, that's a lot of pings. I'm taking a %s break.":                                           "哇，一下子太多人叫我了。我先休息 %s。",
+		"Whoa, that's a lot of pings. I'll answer in one go in %s.":                                     "哇，一下子太多人叫我了。%s 後我一次回覆大家。",
+		"No startup report.":                                    "沒有啟動報告。",
+		"Model switched since startup to %q.":                   "啟動後模型已切換為 %q。",
+		"I'm getting too many messages here, give me a minute.": "這裡訊息太多了，讓我喘口氣。",
+
+		// Admin commands.
+		"Only moderators can do that.": "只有版主可以這麼做。",
+		"Only admins can do that.":     "只有管理員可以這麼做。",
+		"Only owners can do that.":     "只有擁有者可以這麼做。",
+		"Current model: %q":            "目前的模型：%q",
+		"Switched to model %q.":        "已切換到模型 %q。",
+		"Nothing to reload.":           "沒有需要重新載入的設定。",
+		"Reload failed: %s":            "重新載入失敗：%s",
+		"Configuration reloaded.":      "設定已重新載入。",
+		"Session of %s cleared.":       "已清除 %s 的對話。",
+		"Bye!":                         "掰掰！",
+		"Usage: /debug prompt <text>":  "用法：/debug prompt <文字>",
+		"Usage: /admin model [name] | reload | clear [channel] | shutdown": "用法：/admin model [名稱] | reload | clear [頻道] | shutdown",
+
+		// Voice, memory and GIFs.
+		"Voice replies are disabled.":                      "語音回覆未啟用。",
+		"Voice replies are on.":                            "語音回覆已開啟。",
+		"Voice replies are off.":                           "語音回覆已關閉。",
+		"Usage: /voice on|off":                             "用法：/voice on|off",
+		"Long-term memory is disabled.":                    "長期記憶未啟用。",
+		"Sorry, I couldn't remember that.":                 "抱歉，我記不住這件事。",
+		"Got it, I'll remember that.":                      "收到，我會記住的。",
+		"GIF replies are disabled here.":                   "這裡不能用 GIF 回覆。",
+		"Sorry, I couldn't find a GIF for that.":           "抱歉，找不到適合的 GIF。",
+		"Voice messages are disabled.":                     "語音訊息未啟用。",
+		"Sorry, I couldn't understand that voice message.": "抱歉，我聽不懂這則語音訊息。",
+		"I didn't hear anything in that voice message.":    "這則語音訊息裡什麼都沒聽到。",
+		"Sorry, I couldn't look at that image.":            "抱歉，我看不了這張圖。",
+
+		// Channel settings.
+		"Channel settings:\n%s":                "頻道設定：\n%s",
+		"default settings":                     "預設設定",
+		"Sorry, I couldn't save the settings.": "抱歉，無法儲存設定。",
+		"Channel settings reset.":              "頻道設定已重設。",
+		"%s updated.":                          "%s 已更新。",
+		"Usage: /config | /config set <key> [value] | /config reset\nKeys: %s": "用法：/config | /config set <設定> [值] | /config reset\n可用設定：%s",
+
+		// Personas.
+		"Current persona: %s. No persona available.": "目前的角色：%s。沒有可用的角色。",
+		"Current persona: %s. Available: %s":         "目前的角色：%s。可用的角色：%s",
+		"none":                                       "無",
+		"Back to my usual self.":                     "我變回原本的我了。",
+		"I don't know any persona named %q.":         "我不認識叫做 %q 的角色。",
+		"A duel is already running here.":            "這裡已經有一場對決在進行了。",
+		"%s vs %s: %s":                               "%s 對決 %s：%s",
+		"The duel ran out of breath.":                "對決已經沒力氣了。",
+		"I'm now %s.":                                "我現在是 %s。",
+
+		"You're #%d in line.":      "你排在第 %d 位。",
+		"You're #%d in line, ~%s.": "你排在第 %d 位，大約 %s。",
+
+		// Image generation.
+		"Meme templates are disabled.":              "迷因模板未啟用。",
+		"Sorry, I couldn't make that meme.":         "抱歉，做不出這張迷因圖。",
+		"Image generation is disabled.":             "圖片生成未啟用。",
+		"Sorry, I couldn't draw that.":              "抱歉，我畫不出來。",
+		"Waiting to draw, %d in line before you...": "排隊等待作畫中，前面還有 %d 位...",
+		"Drawing... %d%%":                           "作畫中... %d%%",
+		" (about %ds left)":                         "（大約還剩 %d 秒）",
+
+		// Feedback.
+		"Feedback collection is disabled.":       "意見回饋未啟用。",
+		"There's no reply of mine to rate here.": "這裡沒有我的回覆可以評分。",
+		"Thanks for the feedback!":               "感謝你的回饋！",
+
+		// Commands.
+		"Commands:":                                           "指令：",
+		"Usage: %s":                                           "用法：%s",
+		"List the commands.":                                  "列出所有指令。",
+		"Turn voice replies on or off.":                       "開啟或關閉語音回覆。",
+		"Store a fact in my long-term memory.":                "把一件事存進我的長期記憶。",
+		"Rate my last reply as good.":                         "給我上一則回覆好評。",
+		"Rate my last reply as bad.":                          "給我上一則回覆負評。",
+		"Show or pick the language of my messages.":           "顯示或選擇我訊息的語言。",
+		"Show the personas, or switch persona.":               "顯示角色，或切換角色。",
+		"Make two personas talk to each other about a topic.": "讓兩個角色針對一個話題互相對話。",
+		"Show or change the settings of the channel.":         "顯示或修改頻道設定。",
+		"Show the request a message would send to the model.": "顯示訊息會送給模型的請求。",
+		"Administer the bot.":                                 "管理機器人。",
+		"Reply with a reaction GIF.":                          "用 GIF 回應。",
+		"Draw a picture.":                                     "畫一張圖。",
+		"Show me an image file.":                              "給我看一個圖片檔。",
+		"Send me a voice message file.":                       "傳一個語音訊息檔給我。",
+		"Reply to my last message, as if quoting it.":         "回覆我的上一則訊息，如同引用它。",
+
+		"Show or pick the style of my replies, e.g. short or formal.":                        "顯示或選擇我回覆的風格，例如 short 或 formal。",
+		"Show or pick the language of my replies.":                                           "顯示或選擇我回覆的語言。",
+		"Delete what I keep of you: our conversations, your messages, memories and ratings.": "刪除我保存的你的資料：我們的對話、你的訊息、記憶和評分。",
+		"Delete what I keep of you, and stop keeping your messages.":                         "刪除我保存的你的資料，並不再保存你的訊息。",
+		"Find past messages of this channel.":                                                "搜尋這個頻道過去的訊息。",
+		"Show how busy I am.":                                                                "顯示我有多忙。",
+		"Show the tokens used by my last reply, and the context left.":                       "顯示我上一則回覆使用的 token 數，以及剩餘的上下文。",
+		"Show what I'm running with: backend, model, frontends, plugins and files.":          "顯示我目前的運行設定：後端、模型、前端、外掛和檔案。",
+
+		"Answer with other settings for this message only, e.g. max_tokens=512.": "只在這則訊息使用其他設定回覆，例如 max_tokens=512。",
+		"Answer with a long reply.": "用長篇回覆。",
+		"Make a meme about the text, or answer in meme speak, e.g. /meme spongebob <text>.": "做一張關於這段文字的迷因圖，或用迷因語氣回答，例如 /meme spongebob <文字>。",
+		"Invalid override: %s": "無效的設定：%s",
+
+		// Reply style.
+		"Style: %s. Available: %s":              "風格：%s。可用的風格：%s",
+		"Back to my usual style.":               "我恢復原本的風格了。",
+		"Unknown style %q. Available: %s":       "未知的風格 %q。可用的風格：%s",
+		"Style set to %s.":                      "風格已設為 %s。",
+		"Reply language: %s.":                   "回覆語言：%s。",
+		"I'll reply in whatever language fits.": "我會用適合的語言回覆。",
+		"Reply language set to %s.":             "回覆語言已設為 %s。",
+
+		// Search.
+		"Search is not enabled.": "搜尋功能未啟用。",
+		"Nothing found for %q.":  "找不到 %q。",
+		"Found for %q:":          "%q 的搜尋結果：",
+		"me":                     "我",
+		"someone":                "某人",
+
+		// Status.
+		"Requests waiting: %d":                            "等待中的請求：%d",
+		"Backend slots busy: %d of %d":                    "後端忙碌的槽位：%d / %d",
+		"Backend slots busy: unknown":                     "後端忙碌的槽位：未知",
+		"Average reply time: %s over the last %d replies": "平均回覆時間：%s（最近 %d 則回覆）",
+		"Average reply time: no reply yet":                "平均回覆時間：尚無回覆",
+
+		// Token usage.
+		"Tokens: %s%d prompt + %s%d reply": "Token：提示 %s%d + 回覆 %s%d",
+		", %d of %d context left":          "，上下文剩餘 %d / %d",
+		", %d of %d history turns kept.":   "，保留 %d / %d 輪對話紀錄。",
+		"I haven't replied here yet.":      "我還沒在這裡回覆過。",
+
+		// Privacy.
+		"Done, I forgot %d things about you.":                                      "好了，我忘記了關於你的 %d 件事。",
+		"Done, I forgot %d things about you and won't keep your messages anymore.": "好了，我忘記了關於你的 %d 件事，之後也不會再保存你的訊息。",
+		"Welcome back, I'll remember our conversations again.":                     "歡迎回來，我會再記得我們的對話。",
+		"I couldn't save your choice, try again later.":                            "我無法儲存你的選擇，請稍後再試。",
+
+		// Profanity filter.
+		"I'd rather not say that.": "這個我還是不說好了。",
+
+		// Long replies.
+		"Full reply: %s":         "完整回覆：%s",
+		"(Full reply attached.)": "（完整回覆在附件。）",
+
+		// Locales.
+		"Locale: %s. Available: %s":        "語系：%s。可用的語系：%s",
+		"Locale set to %s.":                "語系已設為 %s。",
+		"Unknown locale %q. Available: %s": "未知的語系 %q。可用的語系：%s",
+	},
+}
+
+// # Message catalog
+//
+// This struct holds the translations of the bot strings, the built-in ones plus the catalog files of a directory.
+// Each file is named after its locale, e.g. `ja.json`, and maps English source strings to their translation.
+// Strings without translation are shown in English.
+type MessageCatalog struct {
+	dir string
+
+	mu      sync.RWMutex
+	locales map[string]map[string]string
+}
+
+// # Load message catalog
+//
+// This function loads the catalog files of `dir` over the built-in translations. An empty `dir` keeps the built-in ones only.
+func LoadMessageCatalog(dir string) (*MessageCatalog, error) {
+	catalog := &MessageCatalog{dir: dir}
+	if err := catalog.Reload(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// # Reload message catalog
+//
+// This function reads the catalog files again. On error, the current translations are kept.
+func (catalog *MessageCatalog) Reload() error {
+	locales := map[string]map[string]string{}
+	for locale, messages := range BuiltinCatalogs {
+		locales[locale] = map[string]string{}
+		for source, translation := range messages {
+			locales[locale][source] = translation
+		}
+	}
+
+	if catalog.dir != "" {
+		paths, err := filepath.Glob(filepath.Join(catalog.dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(data, &messages); err != nil {
+				return fmt.Errorf("invalid message catalog %s: %w", path, err)
+			}
+			locale := normalizeLocale(strings.TrimSuffix(filepath.Base(path), ".json"))
+			if locales[locale] == nil {
+				locales[locale] = map[string]string{}
+			}
+			for source, translation := range messages {
+				locales[locale][source] = translation
+			}
+		}
+	}
+
+	catalog.mu.Lock()
+	catalog.locales = locales
+	catalog.mu.Unlock()
+	return nil
+}
+
+// # Translate bot string
+//
+// This function returns the translation of `source` in `locale`, falling back to the base language
+// (`zh` for `zh-tw`), then to the English source string.
+func (catalog *MessageCatalog) Translate(locale string, source string) string {
+	if catalog == nil {
+		return source
+	}
+	catalog.mu.RLock()
+	defer catalog.mu.RUnlock()
+
+	locale = normalizeLocale(locale)
+	for _, candidate := range []string{locale, languageBase(locale)} {
+		if translation, found := catalog.locales[candidate][source]; found && translation != "" {
+			return translation
+		}
+	}
+	return source
+}
+
+// # Available locales
+//
+// This function returns the sorted locales with a catalog, English included.
+func (catalog *MessageCatalog) Locales() []string {
+	locales := []string{DEFAULT_LOCALE}
+	if catalog == nil {
+		return locales
+	}
+	catalog.mu.RLock()
+	defer catalog.mu.RUnlock()
+
+	for locale := range catalog.locales {
+		if locale != DEFAULT_LOCALE {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// # Has locale
+//
+// This function reports whether the locale, or its base language, has a catalog.
+func (catalog *MessageCatalog) HasLocale(locale string) bool {
+	locale = normalizeLocale(locale)
+	for _, available := range catalog.Locales() {
+		if available == locale || available == languageBase(locale) {
+			return true
+		}
+	}
+	return false
+}
+
+// # Normalize locale
+//
+// This function lowercases a locale code and uses dashes, so `zh_TW` and `zh-tw` name the same locale.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// # User locales
+//
+// This struct keeps the locale picked by each user with `/locale`, overriding the channel locale.
+type UserLocales struct {
+	mu      sync.Mutex
+	locales map[string]string
+}
+
+// # Get user locale
+//
+// This function returns the locale of the user, empty if they didn't pick one.
+func (users *UserLocales) Get(user string) string {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	return users.locales[user]
+}
+
+// # Set user locale
+//
+// This function sets the locale of the user; an empty locale goes back to the channel locale.
+func (users *UserLocales) Set(user string, locale string) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	if users.locales == nil {
+		users.locales = map[string]string{}
+	}
+	if locale == "" {
+		delete(users.locales, user)
+		return
+	}
+	users.locales[user] = locale
+}
+
+// # Locale of a message
+//
+// This function returns the locale the bot answers the message in: the locale of the user, else the one of the channel,
+// else the bot default.
+func (bot *Bot) localeOf(message Message) string {
+	if locale := bot.UserLocales.Get(message.User); locale != "" {
+		return locale
+	}
+	if locale := bot.Channels.Get(message.Channel).Locale; locale != "" {
+		return locale
+	}
+	if bot.Locale != "" {
+		return bot.Locale
+	}
+	return DEFAULT_LOCALE
+}
+
+// # Translate bot string for a message
+//
+// This function returns the translation of a bot string in the locale of the message.
+// With arguments, the translated string is used as the format.
+func (bot *Bot) T(message Message, source string, args ...interface{}) string {
+	text := bot.Catalog.Translate(bot.localeOf(message), source)
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// # Set locale
+//
+// This function handles the `/locale` command: without a code it shows the locale of the user,
+// `default` goes back to the channel locale, and any other code picks that locale for the user.
+func (bot *Bot) setLocale(message Message, code string) Reply {
+	available := strings.Join(bot.Catalog.Locales(), ", ")
+	switch {
+	case code == "":
+		return Reply{Text: bot.T(message, "Locale: %s. Available: %s", bot.localeOf(message), available)}
+	case strings.EqualFold(code, "default"):
+		bot.UserLocales.Set(message.User, "")
+	case !bot.Catalog.HasLocale(code):
+		return Reply{Text: bot.T(message, "Unknown locale %q. Available: %s", code, available)}
+	default:
+		bot.UserLocales.Set(message.User, normalizeLocale(code))
+	}
+	return Reply{Text: bot.T(message, "Locale set to %s.", bot.localeOf(message))}
+}
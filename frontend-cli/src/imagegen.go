@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DRAW_PROMPT = `Write a Stable Diffusion prompt for the picture requested below.
+Reply with a comma-separated list of keywords describing the subject, the style and the quality, nothing else.
+
+Request: %s`
+
+const IMAGE_NEGATIVE_PROMPT = "lowres, bad anatomy, bad hands, text, error, missing fingers, cropped, worst quality, low quality, jpeg artifacts, watermark, blurry"
+
+const IMAGE_PROGRESS_INTERVAL = 2 * time.Second // Interval between progress polls.
+
+type ImageGenerationParameters struct {
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt"`
+	Steps          int     `json:"steps"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	CfgScale       float64 `json:"cfg_scale"`
+	SamplerName    string  `json:"sampler_name,omitempty"`
+	Seed           int     `json:"seed"`
+}
+
+// # Check and fix image generation parameters
+//
+// This function checks the image generation parameters and fixes them if needed.
+// The default values are the ones of the AUTOMATIC1111 web UI.
+func (igp *ImageGenerationParameters) CheckAndFix() {
+	if igp.Steps <= 0 {
+		igp.Steps = 20
+	}
+	if igp.Width <= 0 {
+		igp.Width = 512
+	}
+	if igp.Height <= 0 {
+		igp.Height = 512
+	}
+	if igp.CfgScale <= 0 {
+		igp.CfgScale = 7
+	}
+	if igp.Seed == 0 {
+		igp.Seed = -1
+	}
+}
+
+// # Stable Diffusion client
+//
+// This struct talks to an AUTOMATIC1111 web UI started with `--api`.
+// ComfyUI exposes a workflow graph API instead, which this client doesn't speak.
+type StableDiffusionClient struct {
+	BaseUrl string // e.g. `http://sd:7860`
+
+	http_client http.Client
+}
+
+// # Create a new Stable Diffusion client
+//
+// This function creates a client for the web UI at `base_url`.
+// Generation can take minutes on small GPUs, so the timeout is generous.
+func NewStableDiffusionClient(base_url string) *StableDiffusionClient {
+	return &StableDiffusionClient{BaseUrl: strings.TrimSuffix(base_url, "/"), http_client: http.Client{Timeout: 10 * time.Minute}}
+}
+
+// # Text to image
+//
+// This function generates an image and returns it PNG-encoded.
+func (client *StableDiffusionClient) Txt2Img(params ImageGenerationParameters) ([]byte, error) {
+	params.CheckAndFix()
+	request_body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.http_client.Post(client.BaseUrl+"/sdapi/v1/txt2img", "application/json", strings.NewReader(string(request_body)))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("txt2img failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var txt2img_response struct {
+		Images []string `json:"images"`
+	}
+	if err := json.Unmarshal(body, &txt2img_response); err != nil {
+		return nil, err
+	}
+	if len(txt2img_response.Images) == 0 {
+		return nil, fmt.Errorf("txt2img returned no image")
+	}
+	return base64.StdEncoding.DecodeString(txt2img_response.Images[0])
+}
+
+// # Get progress
+//
+// This function returns the progress of the current generation (0 to 1) and its estimated remaining time.
+func (client *StableDiffusionClient) Progress() (float64, time.Duration, error) {
+	var progress_response struct {
+		Progress    float64 `json:"progress"`
+		EtaRelative float64 `json:"eta_relative"`
+	}
+	if err := getJSON(&client.http_client, client.BaseUrl+"/sdapi/v1/progress?skip_current_image=true", &progress_response); err != nil {
+		return 0, 0, err
+	}
+	return progress_response.Progress, time.Duration(progress_response.EtaRelative * float64(time.Second)), nil
+}
+
+type ImageJobUpdate struct {
+	Position int           // Jobs ahead in the queue, 0 once running.
+	Progress float64       // Progress of the running job, 0 to 1.
+	Eta      time.Duration // Estimated remaining time of the running job.
+	Done     bool
+	Image    []byte // Generated image, set when done.
+	Err      error  // Generation error, set when done.
+}
+
+type imageJob struct {
+	params  ImageGenerationParameters
+	updates chan ImageJobUpdate
+}
+
+// # Image job queue
+//
+// This struct runs image generations one at a time, as the GPU can't do more anyway,
+// and reports the queue position and the progress of every job to its submitter.
+type ImageJobQueue struct {
+	client *StableDiffusionClient
+
+	mu      sync.Mutex
+	pending []*imageJob
+	running bool // A job is generating, ahead of the pending ones.
+	wake    chan struct{}
+}
+
+// # Create a new image job queue
+//
+// This function creates the queue and starts its worker.
+func NewImageJobQueue(client *StableDiffusionClient) *ImageJobQueue {
+	queue := &ImageJobQueue{client: client, wake: make(chan struct{}, 1)}
+	go queue.run()
+	return queue
+}
+
+// # Submit job
+//
+// This function queues an image generation.
+// The returned channel receives progress updates and is closed after the final (`Done`) update.
+func (queue *ImageJobQueue) Submit(params ImageGenerationParameters) <-chan ImageJobUpdate {
+	job := &imageJob{params: params, updates: make(chan ImageJobUpdate, 16)}
+
+	queue.mu.Lock()
+	queue.pending = append(queue.pending, job)
+	position := len(queue.pending) - 1
+	if queue.running {
+		position++
+	}
+	queue.mu.Unlock()
+
+	job.updates <- ImageJobUpdate{Position: position}
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	return job.updates
+}
+
+// # Send update
+//
+// This function sends an update without blocking the worker; stale progress updates are dropped
+// if the submitter doesn't keep up.
+func (job *imageJob) send(update ImageJobUpdate) {
+	select {
+	case job.updates <- update:
+	default:
+	}
+}
+
+// # Run the queue
+//
+// This function is the worker goroutine of the queue.
+func (queue *ImageJobQueue) run() {
+	for range queue.wake {
+		for {
+			queue.mu.Lock()
+			if len(queue.pending) == 0 {
+				queue.mu.Unlock()
+				break
+			}
+			job := queue.pending[0]
+			queue.pending, queue.running = queue.pending[1:], true
+			for position, waiting := range queue.pending {
+				waiting.send(ImageJobUpdate{Position: position + 1})
+			}
+			queue.mu.Unlock()
+
+			queue.runJob(job)
+			queue.mu.Lock()
+			queue.running = false
+			queue.mu.Unlock()
+		}
+	}
+}
+
+// # Run a job
+//
+// This function generates the image of a job, polling the progress while it runs.
+func (queue *ImageJobQueue) runJob(job *imageJob) {
+	finished := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(IMAGE_PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				if progress, eta, err := queue.client.Progress(); err == nil {
+					job.send(ImageJobUpdate{Progress: progress, Eta: eta})
+				}
+			}
+		}
+	}()
+
+	image_data, err := queue.client.Txt2Img(job.params)
+	close(finished)
+
+	// The final update must not be dropped.
+	job.updates <- ImageJobUpdate{Progress: 1, Done: true, Image: image_data, Err: err}
+	close(job.updates)
+}
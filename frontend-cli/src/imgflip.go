@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const IMGFLIP_API = "https://api.imgflip.com"
+
+const (
+	MEME_BACKEND_LOCAL   = "local"   // Memes rendered from the template library.
+	MEME_BACKEND_IMGFLIP = "imgflip" // Memes made by Imgflip, with its popular templates.
+)
+
+// # Meme maker
+//
+// This interface abstracts where memes are made: rendered locally, or by a remote service.
+// Local renderers return the PNG data, remote services return the URL of the meme
+// (and may also return the data).
+type MemeMaker interface {
+	// MemeTemplates returns the templates the memes can be made from, the ones matching the query first.
+	MemeTemplates(query string) ([]MemeTemplate, error)
+	MakeMeme(template_name string, texts []string) (MemeResult, error)
+}
+
+type MemeResult struct {
+	Image []byte // Encoded image, if available.
+	Url   string // URL of the image, if hosted.
+}
+
+// # Local meme maker
+//
+// This struct renders memes from the local template library.
+type LocalMemeMaker struct {
+	Library  *MemeTemplateLibrary
+	Renderer *MemeRenderer
+}
+
+func (maker *LocalMemeMaker) MemeTemplates(query string) ([]MemeTemplate, error) {
+	return append(maker.Library.Search(query), maker.Library.List()...), nil
+}
+
+func (maker *LocalMemeMaker) MakeMeme(template_name string, texts []string) (MemeResult, error) {
+	meme_template, found := maker.Library.Find(template_name)
+	if !found {
+		return MemeResult{}, fmt.Errorf("no template named %q", template_name)
+	}
+
+	rendered, err := maker.Library.Render(maker.Renderer, meme_template, texts)
+	if err != nil {
+		return MemeResult{}, err
+	}
+	return MemeResult{Image: rendered}, nil
+}
+
+type ImgflipTemplate struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	BoxCount int    `json:"box_count"`
+}
+
+type imgflipResponse struct {
+	Success      bool            `json:"success"`
+	ErrorMessage string          `json:"error_message"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// # Imgflip client
+//
+// This struct creates memes through the Imgflip API (https://imgflip.com/api).
+// Captioning needs an Imgflip account; the template list is public.
+type ImgflipClient struct {
+	Username string
+	Password string
+
+	http_client  http.Client
+	mu           sync.Mutex
+	templates    []ImgflipTemplate
+	templates_at time.Time
+}
+
+// # Create a new Imgflip client
+//
+// This function creates a client authenticating with the given account.
+func NewImgflipClient(username string, password string) *ImgflipClient {
+	return &ImgflipClient{Username: username, Password: password, http_client: http.Client{Timeout: 30 * time.Second}}
+}
+
+// # Call the API
+//
+// This function sends a request to the API and decodes the `data` field of a successful response.
+func (client *ImgflipClient) call(method string, endpoint string, form url.Values, data interface{}) error {
+	var resp *http.Response
+	var err error
+	if method == http.MethodPost {
+		resp, err = client.http_client.PostForm(IMGFLIP_API+"/"+endpoint, form)
+	} else {
+		resp, err = client.http_client.Get(IMGFLIP_API + "/" + endpoint)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var api_response imgflipResponse
+	if err := json.Unmarshal(body, &api_response); err != nil {
+		return fmt.Errorf("imgflip returned status %d: %s", resp.StatusCode, string(body))
+	}
+	if !api_response.Success {
+		return fmt.Errorf("imgflip: %s", api_response.ErrorMessage)
+	}
+	return json.Unmarshal(api_response.Data, data)
+}
+
+// # Get templates
+//
+// This function returns the popular templates of Imgflip.
+// The list is cached for an hour, as it rarely changes.
+func (client *ImgflipClient) Templates() ([]ImgflipTemplate, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.templates != nil && time.Since(client.templates_at) < time.Hour {
+		return client.templates, nil
+	}
+
+	var data struct {
+		Memes []ImgflipTemplate `json:"memes"`
+	}
+	if err := client.call(http.MethodGet, "get_memes", nil, &data); err != nil {
+		return nil, err
+	}
+
+	client.templates = data.Memes
+	client.templates_at = time.Now()
+	return client.templates, nil
+}
+
+// # Look up template ID
+//
+// This function resolves a template name to its Imgflip ID.
+// Numeric names are taken as IDs; other names must match a popular template, ignoring case.
+func (client *ImgflipClient) LookupTemplateID(name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return name, nil
+	}
+
+	templates, err := client.Templates()
+	if err != nil {
+		return "", err
+	}
+	for _, imgflip_template := range templates {
+		if strings.EqualFold(imgflip_template.Name, name) {
+			return imgflip_template.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no imgflip template named %q", name)
+}
+
+// # Search templates
+//
+// This function returns the popular templates whose name contains the query, ignoring case.
+func (client *ImgflipClient) SearchTemplates(query string) ([]ImgflipTemplate, error) {
+	templates, err := client.Templates()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ImgflipTemplate
+	for _, imgflip_template := range templates {
+		if strings.Contains(strings.ToLower(imgflip_template.Name), strings.ToLower(query)) {
+			results = append(results, imgflip_template)
+		}
+	}
+	return results, nil
+}
+
+// # Caption image
+//
+// This function captions a template with the `caption_image` API and returns the URL of the meme.
+// Texts are sent as text boxes, so templates with more than two boxes are supported.
+func (client *ImgflipClient) CaptionImage(template_id string, texts []string) (string, error) {
+	if client.Username == "" || client.Password == "" {
+		return "", fmt.Errorf("imgflip credentials are not configured")
+	}
+
+	form := url.Values{}
+	form.Set("template_id", template_id)
+	form.Set("username", client.Username)
+	form.Set("password", client.Password)
+	for i, text := range texts {
+		form.Set(fmt.Sprintf("boxes[%d][text]", i), text)
+	}
+
+	var data struct {
+		Url     string `json:"url"`
+		PageUrl string `json:"page_url"`
+	}
+	if err := client.call(http.MethodPost, "caption_image", form, &data); err != nil {
+		return "", err
+	}
+	return data.Url, nil
+}
+
+// # Meme templates
+//
+// This function returns the popular templates of Imgflip as meme templates, the ones whose name contains the query first.
+// Imgflip places the texts itself, so only the number of their text boxes is known.
+func (client *ImgflipClient) MemeTemplates(query string) ([]MemeTemplate, error) {
+	matching, err := client.SearchTemplates(query)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := client.Templates()
+	if err != nil {
+		return nil, err
+	}
+	var meme_templates []MemeTemplate
+	for _, imgflip_template := range append(matching, templates...) {
+		meme_templates = append(meme_templates, MemeTemplate{Name: imgflip_template.Name, Boxes: make([]MemeTextBox, max(imgflip_template.BoxCount, 1))})
+	}
+	return meme_templates, nil
+}
+
+func (client *ImgflipClient) MakeMeme(template_name string, texts []string) (MemeResult, error) {
+	template_id, err := client.LookupTemplateID(template_name)
+	if err != nil {
+		return MemeResult{}, err
+	}
+
+	meme_url, err := client.CaptionImage(template_id, texts)
+	if err != nil {
+		return MemeResult{}, err
+	}
+	return MemeResult{Url: meme_url}, nil
+}
+
+// # Imgflip command
+//
+// This function handles the `imgflip` subcommand.
+//
+// Usage:
+//
+// - imgflip search <query>
+// - imgflip caption <template name|id> <text>...
+func runImgflipCommand(client *ImgflipClient, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: imgflip search <query> | caption <template name|id> <text>...")
+	}
+
+	switch args[0] {
+	case "search":
+		results, err := client.SearchTemplates(strings.Join(args[1:], " "))
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			fmt.Println("No template found.")
+		}
+		for _, imgflip_template := range results {
+			fmt.Printf("%-12s %-40s %d boxes\n", imgflip_template.ID, imgflip_template.Name, imgflip_template.BoxCount)
+		}
+	case "caption":
+		result, err := client.MakeMeme(args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		fmt.Println(result.Url)
+	default:
+		return fmt.Errorf("unknown imgflip command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_INIT_CONFIG = "memebot.json"
+
+const INIT_TIMEOUT = 30 * time.Second
+
+const DEFAULT_PERSONAS_DIR = "personas"
+
+// Settings `init` asks for; the others of an existing configuration are kept as they are.
+var init_settings = []string{"server", "port", "model", "chat-template", "personas", "persona"}
+
+// # Ask
+//
+// This function prints a question with its default answer, and returns the line typed, or the default when the line is empty.
+func (console *Console) Ask(question string, default_answer string) (string, error) {
+	if default_answer != "" {
+		fmt.Printf("%s [%s]: ", question, default_answer)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := console.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return default_answer, nil
+	}
+	return answer, nil
+}
+
+// # Confirm
+//
+// This function asks a yes or no question, no by default.
+func (console *Console) Confirm(question string) (bool, error) {
+	answer, err := console.Ask(question+" (y/N)", "")
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+// # Test completion
+//
+// This function checks that the backend answers a completion in the chat template, and returns the completion.
+func testCompletion(ctx context.Context, client *LlmClient, model string, template_name string) (string, error) {
+	if err := client.Ping(ctx); err != nil {
+		return "", err
+	}
+	chat_template, found := GetChatTemplate(template_name)
+	if !found {
+		return "", fmt.Errorf("unknown chat template %q", template_name)
+	}
+	params := LlmGenerationParameters{ModelName: model, MaxTokens: SELFTEST_MAX_TOKENS}.SetPrompt(chat_template.FormatConversation(nil, SELFTEST_PROMPT))
+	text, _, err := sendRequest(ctx, client.Server, client.Port, COMPLETIONS_ENDPOINT, NewGenerationRequest(Message{User: "init"}, params))
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", errors.New("the model returned an empty completion")
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// # Init subcommand
+//
+// This function handles `init [-out path] [-force]`: it asks for the backend, the model, the chat template and the persona,
+// checks them with a test completion, and writes a configuration file to start the bot with `-config`.
+// The answers default to the current settings. When the configuration file exists, `init` edits it: the answers default
+// to its settings, and the settings it doesn't ask about are kept. With `-force`, it starts over, dropping them.
+func runInitCommand(console *Console, server string, port int, model string, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	out := flags.String("out", DEFAULT_INIT_CONFIG, "path of the configuration file written, edited if it exists")
+	force := flags.Bool("force", false, "start over, dropping the settings of the existing configuration file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Println("Let's set up the bot. Press Enter to keep the value in brackets.")
+	settings := map[string]interface{}{}
+	if _, err := os.Stat(*out); err == nil {
+		existing, err := ReadConfigurationFile(*out)
+		if err != nil && !*force {
+			return fmt.Errorf("%w, use -force to start over", err)
+		}
+		if *force {
+			if dropped := droppedInitSettings(existing); len(dropped) > 0 {
+				fmt.Printf("Starting over: the other settings of %s will be dropped: %s.\n", *out, strings.Join(dropped, ", "))
+			}
+		} else {
+			fmt.Printf("Editing %s, keeping the settings not asked about.\n", *out)
+			settings = existing
+			server = initSetting(settings, "server", server)
+			if port, err = strconv.Atoi(initSetting(settings, "port", strconv.Itoa(port))); err != nil {
+				return fmt.Errorf("invalid port in %s: %w", *out, err)
+			}
+			model = initSetting(settings, "model", model)
+		}
+	}
+
+	// Backend.
+	var err error
+	if server, err = console.Ask("Host name of the llama-cpp-python server", server); err != nil {
+		return err
+	}
+	port_answer, err := console.Ask("Port of the server", strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	if port, err = strconv.Atoi(port_answer); err != nil {
+		return fmt.Errorf("invalid port %q", port_answer)
+	}
+	settings["server"], settings["port"] = server, port
+	client := NewLlmClient(server, port)
+
+	// Model, and the chat template of its family, detected when the backend tells.
+	if model, err = console.Ask("Model requested from the server, empty for the loaded model", model); err != nil {
+		return err
+	}
+	if model != "" {
+		settings["model"] = model
+	} else {
+		delete(settings, "model")
+	}
+	template_name := initSetting(settings, "chat-template", DefaultChatTemplateName)
+	props_ctx, cancel := context.WithTimeout(context.Background(), INIT_TIMEOUT)
+	props, err := client.Props(props_ctx)
+	cancel()
+	if name, found := DetectChatTemplate(props.ChatTemplate); err == nil && found {
+		template_name = name
+		fmt.Printf("The server runs a %s model.\n", name)
+	}
+	names := make([]string, 0, len(ChatTemplates))
+	for name := range ChatTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for {
+		answer, err := console.Ask(fmt.Sprintf("Chat template (%s)", strings.Join(names, ", ")), template_name)
+		if err != nil {
+			return err
+		}
+		if _, found := ChatTemplates[answer]; found {
+			template_name = answer
+			break
+		}
+		fmt.Printf("Unknown chat template %q.\n", answer)
+	}
+	settings["chat-template"] = template_name
+
+	// Persona, created when it isn't in the persona directory.
+	persona_name, err := console.Ask("Persona played by the bot, empty for none", initSetting(settings, "persona", ""))
+	if err != nil {
+		return err
+	}
+	delete(settings, "persona")
+	if persona_name != "" {
+		personas_dir := DEFAULT_PERSONAS_DIR
+		if found := flag.Lookup("personas"); found != nil && found.Value.String() != "" {
+			personas_dir = found.Value.String()
+		}
+		personas_dir = initSetting(settings, "personas", personas_dir)
+		if personas_dir, err = console.Ask("Directory of the persona files", personas_dir); err != nil {
+			return err
+		}
+		library, err := LoadPersonaLibrary(personas_dir)
+		if err != nil {
+			return err
+		}
+		if _, found := library.Find(persona_name); !found {
+			description, err := console.Ask(fmt.Sprintf("Describe %s in a sentence", persona_name), "")
+			if err != nil {
+				return err
+			}
+			path, err := writePersona(personas_dir, persona_name, description)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Wrote the persona %s.\n", path)
+		}
+		settings["personas"], settings["persona"] = personas_dir, persona_name
+	}
+
+	// Connectivity.
+	fmt.Println("Checking the server with a test completion...")
+	ctx, cancel := context.WithTimeout(context.Background(), INIT_TIMEOUT)
+	text, err := testCompletion(ctx, client, model, template_name)
+	cancel()
+	if err != nil {
+		fmt.Printf("The test completion failed: %v\n", err)
+		write, err := console.Confirm("Write the configuration anyway?")
+		if err != nil || !write {
+			return errors.Join(errors.New("no configuration written"), err)
+		}
+	} else {
+		fmt.Printf("The model answered %q.\n", text)
+	}
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s. Start the bot with:\n\n\t%s -%s %s\n", *out, filepath.Base(os.Args[0]), CONFIG_FLAG, *out)
+	return nil
+}
+
+// # Init setting
+//
+// This function returns a setting of the configuration edited by `init`, or the default when it isn't set.
+func initSetting(settings map[string]interface{}, name string, default_value string) string {
+	if value, found := settings[name]; found && value != nil {
+		return fmt.Sprint(value)
+	}
+	return default_value
+}
+
+// # Dropped init settings
+//
+// This function returns the names of the settings of a configuration `init` doesn't ask about, sorted.
+func droppedInitSettings(settings map[string]interface{}) []string {
+	var dropped []string
+	for name := range settings {
+		if !slices.Contains(init_settings, name) {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// # Write persona
+//
+// This function writes a persona file with a name and a description to the directory, creating it if needed,
+// and returns its path. The file can be completed later with the other fields of a persona card.
+func writePersona(dir string, name string, description string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(map[string]string{"name": name, "description": description}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strings.ToLower(strings.Join(strings.Fields(name), "_"))+".json")
+	return path, os.WriteFile(path, append(data, '\n'), 0600)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JOURNAL_ACCEPT = "accept"
+	JOURNAL_DONE   = "done"
+)
+
+type JournalEntry struct {
+	Op      string    `json:"op"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key"`               // Message key, see `Message.Key`.
+	Message *Message  `json:"message,omitempty"` // Set on accept.
+}
+
+// # Message journal
+//
+// This struct persists the messages accepted from frontends until they are answered,
+// so a restart doesn't lose them, and remembers the IDs answered over the last `Window` to drop redeliveries,
+// like `DuplicateFilter`. A window of 0 or less remembers none. The journal is a JSON lines file, compacted when opened.
+type MessageJournal struct {
+	Window time.Duration
+
+	path string
+
+	mu          sync.Mutex
+	file        *os.File
+	pending     map[string]JournalEntry
+	done        map[string]time.Time
+	last_pruned time.Time
+}
+
+// # Open message journal
+//
+// This function loads the journal at `path`, creating it if it doesn't exist,
+// and rewrites it without the answered messages older than the dedup `window`.
+func OpenMessageJournal(path string, window time.Duration) (*MessageJournal, error) {
+	journal := &MessageJournal{Window: window, path: path, pending: map[string]JournalEntry{}, done: map[string]time.Time{}}
+
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var entry JournalEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				// A crash may leave a truncated last line behind.
+				log.Printf("skipping corrupted journal entry in %s: %v\n", path, err)
+				continue
+			}
+			switch entry.Op {
+			case JOURNAL_ACCEPT:
+				if _, answered := journal.done[entry.Key]; !answered && entry.Message != nil {
+					journal.pending[entry.Key] = entry
+				}
+			case JOURNAL_DONE:
+				delete(journal.pending, entry.Key)
+				journal.done[entry.Key] = entry.Time
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := journal.compact(); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// # Compact
+//
+// This function rewrites the journal with the pending messages and the recent answered IDs only,
+// then reopens it for appending.
+func (journal *MessageJournal) compact() error {
+	var entries []JournalEntry
+	for _, entry := range journal.pending {
+		entries = append(entries, entry)
+	}
+	journal.prune(time.Now())
+	for key, answered_at := range journal.done {
+		entries = append(entries, JournalEntry{Op: JOURNAL_DONE, Time: answered_at, Key: key})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(journal.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(journal.path+".tmp", journal.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(journal.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	journal.file = file
+	return nil
+}
+
+// # Prune answered IDs
+//
+// This function forgets the IDs answered before the window. The lock must be held, or the journal not shared yet.
+func (journal *MessageJournal) prune(now time.Time) {
+	for key, answered_at := range journal.done {
+		if now.Sub(answered_at) >= journal.Window {
+			delete(journal.done, key)
+		}
+	}
+	journal.last_pruned = now
+}
+
+// # Append entry
+//
+// This function writes an entry and syncs it to disk. The lock must be held.
+func (journal *MessageJournal) append(entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return journal.file.Sync()
+}
+
+// # Accept message
+//
+// This function records a message before it is handled.
+// It returns false if the message is pending, or was answered within the window: a redelivery to drop.
+// Messages without ID can't be deduplicated nor resumed, and are always accepted.
+func (journal *MessageJournal) Accept(message Message) (bool, error) {
+	key := message.Key()
+	if journal == nil || key == "" {
+		return true, nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	if _, found := journal.pending[key]; found {
+		return false, nil
+	}
+	now := time.Now()
+	if now.Sub(journal.last_pruned) > journal.Window {
+		journal.prune(now)
+	}
+	if answered_at, found := journal.done[key]; found && now.Sub(answered_at) < journal.Window {
+		return false, nil
+	}
+
+	entry := JournalEntry{Op: JOURNAL_ACCEPT, Time: now, Key: key, Message: &message}
+	journal.pending[key] = entry
+	return true, journal.append(entry)
+}
+
+// # Mark message done
+//
+// This function records that the message with the given key has been answered.
+func (journal *MessageJournal) Done(key string) error {
+	if journal == nil || key == "" {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	answered_at := time.Now()
+	delete(journal.pending, key)
+	if journal.Window > 0 {
+		journal.done[key] = answered_at
+	}
+	return journal.append(JournalEntry{Op: JOURNAL_DONE, Time: answered_at, Key: key})
+}
+
+// # Pending messages
+//
+// This function returns the messages accepted but not answered, oldest first.
+func (journal *MessageJournal) Pending() []Message {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	entries := make([]JournalEntry, 0, len(journal.pending))
+	for _, entry := range journal.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	messages := make([]Message, len(entries))
+	for i, entry := range entries {
+		messages[i] = *entry.Message
+	}
+	return messages
+}
+
+// # Resume pending messages
+//
+// This function answers the messages left pending by the previous run, posting the replies through `Post`.
+func (bot *Bot) ResumePending() {
+	for _, message := range bot.Journal.Pending() {
+		log.Printf("resuming message %s from %s in %s\n", message.ID, message.User, message.Channel)
+		reply := bot.respond(message)
+		bot.Post(message.Channel, reply)
+		if err := bot.Journal.Done(message.Key()); err != nil {
+			log.Println(fmt.Errorf("journal: %w", err))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const MEMORY_KIND_KB = "kb"
+
+const KB_CHUNK_SIZE = 800       // Maximum chunk length in runes.
+const KB_MAX_DOCUMENT = 8 << 20 // Maximum document size in bytes.
+
+var html_drop_pattern = regexp.MustCompile(`(?is)<(script|style|noscript)[^>]*>.*?</(script|style|noscript)>`)
+var html_tag_pattern = regexp.MustCompile(`(?s)<[^>]*>`)
+var blank_lines_pattern = regexp.MustCompile(`\n\s*\n+`)
+
+// # Read document
+//
+// This function reads a document from a local file or an http(s) URL.
+// HTML pages are reduced to their text content.
+func ReadDocument(source string) (string, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(source, ".html") || strings.HasSuffix(source, ".htm") {
+			return HtmlToText(string(data)), nil
+		}
+		return string(data), nil
+	}
+
+	http_client := http.Client{Timeout: 30 * time.Second}
+	resp, err := http_client.Get(source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() // Close the response body
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s failed with status %d", source, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, KB_MAX_DOCUMENT))
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return HtmlToText(string(data)), nil
+	}
+	return string(data), nil
+}
+
+// # HTML to text
+//
+// This function strips scripts, styles and tags from an HTML page and unescapes the entities.
+// It is not a real HTML parser, but good enough for FAQ pages and wikis.
+func HtmlToText(page string) string {
+	page = html_drop_pattern.ReplaceAllString(page, "")
+	page = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n\n", "</div>", "\n\n", "</li>", "\n", "</h1>", "\n\n", "</h2>", "\n\n", "</h3>", "\n\n").Replace(page)
+	page = html_tag_pattern.ReplaceAllString(page, "")
+	return html.UnescapeString(page)
+}
+
+// # Chunk document
+//
+// This function splits a document into chunks of at most `size` runes.
+// Paragraphs are kept together where possible, and merged while they fit in one chunk.
+func ChunkDocument(text string, size int) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var chunks []string
+	var current []rune
+	flush := func() {
+		if chunk := strings.TrimSpace(string(current)); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current = current[:0]
+	}
+
+	for _, paragraph := range blank_lines_pattern.Split(text, -1) {
+		runes := []rune(strings.TrimSpace(paragraph))
+		if len(runes) == 0 {
+			continue
+		}
+
+		// Start a new chunk if the paragraph doesn't fit in the current one.
+		if len(current) > 0 && len(current)+2+len(runes) > size {
+			flush()
+		}
+
+		// Hard-split paragraphs longer than a chunk.
+		for len(runes) > size {
+			flush()
+			current = append(current, runes[:size]...)
+			flush()
+			runes = runes[size:]
+		}
+
+		if len(current) > 0 {
+			current = append(current, '\n', '\n')
+		}
+		current = append(current, runes...)
+	}
+	flush()
+	return chunks
+}
+
+// # Add to knowledge base
+//
+// This function reads, chunks and embeds a document, storing every chunk in the long-term memory,
+// for the channel only when `channel` is set, e.g. the lore of a roleplay server. It returns the number of chunks stored.
+func (memory *LongTermMemory) AddDocument(source string, channel string) (int, error) {
+	document, err := ReadDocument(source)
+	if err != nil {
+		return 0, err
+	}
+
+	chunks := ChunkDocument(document, KB_CHUNK_SIZE)
+	if len(chunks) == 0 {
+		return 0, fmt.Errorf("%s has no text content", source)
+	}
+
+	// Embed in batches to keep the requests small.
+	const batch_size = 16
+	stored := 0
+	for start := 0; start < len(chunks); start += batch_size {
+		end := min(start+batch_size, len(chunks))
+		vectors, err := memory.Client.Embed(chunks[start:end]...)
+		if err != nil {
+			return stored, err
+		}
+		for i, vector := range vectors {
+			if _, err := memory.Store.Add(MemoryEntry{Kind: MEMORY_KIND_KB, Text: chunks[start+i], Vector: vector, Channel: channel}); err != nil {
+				return stored, err
+			}
+			stored++
+		}
+	}
+	return stored, nil
+}
+
+// # Knowledge base command
+//
+// This function handles the `kb` subcommand.
+//
+// Usage:
+//
+// - kb add [-channel <id>] <file|url>...
+func runKbCommand(memory *LongTermMemory, args []string) error {
+	const usage = "usage: kb add [-channel <id>] <file|url>..."
+	if len(args) < 1 || args[0] != "add" {
+		return fmt.Errorf(usage)
+	}
+	flags := flag.NewFlagSet("kb add", flag.ContinueOnError)
+	channel := flags.String("channel", "", "channel the documents are recalled in, empty for every channel")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf(usage)
+	}
+	if memory == nil {
+		return fmt.Errorf("the knowledge base needs a memory store, set it with -memory")
+	}
+
+	for _, source := range flags.Args() {
+		stored, err := memory.AddDocument(source, *channel)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		fmt.Printf("Added %d chunks from %s\n", stored, source)
+	}
+	return nil
+}
@@ -3,21 +3,72 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 const CHAT_TEMPLATE = `<start_of_turn>user
-%s<end_of_turn>
+{{.Prompt}}<end_of_turn>
 <start_of_turn>model
 `
 const CHAT_TEMPLATE_END = "<end_of_turn>"
 
+const DEFAULT_CHAT_TEMPLATE = "gemma"
+
+// Chat template of the channels without one. With `-template-from-backend`, the template matching the loaded model.
+var DefaultChatTemplateName = DEFAULT_CHAT_TEMPLATE
+
+// # Chat template
+//
+// This struct describes the prompt format of a model family.
+// `Turn` wraps a user prompt and opens the model turn, `End` closes a model turn.
+// `Turn` is a Go text/template executed with a `PromptData`, e.g. `[INST] {{.Prompt}} [/INST]`.
+type ChatTemplate struct {
+	Turn string `json:"turn"`
+	End  string `json:"end"`
+
+	// Variables are the values of the template variables other than the prompt.
+	Variables PromptVariables `json:"-"`
+
+	turn *template.Template
+}
+
+// Known chat templates, by name.
+var ChatTemplates = map[string]ChatTemplate{
+	"gemma":   MustParseChatTemplate(CHAT_TEMPLATE, CHAT_TEMPLATE_END),
+	"chatml":  MustParseChatTemplate("<|im_start|>user\n{{.Prompt}}<|im_end|>\n<|im_start|>assistant\n", "<|im_end|>"),
+	"llama3":  MustParseChatTemplate("<|start_header_id|>user<|end_header_id|>\n\n{{.Prompt}}<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n", "<|eot_id|>"),
+	"mistral": MustParseChatTemplate("[INST] {{.Prompt}} [/INST]", "</s>"),
+}
+
+// # Get chat template
+//
+// This function returns the chat template with the given name, or the default template if the name is empty.
+func GetChatTemplate(name string) (ChatTemplate, bool) {
+	if name == "" {
+		name = DefaultChatTemplateName
+	}
+	chat_template, found := ChatTemplates[name]
+	return chat_template, found
+}
+
+const COMPLETIONS_ENDPOINT = "v1/completions"
+
+const MAX_GENERATION_ATTEMPTS = 3 // Attempts of a generation before reporting the error.
+
+const TRUNCATION_MARKER = "…" // Appended to the replies cut by the generation timeout.
+
 type LlmGenerationParameters struct {
 	ModelName     string  `json:"model"`
 	Prompt        string  `json:"prompt"`
@@ -27,6 +78,10 @@ type LlmGenerationParameters struct {
 	Temperature   float64 `json:"temperature"`
 	Stream        bool    `json:"stream"`
 	MaxTokens     int     `json:"max_tokens"`
+	Grammar       string  `json:"grammar,omitempty"`      // GBNF grammar constraining the output.
+	CachePrompt   bool    `json:"cache_prompt,omitempty"` // Reuse the KV cache of the prompt prefix evaluated last time (llama.cpp).
+	SlotID        *int    `json:"id_slot,omitempty"`      // Backend slot to run the generation in, nil for any (llama.cpp).
+	Seed          *int    `json:"seed,omitempty"`         // Sampling seed, nil for a random one.
 }
 
 // # Check and fix generation parameters
@@ -81,7 +136,56 @@ func (lgp *LlmGenerationParameters) ToJSON() string {
 //
 // - prompt: the user prompt
 func FormatPrompt(prompt string) string {
-	return fmt.Sprintf(CHAT_TEMPLATE, prompt)
+	return ChatTemplates[DefaultChatTemplateName].FormatPrompt(prompt)
+}
+
+// # Prompt formatter
+//
+// This function formats the prompt with the chat template and its variables.
+// A template failing to execute leaves the prompt unformatted.
+func (chat_template ChatTemplate) FormatPrompt(prompt string) string {
+	if chat_template.turn == nil {
+		return prompt
+	}
+	var builder strings.Builder
+	if err := chat_template.turn.Execute(&builder, NewPromptData(chat_template.Variables, prompt)); err != nil {
+		log.Println(err)
+		return prompt
+	}
+	return builder.String()
+}
+
+type ChatTurn struct {
+	User    string `json:"user"`
+	Model   string `json:"model"`
+	Speaker string `json:"speaker,omitempty"` // Platform ID of the sender of the user turn, empty when unknown.
+}
+
+// # Conversation formatter
+//
+// This function formats previous turns followed by the prompt, so the model sees the whole conversation.
+//
+// Parameters:
+//
+// - turns: the completed turns, oldest first
+// - prompt: the user prompt
+func FormatConversation(turns []ChatTurn, prompt string) string {
+	return ChatTemplates[DefaultChatTemplateName].FormatConversation(turns, prompt)
+}
+
+// # Conversation formatter
+//
+// This function formats previous turns followed by the prompt with the chat template.
+func (chat_template ChatTemplate) FormatConversation(turns []ChatTurn, prompt string) string {
+	var builder strings.Builder
+	for _, turn := range turns {
+		builder.WriteString(chat_template.FormatPrompt(turn.User))
+		builder.WriteString(turn.Model)
+		builder.WriteString(chat_template.End)
+		builder.WriteString("\n")
+	}
+	builder.WriteString(chat_template.FormatPrompt(prompt))
+	return builder.String()
 }
 
 const SampleResponse = `{
@@ -115,28 +219,55 @@ type LlmResponse struct {
 		Logprobs     interface{} `json:"logprobs"`
 		FinishReason string      `json:"finish_reason"`
 	} `json:"choices"`
-	Usage interface{} `json:"usage"`
+	Usage *LlmUsage `json:"usage"`
+}
+
+// # Token usage
+//
+// This struct is the token count of a generation, as reported by the backend.
+type LlmUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	Estimated bool `json:"-"` // Counted by `EstimateTokens`, the backend didn't report it.
 }
 
 // # Parse response
 //
-// This function parses the response from the model.
+// This function parses the response from the model, repairing the encoding of the generated texts.
 func ParseResponse(response string) LlmResponse {
 	var llmResponse LlmResponse
 	json.Unmarshal([]byte(response), &llmResponse)
+	for i := range llmResponse.Choices {
+		llmResponse.Choices[i].Text = CleanResponseText(llmResponse.Choices[i].Text)
+	}
 	return llmResponse
 }
 
 // # Connect to server endpoint and send prompt
 //
 // This function connects to the local server and sends the prompt to the model.
+// Errors reported by the backend are returned as `*BackendError`.
 func SendPrompt(server string, port int, endpoint string, param_with_prompt LlmGenerationParameters) (string, error) {
+	return SendPromptContext(context.Background(), server, port, endpoint, param_with_prompt)
+}
+
+// # Send prompt with context
+//
+// This function sends the prompt like `SendPrompt`, giving up when the context is done.
+func SendPromptContext(ctx context.Context, server string, port int, endpoint string, param_with_prompt LlmGenerationParameters) (string, error) {
 
 	// Construct the URL
 	url := fmt.Sprintf("http://%s:%d/%s", server, port, endpoint)
 
 	// Send the prompt to the model
-	resp, err := http.Post(url, "application/json", strings.NewReader(param_with_prompt.ToJSON()))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(param_with_prompt.ToJSON()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return "", err
 	}
@@ -147,67 +278,402 @@ func SendPrompt(server string, port int, endpoint string, param_with_prompt LlmG
 	if err != nil {
 		return "", err
 	}
+	if err := ParseBackendError(resp.StatusCode, body); err != nil {
+		return "", err
+	}
 	return string(body), nil
 }
 
 // # Model I/O handler
 //
-// This function handles the communication between the user prompt queue and the model response queue.
-//
-// Note that the `user_prompt_queue` expects the prompt has been given by the user.
-func modelIoHandler(ctx context.Context, server string, port int, endpoint string, param_with_prompt_queue <-chan LlmGenerationParameters, model_response_queue chan<- string, wg *sync.WaitGroup) {
+// This function takes the generation requests from the request queue by priority, sends them to the model
+// and answers each request with the model output, or with the error after the last attempt.
+// Errors of the last attempt are left to the requester to report.
+// With a hedge, every request is raced against the hedge backend, see `hedgedRequest`.
+// Requests for another backend, like the fast path, are sent to it alone.
+// An empty completion is retried once right away, with adjusted sampling, see `emptyRetrySampling`.
+func modelIoHandler(ctx context.Context, server string, port int, endpoint string, requests *RequestQueue, wg *sync.WaitGroup, hedge *Hedge) {
 
 	defer wg.Done()
 
 	for {
-		select {
-		case <-ctx.Done():
+		// Get the most urgent request
+		request, ok := requests.Pop(ctx)
+		if !ok {
 			return
-		default:
-			// Get the user prompt
-			param_with_prompt := <-param_with_prompt_queue
-
-			for {
-				// Send the prompt to the model
-				response, err := SendPrompt(server, port, endpoint, param_with_prompt)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(1 * time.Second)
-					continue
-				}
+		}
 
-				// Get the actual response from the model
-				model_output := ParseResponse(response).Choices[0].Text
+		started_at := time.Now()
+		var err error
+		for attempt := 1; attempt <= MAX_GENERATION_ATTEMPTS; attempt++ {
+			if attempt > 1 && request.OnRestart != nil {
+				request.OnRestart()
+			}
 
-				// Send the model response to the response queue
-				model_response_queue <- model_output
+			// Send the prompt to the model
+			send := func() (string, *LlmUsage, error) {
+				switch {
+				case request.Backend != nil:
+					return sendRequest(ctx, request.Backend.Server, request.Backend.Port, endpoint, request)
+				case hedge != nil:
+					return hedgedRequest(ctx, []*LlmClient{NewLlmClient(server, port), hedge.Backend}, hedge.Delay, endpoint, request)
+				default:
+					return sendRequest(ctx, server, port, endpoint, request)
+				}
+			}
+			var text string
+			var usage *LlmUsage
+			text, usage, err = send()
+			var empty_err *EmptyCompletionError
+			if errors.As(err, &empty_err) {
+				log.Printf("request %s from %s in %s: %v, generating it again with other sampling\n", request.ID, request.User, request.Channel, err)
+				request.Params = emptyRetrySampling(request.Params, empty_err.FinishReason)
+				if request.OnRestart != nil {
+					request.OnRestart()
+				}
+				text, usage, err = send()
+			}
+			if err == nil {
+				request.Respond(text, usage, nil, started_at)
+				break
+			}
 
+			err = fmt.Errorf("request %s from %s in %s, attempt %d: %w", request.ID, request.User, request.Channel, attempt, err)
+			// Retrying a bad request would fail the same way, and an empty completion was retried already.
+			var backend_err *BackendError
+			if errors.As(err, &backend_err) && !backend_err.IsRetryable() || errors.As(err, &empty_err) {
 				break
 			}
+			if attempt < MAX_GENERATION_ATTEMPTS {
+				log.Println(err)
+				time.Sleep(1 * time.Second)
+			}
+		}
+		if err != nil {
+			request.Respond("", nil, err, started_at)
+		}
+	}
+}
+
+// # Send generation request
+//
+// This function sends the request to the model and returns the generated text and the token usage, if reported,
+// streaming the tokens to the requester when it asks for them.
+//
+// Requests with a timeout are always streamed: when the timeout expires, the stream is stopped
+// and the text generated so far is returned with a truncation marker, rather than an error.
+func sendRequest(ctx context.Context, server string, port int, endpoint string, request *GenerationRequest) (string, *LlmUsage, error) {
+	if request.Timeout > 0 {
+		timeout_ctx, cancel := context.WithTimeout(ctx, request.Timeout)
+		defer cancel()
+
+		on_token := request.OnToken
+		if on_token == nil {
+			on_token = func(string) {}
 		}
+		text, usage, err := StreamPrompt(timeout_ctx, server, port, endpoint, request.Params, on_token)
+		if err != nil && timeout_ctx.Err() == context.DeadlineExceeded && ctx.Err() == nil && strings.TrimSpace(text) != "" {
+			log.Printf("request %s cut after %s, returning the partial text\n", request.ID, request.Timeout)
+			on_token(TRUNCATION_MARKER)
+			return CleanResponseText(text) + TRUNCATION_MARKER, usage, nil
+		}
+		return CleanResponseText(text), usage, err
+	}
+	if request.OnToken != nil {
+		text, usage, err := StreamPrompt(ctx, server, port, endpoint, request.Params, request.OnToken)
+		return CleanResponseText(text), usage, err
+	}
+
+	response, err := SendPromptContext(ctx, server, port, endpoint, request.Params)
+	if err != nil {
+		return "", nil, err
 	}
+
+	// Get the actual response from the model
+	parsed := ParseResponse(response)
+	if len(parsed.Choices) == 0 {
+		return "", nil, fmt.Errorf("no completion in response: %.200s", response)
+	}
+	return parsed.Choices[0].Text, parsed.Usage, checkCompletion(parsed.Choices[0].Text, parsed.Choices[0].FinishReason)
 }
 
 func main() {
-	// Test sending a prompt to the model
-	server := "backend"
-	port := 8000
-	endpoint := "v1/completions"
+	memory_path := flag.String("memory", "", "path of the long-term memory store, empty to disable")
+	memory_top_k := flag.Int("memory-top-k", 3, "number of memories recalled per prompt")
+	memory_cross_channel := flag.Bool("memory-cross-channel", false, "recall the memories of a user from every channel, not only from the one they write in")
+	templates_dir := flag.String("templates", "", "directory of the meme template library, empty to disable")
+	font_path := flag.String("font", "", "path of the meme caption font (e.g. impact.ttf), empty for the bundled font")
+	meme_backend := flag.String("meme-backend", MEME_BACKEND_LOCAL, "where /meme makes the memes: local (from the -templates library) or imgflip (with the imgflip account)")
+	imgflip_username := flag.String("imgflip-username", "", "imgflip account username, for the imgflip meme backend")
+	imgflip_password := flag.String("imgflip-password", "", "imgflip account password, for the imgflip meme backend")
+	gif_provider := flag.String("gif-provider", "", "reaction GIF provider, giphy or tenor, empty to disable")
+	gif_api_key := flag.String("gif-api-key", "", "API key of the reaction GIF provider")
+	gif_channels := flag.String("gif-channels", "", "comma-separated channels allowed to use GIF replies, empty for all")
+	sd_url := flag.String("sd-url", "", "URL of the AUTOMATIC1111 Stable Diffusion web UI, empty to disable /draw")
+	image_dir := flag.String("image-dir", os.TempDir(), "directory where the CLI saves the images and voice messages it receives")
+	code_blocks := flag.Bool("code-blocks", true, "wrap the code of the replies in fenced code blocks, for platforms rendering Markdown")
+	frontends_flag := flag.String("frontends", "cli", "comma-separated frontends run at once, sharing the sessions and the backend: cli")
+	color := flag.String("color", "auto", "highlight the code of the replies in the terminal: auto, always or never")
+	attach_long := flag.Bool("attach-long", false, "send the replies longer than 3 messages as a text file, with their start as a summary")
+	paste_url := flag.String("paste-url", "", "URL of a pastebin-style service the long replies are posted to instead of attached, answering with the link of the paste")
+	paste_field := flag.String("paste-field", "", "multipart form field of the pasted text, e.g. `file` for 0x0.st, empty to post the text as the body")
+	message_limit_flag := flag.String("message-limit", "0", "longest reply message in characters, or the platform whose limit to follow: discord, telegram; longer replies are split, 0 for no limit")
+	whisper_url := flag.String("whisper-url", "", "URL of the whisper transcription endpoint, empty to disable voice messages")
+	whisper_model := flag.String("whisper-model", "", "model name sent to the transcription endpoint")
+	tts_url := flag.String("tts-url", "", "URL of the text-to-speech endpoint, empty to disable voice replies")
+	tts_voice := flag.String("tts-voice", "", "voice used for voice replies")
+	personas_dir := flag.String("personas", "", "directory of the persona files, empty to disable personas")
+	default_persona := flag.String("persona", "", "persona played by default")
+	channels_path := flag.String("channels", "", "path of the per-channel configuration file, empty to keep it in memory")
+	profanity_path := flag.String("profanity", "", "path of the profanity list, one word or `re:` regular expression per line, empty to disable the filter")
+	profanity_default := flag.String("profanity-default", PROFANITY_MASK, "what the profanity filter does in channels without a setting: off, mask or block")
+	optout_path := flag.String("optout", "", "path of the list of users who opted out with /optout, empty to keep it in memory")
+	owner_users := flag.String("owners", "", "comma-separated user IDs with the owner permission, who may also shut the bot down")
+	owner_roles := flag.String("owner-roles", OWNER_ROLE, "comma-separated platform roles with the owner permission")
+	admin_users := flag.String("admins", "", "comma-separated user IDs with the admin permission, who may change the settings and the model")
+	admin_roles := flag.String("admin-roles", ADMIN_ROLE, "comma-separated platform roles with the admin permission")
+	moderator_users := flag.String("moderators", "", "comma-separated user IDs with the moderator permission, who may clear sessions")
+	moderator_roles := flag.String("moderator-roles", MODERATOR_ROLE, "comma-separated platform roles with the moderator permission")
+	experiment_path := flag.String("experiment", "", "path of the A/B test parameter variants file, empty to disable")
+	breaker_threshold := flag.Int("breaker-threshold", DEFAULT_BREAKER_THRESHOLD, "failed generations in a row after which the bot stops waiting on the backend, 0 to always wait")
+	breaker_cooldown := flag.Duration("breaker-cooldown", DEFAULT_BREAKER_COOLDOWN, "time before trying the backend again after it failed")
+	fallback_path := flag.String("fallback-replies", "", "path of a JSON array of canned replies while the backend is down, empty to explain the error")
+	warm_up := flag.Bool("warm-up", false, "send a one-token generation at startup, so the backend loads the model before the first message")
+	keep_alive := flag.Duration("keep-alive", 0, "idle time after which a one-token generation keeps the model loaded in the backend, 0 to disable")
+	session_idle_timeout := flag.Duration("session-idle-timeout", 0, "idle time after which the conversation of a channel is archived and cleared, 0 to disable")
+	session_archive_path := flag.String("session-archive", "", "path of the archive of cleared conversations, empty to disable")
+	dedup_window := flag.Duration("dedup-window", DEFAULT_DEDUP_WINDOW, "window in which redelivered messages are ignored, 0 to disable")
+	search_path := flag.String("search-index", "", "path of the message index searched by /search, empty to disable")
+	journal_path := flag.String("journal", "", "path of the message journal keeping unanswered messages across restarts, empty to disable")
+	feedback_path := flag.String("feedback", "", "path of the reply ratings store, empty to disable feedback")
+	audit_path := flag.String("audit-log", "", "path of the audit log, empty to disable")
+	retention_days := flag.Int("retention-days", 0, "days after which the message log, archived conversations and remembered exchanges are deleted, 0 to keep them")
+	retention_per_user := flag.Int("retention-max-per-user", 0, "messages of the message log kept per user, 0 for no limit")
+	audit_retention_days := flag.Int("audit-retention-days", 0, "days after which the audit log entries are deleted, 0 to keep them")
+	janitor_interval := flag.Duration("janitor-interval", JANITOR_INTERVAL, "time between two runs of the retention policy")
+	server_flag := flag.String("server", "backend", "host name of the llama-cpp-python server")
+	port_flag := flag.Int("port", 8000, "port of the llama-cpp-python server")
+	model_flag := flag.String("model", "", "model requested from the server, empty for the loaded model")
+	top_k := flag.Int("top-k", 64, "top-k sampling")
+	top_p := flag.Float64("top-p", 0.9, "top-p sampling")
+	repeat_penalty := flag.Float64("repeat-penalty", 1.2, "repetition penalty")
+	temperature := flag.Float64("temperature", 0.9, "sampling temperature")
+	max_tokens := flag.Int("max-tokens", 32, "maximum number of tokens generated per reply")
+	triggers_path := flag.String("triggers", "", "path of the spontaneous reply triggers file, empty to disable")
+	context_window := flag.Int("context-window", DEFAULT_CONTEXT_WINDOW, "number of recent messages per channel given as context when chiming in")
+	group_context := flag.Int("group-context", 0, "number of recent messages of the channel, from anyone, given to the model with each message, at most -context-window; 0 for only the exchanges with the bot")
+	history_turns := flag.Int("history-turns", DEFAULT_HISTORY_TURNS, "number of previous exchanges per channel given as context")
+	schedules_path := flag.String("schedules", "", "path of the scheduled posts file, empty to disable")
+	stream := flag.Bool("stream", false, "print the replies as they are generated")
+	stream_tokens := flag.Int("stream-tokens", DEFAULT_STREAM_TOKENS, "tokens between two partial reply updates when streaming")
+	stream_interval := flag.Duration("stream-interval", DEFAULT_STREAM_INTERVAL, "longest delay between two partial reply updates when streaming")
+	translate_provider := flag.String("translate", "", "translation provider for channels with translation: llm or libretranslate, empty to disable")
+	translate_url := flag.String("translate-url", "", "URL of the LibreTranslate server")
+	translate_api_key := flag.String("translate-api-key", "", "API key of the LibreTranslate server")
+	model_language := flag.String("model-language", DEFAULT_MODEL_LANGUAGE, "language the model writes best, as an ISO 639-1 code")
+	locale := flag.String("locale", DEFAULT_LOCALE, "locale of the bot strings, for channels and users without one")
+	locales_dir := flag.String("locales", "", "directory of extra message catalogs, one <locale>.json file per locale")
+	bot_name := flag.String("bot-name", DEFAULT_BOT_NAME, "name of the bot in chat templates, when no persona is played")
+	generation_timeout := flag.Duration("generation-timeout", 0, "wall-clock budget of a generation, past which the text generated so far is returned, 0 to disable")
+	hedge_backend := flag.String("hedge-backend", "", "host:port of a second backend every generation is raced against, empty to disable")
+	hedge_delay := flag.Duration("hedge-delay", 0, "delay before sending a generation to the hedge backend, 0 to send it right away")
+	context_size := flag.Int("context-size", 0, "context size of the model in tokens, 0 to read it from the /props endpoint of the backend")
+	repeat_window := flag.Int("repeat-window", DEFAULT_REPEAT_WINDOW, "last replies of a channel a new reply is compared to, generating it again when it repeats one, 0 to allow repeats")
+	repeat_similarity := flag.Float64("repeat-similarity", DEFAULT_REPEAT_SIMILARITY, "share of common words, from 0 to 1, past which a reply repeats an earlier one")
+	burst_limit := flag.Int("burst-limit", DEFAULT_BURST_LIMIT, "messages triggering the bot in a channel per -burst-window past which the channel cools down, 0 to never cool down")
+	burst_window := flag.Duration("burst-window", DEFAULT_BURST_WINDOW, "window the messages triggering the bot are counted over")
+	burst_cooldown := flag.Duration("burst-cooldown", DEFAULT_BURST_COOLDOWN, "silence of a channel cooling down")
+	burst_mode := flag.String("burst-mode", BURST_BATCH, "messages addressed to the bot during a cooldown: batch (answered together after it) or ignore")
+	queue_notice_depth := flag.Int("queue-notice-depth", DEFAULT_QUEUE_NOTICE_DEPTH, "requests waiting ahead of a chat request past which its sender is told their place in line and the wait, 0 to never tell")
+	token_footer := flag.Bool("token-footer", false, "append the token usage and the context left to the replies")
+	cache_prompt := flag.Bool("cache-prompt", false, "let llama.cpp backends reuse the cached persona and history prefix of each channel")
+	prompt_slots := flag.Int("prompt-slots", 0, "backend slots the channels are pinned to with -cache-prompt, 0 to read them from /props, -1 to let the backend pick")
+	template_from_backend := flag.Bool("template-from-backend", false, "use the chat template matching the model loaded by the backend, read from its /props endpoint")
+	unfurl := flag.Bool("unfurl", false, "fetch the pages linked in the messages and give their text to the model")
+	unfurl_allow := flag.String("unfurl-allow", "", "comma-separated hosts whose links are fetched, empty for all; allowed hosts may be on the local network")
+	unfurl_deny := flag.String("unfurl-deny", "", "comma-separated hosts whose links are never fetched")
+	unfurl_timeout := flag.Duration("unfurl-timeout", 5*time.Second, "timeout of a link fetch")
+	fast_model := flag.String("fast-model", "", "small model tried first on short messages, escalating to -model when its answer isn't confident")
+	fast_backend := flag.String("fast-backend", "", "host:port of the backend serving -fast-model, empty for the main backend")
+	unfurl_max_bytes := flag.Int64("unfurl-max-bytes", DEFAULT_UNFURL_MAX_BYTES, "bytes read per linked page")
+	stickers_path := flag.String("stickers", "", "path of a JSON file mapping reaction emoji to platform sticker IDs, empty for none")
+	chat_templates_path := flag.String("chat-templates", "", "path of a JSON file of extra chat templates, by name")
+	chat_template_flag := flag.String("chat-template", DEFAULT_CHAT_TEMPLATE, "chat template of the channels without one: gemma, chatml, llama3, mistral, or one of -chat-templates")
+	dry_run := flag.Bool("dry-run", false, "reply with the requests that would be sent to the backend instead of sending them")
+	cassette_path := flag.String("cassette", "", "path of a cassette of recorded HTTP traffic with the backends, for deterministic integration runs, empty to disable")
+	cassette_mode := flag.String("cassette-mode", CASSETTE_REPLAY, "what to do with the -cassette: record the traffic, or replay it without any server")
+	health_addr := flag.String("health-addr", "", "address serving the /healthz and /readyz probes (e.g. :8080), empty to disable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Every flag can also be set with a %s<FLAG> environment variable (e.g. %s)\n", ENV_PREFIX, EnvName("memory-top-k"))
+		fmt.Fprintf(flag.CommandLine.Output(), "or in the -config file. Precedence: flags > environment > file > defaults.\n\n")
+		flag.PrintDefaults()
+	}
+	sources, err := LoadConfiguration(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Record or replay the traffic with the backends, before any request. The clients without a transport of their own
+	// use the default one: all the clients of the backends and services, but the link previews of -unfurl.
+	if *cassette_path != "" {
+		cassette, err := OpenCassette(*cassette_path, *cassette_mode, http.DefaultTransport)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.DefaultTransport = cassette
+		log.Printf("%s the HTTP traffic with the cassette %s\n", *cassette_mode, *cassette_path)
+	}
+
+	server := *server_flag
+	port := *port_flag
+	endpoint := COMPLETIONS_ENDPOINT
 	param_template := LlmGenerationParameters{
-		ModelName:     "",
-		TopK:          64,
-		TopP:          0.9,
-		RepeatPenalty: 1.2,
-		Temperature:   0.9,
+		ModelName:     *model_flag,
+		TopK:          *top_k,
+		TopP:          *top_p,
+		RepeatPenalty: *repeat_penalty,
+		Temperature:   *temperature,
 		Stream:        false,
-		MaxTokens:     32,
+		MaxTokens:     *max_tokens,
+	}
+
+	// Load the extra chat templates, before the channel settings refer to them.
+	if *chat_templates_path != "" {
+		if err := LoadChatTemplates(*chat_templates_path); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if _, found := ChatTemplates[*chat_template_flag]; !found {
+		log.Fatalf("unknown chat template %q\n", *chat_template_flag)
+	}
+	DefaultChatTemplateName = *chat_template_flag
+
+	// Match the chat template and the context size to the loaded model.
+	model_context_size, model_slots := *context_size, *prompt_slots
+	backend_kind := "OpenAI-compatible completions" // A llama.cpp server when it answers /props.
+	if *template_from_backend || model_context_size == 0 || (*cache_prompt && model_slots == 0) {
+		props_ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		props, err := NewLlmClient(server, port).Props(props_ctx)
+		cancel()
+		switch {
+		case err != nil:
+			if *template_from_backend {
+				log.Println(fmt.Errorf("chat template from backend: %w", err))
+			}
+		case *template_from_backend:
+			if name, found := DetectChatTemplate(props.ChatTemplate); found {
+				DefaultChatTemplateName = name
+				log.Printf("using the %s chat template of the model\n", name)
+			} else {
+				log.Printf("unknown chat template of the model, keeping %s\n", DefaultChatTemplateName)
+			}
+		}
+		if err == nil {
+			backend_kind = fmt.Sprintf("llama.cpp server, %d slots, %d-token context", props.TotalSlots, props.DefaultGenerationSettings.NCtx)
+		}
+		if err == nil && model_context_size == 0 {
+			model_context_size = props.DefaultGenerationSettings.NCtx
+		}
+		if err == nil && model_slots == 0 {
+			model_slots = props.TotalSlots
+		}
+	}
+
+	// Open the long-term memory.
+	var memory *LongTermMemory
+	if *memory_path != "" {
+		store, err := OpenVectorStore(*memory_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		memory = &LongTermMemory{Client: NewLlmClient(server, port), Store: store, TopK: *memory_top_k, MinScore: 0.5, CrossChannel: *memory_cross_channel}
+	}
+
+	// Load the meme template library.
+	var library *MemeTemplateLibrary
+	if *templates_dir != "" {
+		var err error
+		library, err = LoadMemeTemplateLibrary(*templates_dir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Run subcommands.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "kb":
+			if err := runKbCommand(memory, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "caption":
+			if err := runCaptionCommand(library, *font_path, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "imgflip":
+			if err := runImgflipCommand(NewImgflipClient(*imgflip_username, *imgflip_password), flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "bench":
+			if err := runBenchCommand(server, port, endpoint, param_template, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "mockserver":
+			if err := runMockServerCommand(flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "feedback":
+			if err := runFeedbackCommand(*feedback_path, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "export-dataset":
+			if err := runDatasetCommand(*feedback_path, *search_path, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "export", "import":
+			if err := runStateCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "selftest":
+			checks := selfTestChecks(NewLlmClient(server, port), endpoint, param_template, library, *font_path, *sd_url, NewImgflipClient(*imgflip_username, *imgflip_password))
+			if err := runSelfTestCommand(checks, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "init":
+			if err := runInitCommand(OpenConsole(), server, port, *model_flag, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "templates":
+			if err := runTemplatesCommand(library, *font_path, flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+		default:
+			log.Fatalf("unknown command %q\n", flag.Arg(0))
+		}
+		return
 	}
 
 	ctx := context.Background()
 
-	// Create channels.
-	param_with_prompt_queue := make(chan LlmGenerationParameters)
-	model_response_queue := make(chan string)
+	// Serve the container probes.
+	if *health_addr != "" {
+		health := &HealthServer{Client: NewLlmClient(server, port)}
+		health.Serve(*health_addr)
+	}
+
+	// Race the requests against a second backend.
+	var hedge *Hedge
+	if *hedge_backend != "" {
+		hedge_client, err := ParseBackendAddress(*hedge_backend)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hedge = &Hedge{Backend: hedge_client, Delay: *hedge_delay}
+	}
+
+	// Create the request queue.
+	requests := NewRequestQueue()
 
 	// Create a wait group.
 	wg := new(sync.WaitGroup)
@@ -216,24 +682,333 @@ func main() {
 	wg.Add(1)
 
 	// Start the model I/O handler.
-	go modelIoHandler(ctx, server, port, endpoint, param_with_prompt_queue, model_response_queue, wg)
+	go modelIoHandler(ctx, server, port, endpoint, requests, wg, hedge)
+
+	// Create the bot.
+	bot := NewBot(NewLlmClient(server, port), param_template, requests)
+	bot.Memory = memory
+	if *gif_provider != "" {
+		searcher, err := NewGifSearcher(*gif_provider, *gif_api_key)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		bot.Gifs = &GifResponder{Searcher: searcher, Channels: map[string]bool{}}
+		for _, channel := range strings.Split(*gif_channels, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				bot.Gifs.Channels[channel] = true
+			}
+		}
+	}
 
-	// User cli interaction.
-	for {
-		var user_input string
-		fmt.Print("User: ")
-		fmt.Scanln(&user_input)
+	if *personas_dir != "" {
+		personas, err := LoadPersonaLibrary(*personas_dir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		bot.Personas = personas
+	}
+	if *default_persona != "" {
+		if _, found := bot.Personas.Find(*default_persona); !found {
+			log.Fatalf("unknown persona %q\n", *default_persona)
+		}
+		bot.DefaultPersona = *default_persona
+	}
+	bot.ContextWindow = *context_window
+	bot.GroupContext = min(*group_context, *context_window)
+	bot.HistoryTurns = *history_turns
+	bot.SessionIdleTimeout = *session_idle_timeout
+	bot.Retention = RetentionPolicy{
+		MaxAge:      time.Duration(*retention_days) * RETENTION_DAY,
+		MaxPerUser:  *retention_per_user,
+		AuditMaxAge: time.Duration(*audit_retention_days) * RETENTION_DAY,
+	}
+	bot.GenerationTimeout = *generation_timeout
+	bot.ContextSize = model_context_size
+	if *cache_prompt {
+		bot.PromptCache = NewPromptCache(model_slots)
+	}
+	bot.TokenFooter = *token_footer
+	bot.RepeatWindow, bot.RepeatSimilarity = *repeat_window, *repeat_similarity
+	bot.QueueNoticeDepth = *queue_notice_depth
+	burst, err := NewBurstGuard(*burst_limit, *burst_window, *burst_cooldown, *burst_mode)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bot.Burst = burst
+	bot.StreamTokens = *stream_tokens
+	bot.StreamInterval = *stream_interval
+	bot.ModelLanguage = *model_language
+	bot.Locale = normalizeLocale(*locale)
+	bot.DryRun = *dry_run
+	bot.Name = *bot_name
+	bot.Dedup.Window = *dedup_window
+	channels, err := OpenChannelConfigStore(*channels_path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bot.Channels = channels
+	if *profanity_path != "" {
+		bot.Profanity, err = LoadProfanityFilter(*profanity_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.ProfanitySeverity, err = parseProfanitySeverity(*profanity_default)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bot.Privacy, err = OpenPrivacyStore(*optout_path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *translate_provider != "" {
+		bot.Translator, err = NewTranslator(*translate_provider, *translate_url, *translate_api_key, func(prompt string) (string, error) {
+			return bot.Generate(Message{User: "translator"}, prompt)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.Catalog, err = LoadMessageCatalog(*locales_dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *triggers_path != "" {
+		bot.Triggers, err = LoadTriggerEngine(*triggers_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *experiment_path != "" {
+		bot.Experiment, err = LoadExperiment(*experiment_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.Permissions = NewPermissionPolicy()
+	bot.Permissions.Grant(PERMISSION_OWNER, *owner_users, *owner_roles)
+	bot.Permissions.Grant(PERMISSION_ADMIN, *admin_users, *admin_roles)
+	bot.Permissions.Grant(PERMISSION_MODERATOR, *moderator_users, *moderator_roles)
+	if *audit_path != "" {
+		bot.Audit, err = OpenAuditLog(*audit_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *search_path != "" {
+		bot.Search, err = OpenMessageIndex(*search_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *journal_path != "" {
+		bot.Journal, err = OpenMessageJournal(*journal_path, bot.Dedup.Window)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.Breaker = NewCircuitBreaker(*breaker_threshold, *breaker_cooldown)
+	bot.CodeBlocks = *code_blocks
+	if *fallback_path != "" {
+		bot.FallbackReplies, err = LoadFallbackReplies(*fallback_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *fast_model != "" || *fast_backend != "" {
+		bot.FastPath = &FastPath{Model: *fast_model}
+		if *fast_backend != "" {
+			bot.FastPath.Backend, err = ParseBackendAddress(*fast_backend)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	if *unfurl {
+		bot.Unfurler = NewLinkUnfurler(*unfurl_allow, *unfurl_deny, *unfurl_timeout, *unfurl_max_bytes)
+	}
+	if *stickers_path != "" {
+		bot.Stickers, err = LoadStickers(*stickers_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *session_archive_path != "" {
+		bot.SessionArchive, err = OpenSessionArchive(*session_archive_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *feedback_path != "" {
+		bot.Feedback, err = OpenFeedbackStore(*feedback_path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.Reload = func() error {
+		// Stores reload in place, so sessions and pending requests are not affected.
+		if bot.Personas != nil {
+			if err := bot.Personas.Reload(); err != nil {
+				return err
+			}
+		}
+		if library != nil {
+			if err := library.Reload(); err != nil {
+				return err
+			}
+		}
+		if bot.Triggers != nil {
+			if err := bot.Triggers.Reload(); err != nil {
+				return err
+			}
+		}
+		if bot.Experiment != nil {
+			if err := bot.Experiment.Reload(); err != nil {
+				return err
+			}
+		}
+		if err := bot.Catalog.Reload(); err != nil {
+			return err
+		}
+		return bot.Channels.Reload()
+	}
+
+	// Reload the configuration on SIGHUP.
+	reload_signal := make(chan os.Signal, 1)
+	signal.Notify(reload_signal, syscall.SIGHUP)
+	go func() {
+		for range reload_signal {
+			if err := bot.Reload(); err != nil {
+				log.Println("reload failed:", err)
+			} else {
+				log.Println("configuration reloaded")
+			}
+		}
+	}()
+	if *sd_url != "" {
+		bot.Images = NewImageJobQueue(NewStableDiffusionClient(*sd_url))
+	}
+	switch *meme_backend {
+	case MEME_BACKEND_LOCAL:
+		if library != nil {
+			renderer, err := NewMemeRenderer(*font_path)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			bot.MemeMaker = &LocalMemeMaker{Library: library, Renderer: renderer}
+		}
+	case MEME_BACKEND_IMGFLIP:
+		if *imgflip_username == "" || *imgflip_password == "" {
+			log.Fatalln("the imgflip meme backend needs -imgflip-username and -imgflip-password")
+		}
+		bot.MemeMaker = NewImgflipClient(*imgflip_username, *imgflip_password)
+	default:
+		log.Fatalf("invalid -meme-backend %q, expected %s or %s\n", *meme_backend, MEME_BACKEND_LOCAL, MEME_BACKEND_IMGFLIP)
+	}
+	if *whisper_url != "" {
+		bot.Transcriber = NewTranscriptionClient(*whisper_url, *whisper_model)
+	}
+	if *tts_url != "" {
+		bot.Speech = NewSpeechClient(*tts_url, "", *tts_voice)
+	}
+	message_limit, err := ParseMessageLimit(*message_limit_flag)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bot.MessageLimit, bot.AttachLongReplies = message_limit, *attach_long
+	if *paste_url != "" {
+		bot.Paste = NewPasteClient(*paste_url, *paste_field)
+	}
+	console := OpenConsole()
+	var highlight bool
+	switch *color {
+	case "auto":
+		highlight = console.ANSI && colorTerminal()
+	case "always":
+		highlight = true
+	case "never":
+	default:
+		log.Fatalf("invalid -color %q, expected auto, always or never\n", *color)
+	}
+
+	// The frontends, sharing the bot. The first one gets the posts to the channels no frontend has heard from.
+	supervisor := NewSupervisor(bot)
+	for _, name := range strings.Split(*frontends_flag, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "cli":
+			// User cli interaction.
+			// Whoever has the terminal runs the bot, so they get the owner role.
+			cli := &CliFrontend{Console: console, User: os.Getenv("USER"), Roles: []string{OWNER_ROLE},
+				MediaDir: *image_dir, Limit: message_limit, Highlight: highlight, Stream: *stream}
+			cli.RegisterCommands(bot.Commands, func() bool { return bot.Transcriber != nil })
+			err = supervisor.Add(name, cli)
+		default:
+			err = fmt.Errorf("unknown frontend %q, expected cli", name)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	bot.Post, bot.Status, bot.ClearStatus = supervisor.Post, supervisor.Status, supervisor.ClearStatus
+
+	// Answer the messages left unanswered by the previous run.
+	go bot.ResumePending()
 
-		// Set the prompt
-		param_with_prompt := param_template.SetPrompt(FormatPrompt(user_input))
+	// Clear the idle conversations.
+	go bot.ExpireSessions(ctx)
 
-		// Send the prompt to the model
-		param_with_prompt_queue <- param_with_prompt
+	// Delete what the retention policy no longer keeps.
+	go bot.RunJanitor(ctx, *janitor_interval)
 
-		// Get the model response
-		response := <-model_response_queue
+	// Keep the model loaded.
+	if *warm_up {
+		go func() {
+			if err := bot.WarmUp(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	go bot.KeepAlive(ctx, *keep_alive)
+
+	// Post the scheduled content.
+	if *schedules_path != "" {
+		scheduler, err := LoadScheduler(*schedules_path, bot)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go scheduler.Run(ctx)
 
-		// Print the model response
-		fmt.Println("Model:", response)
+		reload := bot.Reload
+		bot.Reload = func() error {
+			if err := reload(); err != nil {
+				return err
+			}
+			return scheduler.Reload()
+		}
 	}
+
+	// Report what this instance uses, once, and for `/about`.
+	report := NewStartupReport(flag.CommandLine, sources)
+	report.Backend = []string{fmt.Sprintf("http://%s:%d/%s", server, port, endpoint), backend_kind}
+	if hedge != nil {
+		report.Backend = append(report.Backend, fmt.Sprintf("raced against %s after %s", *hedge_backend, *hedge_delay))
+	}
+	if bot.FastPath != nil {
+		report.Backend = append(report.Backend, fmt.Sprintf("fast path on %q", bot.FastPath.Model))
+	}
+	if *cassette_path != "" {
+		report.Backend = append(report.Backend, fmt.Sprintf("%s from the cassette %s", *cassette_mode, *cassette_path))
+	}
+	if bot.DryRun {
+		report.Backend = append(report.Backend, "dry run")
+	}
+	report.Model, report.ChatTemplate = bot.ParamTemplate.ModelName, DefaultChatTemplateName
+	report.Frontends, report.Plugins = supervisor.names, bot.Plugins()
+	if *schedules_path != "" {
+		report.Plugins = append(report.Plugins, "scheduler")
+	}
+	bot.About = report
+	log.Printf("startup report:\n%s\n", report)
+
+	supervisor.Run(ctx)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"  // Register the GIF decoder for templates.
+	_ "image/jpeg" // Register the JPEG decoder for templates.
+	"image/png"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const MEME_MAX_LINES = 3        // Maximum lines per caption box before the text is shrunk.
+const MEME_MARGIN_RATIO = 0.04  // Margin around the captions, relative to the image width.
+const MEME_STROKE_RATIO = 0.035 // Outline width, relative to the font size.
+
+var caption_top_pattern = regexp.MustCompile(`(?im)^\s*top(?:\s*text)?\s*:\s*(.*)$`)
+var caption_bottom_pattern = regexp.MustCompile(`(?im)^\s*bottom(?:\s*text)?\s*:\s*(.*)$`)
+
+type MemeCaption struct {
+	TopText    string `json:"top_text"`
+	BottomText string `json:"bottom_text"`
+}
+
+// # Parse meme caption
+//
+// This function extracts the caption from the model output.
+// The model is expected to answer with `TOP: ...` and `BOTTOM: ...` lines;
+// otherwise the first line becomes the top text and the rest the bottom text.
+func ParseMemeCaption(model_output string) MemeCaption {
+	top := caption_top_pattern.FindStringSubmatch(model_output)
+	bottom := caption_bottom_pattern.FindStringSubmatch(model_output)
+	if top != nil || bottom != nil {
+		var caption MemeCaption
+		if top != nil {
+			caption.TopText = strings.TrimSpace(top[1])
+		}
+		if bottom != nil {
+			caption.BottomText = strings.TrimSpace(bottom[1])
+		}
+		return caption
+	}
+
+	first, rest, _ := strings.Cut(strings.TrimSpace(model_output), "\n")
+	return MemeCaption{TopText: strings.TrimSpace(first), BottomText: strings.TrimSpace(strings.ReplaceAll(rest, "\n", " "))}
+}
+
+// # Meme renderer
+//
+// This struct renders image macros: white, black-outlined, upper-case captions
+// on top of a template image, in the style of the classic Impact memes.
+type MemeRenderer struct {
+	font *opentype.Font
+}
+
+// # Create a new meme renderer
+//
+// This function loads the TrueType/OpenType font at `font_path` (e.g. `impact.ttf`).
+// If the path is empty, the bundled Go Bold font is used instead.
+func NewMemeRenderer(font_path string) (*MemeRenderer, error) {
+	font_data := gobold.TTF
+	if font_path != "" {
+		data, err := os.ReadFile(font_path)
+		if err != nil {
+			return nil, err
+		}
+		font_data = data
+	}
+
+	parsed, err := opentype.Parse(font_data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse font: %w", err)
+	}
+	return &MemeRenderer{font: parsed}, nil
+}
+
+// # Load template image
+//
+// This function decodes a PNG, JPEG or GIF template image.
+func LoadTemplateImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	template_image, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", path, err)
+	}
+	return template_image, nil
+}
+
+// # Meme text box
+//
+// This struct describes where a caption goes on a template.
+// Positions and sizes are relative to the image size (0 to 1), so they survive resizing the template.
+type MemeTextBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Align  string  `json:"align,omitempty"` // Vertical alignment: "top", "middle" (default) or "bottom".
+}
+
+// # Text box is inside
+//
+// This function reports whether the box has an area and lies within the image, rounding errors of the fractions aside.
+func (box MemeTextBox) Inside() bool {
+	const epsilon = 1e-9
+	return box.X >= 0 && box.Y >= 0 && box.Width > 0 && box.Height > 0 &&
+		box.X+box.Width <= 1+epsilon && box.Y+box.Height <= 1+epsilon
+}
+
+// The classic layout: top text in the upper third, bottom text in the lower third.
+var DefaultMemeTextBoxes = []MemeTextBox{
+	{X: MEME_MARGIN_RATIO, Y: MEME_MARGIN_RATIO, Width: 1 - 2*MEME_MARGIN_RATIO, Height: 1.0/3 - MEME_MARGIN_RATIO, Align: "top"},
+	{X: MEME_MARGIN_RATIO, Y: 2.0 / 3, Width: 1 - 2*MEME_MARGIN_RATIO, Height: 1.0/3 - MEME_MARGIN_RATIO, Align: "bottom"},
+}
+
+// # Render meme
+//
+// This function draws the caption on a copy of the template image and returns the result as PNG.
+func (renderer *MemeRenderer) Render(template_image image.Image, caption MemeCaption) ([]byte, error) {
+	return renderer.RenderBoxes(template_image, DefaultMemeTextBoxes, []string{caption.TopText, caption.BottomText})
+}
+
+// # Render meme into text boxes
+//
+// This function draws `texts[i]` into `boxes[i]` on a copy of the template image and returns the result as PNG.
+// Extra texts without a box are ignored.
+func (renderer *MemeRenderer) RenderBoxes(template_image image.Image, boxes []MemeTextBox, texts []string) ([]byte, error) {
+	bounds := template_image.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), template_image, bounds.Min, draw.Src)
+
+	for i, box := range boxes {
+		if i >= len(texts) {
+			break
+		}
+		if err := renderer.drawCaption(canvas, texts[i], box); err != nil {
+			return nil, err
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, canvas); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// # Draw caption
+//
+// This function draws a single caption into a text box.
+// The font starts at a sixth of the image height and shrinks until every word fits the width of the box,
+// then until the wrapped text fits the box. Words are only broken when they don't fit even at the smallest size.
+func (renderer *MemeRenderer) drawCaption(canvas *image.RGBA, text string, box MemeTextBox) error {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	if text == "" {
+		return nil
+	}
+
+	canvas_width := float64(canvas.Bounds().Dx())
+	canvas_height := float64(canvas.Bounds().Dy())
+	left := int(box.X * canvas_width)
+	top := int(box.Y * canvas_height)
+	width := int(box.Width * canvas_width)
+	height := int(box.Height * canvas_height)
+	size := min(canvas_height/6, float64(height))
+
+	var face font.Face
+	var lines []string
+	for {
+		var err error
+		face, err = opentype.NewFace(renderer.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return err
+		}
+
+		if size > 8 && !wordsFit(face, text, width) {
+			face.Close()
+			size *= 0.9
+			continue
+		}
+		lines = wrapText(face, text, width)
+		line_height := face.Metrics().Height.Ceil()
+		if (len(lines) <= MEME_MAX_LINES && len(lines)*line_height <= height) || size <= 8 {
+			break
+		}
+		face.Close()
+		size *= 0.9
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	line_height := metrics.Height.Ceil()
+	text_height := len(lines) * line_height
+	y := top + metrics.Ascent.Ceil()
+	switch box.Align {
+	case "top":
+	case "bottom":
+		y += height - text_height
+	default:
+		y += (height - text_height) / 2
+	}
+
+	stroke := max(1, int(size*MEME_STROKE_RATIO))
+	for _, line := range lines {
+		line_width := font.MeasureString(face, line).Ceil()
+		x := left + (width-line_width)/2
+		drawStrokedString(canvas, face, line, x, y, stroke)
+		y += line_height
+	}
+	return nil
+}
+
+// # Words fit
+//
+// This function reports whether every word of the text fits on a line `width` pixels wide.
+func wordsFit(face font.Face, text string, width int) bool {
+	for _, word := range strings.Fields(text) {
+		if font.MeasureString(face, word).Ceil() > width {
+			return false
+		}
+	}
+	return true
+}
+
+// # Wrap text
+//
+// This function splits the text into lines no wider than `width` pixels.
+// Words are kept whole unless a single word is wider than a line, which is
+// also what happens to CJK text without spaces. A line gets at least one character, even one wider than `width`.
+func wrapText(face font.Face, text string, width int) []string {
+	fits := func(line string) bool {
+		return font.MeasureString(face, line).Ceil() <= width
+	}
+
+	var lines []string
+	current := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if current != "" {
+			candidate = current + " " + word
+		}
+		if fits(candidate) {
+			current = candidate
+			continue
+		}
+		if current != "" {
+			lines = append(lines, current)
+			current = ""
+		}
+
+		// Break words which don't fit on a line by themselves.
+		for !fits(word) {
+			runes := []rune(word)
+			cut := len(runes) - 1
+			for cut > 1 && !fits(string(runes[:cut])) {
+				cut--
+			}
+			cut = max(cut, 1)
+			lines = append(lines, string(runes[:cut]))
+			word = string(runes[cut:])
+		}
+		current = word
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// # Draw stroked string
+//
+// This function draws white text with a black outline, by stamping the text in black
+// around the baseline position before drawing it in white on top.
+func drawStrokedString(canvas *image.RGBA, face font.Face, text string, x int, y int, stroke int) {
+	drawer := font.Drawer{Dst: canvas, Face: face, Src: image.NewUniform(color.Black)}
+	for dy := -stroke; dy <= stroke; dy++ {
+		for dx := -stroke; dx <= stroke; dx++ {
+			if dx*dx+dy*dy > stroke*stroke {
+				continue
+			}
+			drawer.Dot = fixed.P(x+dx, y+dy)
+			drawer.DrawString(text)
+		}
+	}
+
+	drawer.Src = image.NewUniform(color.White)
+	drawer.Dot = fixed.P(x, y)
+	drawer.DrawString(text)
+}
+
+// # Caption command
+//
+// This function handles the `caption` subcommand, which renders a caption onto a template.
+// The template is either the name of a library template, which gets one text per text box,
+// or the path of an image, which gets the classic top and bottom texts.
+//
+// Usage:
+//
+// - caption <template name|image> <output png> <text>...
+func runCaptionCommand(library *MemeTemplateLibrary, font_path string, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: caption <template name|image> <output png> <text>...")
+	}
+
+	renderer, err := NewMemeRenderer(font_path)
+	if err != nil {
+		return err
+	}
+
+	var rendered []byte
+	if meme_template, found := library.Find(args[0]); found {
+		rendered, err = library.Render(renderer, meme_template, args[2:])
+	} else {
+		var template_image image.Image
+		template_image, err = LoadTemplateImage(args[0])
+		if err != nil {
+			return err
+		}
+
+		caption := MemeCaption{TopText: args[2]}
+		if len(args) > 3 {
+			caption.BottomText = strings.Join(args[3:], " ")
+		}
+		rendered, err = renderer.Render(template_image, caption)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(args[1], rendered, 0644)
+}
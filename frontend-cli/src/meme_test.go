@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+)
+
+func TestWrapText(t *testing.T) {
+	renderer, err := NewMemeRenderer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	face, err := opentype.NewFace(renderer.font, &opentype.FaceOptions{Size: 40, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer face.Close()
+	glyph := font.MeasureString(face, "W").Ceil()
+
+	tests := []struct {
+		name  string
+		text  string
+		width int
+		want  int // Lines.
+	}{
+		{"empty", "", 400, 0},
+		{"one line", "ONE DOES NOT", 1000, 1},
+		{"words", "ONE DOES NOT SIMPLY WALK INTO MORDOR", 300, 4},
+		{"long word", strings.Repeat("W", 20), 5 * glyph, 4},
+		{"CJK without spaces", strings.Repeat("梗", 12), 5 * glyph, 2},
+		{"glyph wider than the line", "WOW", glyph / 2, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := wrapText(face, test.text, test.width)
+			if len(lines) != test.want {
+				t.Errorf("wrapText(%q, %d) = %q, want %d lines", test.text, test.width, lines, test.want)
+			}
+			if joined := strings.Join(lines, ""); strings.ReplaceAll(joined, " ", "") != strings.ReplaceAll(test.text, " ", "") {
+				t.Errorf("wrapText(%q, %d) lost text: %q", test.text, test.width, lines)
+			}
+			for _, line := range lines {
+				if len([]rune(line)) > 1 && font.MeasureString(face, line).Ceil() > test.width {
+					t.Errorf("line %q is wider than %d", line, test.width)
+				}
+			}
+		})
+	}
+}
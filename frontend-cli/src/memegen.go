@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const MEME_PROMPT = `Make a funny meme about: %s
+
+Pick the template that fits best, and write the text of each of its boxes, short and punchy.
+Templates, with their number of text boxes:
+%s
+
+Answer with JSON: {"template": "<name>", "texts": ["<text of box 1>", ...]}`
+
+const (
+	MEME_MAX_CANDIDATES = 20  // Templates offered to the model, the ones matching the topic first.
+	MEME_MAX_TOKENS     = 160 // Enough for the JSON of a few boxes.
+)
+
+// # Meme choice
+//
+// This struct is the answer of the model to the meme prompt: a template of the library, and the texts of its boxes.
+type MemeChoice struct {
+	Template string   `json:"template"`
+	Texts    []string `json:"texts"`
+}
+
+// # Meme choice grammar
+//
+// This function returns a GBNF grammar constraining the generation to the JSON of a `MemeChoice` of the templates.
+func MemeChoiceGrammar(templates []MemeTemplate) string {
+	names := make([]string, len(templates))
+	for i, meme_template := range templates {
+		name, _ := json.Marshal(meme_template.Name)
+		names[i] = strconv.Quote(string(name))
+	}
+	return strings.Join([]string{
+		`root ::= "{" ws "\"template\":" ws template "," ws "\"texts\":" ws "[" ws text (ws "," ws text)* ws "]" ws "}"`,
+		`template ::= ` + strings.Join(names, " | "),
+		`text ::= "\"" ([^"\\\n] | "\\" ["\\/nt])* "\""`,
+		`ws ::= [ \t\n]*`,
+	}, "\n")
+}
+
+// # Meme candidates
+//
+// This function returns the templates offered to the model, once each, in the order of the meme maker: the ones matching the topic,
+// then the others, at most `MEME_MAX_CANDIDATES`.
+func memeCandidates(templates []MemeTemplate) []MemeTemplate {
+	var candidates []MemeTemplate
+	offered := map[string]bool{}
+	for _, meme_template := range templates {
+		if len(candidates) == MEME_MAX_CANDIDATES {
+			break
+		}
+		if !offered[meme_template.Name] {
+			offered[meme_template.Name] = true
+			candidates = append(candidates, meme_template)
+		}
+	}
+	return candidates
+}
+
+// # Decode meme choice
+//
+// This function decodes the JSON object of the model output, with its texts trimmed and the empty ones dropped.
+func decodeMemeChoice(model_output string) (MemeChoice, error) {
+	start, end := strings.Index(model_output, "{"), strings.LastIndex(model_output, "}")
+	if start < 0 || end < start {
+		return MemeChoice{}, fmt.Errorf("no JSON in the meme choice %q", model_output)
+	}
+	var choice MemeChoice
+	if err := json.Unmarshal([]byte(model_output[start:end+1]), &choice); err != nil {
+		return MemeChoice{}, fmt.Errorf("invalid meme choice %q: %w", model_output, err)
+	}
+	choice.Texts = nonEmptyTexts(choice.Texts)
+	return choice, nil
+}
+
+func nonEmptyTexts(texts []string) []string {
+	var kept []string
+	for _, text := range texts {
+		if text = strings.TrimSpace(text); text != "" {
+			kept = append(kept, text)
+		}
+	}
+	return kept
+}
+
+// # Parse meme choice
+//
+// This function reads the choice of the model, checking the template is one of the candidates and has texts.
+func parseMemeChoice(candidates []MemeTemplate, model_output string) (MemeTemplate, []string, error) {
+	choice, err := decodeMemeChoice(model_output)
+	if err != nil {
+		return MemeTemplate{}, nil, err
+	}
+	var meme_template MemeTemplate
+	for _, candidate := range candidates {
+		if strings.EqualFold(candidate.Name, choice.Template) {
+			meme_template = candidate
+		}
+	}
+	if meme_template.Name == "" {
+		return MemeTemplate{}, nil, fmt.Errorf("the model picked the unknown template %q", choice.Template)
+	}
+	if len(choice.Texts) == 0 {
+		return MemeTemplate{}, nil, errors.New("the model wrote no meme text")
+	}
+	return meme_template, choice.Texts, nil
+}
+
+// # Make meme
+//
+// This function makes a meme about the topic in two passes: the model picks a template of the meme maker and writes its texts,
+// constrained to JSON, then the meme maker draws them on the template, locally or with Imgflip. When the model fails or its choice
+// is unusable, a random template gets the texts the model wrote, as top and bottom texts, or the topic.
+// Memes hosted by the meme maker are answered with their link.
+func (bot *Bot) makeMeme(message Message, topic string) Reply {
+	if bot.MemeMaker == nil {
+		return Reply{Text: bot.T(message, "Meme templates are disabled.")}
+	}
+	templates, err := bot.MemeMaker.MemeTemplates(topic)
+	if err != nil {
+		log.Println(fmt.Errorf("meme templates: %w", err))
+		return Reply{Text: bot.T(message, "Sorry, I couldn't make that meme.")}
+	}
+	if len(templates) == 0 {
+		log.Printf("no meme templates for %q\n", topic)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't make that meme.")}
+	}
+
+	// Pass 1: the template and the texts.
+	candidates := memeCandidates(templates)
+	lines := make([]string, len(candidates))
+	for i, meme_template := range candidates {
+		lines[i] = fmt.Sprintf("- %s (%d boxes): %s", meme_template.Name, len(meme_template.TextBoxes()), meme_template.Description)
+	}
+	params := bot.Params().SetPrompt(FormatPrompt(fmt.Sprintf(MEME_PROMPT, topic, strings.Join(lines, "\n"))))
+	params.Grammar = MemeChoiceGrammar(candidates)
+	params.MaxTokens = MEME_MAX_TOKENS
+
+	message.OnPartialReply = nil
+	response, err := bot.generate(message, params)
+	meme_template, texts := MemeTemplate{}, []string(nil)
+	if err == nil {
+		meme_template, texts, err = parseMemeChoice(candidates, response)
+	}
+	if err != nil {
+		log.Println(fmt.Errorf("meme about %q, falling back to a random template: %w", topic, err))
+		meme_template, texts = candidates[rand.Intn(len(candidates))], fallbackMemeTexts(response, topic)
+	}
+	texts = texts[:min(len(texts), len(meme_template.TextBoxes()))]
+
+	// Pass 2: the image.
+	result, err := bot.MemeMaker.MakeMeme(meme_template.Name, texts)
+	if err != nil {
+		log.Println(err)
+		return Reply{Text: bot.T(message, "Sorry, I couldn't make that meme.")}
+	}
+	text := strings.Join(texts, " / ")
+	if result.Image == nil && result.Url != "" {
+		text += "\n" + result.Url
+	}
+	return Reply{Text: text, Image: result.Image}
+}
+
+// # Fallback meme texts
+//
+// This function returns the texts of a meme the model failed to choose: the texts of its choice if it wrote some,
+// its top and bottom texts if it wrote plain text, or the topic.
+func fallbackMemeTexts(model_output string, topic string) []string {
+	var texts []string
+	if choice, err := decodeMemeChoice(model_output); err == nil {
+		texts = choice.Texts
+	} else if !strings.Contains(model_output, "{") {
+		caption := ParseMemeCaption(model_output)
+		texts = nonEmptyTexts([]string{caption.TopText, caption.BottomText})
+	}
+	if len(texts) == 0 {
+		return []string{topic}
+	}
+	return texts
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const MEME_SPEAK_OFF = "off" // Turns the effects of the channel off for a message.
+
+const MEME_SPEAK_EMOJI_PROBABILITY = 0.5 // Chance of an emoji after each sentence.
+
+// Emoji sprinkled over the replies.
+var MemeSpeakEmojis = []string{"😂", "🤣", "💀", "🔥", "😭", "✨", "💯", "🙏", "😎", "👀", "🤡", "🚀"}
+
+// Meme-speak effects on the letters, by name. The decorations of `owo` and `emoji` are added once to the whole reply.
+var MemeSpeakEffects = map[string]func(text string) string{
+	"caps":      strings.ToUpper,
+	"spongebob": spongebobCase,
+	"owo":       owoify,
+	"emoji":     func(text string) string { return text },
+}
+
+var (
+	owo_vowel_pattern    = regexp.MustCompile(`([nN])([aeiouAEIOU])`)
+	sentence_end_pattern = regexp.MustCompile(`([.!?])(\s|$)`)
+)
+
+var owo_faces = []string{"owo", "uwu", ">w<", "^w^"}
+
+// # SpongeBob case
+//
+// This function alternates the case of the letters, starting lower: `sPoNgEbOb`.
+func spongebobCase(text string) string {
+	var spongebob strings.Builder
+	upper := false
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			if upper {
+				r = unicode.ToUpper(r)
+			} else {
+				r = unicode.ToLower(r)
+			}
+			upper = !upper
+		}
+		spongebob.WriteRune(r)
+	}
+	return spongebob.String()
+}
+
+// # OwO-ify
+//
+// This function turns `r` and `l` into `w`, and `na` into `nya`.
+func owoify(text string) string {
+	text = strings.NewReplacer("r", "w", "l", "w", "R", "W", "L", "W").Replace(text)
+	return owo_vowel_pattern.ReplaceAllStringFunc(text, func(syllable string) string {
+		if unicode.IsUpper(rune(syllable[1])) {
+			return syllable[:1] + "Y" + syllable[1:]
+		}
+		return syllable[:1] + "y" + syllable[1:]
+	})
+}
+
+// # Sprinkle emoji
+//
+// This function puts emoji after some sentences, and always one at the end.
+func sprinkleEmoji(text string) string {
+	text = sentence_end_pattern.ReplaceAllStringFunc(text, func(end string) string {
+		if rand.Float64() >= MEME_SPEAK_EMOJI_PROBABILITY {
+			return end
+		}
+		return end[:1] + " " + MemeSpeakEmojis[rand.Intn(len(MemeSpeakEmojis))] + end[1:]
+	})
+	if strings.TrimSpace(text) == "" {
+		return text
+	}
+	return text + " " + MemeSpeakEmojis[rand.Intn(len(MemeSpeakEmojis))]
+}
+
+// # Parse meme-speak effects
+//
+// This function checks a comma-separated list of effects, e.g. `caps,emoji`. Empty stands for none, `off` for none either,
+// overriding the effects of the channel.
+func parseMemeSpeak(value string) (string, error) {
+	value = strings.ToLower(strings.ReplaceAll(value, " ", ""))
+	if value == "" || value == MEME_SPEAK_OFF {
+		return value, nil
+	}
+	for _, effect := range strings.Split(value, ",") {
+		if MemeSpeakEffects[effect] == nil {
+			return "", fmt.Errorf("unknown meme-speak effect %q, expected %s, a comma-separated list of %s", effect, MEME_SPEAK_OFF, strings.Join(memeSpeakNames(), ", "))
+		}
+	}
+	return value, nil
+}
+
+// # Meme-speak effect names
+//
+// This function returns the names of the effects, in the order they are applied.
+func memeSpeakNames() []string {
+	return []string{"caps", "spongebob", "owo", "emoji"}
+}
+
+// # Apply meme speak
+//
+// This function applies the effects of the list to the text, in a fixed order so `caps` and `spongebob` don't undo `owo`.
+// Code blocks and links are left alone.
+func ApplyMemeSpeak(text string, effects string) string {
+	if effects == "" || effects == MEME_SPEAK_OFF {
+		return text
+	}
+	selected := map[string]bool{}
+	for _, effect := range strings.Split(effects, ",") {
+		selected[effect] = true
+	}
+
+	transform := func(prose string) string {
+		links := url_pattern.FindAllString(prose, -1)
+		parts := url_pattern.Split(prose, -1)
+		for i := range parts {
+			for _, name := range memeSpeakNames() {
+				if selected[name] {
+					parts[i] = MemeSpeakEffects[name](parts[i])
+				}
+			}
+		}
+		prose = parts[0]
+		for i, link := range links {
+			prose += link + parts[i+1]
+		}
+		if selected["emoji"] {
+			prose = sprinkleEmoji(prose)
+		}
+		if selected["owo"] && strings.TrimSpace(prose) != "" {
+			prose += " " + owo_faces[rand.Intn(len(owo_faces))]
+		}
+		return prose
+	}
+
+	// Transform the prose between the code blocks.
+	var transformed, prose []string
+	in_code := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE) {
+			if !in_code && len(prose) > 0 {
+				transformed = append(transformed, transform(strings.Join(prose, "\n")))
+				prose = nil
+			}
+			in_code = !in_code
+			transformed = append(transformed, line)
+			continue
+		}
+		if in_code {
+			transformed = append(transformed, line)
+		} else {
+			prose = append(prose, line)
+		}
+	}
+	if len(prose) > 0 {
+		transformed = append(transformed, transform(strings.Join(prose, "\n")))
+	}
+	return strings.Join(transformed, "\n")
+}
+
+// # Meme speak of the message
+//
+// This function returns the effects applied to the reply to the message: the ones asked with the message, or the channel's.
+func (bot *Bot) memeSpeak(message Message) string {
+	if message.Overrides != nil && message.Overrides.MemeSpeak != "" {
+		return message.Overrides.MemeSpeak
+	}
+	return bot.Channels.Get(message.Channel).MemeSpeak
+}
+
+// # Meme command
+//
+// This function handles the `/meme` command: `/meme <effects> <text>` answers the text with meme-speak effects,
+// e.g. `/meme spongebob hi`, and `/meme <topic>` makes a meme image about the topic.
+func (bot *Bot) memeReply(message Message, args string) Reply {
+	first, text, _ := strings.Cut(args, " ")
+	effects, err := parseMemeSpeak(first)
+	if err != nil {
+		return bot.makeMeme(message, args)
+	}
+	if strings.TrimSpace(text) == "" {
+		return Reply{Text: bot.T(message, "Usage: %s", "/meme ["+strings.Join(memeSpeakNames(), "|")+"] <text>")}
+	}
+	return bot.chatOverridden(message, strings.TrimSpace(text), RequestOverrides{MemeSpeak: effects})
+}
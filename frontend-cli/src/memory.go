@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MEMORY_PROMPT_HEADER = "Things you remember from earlier conversations:"
+
+const (
+	MEMORY_KIND_EXCHANGE = "exchange"
+	MEMORY_KIND_FACT     = "fact"
+)
+
+type MemoryEntry struct {
+	ID      int       `json:"id"`
+	Kind    string    `json:"kind"`
+	Text    string    `json:"text"`
+	Vector  []float64 `json:"vector"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user,omitempty"`    // Platform ID of the user the memory comes from, empty when unknown.
+	Channel string    `json:"channel,omitempty"` // Channel the memory comes from, empty when unknown.
+}
+
+// # Recallable
+//
+// This function reports whether the entry may be recalled for the user in the channel: the knowledge base is shared,
+// except the documents added for one channel, and the memories of a conversation stay in its channel.
+// With `cross_channel`, the memories of the user in other channels, e.g. their direct messages, are recalled too.
+func (entry MemoryEntry) Recallable(channel string, user string, cross_channel bool) bool {
+	if (entry.Kind == MEMORY_KIND_KB && entry.Channel == "") || (entry.Channel != "" && entry.Channel == channel) {
+		return true
+	}
+	return cross_channel && entry.User != "" && entry.User == user
+}
+
+type ScoredMemory struct {
+	MemoryEntry
+	Score float64
+}
+
+// # Vector store
+//
+// This struct is a small append-only vector store backed by a JSON lines file.
+// All entries are kept in memory and searched by brute force, which is plenty
+// for the amount of exchanges a chat bot accumulates.
+type VectorStore struct {
+	path    string
+	mu      sync.Mutex
+	entries []MemoryEntry
+	next_id int
+}
+
+// # Open vector store
+//
+// This function loads the vector store from `path`, creating an empty store if the file doesn't exist.
+func OpenVectorStore(path string) (*VectorStore, error) {
+	store := &VectorStore{path: path, next_id: 1}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024) // Vectors make for long lines.
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry MemoryEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("corrupted vector store %s: %w", path, err)
+		}
+		store.entries = append(store.entries, entry)
+		if entry.ID >= store.next_id {
+			store.next_id = entry.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// # Add entry
+//
+// This function assigns an ID to the entry, appends it to the store file and keeps it in memory.
+func (store *VectorStore) Add(entry MemoryEntry) (MemoryEntry, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry.ID = store.next_id
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+
+	file, err := os.OpenFile(store.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return entry, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return entry, err
+	}
+
+	store.next_id++
+	store.entries = append(store.entries, entry)
+	return entry, nil
+}
+
+// # Search
+//
+// This function returns the `k` entries `keep` accepts most similar to `vector`, best match first.
+func (store *VectorStore) Search(vector []float64, k int, keep func(entry MemoryEntry) bool) []ScoredMemory {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	scored := make([]ScoredMemory, 0, len(store.entries))
+	for _, entry := range store.entries {
+		if keep(entry) {
+			scored = append(scored, ScoredMemory{MemoryEntry: entry, Score: CosineSimilarity(vector, entry.Vector)})
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+
+	if k < len(scored) {
+		scored = scored[:k]
+	}
+	return scored
+}
+
+// # Forget user
+//
+// This function drops the entries of the user. It returns how many entries were dropped.
+func (store *VectorStore) ForgetUser(user string) (int, error) {
+	return store.Prune(func(entry MemoryEntry) bool { return entry.User != user })
+}
+
+// # Prune
+//
+// This function drops the entries `keep` rejects and rewrites the store file without them.
+// It returns how many entries were dropped.
+func (store *VectorStore) Prune(keep func(entry MemoryEntry) bool) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var kept []MemoryEntry
+	for _, entry := range store.entries {
+		if keep(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	forgotten := len(store.entries) - len(kept)
+	if forgotten == 0 {
+		return 0, nil
+	}
+	if err := rewriteJSONLines(store.path, kept); err != nil {
+		return 0, err
+	}
+	store.entries = kept
+	return forgotten, nil
+}
+
+// # Size
+//
+// This function returns the number of entries in the store.
+func (store *VectorStore) Size() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.entries)
+}
+
+// # Cosine similarity
+//
+// This function returns the cosine similarity of two vectors.
+// Vectors of different length (e.g. produced by another model) are treated as unrelated.
+func CosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, norm_a, norm_b float64
+	for i := range a {
+		dot += a[i] * b[i]
+		norm_a += a[i] * a[i]
+		norm_b += b[i] * b[i]
+	}
+	if norm_a == 0 || norm_b == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(norm_a) * math.Sqrt(norm_b))
+}
+
+// # Long-term memory
+//
+// This struct ties the embeddings client and the vector store together.
+// Past exchanges and user-provided facts are embedded and stored, and the most
+// relevant ones are recalled for every new prompt.
+type LongTermMemory struct {
+	Client       *LlmClient
+	Store        *VectorStore
+	TopK         int     // Number of snippets recalled per prompt.
+	MinScore     float64 // Snippets scoring below this are not recalled.
+	CrossChannel bool    // Recall the memories of the user from the other channels too.
+}
+
+// # Remember
+//
+// This function embeds the text and stores it in the vector store, as coming from the user in the channel.
+func (memory *LongTermMemory) Remember(channel string, user string, kind string, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+
+	vectors, err := memory.Client.Embed(text)
+	if err != nil {
+		return err
+	}
+
+	_, err = memory.Store.Add(MemoryEntry{Kind: kind, Text: text, Vector: vectors[0], User: user, Channel: channel})
+	return err
+}
+
+// # Remember exchange
+//
+// This function stores a user prompt together with the model response.
+func (memory *LongTermMemory) RememberExchange(channel string, user string, user_input string, model_output string) error {
+	return memory.Remember(channel, user, MEMORY_KIND_EXCHANGE, fmt.Sprintf("User: %s\nYou: %s", strings.TrimSpace(user_input), strings.TrimSpace(model_output)))
+}
+
+// # Recall
+//
+// This function returns the snippets most relevant to the prompt of the user in the channel, among the ones they may recall.
+func (memory *LongTermMemory) Recall(channel string, user string, prompt string) ([]string, error) {
+	if memory.Store.Size() == 0 {
+		return nil, nil
+	}
+
+	vectors, err := memory.Client.Embed(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var snippets []string
+	for _, scored := range memory.Store.Search(vectors[0], memory.TopK, func(entry MemoryEntry) bool { return entry.Recallable(channel, user, memory.CrossChannel) }) {
+		if scored.Score < memory.MinScore {
+			break
+		}
+		snippets = append(snippets, scored.Text)
+	}
+	return snippets, nil
+}
+
+// # Inject memories
+//
+// This function prepends the recalled snippets to the user prompt.
+// The chat template has no system turn, so the memories become part of the user turn.
+func InjectMemories(prompt string, memories []string) string {
+	if len(memories) == 0 {
+		return prompt
+	}
+
+	var builder strings.Builder
+	builder.WriteString(MEMORY_PROMPT_HEADER)
+	builder.WriteString("\n")
+	for _, snippet := range memories {
+		builder.WriteString("- ")
+		builder.WriteString(strings.ReplaceAll(snippet, "\n", "\n  "))
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	builder.WriteString(prompt)
+	return builder.String()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// # Display name
+//
+// This function returns the name of the sender shown to the model: the display name when the frontend gives one,
+// the platform ID otherwise.
+func (message Message) DisplayName() string {
+	if message.UserName != "" {
+		return message.UserName
+	}
+	return message.User
+}
+
+// # Resolve mentions
+//
+// This function replaces the platform mentions of the text, e.g. `<@12345>`, by `@` and the display name,
+// so the model reads names instead of raw IDs.
+func ResolveMentions(text string, mentions map[string]string) string {
+	for mention, name := range mentions {
+		text = strings.ReplaceAll(text, mention, "@"+name)
+	}
+	return text
+}
+
+// # Learn members
+//
+// This function remembers the mentions of the message, and the sender's, by lowercase display name,
+// so the replies can mention the members of the channel.
+func (session *Session) LearnMembers(message Message) {
+	if len(message.Mentions) == 0 && message.UserMention == "" {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Members == nil {
+		session.Members = map[string]string{}
+	}
+	for mention, name := range message.Mentions {
+		session.Members[strings.ToLower(name)] = mention
+	}
+	if message.UserMention != "" {
+		session.Members[strings.ToLower(message.DisplayName())] = message.UserMention
+	}
+}
+
+// # Restore mentions
+//
+// This function replaces the `@name` of the known members in the reply by their platform mention,
+// so the platform notifies them. Longer names are matched first, and a name must end where a word ends.
+func RestoreMentions(text string, members map[string]string) string {
+	if len(members) == 0 || !strings.Contains(text, "@") {
+		return text
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	var builder strings.Builder
+	for {
+		at := strings.IndexByte(text, '@')
+		if at < 0 {
+			builder.WriteString(text)
+			return builder.String()
+		}
+		builder.WriteString(text[:at])
+		text = text[at+1:]
+
+		replaced := false
+		for _, name := range names {
+			if len(text) < len(name) || !strings.EqualFold(text[:len(name)], name) {
+				continue
+			}
+			if next, _ := utf8.DecodeRuneInString(text[len(name):]); unicode.IsLetter(next) || unicode.IsNumber(next) {
+				continue
+			}
+			builder.WriteString(members[name])
+			text = text[len(name):]
+			replaced = true
+			break
+		}
+		if !replaced {
+			builder.WriteByte('@')
+		}
+	}
+}
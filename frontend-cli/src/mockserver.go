@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const MOCK_MODEL = "mock"
+
+const MOCK_EMBEDDING_SIZE = 64
+
+const MOCK_CONTEXT_SIZE = 4096
+
+const MOCK_SLOTS = 2
+
+// Jinja chat template reported by `/props`, the one of Gemma models.
+const MOCK_CHAT_TEMPLATE = "{{ bos_token }}{% for message in messages %}<start_of_turn>{{ message['role'] }}\n{{ message['content'] | trim }}<end_of_turn>\n{% endfor %}{% if add_generation_prompt %}<start_of_turn>model\n{% endif %}"
+
+// Replies of the canned mode.
+var MockCannedReplies = []string{
+	"That's the most meme thing I've heard all day.",
+	"Skill issue, honestly.",
+	"Bold of you to assume I know what I'm doing.",
+	"This is fine. Everything is fine.",
+	"Nobody: ... Absolutely nobody: ... Me: this.",
+	"I'm not saying it's aliens, but it's aliens.",
+}
+
+// # Mock backend
+//
+// This struct imitates the llama-cpp-python server, without a model: completions either echo the last user turn
+// or pick a canned reply, and embeddings are derived from a hash of the words, so similar texts stay similar.
+type MockBackend struct {
+	Echo      bool          // Echo the prompt instead of picking canned replies.
+	Canned    []string      // Canned replies.
+	Delay     time.Duration // Delay before every reply, or between streamed tokens.
+	FailRate  float64       // Share of requests answered with a server error, from 0 to 1.
+	EmptyRate float64       // Share of completions answered without text, from 0 to 1.
+
+	busy atomic.Int32 // Completions being answered, shown as busy slots.
+}
+
+// # Mock reply
+//
+// This function returns the reply to a prompt, cut to `max_tokens` words.
+func (mock *MockBackend) reply(prompt string, max_tokens int) []string {
+	var text string
+	if mock.Echo || len(mock.Canned) == 0 {
+		text = "You said: " + lastUserTurn(prompt)
+	} else {
+		text = mock.Canned[rand.Intn(len(mock.Canned))]
+	}
+
+	words := strings.Fields(text)
+	if max_tokens > 0 && len(words) > max_tokens {
+		words = words[:max_tokens]
+	}
+	tokens := make([]string, len(words))
+	for i, word := range words {
+		if i > 0 {
+			word = " " + word
+		}
+		tokens[i] = word
+	}
+	return tokens
+}
+
+// # Mock grammar output
+//
+// This function picks one of the string literals of a GBNF grammar, which is what an alternation of literals,
+// like the reaction grammar, generates. For the meme choice grammar, it picks a template and writes a text in JSON.
+// Richer grammars are not understood.
+func mockGrammarOutput(grammar string) []string {
+	if _, templates, found := strings.Cut(grammar, "\ntemplate ::= "); found {
+		templates, _, _ = strings.Cut(templates, "\n")
+		if choice := mockGrammarOutput(templates); choice != nil {
+			return []string{fmt.Sprintf(`{"template": %s, "texts": ["mock meme text"]}`, choice[0])}
+		}
+	}
+
+	var literals []string
+	for _, quoted := range mock_grammar_literal_pattern.FindAllString(grammar, -1) {
+		if literal, err := strconv.Unquote(quoted); err == nil {
+			literals = append(literals, literal)
+		}
+	}
+	if len(literals) == 0 {
+		return nil
+	}
+	return []string{literals[rand.Intn(len(literals))]}
+}
+
+var mock_grammar_literal_pattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// # Last user turn
+//
+// This function extracts the last user message from a prompt formatted with one of the known chat templates.
+// Unknown formats are returned whole.
+func lastUserTurn(prompt string) string {
+	for _, chat_template := range ChatTemplates {
+		prefix, suffix, _ := strings.Cut(chat_template.FormatPrompt("\x00"), "\x00")
+		start := strings.LastIndex(prompt, prefix)
+		if start >= 0 && strings.HasSuffix(prompt, suffix) && start+len(prefix) <= len(prompt)-len(suffix) {
+			return strings.TrimSpace(prompt[start+len(prefix) : len(prompt)-len(suffix)])
+		}
+	}
+	return strings.TrimSpace(prompt)
+}
+
+// # Mock embedding
+//
+// This function hashes every word of the text into a normalized bag-of-words vector.
+func mockEmbedding(text string) []float64 {
+	vector := make([]float64, MOCK_EMBEDDING_SIZE)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		hash := fnv.New32a()
+		hash.Write([]byte(word))
+		vector[hash.Sum32()%MOCK_EMBEDDING_SIZE] += 1
+	}
+
+	norm := 0.0
+	for _, value := range vector {
+		norm += value * value
+	}
+	if norm > 0 {
+		for i := range vector {
+			vector[i] /= math.Sqrt(norm)
+		}
+	}
+	return vector
+}
+
+// # Handler
+//
+// This function returns the HTTP handler of the mock backend.
+func (mock *MockBackend) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+MODELS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"object": "list",
+			"data":   []map[string]string{{"id": MOCK_MODEL, "object": "model", "owned_by": "me"}},
+		})
+	})
+	mux.HandleFunc("/"+PROPS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"chat_template":               MOCK_CHAT_TEMPLATE,
+			"default_generation_settings": map[string]int{"n_ctx": MOCK_CONTEXT_SIZE},
+			"total_slots":                 MOCK_SLOTS,
+		})
+	})
+	mux.HandleFunc("/"+SLOTS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		slots := make([]BackendSlot, MOCK_SLOTS)
+		for i := range slots {
+			slots[i] = BackendSlot{ID: i, IsProcessing: i < int(mock.busy.Load())}
+		}
+		writeJSON(w, slots)
+	})
+	mux.HandleFunc("/"+COMPLETIONS_ENDPOINT, mock.handleCompletion)
+	mux.HandleFunc("/"+CHAT_COMPLETIONS_ENDPOINT, mock.handleChatCompletion)
+	mux.HandleFunc("/"+EMBEDDINGS_ENDPOINT, mock.handleEmbedding)
+	return mux
+}
+
+// # Check request
+//
+// This function decodes a POST request, failing it at random when asked to.
+// It reports whether the request should be answered.
+func (mock *MockBackend) checkRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if mock.FailRate > 0 && rand.Float64() < mock.FailRate {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]interface{}{"error": map[string]string{"message": "mock failure", "type": "server_error"}})
+		return false
+	}
+	return true
+}
+
+func (mock *MockBackend) handleCompletion(w http.ResponseWriter, r *http.Request) {
+	var request LlmGenerationParameters
+	if !mock.checkRequest(w, r, &request) {
+		return
+	}
+
+	mock.busy.Add(1)
+	defer mock.busy.Add(-1)
+
+	tokens := mock.reply(request.Prompt, request.MaxTokens)
+	if request.Grammar != "" {
+		tokens = mockGrammarOutput(request.Grammar)
+	}
+	if mock.EmptyRate > 0 && rand.Float64() < mock.EmptyRate {
+		tokens = nil
+	}
+	id := fmt.Sprintf("cmpl-mock-%d", time.Now().UnixNano())
+	choice := func(text string, finish_reason interface{}) map[string]interface{} {
+		return map[string]interface{}{"text": text, "index": 0, "logprobs": nil, "finish_reason": finish_reason}
+	}
+	chunk := func(choice map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"id": id, "object": "text_completion", "created": time.Now().Unix(), "model": MOCK_MODEL,
+			"choices": []interface{}{choice}}
+	}
+
+	if request.Stream {
+		mock.stream(w, tokens, func(token string) interface{} {
+			return chunk(choice(token, nil))
+		}, chunk(choice("", mock.finishReason(tokens, request.MaxTokens))))
+		return
+	}
+
+	time.Sleep(mock.Delay)
+	response := chunk(choice(strings.Join(tokens, ""), mock.finishReason(tokens, request.MaxTokens)))
+	response["usage"] = mockUsage(request.Prompt, tokens)
+	writeJSON(w, response)
+}
+
+func (mock *MockBackend) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Messages []struct {
+			Role    string      `json:"role"`
+			Content interface{} `json:"content"`
+		} `json:"messages"`
+		MaxTokens int  `json:"max_tokens"`
+		Stream    bool `json:"stream"`
+	}
+	if !mock.checkRequest(w, r, &request) {
+		return
+	}
+
+	// Multimodal contents are lists of parts, only their text is echoed.
+	prompt := ""
+	for _, message := range request.Messages {
+		if message.Role != "user" {
+			continue
+		}
+		switch content := message.Content.(type) {
+		case string:
+			prompt = content
+		case []interface{}:
+			prompt = ""
+			for _, part := range content {
+				if fields, ok := part.(map[string]interface{}); ok && fields["type"] == "text" {
+					prompt += fmt.Sprint(fields["text"])
+				}
+			}
+		}
+	}
+
+	tokens := mock.reply(prompt, request.MaxTokens)
+	id := fmt.Sprintf("chatcmpl-mock-%d", time.Now().UnixNano())
+	chunk := func(object string, choice map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"id": id, "object": object, "created": time.Now().Unix(), "model": MOCK_MODEL,
+			"choices": []interface{}{choice}}
+	}
+
+	if request.Stream {
+		mock.stream(w, tokens, func(token string) interface{} {
+			return chunk("chat.completion.chunk", map[string]interface{}{"index": 0, "delta": map[string]string{"content": token}, "finish_reason": nil})
+		}, chunk("chat.completion.chunk", map[string]interface{}{"index": 0, "delta": map[string]string{}, "finish_reason": mock.finishReason(tokens, request.MaxTokens)}))
+		return
+	}
+
+	time.Sleep(mock.Delay)
+	response := chunk("chat.completion", map[string]interface{}{
+		"index":         0,
+		"message":       map[string]string{"role": "assistant", "content": strings.Join(tokens, "")},
+		"finish_reason": mock.finishReason(tokens, request.MaxTokens),
+	})
+	response["usage"] = mockUsage(prompt, tokens)
+	writeJSON(w, response)
+}
+
+func (mock *MockBackend) handleEmbedding(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Input interface{} `json:"input"` // Either a string or a list of strings.
+	}
+	if !mock.checkRequest(w, r, &request) {
+		return
+	}
+
+	var inputs []string
+	switch input := request.Input.(type) {
+	case string:
+		inputs = []string{input}
+	case []interface{}:
+		for _, text := range input {
+			inputs = append(inputs, fmt.Sprint(text))
+		}
+	}
+
+	data := make([]map[string]interface{}, len(inputs))
+	prompt_tokens := 0
+	for i, text := range inputs {
+		data[i] = map[string]interface{}{"object": "embedding", "embedding": mockEmbedding(text), "index": i}
+		prompt_tokens += len(strings.Fields(text))
+	}
+	writeJSON(w, map[string]interface{}{
+		"object": "list",
+		"model":  MOCK_MODEL,
+		"data":   data,
+		"usage":  map[string]int{"prompt_tokens": prompt_tokens, "total_tokens": prompt_tokens},
+	})
+}
+
+// # Stream
+//
+// This function sends the tokens as server-sent events, like llama-cpp-python with `"stream": true`,
+// then the final chunk and the `[DONE]` marker.
+func (mock *MockBackend) stream(w http.ResponseWriter, tokens []string, chunk func(token string) interface{}, final interface{}) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	send := func(data string) {
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for _, token := range tokens {
+		time.Sleep(mock.Delay)
+		data, _ := json.Marshal(chunk(token))
+		send(string(data))
+	}
+	data, _ := json.Marshal(final)
+	send(string(data))
+	send("[DONE]")
+}
+
+// # Finish reason
+//
+// This function tells whether the reply stopped by itself or hit the token limit.
+func (mock *MockBackend) finishReason(tokens []string, max_tokens int) string {
+	if max_tokens > 0 && len(tokens) >= max_tokens {
+		return "length"
+	}
+	return "stop"
+}
+
+func mockUsage(prompt string, tokens []string) map[string]int {
+	prompt_tokens := len(strings.Fields(prompt))
+	return map[string]int{"prompt_tokens": prompt_tokens, "completion_tokens": len(tokens), "total_tokens": prompt_tokens + len(tokens)}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Mock server subcommand
+//
+// This function handles `mockserver [-addr :8000] [-mode echo|canned] [-replies file] [-delay 50ms] [-fail-rate 0.1] [-empty-rate 0.1]`,
+// serving a fake backend until interrupted.
+func runMockServerCommand(args []string) error {
+	flags := flag.NewFlagSet("mockserver", flag.ContinueOnError)
+	addr := flags.String("addr", ":8000", "listen address")
+	mode := flags.String("mode", "echo", "reply mode: echo (repeat the last user message) or canned (random canned reply)")
+	replies_path := flags.String("replies", "", "file of canned replies, one per line, replacing the built-in ones")
+	delay := flags.Duration("delay", 0, "delay before every reply, or between streamed tokens")
+	fail_rate := flags.Float64("fail-rate", 0, "share of requests failing with a server error, from 0 to 1")
+	empty_rate := flags.Float64("empty-rate", 0, "share of completions answered without text, from 0 to 1")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *mode != "echo" && *mode != "canned" {
+		return fmt.Errorf("unknown mode %q, expected echo or canned", *mode)
+	}
+
+	mock := &MockBackend{Echo: *mode == "echo", Canned: MockCannedReplies, Delay: *delay, FailRate: *fail_rate, EmptyRate: *empty_rate}
+	if *replies_path != "" {
+		file, err := os.Open(*replies_path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		mock.Canned = nil
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				mock.Canned = append(mock.Canned, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("mock backend listening on %s (%s mode)\n", *addr, *mode)
+	return http.ListenAndServe(*addr, mock.Handler())
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const PERSONA_USER_NAME = "User" // Name substituted for `{{user}}` in persona texts.
+
+var example_start_pattern = regexp.MustCompile(`(?i)<start>`)
+
+// # Sampling overrides
+//
+// This struct holds the sampling parameters a persona prefers.
+// Zero values leave the bot parameters unchanged.
+type SamplingOverrides struct {
+	TopK          int     `json:"top_k,omitempty"`
+	TopP          float64 `json:"top_p,omitempty"`
+	RepeatPenalty float64 `json:"repeat_penalty,omitempty"`
+	Temperature   float64 `json:"temperature,omitempty"`
+	MaxTokens     int     `json:"max_tokens,omitempty"`
+}
+
+// # Apply sampling overrides
+//
+// This function returns a copy of the generation parameters with the overrides applied.
+func (overrides SamplingOverrides) Apply(lgp LlmGenerationParameters) LlmGenerationParameters {
+	if overrides.TopK > 0 {
+		lgp.TopK = overrides.TopK
+	}
+	if overrides.TopP > 0 {
+		lgp.TopP = overrides.TopP
+	}
+	if overrides.RepeatPenalty > 0 {
+		lgp.RepeatPenalty = overrides.RepeatPenalty
+	}
+	if overrides.Temperature > 0 {
+		lgp.Temperature = overrides.Temperature
+	}
+	if overrides.MaxTokens > 0 {
+		lgp.MaxTokens = overrides.MaxTokens
+	}
+	return lgp
+}
+
+// # Persona
+//
+// This struct is a character the bot can play.
+// The fields follow the TavernAI / SillyTavern character cards, plus the preferred sampling parameters.
+type Persona struct {
+	Name         string            `json:"name"`
+	SystemPrompt string            `json:"system_prompt"`
+	Description  string            `json:"description"`
+	Personality  string            `json:"personality"`
+	Scenario     string            `json:"scenario"`
+	FirstMessage string            `json:"first_mes"`
+	Examples     string            `json:"mes_example"`
+	Sampling     SamplingOverrides `json:"sampling"`
+}
+
+// # Parse persona
+//
+// This function parses a persona file.
+// Both flat files (TavernAI V1 cards) and SillyTavern V2 cards (`{"spec": "chara_card_v2", "data": {...}}`) are accepted.
+func ParsePersona(data []byte) (Persona, error) {
+	var card struct {
+		Spec string   `json:"spec"`
+		Data *Persona `json:"data"`
+	}
+	if err := json.Unmarshal(data, &card); err != nil {
+		return Persona{}, err
+	}
+	if card.Data != nil {
+		return *card.Data, nil
+	}
+
+	var persona Persona
+	err := json.Unmarshal(data, &persona)
+	return persona, err
+}
+
+// # Fill placeholders
+//
+// This function replaces the `{{char}}` and `{{user}}` placeholders of card texts.
+func (persona *Persona) fill(text string) string {
+	return strings.NewReplacer("{{char}}", persona.Name, "{{Char}}", persona.Name, "<BOT>", persona.Name,
+		"{{user}}", PERSONA_USER_NAME, "{{User}}", PERSONA_USER_NAME, "<USER>", PERSONA_USER_NAME).Replace(text)
+}
+
+// # Context
+//
+// This function returns the instructions describing the character, to be put before the conversation.
+func (persona *Persona) Context() string {
+	var parts []string
+	if persona.SystemPrompt != "" {
+		parts = append(parts, persona.fill(persona.SystemPrompt))
+	} else {
+		parts = append(parts, fmt.Sprintf("You are %s. Stay in character.", persona.Name))
+	}
+	if persona.Description != "" {
+		parts = append(parts, persona.fill(persona.Description))
+	}
+	if persona.Personality != "" {
+		parts = append(parts, fmt.Sprintf("%s's personality: %s", persona.Name, persona.fill(persona.Personality)))
+	}
+	if persona.Scenario != "" {
+		parts = append(parts, "Scenario: "+persona.fill(persona.Scenario))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// # Example dialogues
+//
+// This function parses the example dialogues of the card into turns.
+// Examples are blocks starting with `<START>`, made of `{{user}}: ...` and `{{char}}: ...` lines;
+// a line without speaker continues the previous one.
+func (persona *Persona) ExampleTurns() []ChatTurn {
+	var turns []ChatTurn
+	for _, block := range example_start_pattern.Split(persona.Examples, -1) {
+		var current ChatTurn
+		speaker := ""
+		for _, line := range strings.Split(persona.fill(block), "\n") {
+			if text, found := strings.CutPrefix(line, PERSONA_USER_NAME+":"); found {
+				if current.User != "" && current.Model != "" {
+					turns = append(turns, current)
+					current = ChatTurn{}
+				}
+				speaker = "user"
+				current.User = strings.TrimSpace(text)
+			} else if text, found := strings.CutPrefix(line, persona.Name+":"); found {
+				speaker = "model"
+				current.Model = strings.TrimSpace(current.Model + "\n" + strings.TrimSpace(text))
+			} else if strings.TrimSpace(line) != "" {
+				switch speaker {
+				case "user":
+					current.User += "\n" + strings.TrimSpace(line)
+				case "model":
+					current.Model += "\n" + strings.TrimSpace(line)
+				}
+			}
+		}
+		if current.User != "" && current.Model != "" {
+			turns = append(turns, current)
+		}
+	}
+	return turns
+}
+
+// # Persona library
+//
+// This struct holds the personas loaded from a directory, one JSON file per persona.
+type PersonaLibrary struct {
+	dir string
+
+	mu       sync.RWMutex
+	personas map[string]Persona
+}
+
+// # Load persona library
+//
+// This function loads every `*.json` persona file of `dir`.
+func LoadPersonaLibrary(dir string) (*PersonaLibrary, error) {
+	library := &PersonaLibrary{dir: dir}
+	if err := library.Reload(); err != nil {
+		return nil, err
+	}
+	return library, nil
+}
+
+// # Reload persona library
+//
+// This function reads the persona files again. On error, the current personas are kept.
+func (library *PersonaLibrary) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(library.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	personas := map[string]Persona{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		persona, err := ParsePersona(data)
+		if err != nil {
+			return fmt.Errorf("invalid persona %s: %w", path, err)
+		}
+		if persona.Name == "" {
+			persona.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		personas[strings.ToLower(persona.Name)] = persona
+	}
+
+	library.mu.Lock()
+	library.personas = personas
+	library.mu.Unlock()
+	return nil
+}
+
+// # Find persona
+//
+// This function returns the persona with the given name, ignoring case.
+// A nil library has no personas.
+func (library *PersonaLibrary) Find(name string) (*Persona, bool) {
+	if library == nil {
+		return nil, false
+	}
+	library.mu.RLock()
+	defer library.mu.RUnlock()
+
+	persona, found := library.personas[strings.ToLower(strings.TrimSpace(name))]
+	if !found {
+		return nil, false
+	}
+	return &persona, true
+}
+
+// # Persona names
+//
+// This function returns the names of the personas, sorted.
+func (library *PersonaLibrary) Names() []string {
+	if library == nil {
+		return nil
+	}
+	library.mu.RLock()
+	defer library.mu.RUnlock()
+
+	names := make([]string, 0, len(library.personas))
+	for _, persona := range library.personas {
+		names = append(names, persona.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// # Persona conversation formatter
+//
+// This function formats the conversation as the persona: the character context opens the first user turn,
+// followed by the example dialogues, the previous turns and the prompt.
+// A nil persona formats the plain conversation.
+func FormatPersonaConversation(chat_template ChatTemplate, persona *Persona, history []ChatTurn, prompt string) string {
+	if persona == nil {
+		return chat_template.FormatConversation(history, prompt)
+	}
+
+	turns := append(persona.ExampleTurns(), history...)
+	context := persona.Context()
+	if len(turns) > 0 {
+		turns[0].User = context + "\n\n" + turns[0].User
+	} else {
+		prompt = context + "\n\n" + prompt
+	}
+	return chat_template.FormatConversation(turns, prompt)
+}
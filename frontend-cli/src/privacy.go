@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// # Privacy store
+//
+// This struct keeps the users who opted out with `/optout`, persisted as a JSON array of platform IDs.
+// The messages of these users are answered, but never kept: not in the recent windows given to the model
+// as group context, nor in the message log, the journal, the long-term memory or the feedback.
+// Without a path, the opt-outs live in memory only.
+type PrivacyStore struct {
+	path string
+
+	mu        sync.Mutex
+	opted_out map[string]bool
+}
+
+// # Open privacy store
+//
+// This function loads the opt-outs from `path`, starting empty if the file doesn't exist.
+func OpenPrivacyStore(path string) (*PrivacyStore, error) {
+	store := &PrivacyStore{path: path, opted_out: map[string]bool{}}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("invalid opt-out list %s: %w", path, err)
+	}
+	for _, user := range users {
+		store.opted_out[user] = true
+	}
+	return store, nil
+}
+
+// # Opted out
+//
+// This function reports whether the user opted out. Nobody opted out of a nil store.
+func (store *PrivacyStore) OptedOut(user string) bool {
+	if store == nil {
+		return false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.opted_out[user]
+}
+
+// # Set opt-out
+//
+// This function opts the user out, or back in, and saves the store.
+func (store *PrivacyStore) Set(user string, opted_out bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if opted_out {
+		store.opted_out[user] = true
+	} else {
+		delete(store.opted_out, user)
+	}
+	if store.path == "" {
+		return nil
+	}
+
+	users := make([]string, 0, len(store.opted_out))
+	for user := range store.opted_out {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(store.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(store.path+".tmp", store.path)
+}
+
+// # Rewrite JSON lines
+//
+// This function replaces the JSON lines file at `path` with the values, through a temporary file renamed over it,
+// so a crash never leaves a truncated file behind.
+func rewriteJSONLines[T any](path string, values []T) error {
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, value := range values {
+		if err := encoder.Encode(value); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// # Forget user
+//
+// This function deletes what the bot keeps of the sender of the message: their turns of the conversation histories
+// and their messages of the recent windows in every channel and in the session archive, their messages and the replies to them
+// in the message log, their memories, their ratings and the cached replies to them. It returns how many items were deleted;
+// stores failing to forget are logged and skipped.
+func (bot *Bot) forgetUser(message Message) int {
+	forgotten := bot.Sessions.ForgetUser(message.User, message.DisplayName())
+	forget := func(store string, count int, err error) {
+		if err != nil {
+			log.Println(fmt.Errorf("forgetting %s in the %s: %w", message.User, store, err))
+		}
+		forgotten += count
+	}
+
+	count, err := bot.Search.ForgetUser(message.User)
+	forget("message log", count, err)
+	if bot.Memory != nil {
+		count, err = bot.Memory.Store.ForgetUser(message.User)
+		forget("memory", count, err)
+	}
+	count, err = bot.Feedback.ForgetUser(message.User)
+	forget("feedback", count, err)
+	count, err = bot.SessionArchive.ForgetUser(message.User, message.DisplayName())
+	forget("session archive", count, err)
+	forget("response cache", bot.responses.ForgetUser(message.User), nil)
+
+	log.Printf("forgot %d items of %s\n", forgotten, message.User)
+	return forgotten
+}
+
+// # Forget me
+//
+// This function handles the `/forgetme` command, deleting what the bot keeps of the user.
+func (bot *Bot) forgetMe(message Message, _ string) Reply {
+	return Reply{Text: bot.T(message, "Done, I forgot %d things about you.", bot.forgetUser(message))}
+}
+
+// # Opt out
+//
+// This function handles the `/optout` command: the bot forgets the user, and stops keeping their messages.
+// `/optout off` opts back in.
+func (bot *Bot) optOut(message Message, args string) Reply {
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "":
+		if err := bot.Privacy.Set(message.User, true); err != nil {
+			log.Println(err)
+			return Reply{Text: bot.T(message, "I couldn't save your choice, try again later.")}
+		}
+		forgotten := bot.forgetUser(message)
+		return Reply{Text: bot.T(message, "Done, I forgot %d things about you and won't keep your messages anymore.", forgotten)}
+	case "off":
+		if err := bot.Privacy.Set(message.User, false); err != nil {
+			log.Println(err)
+			return Reply{Text: bot.T(message, "I couldn't save your choice, try again later.")}
+		}
+		return Reply{Text: bot.T(message, "Welcome back, I'll remember our conversations again.")}
+	default:
+		return Reply{Text: bot.T(message, "Usage: %s", "/optout [off]")}
+	}
+}
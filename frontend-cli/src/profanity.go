@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	PROFANITY_OFF   = "off"   // Replies are posted as generated.
+	PROFANITY_MASK  = "mask"  // Matches are replaced by asterisks.
+	PROFANITY_BLOCK = "block" // Replies with a match are generated again once, then dropped.
+)
+
+const PROFANITY_REGEX_PREFIX = "re:"
+
+// # Profanity filter
+//
+// This struct finds the words of a list in the replies of the model. A nil filter finds nothing.
+type ProfanityFilter struct {
+	patterns []*regexp.Regexp
+}
+
+// # Load profanity filter
+//
+// This function loads the filter from a list with one entry per line: a word or phrase, matched as whole words
+// whatever the case, or a regular expression after `re:`. Empty lines and lines starting with `#` are skipped.
+func LoadProfanityFilter(path string) (*ProfanityFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	filter := &ProfanityFilter{}
+	scanner := bufio.NewScanner(file)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		expression, is_regex := strings.CutPrefix(entry, PROFANITY_REGEX_PREFIX)
+		if !is_regex {
+			expression = `(?i)\b` + regexp.QuoteMeta(entry) + `\b`
+			if first, _ := utf8.DecodeRuneInString(entry); first >= 0x2E80 {
+				expression = regexp.QuoteMeta(entry) // Words of CJK text aren't separated.
+			}
+		}
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line_number, err)
+		}
+		filter.patterns = append(filter.patterns, pattern)
+	}
+	return filter, scanner.Err()
+}
+
+// # Match
+//
+// This function reports whether the text contains an entry of the list.
+func (filter *ProfanityFilter) Match(text string) bool {
+	if filter == nil {
+		return false
+	}
+	for _, pattern := range filter.patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// # Mask
+//
+// This function replaces every rune of the entries found in the text by an asterisk.
+func (filter *ProfanityFilter) Mask(text string) string {
+	if filter == nil {
+		return text
+	}
+	for _, pattern := range filter.patterns {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		})
+	}
+	return text
+}
+
+// # Parse profanity severity
+//
+// This function checks a severity level, empty standing for the default.
+func parseProfanitySeverity(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", PROFANITY_OFF, PROFANITY_MASK, PROFANITY_BLOCK:
+		return value, nil
+	}
+	return "", fmt.Errorf("profanity must be one of %s, %s, %s", PROFANITY_OFF, PROFANITY_MASK, PROFANITY_BLOCK)
+}
+
+// # Profanity severity
+//
+// This function returns the severity of the filter in the channel, the bot default when the channel has none.
+func (bot *Bot) profanitySeverity(channel string) string {
+	if bot.Profanity == nil {
+		return PROFANITY_OFF
+	}
+	if severity := bot.Channels.Get(channel).Profanity; severity != "" {
+		return severity
+	}
+	if bot.ProfanitySeverity != "" {
+		return bot.ProfanitySeverity
+	}
+	return PROFANITY_OFF
+}
+
+// # Filter profanity
+//
+// This function applies the filter of the channel to a reply of the model: masked, or with `block`,
+// generated again once with the same request when it has a match. It returns false when the reply is still blocked.
+func (bot *Bot) filterProfanity(message Message, params LlmGenerationParameters, response string) (string, bool) {
+	switch bot.profanitySeverity(message.Channel) {
+	case PROFANITY_MASK:
+		return bot.Profanity.Mask(response), true
+	case PROFANITY_BLOCK:
+		if !bot.Profanity.Match(response) {
+			return response, true
+		}
+		log.Printf("reply in %s blocked by the profanity filter, generating it again\n", message.Channel)
+		result := bot.generateResult(message, params)
+		if result.Err != nil {
+			log.Println(result.Err)
+			return "", false
+		}
+		if bot.Profanity.Match(result.Text) {
+			log.Printf("reply in %s blocked by the profanity filter again, giving up\n", message.Channel)
+			return "", false
+		}
+		return result.Text, true
+	}
+	return response, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_BOT_NAME = "meme-chatbot" // Name of the bot in chat templates, when no persona is played.
+
+const PROMPT_DATE_FORMAT = "2006-01-02"
+
+const PROMPT_TIME_FORMAT = "15:04"
+
+// # Prompt variables
+//
+// This struct holds the values of the chat template variables describing the conversation.
+type PromptVariables struct {
+	BotName  string // Persona played, or the bot name.
+	UserName string // Platform ID of the sender, empty for prompts nobody sent.
+	Channel  string
+}
+
+// # Prompt data
+//
+// This struct is what chat templates are executed with: the variables, the prompt, and the current date and time.
+// Templates can use any field, e.g. `{{.Prompt}}`, `{{.BotName}}`, `{{.Date}}`,
+// and conditional blocks, e.g. `{{if .UserName}}{{.UserName}}: {{end}}{{.Prompt}}`.
+type PromptData struct {
+	PromptVariables
+	Prompt string
+	Date   string // Current date, e.g. `2024-05-05`.
+	Time   string // Current time, e.g. `14:30`.
+}
+
+// # Create prompt data
+//
+// This function returns the data formatting the prompt now.
+func NewPromptData(variables PromptVariables, prompt string) PromptData {
+	now := time.Now()
+	return PromptData{
+		PromptVariables: variables,
+		Prompt:          prompt,
+		Date:            now.Format(PROMPT_DATE_FORMAT),
+		Time:            now.Format(PROMPT_TIME_FORMAT),
+	}
+}
+
+// # Parse chat template
+//
+// This function parses the turn template of a chat template, and checks it executes.
+func ParseChatTemplate(turn string, end string) (ChatTemplate, error) {
+	parsed, err := template.New("turn").Option("missingkey=error").Parse(turn)
+	if err != nil {
+		return ChatTemplate{}, err
+	}
+	if err := parsed.Execute(io.Discard, NewPromptData(PromptVariables{}, "")); err != nil {
+		return ChatTemplate{}, err
+	}
+	return ChatTemplate{Turn: turn, End: end, turn: parsed}, nil
+}
+
+// # Parse built-in chat template
+//
+// This function parses a chat template known to be valid, panicking otherwise.
+func MustParseChatTemplate(turn string, end string) ChatTemplate {
+	chat_template, err := ParseChatTemplate(turn, end)
+	if err != nil {
+		panic(err)
+	}
+	return chat_template
+}
+
+// # With variables
+//
+// This function returns a copy of the chat template formatting prompts with the given variables.
+func (chat_template ChatTemplate) With(variables PromptVariables) ChatTemplate {
+	chat_template.Variables = variables
+	return chat_template
+}
+
+// # Load chat templates
+//
+// This function adds the chat templates of a JSON file to the known templates.
+// The file maps template names to their turn template and end marker:
+//
+//	{"zephyr": {"turn": "<|user|>\n{{.Prompt}}</s>\n<|assistant|>\n", "end": "</s>"}}
+//
+// A template of the same name as a built-in one replaces it.
+func LoadChatTemplates(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var templates map[string]ChatTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("invalid chat templates %s: %w", path, err)
+	}
+	for name, loaded := range templates {
+		chat_template, err := ParseChatTemplate(loaded.Turn, loaded.End)
+		if err != nil {
+			return fmt.Errorf("invalid chat template %q in %s: %w", name, path, err)
+		}
+		ChatTemplates[name] = chat_template
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const PROPS_ENDPOINT = "props"
+
+// # Backend properties
+//
+// This struct is the answer of the `/props` endpoint of llama.cpp servers, describing the loaded model.
+type BackendProps struct {
+	ChatTemplate string `json:"chat_template"` // Jinja chat template embedded in the GGUF metadata.
+	TotalSlots   int    `json:"total_slots"`   // Parallel generation slots, each with its own KV cache.
+
+	DefaultGenerationSettings struct {
+		NCtx int `json:"n_ctx"` // Context size, in tokens.
+	} `json:"default_generation_settings"`
+}
+
+// # Get backend properties
+//
+// This function fetches the properties of the loaded model. Backends without `/props`, like llama-cpp-python, fail.
+func (client *LlmClient) Props(ctx context.Context) (BackendProps, error) {
+	var props BackendProps
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url(PROPS_ENDPOINT), nil)
+	if err != nil {
+		return props, err
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return props, err
+	}
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return props, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return props, ParseBackendError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &props); err != nil {
+		return props, fmt.Errorf("invalid backend properties: %w", err)
+	}
+	return props, nil
+}
+
+// Markers of the Jinja chat templates of the model families, matched to the known chat templates.
+var chat_template_markers = []struct {
+	Marker string
+	Name   string
+}{
+	{"<start_of_turn>", "gemma"},
+	{"<|im_start|>", "chatml"},
+	{"<|start_header_id|>", "llama3"},
+	{"[INST]", "mistral"},
+}
+
+// # Detect chat template
+//
+// This function returns the name of the known chat template matching a Jinja chat template, from the turn markers it uses.
+// Go can't run Jinja, so models of an unknown family need their template given with `-chat-templates`.
+func DetectChatTemplate(jinja string) (string, bool) {
+	for _, candidate := range chat_template_markers {
+		if strings.Contains(jinja, candidate.Marker) {
+			return candidate.Name, true
+		}
+	}
+	return "", false
+}
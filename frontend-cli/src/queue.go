@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// # Request priority
+//
+// Lower values are served first. Live messages are interactive, unprompted work like scheduled posts is background.
+type RequestPriority int
+
+const (
+	PRIORITY_INTERACTIVE RequestPriority = iota
+	PRIORITY_BACKGROUND
+)
+
+// # Request queue
+//
+// This struct holds the pending generation requests, served by priority, then in order of arrival.
+// Interactive requests jump ahead of waiting background requests; a generation already running is not interrupted.
+type RequestQueue struct {
+	mu       sync.Mutex
+	requests request_heap
+	sequence uint64
+	ready    chan struct{} // Signaled when requests are waiting.
+	pushed   time.Time     // When the last request was pushed.
+}
+
+type queued_request struct {
+	request  *GenerationRequest
+	sequence uint64
+}
+
+type request_heap []queued_request
+
+func (h request_heap) Len() int { return len(h) }
+func (h request_heap) Less(i, j int) bool {
+	if h[i].request.Priority != h[j].request.Priority {
+		return h[i].request.Priority < h[j].request.Priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+func (h request_heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *request_heap) Push(x interface{}) { *h = append(*h, x.(queued_request)) }
+func (h *request_heap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func NewRequestQueue() *RequestQueue {
+	return &RequestQueue{ready: make(chan struct{}, 1)}
+}
+
+// # Push request
+//
+// This function adds a request to the queue.
+func (queue *RequestQueue) Push(request *GenerationRequest) {
+	queue.mu.Lock()
+	queue.sequence++
+	queue.pushed = time.Now()
+	heap.Push(&queue.requests, queued_request{request: request, sequence: queue.sequence})
+	queue.mu.Unlock()
+	queue.signal()
+}
+
+// # Pop request
+//
+// This function takes the most urgent request, waiting for one if the queue is empty.
+// It returns false when the context is done first.
+func (queue *RequestQueue) Pop(ctx context.Context) (*GenerationRequest, bool) {
+	for {
+		queue.mu.Lock()
+		if queue.requests.Len() > 0 {
+			item := heap.Pop(&queue.requests).(queued_request)
+			remaining := queue.requests.Len()
+			queue.mu.Unlock()
+
+			// Wake up another worker for the remaining requests.
+			if remaining > 0 {
+				queue.signal()
+			}
+			return item.request, true
+		}
+		queue.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-queue.ready:
+		}
+	}
+}
+
+// # Queue length
+//
+// This function returns the number of waiting requests.
+func (queue *RequestQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.requests.Len()
+}
+
+// # Queue position
+//
+// This function returns how many waiting requests will be served before the request, 0 when it's next or no longer waiting.
+func (queue *RequestQueue) Position(request *GenerationRequest) int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	var target *queued_request
+	for i := range queue.requests {
+		if queue.requests[i].request == request {
+			target = &queue.requests[i]
+		}
+	}
+	if target == nil {
+		return 0
+	}
+	ahead := 0
+	for _, item := range queue.requests {
+		if item.request.Priority < target.request.Priority || (item.request.Priority == target.request.Priority && item.sequence < target.sequence) {
+			ahead++
+		}
+	}
+	return ahead
+}
+
+// # Last push
+//
+// This function returns when the last request was pushed, zero if none was.
+func (queue *RequestQueue) LastPush() time.Time {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.pushed
+}
+
+func (queue *RequestQueue) signal() {
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
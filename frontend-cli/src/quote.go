@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const QUOTE_PROMPT_HEADER = "The user is replying to this message from %s:"
+
+const QUOTE_MAX_RUNES = 500 // Longer quotes are cut, the start is usually enough to know what "this" is.
+
+// # Quoted message
+//
+// This struct is the earlier message a message replies to, on platforms with threaded replies
+// (Discord replies, Telegram replies). It may be older than the session history, or from another user.
+type QuotedMessage struct {
+	ID   string `json:"id,omitempty"`
+	User string `json:"user"` // Sender, `BOT_SPEAKER` when the bot is quoted.
+	Text string `json:"text"`
+}
+
+// # Inject quote
+//
+// This function prepends the quoted message to the user prompt, so the model knows what the reply refers to.
+func InjectQuote(prompt string, quote *QuotedMessage) string {
+	if quote == nil || strings.TrimSpace(quote.Text) == "" {
+		return prompt
+	}
+
+	text := strings.TrimSpace(quote.Text)
+	if runes := []rune(text); len(runes) > QUOTE_MAX_RUNES {
+		text = string(runes[:QUOTE_MAX_RUNES]) + "…"
+	}
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf(QUOTE_PROMPT_HEADER, quote.User))
+	builder.WriteString("\n")
+	for _, line := range strings.Split(text, "\n") {
+		builder.WriteString("> ")
+		builder.WriteString(line)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	builder.WriteString(prompt)
+	return builder.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// # Rate limiter
+//
+// This struct is a sliding-window rate limiter, counting events per key over the last `Window`.
+type RateLimiter struct {
+	Window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{Window: window, events: map[string][]time.Time{}}
+}
+
+// # Allow
+//
+// This function records an event for the key and reports whether it is within `limit` events per window.
+// Rejected events are not recorded, so a flood doesn't extend the wait. A limit of 0 or less allows everything.
+func (limiter *RateLimiter) Allow(key string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	recent := limiter.events[key][:0]
+	for _, event := range limiter.events[key] {
+		if now.Sub(event) < limiter.Window {
+			recent = append(recent, event)
+		}
+	}
+
+	if len(recent) >= limit {
+		limiter.events[key] = recent
+		return false
+	}
+	limiter.events[key] = append(recent, now)
+	return true
+}
+
+// # Reset
+//
+// This function forgets the events of the key, starting a fresh window.
+func (limiter *RateLimiter) Reset(key string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	delete(limiter.events, key)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const REACTION_PROMPT = `React to this chat message with a single emoji, picked from: %s
+
+Message: %s`
+
+const REACTION_MAX_TOKENS = 8 // An emoji is a few tokens at most.
+
+const REACTION_MAX_WORDS = 4 // Longer messages deserve a real reply.
+
+// Emoji the bot reacts with.
+var ReactionEmojis = []string{"😂", "🤣", "👍", "👀", "🔥", "❤️", "😭", "💀", "🤔", "🙏", "😎", "🎉"}
+
+// # Choice grammar
+//
+// This function returns a GBNF grammar constraining the generation to one of the choices, e.g. emoji,
+// for the backends supporting grammars (llama.cpp, llama-cpp-python).
+func ChoiceGrammar(choices []string) string {
+	alternatives := make([]string, len(choices))
+	for i, choice := range choices {
+		alternatives[i] = strconv.Quote(choice)
+	}
+	return "root ::= " + strings.Join(alternatives, " | ")
+}
+
+// # Find reaction
+//
+// This function returns the first of the emoji found in the response.
+// Backends ignoring the grammar may write more than an emoji.
+func findReaction(response string, emojis []string) (string, bool) {
+	first, position := "", len(response)
+	for _, emoji := range emojis {
+		if index := strings.Index(response, emoji); index >= 0 && index < position {
+			first, position = emoji, index
+		}
+	}
+	return first, first != ""
+}
+
+// # Should react
+//
+// This function draws whether a message gets just an emoji reaction, given the reaction probability of the channel.
+// Only short remarks are reacted to, questions and longer messages get a real reply.
+func shouldReact(probability float64, user_input string) bool {
+	if probability <= 0 || strings.Contains(user_input, "?") || len(strings.Fields(user_input)) > REACTION_MAX_WORDS {
+		return false
+	}
+	return rand.Float64() < probability
+}
+
+// # Load stickers
+//
+// This function loads the platform stickers sent along the reactions, as a JSON object mapping emoji to sticker IDs.
+func LoadStickers(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stickers map[string]string
+	if err := json.Unmarshal(data, &stickers); err != nil {
+		return nil, fmt.Errorf("invalid stickers %s: %w", path, err)
+	}
+	return stickers, nil
+}
+
+// # React
+//
+// This function answers the message with an emoji reaction, and the matching sticker if there is one.
+// The generation is constrained to the reaction emoji. Failures stay silent, a missing reaction goes unnoticed.
+func (bot *Bot) react(message Message, user_input string) Reply {
+	params := bot.Params().SetPrompt(FormatPrompt(fmt.Sprintf(REACTION_PROMPT, strings.Join(ReactionEmojis, " "), user_input)))
+	params.Grammar = ChoiceGrammar(ReactionEmojis)
+	params.MaxTokens = REACTION_MAX_TOKENS
+
+	message.OnPartialReply = nil
+	response, err := bot.generate(message, params)
+	if err != nil {
+		log.Println(err)
+		return Reply{}
+	}
+	reaction, found := findReaction(response, ReactionEmojis)
+	if !found {
+		log.Printf("no reaction in %q\n", response)
+		return Reply{}
+	}
+	return Reply{Reaction: reaction, Sticker: bot.Stickers[reaction]}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+)
+
+const (
+	DEFAULT_REPEAT_WINDOW     = 20  // Last replies of a channel a new reply is compared to.
+	DEFAULT_REPEAT_SIMILARITY = 0.8 // Share of common words past which a reply repeats an earlier one.
+	REPEAT_MAX_RETRIES        = 2   // Generations again before posting a repeated reply anyway.
+	REPEAT_TEMPERATURE_STEP   = 0.2 // Temperature added on each generation again.
+	REPEAT_MAX_TEMPERATURE    = 1.5
+)
+
+// # Jaccard similarity
+//
+// This function returns the share of the terms in common between two sets of unique terms, from 0 to 1.
+func jaccardSimilarity(a []string, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for _, term := range a {
+		for _, other := range b {
+			if term == other {
+				common++
+				break
+			}
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// # Reply fingerprints
+//
+// This struct keeps the fingerprints of the last replies of the bot in a channel: the sets of their words,
+// which catch the same quip with another punctuation or case.
+type ReplyFingerprints struct {
+	mu           sync.Mutex
+	fingerprints [][]string
+}
+
+// # Add fingerprint
+//
+// This function keeps the fingerprint of a reply, forgetting the oldest beyond `window`.
+func (replies *ReplyFingerprints) Add(reply string, window int) {
+	terms := uniqueTerms(reply, false)
+	if len(terms) == 0 || window <= 0 {
+		return
+	}
+	replies.mu.Lock()
+	defer replies.mu.Unlock()
+	replies.fingerprints = append(replies.fingerprints, terms)
+	if len(replies.fingerprints) > window {
+		replies.fingerprints = replies.fingerprints[len(replies.fingerprints)-window:]
+	}
+}
+
+// # Repeats
+//
+// This function reports whether the reply is near-identical to one of the kept replies.
+func (replies *ReplyFingerprints) Repeats(reply string, min_similarity float64) bool {
+	terms := uniqueTerms(reply, false)
+	if len(terms) == 0 {
+		return false
+	}
+	replies.mu.Lock()
+	defer replies.mu.Unlock()
+	for _, fingerprint := range replies.fingerprints {
+		if jaccardSimilarity(terms, fingerprint) >= min_similarity {
+			return true
+		}
+	}
+	return false
+}
+
+// # Avoid repeats
+//
+// This function generates the reply again, with another seed and a higher temperature, while it repeats one of the last replies
+// of the channel, up to `REPEAT_MAX_RETRIES` times. The last generation is posted even if it still repeats.
+// It returns the reply with its token usage.
+func (bot *Bot) avoidRepeats(message Message, params LlmGenerationParameters, response string, usage *LlmUsage) (string, *LlmUsage) {
+	if bot.RepeatWindow <= 0 || bot.DryRun {
+		return response, usage
+	}
+	replies := &bot.Sessions.Get(message.Channel).Replies
+	for retry := 1; retry <= REPEAT_MAX_RETRIES && replies.Repeats(response, bot.RepeatSimilarity); retry++ {
+		log.Printf("reply in %s repeats a recent one, generating it again (%d/%d)\n", message.Channel, retry, REPEAT_MAX_RETRIES)
+		seed := rand.Intn(1 << 31)
+		params.Seed = &seed
+		params.Temperature = min(params.Temperature+REPEAT_TEMPERATURE_STEP, REPEAT_MAX_TEMPERATURE)
+		result := bot.generateResult(message, params)
+		if result.Err != nil {
+			log.Println(result.Err)
+			break
+		}
+		response, usage = result.Text, result.Usage
+	}
+	replies.Add(response, bot.RepeatWindow)
+	return response, usage
+}
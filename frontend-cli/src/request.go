@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const LONG_REPLY_MAX_TOKENS = 512 // Token limit of the replies asked with `/long`.
+
+// Keys accepted by `ParseRequestOverrides`.
+var RequestOverrideKeys = []string{"temperature", "top_p", "top_k", "repeat_penalty", "max_tokens", "template", "meme_speak"}
+
+// # Request overrides
+//
+// This struct holds the settings of a single message that differ from the session defaults,
+// e.g. a higher token limit for a long story. They are layered last, over the experiment variant.
+type RequestOverrides struct {
+	Sampling  SamplingOverrides `json:"sampling"`
+	Template  string            `json:"template,omitempty"`   // Chat template, by name.
+	MemeSpeak string            `json:"meme_speak,omitempty"` // Meme-speak effects of the reply, see `ApplyMemeSpeak`.
+}
+
+// # Parse request overrides
+//
+// This function parses the leading `key=value` words of the text, e.g. `max_tokens=512 temperature=1.2 tell me a story`,
+// and returns the overrides with the rest of the text.
+func ParseRequestOverrides(text string) (RequestOverrides, string, error) {
+	var config ChannelConfig
+	words := strings.Fields(text)
+	for len(words) > 0 {
+		key, value, found := strings.Cut(words[0], "=")
+		if !found {
+			break
+		}
+		switch key {
+		case "temperature", "top_p", "top_k", "repeat_penalty", "max_tokens", "template", "meme_speak":
+			if err := config.Set(key, value); err != nil {
+				return RequestOverrides{}, "", err
+			}
+		default:
+			return RequestOverrides{}, "", fmt.Errorf("unknown override %q, expected one of %s", key, strings.Join(RequestOverrideKeys, ", "))
+		}
+		words = words[1:]
+	}
+	return RequestOverrides{Sampling: config.Sampling, Template: config.Template, MemeSpeak: config.MemeSpeak}, strings.Join(words, " "), nil
+}
+
+// # Generation request
+//
+// This struct is the envelope of a prompt sent to the model I/O handler: who asked, when, and with which parameters.
+// The handler answers on the request itself, so concurrent requests never get each other's results.
+type GenerationRequest struct {
+	ID          string
+	Channel     string
+	User        string
+	Params      LlmGenerationParameters // Parameters with the formatted prompt, overrides applied.
+	Overrides   RequestOverrides        // Settings of the message over the session defaults.
+	Priority    RequestPriority
+	SubmittedAt time.Time
+
+	// OnToken, when set, streams the generation: it is called with every token as it arrives.
+	OnToken func(token string)
+	// OnRestart, when set, is called before a streamed generation is retried.
+	OnRestart func()
+
+	// Backend answers the request instead of the backend of the bot, nil for the bot's. Such requests aren't hedged.
+	Backend *LlmClient
+
+	// Timeout is the wall-clock budget of an attempt, 0 for none. Past it, the text generated so far is returned, see `sendRequest`.
+	Timeout time.Duration
+
+	result chan *GenerationResult
+}
+
+// # Generation result
+//
+// This struct is the envelope of the model output for a request. `Err` is set when the generation failed.
+type GenerationResult struct {
+	RequestID   string
+	Text        string
+	Usage       *LlmUsage // Token usage, estimated when the backend doesn't report it. Nil on error.
+	Err         error
+	SubmittedAt time.Time
+	StartedAt   time.Time // When the handler picked up the request.
+	FinishedAt  time.Time
+}
+
+// # Create a new generation request
+//
+// This function wraps the parameters of a generation asked by the sender of the message.
+// Background messages make background requests, and the sampling overrides of the message are applied.
+func NewGenerationRequest(message Message, params LlmGenerationParameters) *GenerationRequest {
+	priority := PRIORITY_INTERACTIVE
+	if message.Background {
+		priority = PRIORITY_BACKGROUND
+	}
+	var overrides RequestOverrides
+	if message.Overrides != nil {
+		overrides = *message.Overrides
+	}
+	return &GenerationRequest{
+		ID:          newRequestID(),
+		Channel:     message.Channel,
+		User:        message.User,
+		Params:      overrides.Sampling.Apply(params),
+		Overrides:   overrides,
+		Priority:    priority,
+		SubmittedAt: time.Now(),
+		result:      make(chan *GenerationResult, 1),
+	}
+}
+
+// # New request ID
+//
+// This function returns a random request ID, e.g. `req-1f3a9c0d2b4e6f70`.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("req-%x", time.Now().UnixNano())
+	}
+	return "req-" + hex.EncodeToString(id)
+}
+
+// # Respond
+//
+// This function answers the request. It must be called exactly once.
+func (request *GenerationRequest) Respond(text string, usage *LlmUsage, err error, started_at time.Time) {
+	if usage == nil && err == nil {
+		prompt_tokens, completion_tokens := EstimateTokens(request.Params.Prompt), EstimateTokens(text)
+		usage = &LlmUsage{PromptTokens: prompt_tokens, CompletionTokens: completion_tokens, TotalTokens: prompt_tokens + completion_tokens, Estimated: true}
+	}
+	request.result <- &GenerationResult{
+		RequestID:   request.ID,
+		Text:        text,
+		Usage:       usage,
+		Err:         err,
+		SubmittedAt: request.SubmittedAt,
+		StartedAt:   started_at,
+		FinishedAt:  time.Now(),
+	}
+}
+
+// # Wait for the result
+//
+// This function blocks until the request is answered.
+func (request *GenerationRequest) Wait() *GenerationResult {
+	return <-request.result
+}
+
+// # Queue time
+//
+// This function returns how long the request waited before being picked up.
+func (result *GenerationResult) QueueTime() time.Duration {
+	return result.StartedAt.Sub(result.SubmittedAt)
+}
+
+// # Generation time
+//
+// This function returns how long the backend took, retries included.
+func (result *GenerationResult) GenerationTime() time.Duration {
+	return result.FinishedAt.Sub(result.StartedAt)
+}
+
+// # Chat with overrides
+//
+// This function handles the `/with` command, answering the rest of the text with the settings given before it,
+// e.g. `/with max_tokens=512 temperature=1.2 write a story`. The session settings are left unchanged.
+func (bot *Bot) chatWith(message Message, args string) Reply {
+	overrides, text, err := ParseRequestOverrides(args)
+	if err != nil {
+		return Reply{Text: bot.T(message, "Invalid override: %s", err)}
+	}
+	if text == "" {
+		return Reply{Text: bot.T(message, "Usage: %s", "/with key=value... <text>")}
+	}
+	return bot.chatOverridden(message, text, overrides)
+}
+
+// # Long reply
+//
+// This function handles the `/long` command, answering the text with a higher token limit.
+func (bot *Bot) longReply(message Message, text string) Reply {
+	return bot.chatOverridden(message, text, RequestOverrides{Sampling: SamplingOverrides{MaxTokens: LONG_REPLY_MAX_TOKENS}})
+}
+
+func (bot *Bot) chatOverridden(message Message, text string, overrides RequestOverrides) Reply {
+	if !bot.rate_limiter.Allow(message.Channel, bot.Channels.Get(message.Channel).RateLimit) {
+		return Reply{Text: bot.T(message, "I'm getting too many messages here, give me a minute.")}
+	}
+	message.Overrides = &overrides
+	return bot.chat(message, text)
+}
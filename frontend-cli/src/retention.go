@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const JANITOR_INTERVAL = time.Hour
+
+const RETENTION_DAY = 24 * time.Hour
+
+// # Retention policy
+//
+// This struct tells how long the bot keeps what it stores. Zero keeps everything.
+type RetentionPolicy struct {
+	MaxAge      time.Duration // Age past which the message log, the archived conversations and the remembered exchanges are deleted.
+	MaxPerUser  int           // Messages of the message log kept per user, with the replies to them, the oldest deleted first.
+	AuditMaxAge time.Duration // Age past which the audit log entries are deleted.
+}
+
+// # Enabled
+//
+// This function reports whether the policy deletes anything.
+func (policy RetentionPolicy) Enabled() bool {
+	return policy.MaxAge > 0 || policy.MaxPerUser > 0 || policy.AuditMaxAge > 0
+}
+
+// # Replace append file
+//
+// This function rewrites the JSON lines file opened for appending in `file` with the values, and opens it again,
+// so the next entries are appended to the rewritten file.
+func replaceAppendFile[T any](file **os.File, values []T) error {
+	path := (*file).Name()
+	if err := rewriteJSONLines(path, values); err != nil {
+		return err
+	}
+	reopened, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	(*file).Close()
+	*file = reopened
+	return nil
+}
+
+// # Prune append file
+//
+// This function drops the entries `keep` rejects from the JSON lines file opened for appending in `file`.
+// Lines that can't be decoded are dropped too, the readers of the file skip them anyway. It returns how many entries were dropped.
+// The caller holds the lock of the file.
+func pruneAppendFile[T any](file **os.File, keep func(entry T) bool) (int, error) {
+	return editAppendFile(file, func(entry *T) (bool, int) {
+		if keep(*entry) {
+			return true, 0
+		}
+		return false, 1
+	})
+}
+
+// # Edit append file
+//
+// This function rewrites the entries of the JSON lines file opened for appending in `file` with `change`, which edits an entry
+// in place and returns whether to keep it, and how many items it removed from it or with it. Lines that can't be decoded
+// are dropped, and count as one item. The file is only rewritten when items were removed, and the total is returned.
+// The caller holds the lock of the file.
+func editAppendFile[T any](file **os.File, change func(entry *T) (bool, int)) (int, error) {
+	read, err := os.Open((*file).Name())
+	if err != nil {
+		return 0, err
+	}
+	defer read.Close()
+
+	var kept []T
+	removed := 0
+	scanner := bufio.NewScanner(read)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry T
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			removed++
+			continue
+		}
+		keep, count := change(&entry)
+		removed += count
+		if keep {
+			kept = append(kept, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, replaceAppendFile(file, kept)
+}
+
+// # Prune audit log
+//
+// This function drops the audit entries `keep` rejects. It returns how many were dropped.
+func (audit *AuditLog) Prune(keep func(entry AuditEntry) bool) (int, error) {
+	if audit == nil {
+		return 0, nil
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	return pruneAppendFile(&audit.file, keep)
+}
+
+// # Prune session archive
+//
+// This function drops the archived sessions `keep` rejects. It returns how many were dropped.
+func (archive *SessionArchive) Prune(keep func(session ArchivedSession) bool) (int, error) {
+	if archive == nil {
+		return 0, nil
+	}
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return pruneAppendFile(&archive.file, keep)
+}
+
+// # Keep newest per user
+//
+// This function returns a filter for `MessageIndex.Prune` keeping the last `limit` messages of each user,
+// counting the replies of the bot to them. Messages without a user are kept.
+func keepNewestPerUser(messages []IndexedMessage, limit int) func(message IndexedMessage) bool {
+	remaining := map[string]int{}
+	for _, message := range messages {
+		remaining[message.UserID]++
+	}
+	return func(message IndexedMessage) bool {
+		if message.UserID == "" {
+			return true
+		}
+		remaining[message.UserID]--
+		return remaining[message.UserID] < limit
+	}
+}
+
+// # Apply retention
+//
+// This function deletes what the retention policy no longer keeps, store by store, and returns how many items were deleted.
+// Stores failing to prune are logged and skipped. The remembered facts and the ratings are kept, they were given on purpose.
+func (bot *Bot) ApplyRetention(now time.Time) int {
+	policy := bot.Retention
+	deleted := 0
+	prune := func(store string, count int, err error) {
+		if err != nil {
+			log.Println(fmt.Errorf("applying the retention policy to the %s: %w", store, err))
+		}
+		deleted += count
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+		count, err := bot.Search.Prune(func(message IndexedMessage) bool { return message.Time.After(cutoff) })
+		prune("message log", count, err)
+		count, err = bot.SessionArchive.Prune(func(session ArchivedSession) bool { return session.ArchivedAt.After(cutoff) })
+		prune("session archive", count, err)
+		if bot.Memory != nil {
+			count, err = bot.Memory.Store.Prune(func(entry MemoryEntry) bool {
+				return entry.Kind != MEMORY_KIND_EXCHANGE || entry.Created.After(cutoff)
+			})
+			prune("memory", count, err)
+		}
+	}
+	if policy.MaxPerUser > 0 && bot.Search != nil {
+		count := 0
+		messages, err := bot.Search.Messages()
+		if err == nil {
+			count, err = bot.Search.Prune(keepNewestPerUser(messages, policy.MaxPerUser))
+		}
+		prune("message log", count, err)
+	}
+	if policy.AuditMaxAge > 0 {
+		cutoff := now.Add(-policy.AuditMaxAge)
+		count, err := bot.Audit.Prune(func(entry AuditEntry) bool { return entry.Time.After(cutoff) })
+		prune("audit log", count, err)
+	}
+
+	if deleted > 0 {
+		log.Printf("retention policy deleted %d items\n", deleted)
+	}
+	return deleted
+}
+
+// # Run janitor
+//
+// This function applies the retention policy at start, then every `interval`. It returns when the context is done.
+func (bot *Bot) RunJanitor(ctx context.Context, interval time.Duration) {
+	if !bot.Retention.Enabled() || interval <= 0 {
+		return
+	}
+	bot.ApplyRetention(time.Now())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bot.ApplyRetention(now)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const REVIEW_PROMPT = `You moderate a chat channel with these rules:
+%s
+
+Does the reply below follow every rule? Answer PASS or FAIL.
+
+Reply: %s`
+
+const (
+	REVIEW_PASS = "PASS"
+	REVIEW_FAIL = "FAIL"
+)
+
+const REVIEW_MAX_TOKENS = 4 // A verdict is a word.
+
+const REVIEW_TEMPERATURE = 0.1 // The verdict should be the most likely one, not a creative one.
+
+// # Review reply
+//
+// This function asks the model whether a draft reply follows the rules of the channel, in a short generation
+// constrained to a verdict. Drafts are only posted when they pass: a failed review, or a verdict that can't be read,
+// drops the draft, as a public channel is better off with silence than with an unchecked reply.
+func (bot *Bot) reviewReply(message Message, rules string, draft string) bool {
+	if bot.DryRun {
+		return true // The draft is the request, there's nothing to review.
+	}
+
+	params := bot.Params().SetPrompt(FormatPrompt(fmt.Sprintf(REVIEW_PROMPT, rules, draft)))
+	params.Grammar = ChoiceGrammar([]string{REVIEW_PASS, REVIEW_FAIL})
+	params.MaxTokens = REVIEW_MAX_TOKENS
+	params.Temperature = REVIEW_TEMPERATURE
+
+	message.OnPartialReply = nil
+	verdict, err := bot.generate(message, params)
+	if err != nil {
+		log.Println(fmt.Errorf("review in %s: %w", message.Channel, err))
+		return false
+	}
+	if !strings.Contains(strings.ToUpper(verdict), REVIEW_PASS) {
+		log.Printf("draft in %s dropped by the review (%q): %q\n", message.Channel, strings.TrimSpace(verdict), draft)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SCHEDULER_USER = "scheduler" // Sender of the scheduled prompts.
+
+var cron_shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// # Cron expression
+//
+// This struct is a parsed standard 5-field cron expression: minute, hour, day of month, month, day of week.
+// Each field is the set of matching values.
+type CronExpression struct {
+	minutes, hours, days, months, weekdays map[int]bool
+
+	any_day, any_weekday bool
+}
+
+// # Parse cron expression
+//
+// This function parses a cron expression. Fields accept `*`, values, ranges (`1-5`), lists (`1,15`) and steps (`*/10`, `0-30/5`).
+// The `@daily`-style shortcuts are accepted too.
+func ParseCron(expression string) (*CronExpression, error) {
+	if shortcut, found := cron_shortcuts[strings.TrimSpace(expression)]; found {
+		expression = shortcut
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expression, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday is both 0 and 7.
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &CronExpression{
+		minutes: sets[0], hours: sets[1], days: sets[2], months: sets[3], weekdays: sets[4],
+		any_day: fields[2] == "*", any_weekday: fields[4] == "*",
+	}, nil
+}
+
+// # Parse cron field
+//
+// This function returns the set of values matched by a field.
+func parseCronField(field string, low int, high int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if range_part, step_part, found := strings.Cut(part, "/"); found {
+			parsed, err := strconv.Atoi(step_part)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part, step = range_part, parsed
+		}
+
+		start, end := low, high
+		if part != "*" {
+			first, last, is_range := strings.Cut(part, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if is_range {
+				if end, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				end = high // `5/15` means from 5 every 15.
+			}
+		}
+		if start < low || end > high || start > end {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, low, high)
+		}
+
+		for value := start; value <= end; value += step {
+			set[value] = true
+		}
+	}
+	return set, nil
+}
+
+// # Matches
+//
+// This function reports whether the expression matches the minute of `t`.
+// Like cron, when both the day of month and the day of week are restricted, either may match.
+func (cron *CronExpression) Matches(t time.Time) bool {
+	if !cron.minutes[t.Minute()] || !cron.hours[t.Hour()] || !cron.months[int(t.Month())] {
+		return false
+	}
+
+	day_match := cron.days[t.Day()]
+	weekday_match := cron.weekdays[int(t.Weekday())]
+	switch {
+	case cron.any_day && cron.any_weekday:
+		return true
+	case cron.any_day:
+		return weekday_match
+	case cron.any_weekday:
+		return day_match
+	default:
+		return day_match || weekday_match
+	}
+}
+
+// # Scheduled post
+//
+// This struct describes content posted on a schedule: the model output for `Prompt`, or the fixed `Reply`,
+// or a picture drawn for `Draw`, posted to every channel of `Channels`.
+type ScheduledPost struct {
+	Name     string   `json:"name"`
+	Cron     string   `json:"cron"`
+	Channels []string `json:"channels"`
+
+	Prompt string `json:"prompt,omitempty"`
+	Reply  string `json:"reply,omitempty"`
+	Draw   string `json:"draw,omitempty"`
+
+	cron *CronExpression
+}
+
+// # Scheduler
+//
+// This struct posts the scheduled content, checking the schedules once a minute.
+type Scheduler struct {
+	path string
+	bot  *Bot
+
+	mu    sync.Mutex
+	posts []*ScheduledPost
+}
+
+// # Load scheduler
+//
+// This function loads the schedules from the JSON array at `path`.
+func LoadScheduler(path string, bot *Bot) (*Scheduler, error) {
+	scheduler := &Scheduler{path: path, bot: bot}
+	if err := scheduler.Reload(); err != nil {
+		return nil, err
+	}
+	return scheduler, nil
+}
+
+// # Reload schedules
+//
+// This function reads the schedule file again. On error, the current schedules are kept.
+func (scheduler *Scheduler) Reload() error {
+	data, err := os.ReadFile(scheduler.path)
+	if err != nil {
+		return err
+	}
+
+	var posts []*ScheduledPost
+	if err := json.Unmarshal(data, &posts); err != nil {
+		return fmt.Errorf("invalid schedules %s: %w", scheduler.path, err)
+	}
+	for i, post := range posts {
+		if post.Name == "" {
+			post.Name = fmt.Sprintf("schedule-%d", i+1)
+		}
+		if post.cron, err = ParseCron(post.Cron); err != nil {
+			return fmt.Errorf("schedule %q: %w", post.Name, err)
+		}
+		if len(post.Channels) == 0 {
+			return fmt.Errorf("schedule %q has no channel", post.Name)
+		}
+		if post.Prompt == "" && post.Reply == "" && post.Draw == "" {
+			return fmt.Errorf("schedule %q has no prompt, reply or draw", post.Name)
+		}
+	}
+
+	scheduler.mu.Lock()
+	scheduler.posts = posts
+	scheduler.mu.Unlock()
+	return nil
+}
+
+// # Run
+//
+// This function checks the schedules at the start of every minute until the context is done.
+// Posts run in their own goroutines, so a slow generation doesn't delay the other schedules.
+func (scheduler *Scheduler) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		scheduler.mu.Lock()
+		posts := scheduler.posts
+		scheduler.mu.Unlock()
+
+		for _, post := range posts {
+			if post.cron.Matches(next) {
+				go scheduler.publish(post)
+			}
+		}
+	}
+}
+
+// # Publish
+//
+// This function generates the content of a scheduled post and posts it to its channels.
+// Prompts are generated separately for every channel, so each gets its persona and settings.
+func (scheduler *Scheduler) publish(post *ScheduledPost) {
+	bot := scheduler.bot
+	for _, channel := range post.Channels {
+		message := Message{Channel: channel, User: SCHEDULER_USER, Background: true}
+
+		var reply Reply
+		switch {
+		case post.Prompt != "":
+			reply = bot.chat(message, post.Prompt)
+		case post.Draw != "":
+			reply = bot.draw(message, post.Draw)
+		default:
+			reply = Reply{Text: post.Reply}
+		}
+
+		log.Printf("posting schedule %q to %s\n", post.Name, channel)
+		bot.Post(channel, reply)
+	}
+}
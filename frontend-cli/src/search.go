@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite, with FTS5.
+)
+
+const SEARCH_MAX_RESULTS = 5 // Matches shown by `/search`, newest first.
+
+const SEARCH_SNIPPET_RUNES = 80 // Length of the snippets around the first match.
+
+type IndexedMessage struct {
+	ID      int       `json:"id"`
+	Channel string    `json:"channel"`
+	User    string    `json:"user"`              // Sender, `BOT_SPEAKER` for the replies of the bot.
+	UserID  string    `json:"user_id,omitempty"` // Platform ID of the sender, or of the user the bot replied to.
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// # Message index
+//
+// This struct keeps the conversations in a SQLite database, searched with an FTS5 full-text index.
+// The index holds the terms of `searchTerms` rather than the text, so CJK is searched by pairs of characters
+// like the other scripts by words. The driver is pure Go, so the bot still builds without CGO.
+// Message IDs are never reused, even once messages are pruned. A nil message index records nothing.
+type MessageIndex struct {
+	mu sync.Mutex // Serializes the writes, so `Prune` sees the messages it drops.
+	db *sql.DB
+}
+
+const message_index_schema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel TEXT NOT NULL,
+	user    TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	text    TEXT NOT NULL,
+	time    TEXT NOT NULL
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_terms USING fts5(terms);
+`
+
+const SQLITE_HEADER = "SQLite format 3\x00"
+
+// # Read message lines
+//
+// This function reads the messages of a message log in the JSON lines format of the first versions, oldest first.
+func readMessageLines(path string) ([]IndexedMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []IndexedMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var message IndexedMessage
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			// A crash may leave a truncated last line behind.
+			log.Printf("skipping corrupted message in %s: %v\n", path, err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, scanner.Err()
+}
+
+// # Is message lines
+//
+// This function reports whether the file at `path` is a message log in JSON lines rather than a database.
+// Missing and empty files are neither, and become databases.
+func isMessageLines(path string) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(SQLITE_HEADER))
+	read, err := io.ReadFull(file, header)
+	if read == 0 && (err == io.EOF || err == nil) {
+		return false, nil
+	}
+	return string(header[:read]) != SQLITE_HEADER, nil
+}
+
+// # Read indexed messages
+//
+// This function reads the messages stored at `path`, oldest first, from a database or a JSON lines log.
+// A missing file has no messages.
+func ReadIndexedMessages(path string) ([]IndexedMessage, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if lines, err := isMessageLines(path); err != nil || lines {
+		if err != nil {
+			return nil, err
+		}
+		return readMessageLines(path)
+	}
+	index, err := OpenMessageIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	return index.Messages()
+}
+
+// # Open message index
+//
+// This function opens the message database at `path`, creating it if it doesn't exist.
+// A JSON lines log of the first versions is moved to `<path>.jsonl` and its messages imported, with their IDs.
+func OpenMessageIndex(path string) (*MessageIndex, error) {
+	var imported []IndexedMessage
+	lines, err := isMessageLines(path)
+	if err != nil {
+		return nil, err
+	}
+	if lines {
+		if imported, err = readMessageLines(path); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path, path+".jsonl"); err != nil {
+			return nil, err
+		}
+		log.Printf("moved the message log %s to %s.jsonl, importing its %d messages\n", path, path, len(imported))
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // One writer at a time anyway, and the FTS index must see the message it indexes.
+	if _, err := db.Exec(message_index_schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("message index %s: %w", path, err)
+	}
+	index := &MessageIndex{db: db}
+	for _, message := range imported {
+		if err := index.insert(message); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("importing the message log %s: %w", path, err)
+		}
+	}
+	return index, nil
+}
+
+// # Close
+//
+// This function closes the database.
+func (index *MessageIndex) Close() error {
+	if index == nil {
+		return nil
+	}
+	return index.db.Close()
+}
+
+// # Insert message
+//
+// This function stores a message and indexes its terms, with the ID of the message, or the next one when it has none.
+func (index *MessageIndex) insert(message IndexedMessage) error {
+	tx, err := index.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id sql.NullInt64
+	if message.ID > 0 {
+		id = sql.NullInt64{Int64: int64(message.ID), Valid: true}
+	}
+	result, err := tx.Exec(`INSERT INTO messages (id, channel, user, user_id, text, time) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, message.Channel, message.User, message.UserID, message.Text, message.Time.Format(time.RFC3339Nano))
+	if err != nil {
+		return err
+	}
+	rowid, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO messages_terms (rowid, terms) VALUES (?, ?)`, rowid, strings.Join(uniqueTerms(message.Text, true), " ")); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// # Record message
+//
+// This function stores and indexes a message. Failures are logged, never returned:
+// a full disk shouldn't stop the bot from answering.
+func (index *MessageIndex) Record(channel string, user_id string, user string, text string) {
+	if index == nil || strings.TrimSpace(text) == "" {
+		return
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if err := index.insert(IndexedMessage{Channel: channel, User: user, UserID: user_id, Text: text, Time: time.Now()}); err != nil {
+		log.Println(fmt.Errorf("message index: %w", err))
+	}
+}
+
+// # Scan messages
+//
+// This function reads the messages of a query selecting the columns of `messages`.
+func scanMessages(rows *sql.Rows) ([]IndexedMessage, error) {
+	defer rows.Close()
+
+	var messages []IndexedMessage
+	for rows.Next() {
+		var message IndexedMessage
+		var sent_at string
+		if err := rows.Scan(&message.ID, &message.Channel, &message.User, &message.UserID, &message.Text, &sent_at); err != nil {
+			return nil, err
+		}
+		message.Time, _ = time.Parse(time.RFC3339Nano, sent_at)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// # Messages
+//
+// This function returns every message stored, oldest first.
+func (index *MessageIndex) Messages() ([]IndexedMessage, error) {
+	if index == nil {
+		return nil, nil
+	}
+	rows, err := index.db.Query(`SELECT id, channel, user, user_id, text, time FROM messages ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// # Forget user
+//
+// This function drops the messages of the user, and the replies of the bot to them. It returns how many messages were dropped.
+func (index *MessageIndex) ForgetUser(user_id string) (int, error) {
+	return index.Prune(func(message IndexedMessage) bool { return message.UserID != user_id })
+}
+
+// # Prune
+//
+// This function drops the messages `keep` rejects, with their terms.
+// `keep` sees the messages oldest first. It returns how many messages were dropped.
+func (index *MessageIndex) Prune(keep func(message IndexedMessage) bool) (int, error) {
+	if index == nil {
+		return 0, nil
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	messages, err := index.Messages()
+	if err != nil {
+		return 0, err
+	}
+	var dropped []int
+	for _, message := range messages {
+		if !keep(message) {
+			dropped = append(dropped, message.ID)
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+
+	tx, err := index.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, id := range dropped {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE id = ?`, id); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM messages_terms WHERE rowid = ?`, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(dropped), tx.Commit()
+}
+
+// # Search messages
+//
+// This function returns the messages of a channel containing all the terms of the query, newest first.
+func (index *MessageIndex) Search(channel string, query string, limit int) []IndexedMessage {
+	terms := uniqueTerms(query, false)
+	if index == nil || len(terms) == 0 {
+		return nil
+	}
+
+	// Every term is a phrase of its own, so FTS5 takes none for an operator, and all must match.
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	rows, err := index.db.Query(`SELECT m.id, m.channel, m.user, m.user_id, m.text, m.time
+		FROM messages_terms JOIN messages m ON m.id = messages_terms.rowid
+		WHERE messages_terms MATCH ? AND m.channel = ? ORDER BY m.id DESC LIMIT ?`, strings.Join(phrases, " "), channel, limit)
+	if err != nil {
+		log.Println(fmt.Errorf("message index: %w", err))
+		return nil
+	}
+	results, err := scanMessages(rows)
+	if err != nil {
+		log.Println(fmt.Errorf("message index: %w", err))
+	}
+	return results
+}
+
+// # Search terms
+//
+// This function splits a text into lowercase terms: words for the scripts using spaces,
+// and overlapping pairs of characters for CJK, which doesn't. When indexing, every CJK character is also a term,
+// so single-character queries match; queries only use a CJK character alone when it stands alone.
+func searchTerms(text string, indexing bool) []string {
+	var terms []string
+	var word, cjk []rune
+	flush := func() {
+		if len(word) > 0 {
+			terms = append(terms, string(word))
+		}
+		if len(cjk) == 1 || indexing {
+			for _, char := range cjk {
+				terms = append(terms, string(char))
+			}
+		}
+		for i := 1; i < len(cjk); i++ {
+			terms = append(terms, string(cjk[i-1:i+1]))
+		}
+		word, cjk = word[:0], cjk[:0]
+	}
+	for _, char := range strings.ToLower(text) {
+		switch {
+		case isCJK(char):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, char)
+		case unicode.IsLetter(char) || unicode.IsNumber(char):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, char)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// # Unique search terms
+//
+// This function returns the terms of a text without duplicates.
+func uniqueTerms(text string, indexing bool) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, term := range searchTerms(text, indexing) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func isCJK(char rune) bool {
+	return unicode.In(char, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// # Snippet
+//
+// This function returns the part of the text around the first occurrence of one of the query words,
+// with ellipses where the text was cut.
+func snippet(text string, query string) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= SEARCH_SNIPPET_RUNES {
+		return string(runes)
+	}
+
+	lower := []rune(strings.ToLower(string(runes)))
+	match := 0
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if position := strings.Index(string(lower), word); position >= 0 {
+			match = len([]rune(string(lower)[:position]))
+			break
+		}
+	}
+
+	start := max(match-SEARCH_SNIPPET_RUNES/4, 0)
+	end := min(start+SEARCH_SNIPPET_RUNES, len(runes))
+	start = max(end-SEARCH_SNIPPET_RUNES, 0)
+	result := string(runes[start:end])
+	if start > 0 {
+		result = "…" + result
+	}
+	if end < len(runes) {
+		result += "…"
+	}
+	return result
+}
+
+// # Search
+//
+// This function handles the `/search` command, listing the messages of the channel matching the query.
+func (bot *Bot) search(message Message, query string) Reply {
+	if bot.Search == nil {
+		return Reply{Text: bot.T(message, "Search is not enabled.")}
+	}
+	results := bot.Search.Search(message.Channel, query, SEARCH_MAX_RESULTS)
+	if len(results) == 0 {
+		return Reply{Text: bot.T(message, "Nothing found for %q.", query)}
+	}
+
+	lines := []string{bot.T(message, "Found for %q:", query)}
+	for _, result := range results {
+		user := result.User
+		switch user {
+		case BOT_SPEAKER:
+			user = bot.T(message, "me")
+		case "":
+			user = bot.T(message, "someone")
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", result.Time.Format("2006-01-02 15:04"), user, snippet(result.Text, query)))
+	}
+	return Reply{Text: strings.Join(lines, "\n")}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text     string
+		indexing bool
+		want     []string
+	}{
+		{"", false, nil},
+		{"Hello, World! hello", false, []string{"hello", "world", "hello"}},
+		{"你好世界", false, []string{"你好", "好世", "世界"}},
+		{"你好世界", true, []string{"你", "好", "世", "界", "你好", "好世", "世界"}},
+		{"梗", false, []string{"梗"}},
+		{"meme梗圖 2024", false, []string{"meme", "梗圖", "2024"}},
+		{"meme梗圖 2024", true, []string{"meme", "梗", "圖", "梗圖", "2024"}},
+	}
+	for _, test := range tests {
+		if terms := searchTerms(test.text, test.indexing); !slices.Equal(terms, test.want) {
+			t.Errorf("searchTerms(%q, %v) = %q, want %q", test.text, test.indexing, terms, test.want)
+		}
+	}
+}
+
+// Texts of the messages found, newest first.
+func searchTexts(index *MessageIndex, channel string, query string) []string {
+	var texts []string
+	for _, message := range index.Search(channel, query, SEARCH_MAX_RESULTS) {
+		texts = append(texts, message.Text)
+	}
+	return texts
+}
+
+func TestMessageIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	index, err := OpenMessageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.Record("general", "alice", "Alice", "hello world")
+	index.Record("general", "bob", "Bob", "今天的梗圖好好笑")
+	index.Record("random", "alice", "Alice", "hello from another channel")
+	index.Record("general", "alice", BOT_SPEAKER, "Hello again, World")
+
+	tests := []struct {
+		channel string
+		query   string
+		want    []string
+	}{
+		{"general", "hello world", []string{"Hello again, World", "hello world"}},
+		{"general", "hello", []string{"Hello again, World", "hello world"}},
+		{"random", "hello", []string{"hello from another channel"}},
+		{"general", "梗圖", []string{"今天的梗圖好好笑"}},
+		{"general", "梗", []string{"今天的梗圖好好笑"}},
+		{"general", "hello 梗圖", nil},
+		{"general", `"hello" OR NOT`, nil},
+	}
+	for _, test := range tests {
+		if texts := searchTexts(index, test.channel, test.query); !slices.Equal(texts, test.want) {
+			t.Errorf("Search(%q, %q) = %q, want %q", test.channel, test.query, texts, test.want)
+		}
+	}
+
+	forgotten, err := index.ForgetUser("alice")
+	if err != nil || forgotten != 3 {
+		t.Fatalf("ForgetUser = %d, %v, want 3 messages", forgotten, err)
+	}
+	if texts := searchTexts(index, "general", "hello"); texts != nil {
+		t.Errorf("forgotten messages still found: %q", texts)
+	}
+
+	// The IDs of the forgotten messages, the last one included, are not given again.
+	index.Record("general", "carol", "Carol", "new message")
+	messages, err := index.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1].ID != 5 {
+		t.Errorf("messages after forgetting = %+v, want the new one with ID 5", messages)
+	}
+}
+
+func TestMessageIndexImportsMessageLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+	lines := `{"id":3,"channel":"general","user":"Alice","user_id":"alice","text":"old meme","time":"2024-01-01T00:00:00Z"}
+{"id":4,"channel":"general","user":"Bo
+`
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenMessageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Record("general", "bob", "Bob", "new meme")
+	if texts := searchTexts(index, "general", "meme"); !slices.Equal(texts, []string{"new meme", "old meme"}) {
+		t.Errorf("imported messages found = %q", texts)
+	}
+	index.Close()
+
+	if _, err := os.Stat(path + ".jsonl"); err != nil {
+		t.Errorf("message lines not kept: %v", err)
+	}
+	messages, err := ReadIndexedMessages(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != 3 || messages[1].ID != 4 {
+		t.Errorf("messages read back = %+v, want IDs 3 and 4", messages)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const SELFTEST_PROMPT = "Reply with the single word: ready"
+
+const SELFTEST_MAX_TOKENS = 16 // The end-to-end completion only has to produce something.
+
+const SELFTEST_CAPTION = "SELF TEST"
+
+// # Self-test check
+//
+// This struct is one line of the self-test report. A check returning `errSkipped` wasn't configured.
+type SelfTestCheck struct {
+	Name string
+	Run  func(ctx context.Context) (string, error) // Returns a detail shown when the check passes.
+}
+
+var errSkipped = errors.New("not configured")
+
+// # Configuration file checks
+//
+// This function returns a check loading each configuration file set by a flag, so a broken file fails the self-test
+// instead of the start of the bot.
+func configurationFileChecks() []SelfTestCheck {
+	loaders := []struct {
+		flag    string
+		created bool // The file is created when missing.
+		load    func(path string) error
+	}{
+		{"channels", true, func(path string) error { _, err := OpenChannelConfigStore(path); return err }},
+		{"personas", false, func(path string) error { _, err := LoadPersonaLibrary(path); return err }},
+		{"triggers", false, func(path string) error { _, err := LoadTriggerEngine(path); return err }},
+		{"stickers", false, func(path string) error { _, err := LoadStickers(path); return err }},
+		{"experiment", false, func(path string) error { _, err := LoadExperiment(path); return err }},
+		{"fallback-replies", false, func(path string) error { _, err := LoadFallbackReplies(path); return err }},
+		{"profanity", false, func(path string) error { _, err := LoadProfanityFilter(path); return err }},
+		{"locales", false, func(path string) error { _, err := LoadMessageCatalog(path); return err }},
+		{"optout", true, func(path string) error { _, err := OpenPrivacyStore(path); return err }},
+	}
+
+	var checks []SelfTestCheck
+	for _, loader := range loaders {
+		found := flag.Lookup(loader.flag)
+		if found == nil {
+			continue
+		}
+		path, loader := found.Value.String(), loader
+		checks = append(checks, SelfTestCheck{Name: "file -" + loader.flag, Run: func(context.Context) (string, error) {
+			if path == "" {
+				return "", errSkipped
+			}
+			if _, err := os.Stat(path); err != nil && !(loader.created && errors.Is(err, os.ErrNotExist)) {
+				return "", err
+			}
+			return path, loader.load(path)
+		}})
+	}
+	return checks
+}
+
+// # Self-test checks
+//
+// This function returns the checks of the pipeline, in order: configuration, backend, chat template,
+// an end-to-end completion, then the optional image rendering, image generation and imgflip account.
+func selfTestChecks(client *LlmClient, endpoint string, param_template LlmGenerationParameters, library *MemeTemplateLibrary, font_path string, sd_url string, imgflip *ImgflipClient) []SelfTestCheck {
+	checks := []SelfTestCheck{
+		{"configuration", func(context.Context) (string, error) {
+			if path := flag.Lookup(CONFIG_FLAG).Value.String(); path != "" {
+				return path, nil // Loading it already succeeded.
+			}
+			return "flags and environment only", nil
+		}},
+	}
+	checks = append(checks, configurationFileChecks()...)
+
+	var prompt string
+	checks = append(checks,
+		SelfTestCheck{"backend", func(ctx context.Context) (string, error) {
+			return client.Url(""), client.Ping(ctx)
+		}},
+		SelfTestCheck{"chat template", func(context.Context) (string, error) {
+			chat_template, found := GetChatTemplate("")
+			if !found {
+				return "", fmt.Errorf("unknown chat template %q", DefaultChatTemplateName)
+			}
+			prompt = FormatPersonaConversation(chat_template, nil, []ChatTurn{{User: "hi", Model: "hello"}}, SELFTEST_PROMPT)
+			if !strings.Contains(prompt, SELFTEST_PROMPT) {
+				return "", fmt.Errorf("the %s template lost the user message", DefaultChatTemplateName)
+			}
+			return DefaultChatTemplateName, nil
+		}},
+		SelfTestCheck{"completion", func(ctx context.Context) (string, error) {
+			if prompt == "" {
+				return "", errors.New("no prompt, the chat template failed")
+			}
+			params := param_template.SetPrompt(prompt)
+			params.MaxTokens = SELFTEST_MAX_TOKENS
+			start := time.Now()
+			text, _, err := sendRequest(ctx, client.Server, client.Port, endpoint, NewGenerationRequest(Message{User: "selftest"}, params))
+			if err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(text) == "" {
+				return "", errors.New("the model returned an empty completion")
+			}
+			return fmt.Sprintf("%q in %s", strings.TrimSpace(text), time.Since(start).Round(time.Millisecond)), nil
+		}},
+		SelfTestCheck{"meme rendering", func(context.Context) (string, error) {
+			if library == nil || len(library.List()) == 0 {
+				return "", errSkipped
+			}
+			renderer, err := NewMemeRenderer(font_path)
+			if err != nil {
+				return "", err
+			}
+			meme_template := library.List()[0]
+			rendered, err := library.Render(renderer, meme_template, []string{SELFTEST_CAPTION, SELFTEST_CAPTION})
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %d bytes", meme_template.Name, len(rendered)), nil
+		}},
+		SelfTestCheck{"image generation", func(context.Context) (string, error) {
+			if sd_url == "" {
+				return "", errSkipped
+			}
+			_, _, err := NewStableDiffusionClient(sd_url).Progress()
+			return sd_url, err
+		}},
+		SelfTestCheck{"imgflip account", func(context.Context) (string, error) {
+			if imgflip.Username == "" {
+				return "", errSkipped
+			}
+			templates, err := imgflip.Templates()
+			if err != nil {
+				return "", err
+			}
+			if len(templates) == 0 {
+				return "", errors.New("imgflip has no templates")
+			}
+			url, err := imgflip.CaptionImage(templates[0].ID, []string{SELFTEST_CAPTION})
+			return url, err
+		}},
+	)
+	return checks
+}
+
+// # Self-test subcommand
+//
+// This function handles `selftest [-timeout d]`: it runs the checks of the pipeline with the settings the bot would start with,
+// and prints a pass/fail report. It fails when a check fails, for deployment smoke tests.
+func runSelfTestCommand(checks []SelfTestCheck, args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "time limit of each check")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		detail, err := check.Run(ctx)
+		cancel()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Fprintf(table, "SKIP\t%s\t%v\n", check.Name, err)
+		case err != nil:
+			failed++
+			fmt.Fprintf(table, "FAIL\t%s\t%v\n", check.Name, err)
+		default:
+			fmt.Fprintf(table, "PASS\t%s\t%s\n", check.Name, detail)
+		}
+	}
+	table.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Println("All checks passed.")
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SESSION_EXPIRY_INTERVAL = time.Minute // How often idle sessions are looked for.
+
+// # Session
+//
+// This struct holds the state of the conversation in a channel. Frontends answer the messages of a channel at once,
+// so the settings, the last reply and the members are read with `Settings`, `LastReply` and `MemberMentions`,
+// and changed with `Update`; the history, the recent messages and the replies guard themselves.
+type Session struct {
+	Channel  string
+	Voice    bool              // Reply with voice messages as well as text.
+	Persona  *Persona          // Character picked with `/persona`, nil for the channel default.
+	Styles   []string          // Reply styles picked with `/style`.
+	Language string            // Reply language picked with `/lang`, empty to let the model pick.
+	Recent   RecentMessages    // Last messages of the channel, given as context when chiming in.
+	History  ChatHistory       // Last exchanges with the bot, given as context when answering.
+	Replies  ReplyFingerprints // Last replies of the bot, to catch the repeated ones.
+
+	LastExchange *Exchange // Last generated reply, for feedback.
+	LastUsage    *LlmUsage // Token usage of the last reply, for `/tokens`.
+	LastHistory  int       // Previous exchanges given to the model for the last reply, after truncation.
+	LastActive   time.Time // Time of the last message, guarded by the store lock.
+	busy         int       // Generations writing to the session, guarded by the store lock.
+
+	Members map[string]string // Platform mentions of the members seen in the channel, by lowercase display name.
+
+	mu sync.Mutex
+}
+
+// # Session settings
+//
+// This struct is what was picked for a session with `/voice`, `/persona`, `/style` and `/lang`.
+type SessionSettings struct {
+	Voice    bool
+	Persona  *Persona
+	Styles   []string
+	Language string
+}
+
+// # Settings
+//
+// This function returns the settings of the session.
+func (session *Session) Settings() SessionSettings {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return SessionSettings{Voice: session.Voice, Persona: session.Persona, Styles: session.Styles, Language: session.Language}
+}
+
+// # Last reply
+//
+// This function returns the exchange of the last reply, its token usage, and the exchanges given to the model for it.
+func (session *Session) LastReply() (*Exchange, *LlmUsage, int) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.LastExchange, session.LastUsage, session.LastHistory
+}
+
+// # Member mentions
+//
+// This function returns a copy of the mentions of the members seen in the channel.
+func (session *Session) MemberMentions() map[string]string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return maps.Clone(session.Members)
+}
+
+// # Update session
+//
+// This function changes the settings, the last reply or the members of the session, under its lock.
+func (session *Session) Update(change func(session *Session)) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	change(session)
+}
+
+// # Session store
+//
+// This struct keeps the sessions of every channel the bot talks in.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: map[string]*Session{}}
+}
+
+// # Get session
+//
+// This function returns the session of the channel, creating it on first use.
+func (store *SessionStore) Get(channel string) *Session {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.get(channel)
+}
+
+func (store *SessionStore) get(channel string) *Session {
+	session, found := store.sessions[channel]
+	if !found {
+		session = &Session{Channel: channel}
+		store.sessions[channel] = session
+	}
+	return session
+}
+
+// # Touch session
+//
+// This function returns the session of the channel, marking it active now.
+func (store *SessionStore) Touch(channel string) *Session {
+	session := store.Get(channel)
+	store.mu.Lock()
+	session.LastActive = time.Now()
+	store.mu.Unlock()
+	return session
+}
+
+// # Acquire session
+//
+// This function returns the session of the channel for a generation, which will write its reply to it:
+// the session isn't expired until the generation calls `Release`.
+func (store *SessionStore) Acquire(channel string) *Session {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session := store.get(channel)
+	session.busy++
+	return session
+}
+
+// # Release session
+//
+// This function ends a generation started with `Acquire`.
+func (store *SessionStore) Release(session *Session) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	session.busy--
+}
+
+// # Expire idle sessions
+//
+// This function replaces the sessions without message for `idle` by fresh ones, keeping their settings,
+// and returns the expired sessions with their history. Sessions with a generation running are kept, so its reply isn't lost.
+func (store *SessionStore) Expire(idle time.Duration) []*Session {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var expired []*Session
+	for channel, session := range store.sessions {
+		if session.LastActive.IsZero() || time.Since(session.LastActive) < idle || session.busy > 0 {
+			continue
+		}
+		settings := session.Settings()
+		store.sessions[channel] = &Session{Channel: channel, Voice: settings.Voice, Persona: settings.Persona, Styles: settings.Styles,
+			Language: settings.Language, Members: session.MemberMentions()}
+		expired = append(expired, session)
+	}
+	return expired
+}
+
+// # Delete session
+//
+// This function drops the session of the channel; the next message starts a fresh one.
+func (store *SessionStore) Delete(channel string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, channel)
+}
+
+// # Forget user
+//
+// This function drops what the sessions keep of a user: their turns of the histories, their messages of the recent windows,
+// by display name, and their mention. It returns how many messages were dropped.
+func (store *SessionStore) ForgetUser(user string, name string) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	forgotten := 0
+	for _, session := range store.sessions {
+		forgotten += session.History.Forget(user)
+		forgotten += session.Recent.Forget(name)
+		session.Update(func(session *Session) { delete(session.Members, strings.ToLower(name)) })
+	}
+	return forgotten
+}
+
+// # Archived session
+//
+// This struct is a session cleared for inactivity, as written to the session archive.
+type ArchivedSession struct {
+	Channel    string     `json:"channel"`
+	ArchivedAt time.Time  `json:"archived_at"`
+	LastActive time.Time  `json:"last_active"`
+	History    []ChatTurn `json:"history,omitempty"`
+	Recent     []ChatLine `json:"recent,omitempty"`
+}
+
+// # Session archive
+//
+// This struct appends the cleared sessions to a JSON lines file, so old conversations can still be read.
+type SessionArchive struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// # Open session archive
+//
+// This function opens the session archive at `path` for appending.
+func OpenSessionArchive(path string) (*SessionArchive, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionArchive{file: file}, nil
+}
+
+// # Archive session
+//
+// This function writes the conversation of a session to the archive. Sessions without conversation are skipped.
+// Failures are logged, never returned.
+func (archive *SessionArchive) Archive(session *Session) {
+	if archive == nil {
+		return
+	}
+	entry := ArchivedSession{
+		Channel:    session.Channel,
+		ArchivedAt: time.Now(),
+		LastActive: session.LastActive,
+		History:    session.History.Turns(),
+		Recent:     session.Recent.Lines(),
+	}
+	if len(entry.History) == 0 && len(entry.Recent) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	if _, err := archive.file.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Forget user
+//
+// This function drops the turns of the user from the archived histories, and their messages from the archived recent windows,
+// by display name. Archived sessions left without conversation are dropped. It returns how many messages were dropped.
+func (archive *SessionArchive) ForgetUser(user string, name string) (int, error) {
+	if archive == nil {
+		return 0, nil
+	}
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+
+	return editAppendFile(&archive.file, func(session *ArchivedSession) (bool, int) {
+		forgotten := len(session.History) + len(session.Recent)
+		session.History = slices.DeleteFunc(session.History, func(turn ChatTurn) bool { return turn.Speaker == user })
+		session.Recent = slices.DeleteFunc(session.Recent, func(line ChatLine) bool { return line.User == name })
+		forgotten -= len(session.History) + len(session.Recent)
+		return len(session.History) > 0 || len(session.Recent) > 0, forgotten
+	})
+}
+
+// # Expire idle sessions
+//
+// This function clears, every minute, the sessions idle for longer than the session idle timeout, archiving their conversation,
+// so a topic from hours ago doesn't bleed into a new one. It returns when the context is done.
+func (bot *Bot) ExpireSessions(ctx context.Context) {
+	if bot.SessionIdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(SESSION_EXPIRY_INTERVAL, bot.SessionIdleTimeout))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, session := range bot.Sessions.Expire(bot.SessionIdleTimeout) {
+				log.Printf("session of %s idle since %s, cleared\n", session.Channel, session.LastActive.Format(time.RFC3339))
+				bot.SessionArchive.Archive(session)
+			}
+		}
+	}
+}
+
+// # Chat history
+//
+// This struct holds the last completed turns of the conversation with the bot, oldest first.
+type ChatHistory struct {
+	mu    sync.Mutex
+	turns []ChatTurn
+}
+
+// # Add turn
+//
+// This function appends a turn, dropping the oldest ones beyond `limit`. A limit of 0 keeps no history.
+func (history *ChatHistory) Add(turn ChatTurn, limit int) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if limit <= 0 {
+		history.turns = nil
+		return
+	}
+	history.turns = append(history.turns, turn)
+	if len(history.turns) > limit {
+		history.turns = append([]ChatTurn(nil), history.turns[len(history.turns)-limit:]...)
+	}
+}
+
+// # Turns
+//
+// This function returns a copy of the turns.
+func (history *ChatHistory) Turns() []ChatTurn {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	return append([]ChatTurn(nil), history.turns...)
+}
+
+// # Forget speaker
+//
+// This function drops the turns of the speaker, and returns how many were dropped.
+func (history *ChatHistory) Forget(speaker string) int {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	var kept []ChatTurn
+	for _, turn := range history.turns {
+		if turn.Speaker != speaker {
+			kept = append(kept, turn)
+		}
+	}
+	forgotten := len(history.turns) - len(kept)
+	history.turns = kept
+	return forgotten
+}
+
+// # Trim history
+//
+// This function drops the oldest turns beyond `limit`.
+func (history *ChatHistory) Trim(limit int) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if len(history.turns) > limit {
+		history.turns = append([]ChatTurn(nil), history.turns[len(history.turns)-limit:]...)
+	}
+}
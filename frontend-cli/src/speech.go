@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// # Transcription client
+//
+// This struct transcribes audio through an OpenAI-compatible transcription endpoint,
+// e.g. `http://whisper:8080/v1/audio/transcriptions`, or the `/inference` endpoint of the whisper.cpp server,
+// which takes the same multipart form.
+type TranscriptionClient struct {
+	Url      string
+	Model    string // Model name, required by OpenAI, ignored by whisper.cpp.
+	Language string // Spoken language hint (e.g. `zh`), empty to auto-detect.
+
+	http_client http.Client
+}
+
+// # Create a new transcription client
+//
+// This function creates a client for the transcription endpoint at `url`.
+func NewTranscriptionClient(url string, model string) *TranscriptionClient {
+	if model == "" {
+		model = "whisper-1"
+	}
+	return &TranscriptionClient{Url: url, Model: model, http_client: http.Client{Timeout: 5 * time.Minute}}
+}
+
+// # Transcribe
+//
+// This function uploads the audio and returns its transcription.
+// The file name is sent along, as some servers rely on its extension to pick the decoder.
+func (client *TranscriptionClient) Transcribe(audio []byte, file_name string) (string, error) {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+
+	part, err := writer.CreateFormFile("file", file_name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", err
+	}
+	writer.WriteField("model", client.Model)
+	writer.WriteField("response_format", "json")
+	if client.Language != "" {
+		writer.WriteField("language", client.Language)
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := client.http_client.Post(client.Url, writer.FormDataContentType(), &form)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var transcription struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(body, &transcription); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(transcription.Text), nil
+}
+
+// # Speech client
+//
+// This struct synthesizes speech through an OpenAI-compatible speech endpoint,
+// e.g. `http://tts:8000/v1/audio/speech` served by openedai-speech or a Piper wrapper.
+type SpeechClient struct {
+	Url    string
+	Model  string
+	Voice  string
+	Format string // Audio format: mp3, opus, wav...
+
+	http_client http.Client
+}
+
+// # Create a new speech client
+//
+// This function creates a client for the speech endpoint at `url`.
+func NewSpeechClient(url string, model string, voice string) *SpeechClient {
+	if model == "" {
+		model = "tts-1"
+	}
+	if voice == "" {
+		voice = "alloy"
+	}
+	return &SpeechClient{Url: url, Model: model, Voice: voice, Format: "mp3", http_client: http.Client{Timeout: 2 * time.Minute}}
+}
+
+// # Synthesize
+//
+// This function returns the spoken text, encoded in the client format.
+func (client *SpeechClient) Synthesize(text string) ([]byte, error) {
+	request_body, err := json.Marshal(map[string]string{
+		"model":           client.Model,
+		"input":           text,
+		"voice":           client.Voice,
+		"response_format": client.Format,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.http_client.Post(client.Url, "application/json", bytes.NewReader(request_body))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("speech synthesis failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message length limits of the platforms, in characters.
+var MESSAGE_LIMITS = map[string]int{
+	"discord":  2000,
+	"telegram": 4096,
+}
+
+const CODE_FENCE = "```"
+
+const (
+	SPLIT_MARKER_ROOM = 10 // Runes kept for the continuation marker of each part, e.g. `\n(2/3)`.
+	SPLIT_MIN_LIMIT   = 40 // Shortest part, below which the limit is raised.
+)
+
+// # Parse message limit
+//
+// This function reads a message length limit: a number of characters, 0 for no limit, or the name of a platform.
+func ParseMessageLimit(value string) (int, error) {
+	if limit, found := MESSAGE_LIMITS[strings.ToLower(value)]; found {
+		return limit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid message limit %q, expected a length or one of discord, telegram", value)
+	}
+	return limit, nil
+}
+
+// # Split message
+//
+// This function splits a text longer than the limit into parts that fit, each ending with a `(part/parts)` marker.
+// Parts are cut between code blocks or paragraphs when possible, then between lines, sentences and words.
+// A code block cut in two is closed at the end of the part and opened again, with its language, in the next one.
+// Texts within the limit, or with no limit, are a single part.
+func SplitMessage(text string, limit int) []string {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+	room := max(limit-SPLIT_MARKER_ROOM, SPLIT_MIN_LIMIT)
+
+	var parts []string
+	fence := "" // Opening fence of the code block the rest of the text is in, empty outside code.
+	rest := text
+	for rest != "" {
+		prefix := ""
+		if fence != "" {
+			prefix = fence + "\n"
+		}
+		window := room - utf8.RuneCountInString(prefix)
+		if utf8.RuneCountInString(rest) <= window {
+			parts = append(parts, prefix+strings.TrimRight(rest, " \n"))
+			break
+		}
+
+		cut := splitPoint(rest, window-len("\n"+CODE_FENCE), fence != "")
+		part, next_fence := rest[:cut], openFence(fence, rest[:cut])
+		part = prefix + strings.TrimRight(part, " \n")
+		if next_fence != "" {
+			part += "\n" + CODE_FENCE
+		}
+		parts = append(parts, part)
+
+		rest = strings.TrimLeft(rest[cut:], "\n")
+		if next_fence == "" {
+			rest = strings.TrimLeft(rest, " \n") // Indentation only matters in code.
+		}
+		fence = next_fence
+	}
+
+	for i := range parts {
+		parts[i] += fmt.Sprintf("\n(%d/%d)", i+1, len(parts))
+	}
+	return parts
+}
+
+// # Open fence
+//
+// This function follows the code fences of a text starting in the code block of `fence`, or outside code when empty,
+// and returns the opening fence of the code block the text ends in.
+func openFence(fence string, text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, CODE_FENCE) {
+			continue
+		}
+		if fence == "" {
+			fence = line
+		} else {
+			fence = ""
+		}
+	}
+	return fence
+}
+
+// # Split point
+//
+// This function returns where to cut the text so the first part has at most `window` runes,
+// at the best boundary in the second half of the window: outside code between blocks and paragraphs,
+// then between lines, after a sentence, between words, or anywhere as a last resort.
+func splitPoint(text string, window int, in_code bool) int {
+	end := len(text)
+	for i := range text {
+		if window == 0 {
+			end = i
+			break
+		}
+		window--
+	}
+	head := text[:end]
+	lowest := len(head) / 2
+
+	// Between code blocks and paragraphs, outside code.
+	block, position := -1, 0
+	for _, line := range strings.SplitAfter(head, "\n") {
+		is_fence := strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE)
+		if !in_code && position > lowest && (is_fence || strings.HasSuffix(head[:position], "\n\n")) {
+			block = position
+		}
+		if is_fence {
+			in_code = !in_code
+		}
+		position += len(line)
+		if is_fence && !in_code && strings.HasSuffix(line, "\n") {
+			block = position // After a closing fence.
+		}
+	}
+	if block > lowest {
+		return block
+	}
+
+	if line := strings.LastIndex(head, "\n"); line > lowest {
+		return line + 1
+	}
+	sentence := -1
+	for _, end := range []string{". ", "! ", "? ", "。", "！", "？"} {
+		if i := strings.LastIndex(head, end); i >= 0 && i+len(end) > sentence {
+			sentence = i + len(end)
+		}
+	}
+	if sentence > lowest {
+		return sentence
+	}
+	if space := strings.LastIndex(head, " "); space > lowest {
+		return space + 1
+	}
+	return len(head)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"within the limit", "short", 2000, []string{"short"}},
+		{"no limit", strings.Repeat("long ", 1000), 0, []string{strings.Repeat("long ", 1000)}},
+		{"words", strings.Repeat("word ", 30), 50, []string{
+			"word word word word word word word\n(1/5)",
+			"word word word word word word word\n(2/5)",
+			"word word word word word word word\n(3/5)",
+			"word word word word word word word\n(4/5)",
+			"word word\n(5/5)",
+		}},
+		{"paragraphs", "First paragraph is here.\n\nSecond paragraph is here too.\n\nThird one.", 50, []string{
+			"First paragraph is here.\n(1/3)",
+			"Second paragraph is here too.\n(2/3)",
+			"Third one.\n(3/3)",
+		}},
+		{"code block", "```go\n" + strings.Repeat("x := 1\n", 12) + "```", 60, []string{
+			"```go\nx := 1\nx := 1\nx := 1\nx := 1\nx := 1\n```\n(1/3)",
+			"```go\nx := 1\nx := 1\nx := 1\nx := 1\nx := 1\n```\n(2/3)",
+			"```go\nx := 1\nx := 1\n```\n(3/3)",
+		}},
+		{"CJK without spaces", strings.Repeat("梗", 100), 50, []string{
+			strings.Repeat("梗", 36) + "\n(1/3)",
+			strings.Repeat("梗", 36) + "\n(2/3)",
+			strings.Repeat("梗", 28) + "\n(3/3)",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts := SplitMessage(test.text, test.limit)
+			if !slices.Equal(parts, test.want) {
+				t.Errorf("SplitMessage(%q, %d) = %q, want %q", test.text, test.limit, parts, test.want)
+			}
+			for _, part := range parts {
+				if test.limit > 0 && utf8.RuneCountInString(part) > test.limit {
+					t.Errorf("part %q is longer than %d", part, test.limit)
+				}
+			}
+		})
+	}
+}
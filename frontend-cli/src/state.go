@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const STATE_MANIFEST = "manifest.json"
+
+const STATE_VERSION = 1
+
+// Flags naming the files and directories of the persistent state, archived under their flag name.
+// The message journal is left out: it only holds the messages in flight, and must be empty when the bot moves.
+var StateFlags = []string{
+	"memory", "personas", "channels", "feedback", "session-archive", "search-index",
+	"triggers", "schedules", "stickers", "chat-templates", "locales", "audit-log", "optout",
+}
+
+type StateManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Entries []string  `json:"entries"` // Flag names of the archived state.
+}
+
+// # State paths
+//
+// This function returns the configured paths of the persistent state, by flag name. Unset flags are left out.
+func StatePaths() map[string]string {
+	paths := map[string]string{}
+	for _, name := range StateFlags {
+		if value := flag.Lookup(name).Value.String(); value != "" {
+			paths[name] = value
+		}
+	}
+	return paths
+}
+
+// # State command
+//
+// This function handles the `export` and `import` commands, moving the persistent state of the bot between hosts
+// as a single `.tar.gz` archive. The paths are the ones given by the flags, e.g. `-memory` or `-personas`,
+// so the import may place the state elsewhere than the export found it. The bot must be stopped meanwhile.
+func runStateCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	force := flags.Bool("force", false, "overwrite the existing state files on import")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s [-force] <archive.tar.gz>", command)
+	}
+
+	paths := StatePaths()
+	if len(paths) == 0 {
+		return fmt.Errorf("no state configured, set its paths with -%s...", strings.Join(StateFlags, ", -"))
+	}
+	if command == "export" {
+		return ExportState(flags.Arg(0), paths)
+	}
+	return ImportState(flags.Arg(0), paths, *force)
+}
+
+// # Export state
+//
+// This function writes the state files and directories to a gzipped tar archive, with a manifest of its entries.
+// Configured paths that don't exist yet are skipped.
+func ExportState(archive_path string, paths map[string]string) error {
+	file, err := os.Create(archive_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+
+	manifest := StateManifest{Version: STATE_VERSION, Created: time.Now()}
+	for _, name := range StateFlags {
+		root, found := paths[name]
+		if !found {
+			continue
+		}
+		if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+			log.Printf("skipping %s: %s doesn't exist\n", name, root)
+			continue
+		}
+
+		err := filepath.WalkDir(root, func(file_path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			relative, err := filepath.Rel(root, file_path)
+			if err != nil {
+				return err
+			}
+			archived_name := name
+			if relative != "." {
+				archived_name = path.Join(name, filepath.ToSlash(relative))
+			}
+			return addToArchive(archive, archived_name, file_path)
+		})
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", name, err)
+		}
+		manifest.Entries = append(manifest.Entries, name)
+		fmt.Printf("exported %s from %s\n", name, root)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: STATE_MANIFEST, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// # Add to archive
+//
+// This function writes a file to the archive under the given name.
+func addToArchive(archive *tar.Writer, name string, file_path string) error {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// # Import state
+//
+// This function extracts an exported state archive to the configured paths.
+// Entries whose flag isn't set are skipped, and existing files are only overwritten with `force`.
+func ImportState(archive_path string, paths map[string]string, force bool) error {
+	file, err := os.Open(archive_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("invalid state archive %s: %w", archive_path, err)
+	}
+	archive := tar.NewReader(compressed)
+
+	skipped := map[string]bool{}
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid state archive %s: %w", archive_path, err)
+		}
+		if header.Name == STATE_MANIFEST {
+			var manifest StateManifest
+			if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+				return fmt.Errorf("invalid state manifest: %w", err)
+			}
+			if manifest.Version > STATE_VERSION {
+				return fmt.Errorf("state archive version %d is newer than this bot", manifest.Version)
+			}
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name, relative, _ := strings.Cut(path.Clean(header.Name), "/")
+		root, found := paths[name]
+		if !found {
+			if !skipped[name] {
+				log.Printf("skipping %s: its flag is not set\n", name)
+				skipped[name] = true
+			}
+			continue
+		}
+		if relative != "" && !filepath.IsLocal(filepath.FromSlash(relative)) {
+			return fmt.Errorf("invalid path %q in state archive", header.Name)
+		}
+		target := root
+		if relative != "" {
+			target = filepath.Join(root, filepath.FromSlash(relative))
+		}
+
+		if err := extractFile(archive, target, force); err != nil {
+			return fmt.Errorf("importing %s: %w", name, err)
+		}
+		fmt.Printf("imported %s to %s\n", header.Name, target)
+	}
+	return nil
+}
+
+// # Extract file
+//
+// This function writes the current archive entry to `target`, through a temporary file
+// so an interrupted import doesn't leave a truncated store behind.
+func extractFile(archive *tar.Reader, target string, force bool) error {
+	if _, err := os.Stat(target); err == nil && !force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := io.Copy(temporary, archive); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), target)
+}
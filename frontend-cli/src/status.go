@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SLOTS_ENDPOINT = "slots"
+
+const LATENCY_WINDOW = 20 // Generations averaged in the recent latency.
+
+const STATUS_TIMEOUT = 2 * time.Second // `/status` answers without the slots rather than wait on a stuck backend.
+
+// # Backend slot
+//
+// This struct is a slot of a llama.cpp server, as listed by its `/slots` endpoint.
+// Recent servers report `is_processing`, older ones a `state` that isn't 0 when busy.
+type BackendSlot struct {
+	ID           int  `json:"id"`
+	IsProcessing bool `json:"is_processing"`
+	State        int  `json:"state"`
+}
+
+func (slot BackendSlot) Busy() bool {
+	return slot.IsProcessing || slot.State != 0
+}
+
+// # Get backend slots
+//
+// This function fetches the slots of the backend. Backends without `/slots`, like llama-cpp-python,
+// or llama.cpp servers started without `--slots`, fail.
+func (client *LlmClient) Slots(ctx context.Context) ([]BackendSlot, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Url(SLOTS_ENDPOINT), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ParseBackendError(resp.StatusCode, body)
+	}
+	var slots []BackendSlot
+	if err := json.Unmarshal(body, &slots); err != nil {
+		return nil, fmt.Errorf("invalid backend slots: %w", err)
+	}
+	return slots, nil
+}
+
+// # Latency tracker
+//
+// This struct keeps the durations of the last generations, from submission to result, queueing included.
+type LatencyTracker struct {
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+// # Add duration
+//
+// This function records the duration of a generation, forgetting the oldest beyond the window.
+func (tracker *LatencyTracker) Add(duration time.Duration) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.durations = append(tracker.durations, duration)
+	if len(tracker.durations) > LATENCY_WINDOW {
+		tracker.durations = tracker.durations[len(tracker.durations)-LATENCY_WINDOW:]
+	}
+}
+
+// # Average duration
+//
+// This function returns the average of the recorded durations, and how many there are.
+func (tracker *LatencyTracker) Average() (time.Duration, int) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.durations) == 0 {
+		return 0, 0
+	}
+	var total time.Duration
+	for _, duration := range tracker.durations {
+		total += duration
+	}
+	return total / time.Duration(len(tracker.durations)), len(tracker.durations)
+}
+
+const DEFAULT_QUEUE_NOTICE_DEPTH = 3 // Requests waiting ahead of a chat request past which its sender is told their place in line.
+
+// # Notice queue position
+//
+// This function tells the sender of an interactive request waiting behind at least `QueueNoticeDepth` others
+// their place in line, with a wait estimated from the last generation times, through the status callback.
+// It returns whether a notice was posted, for the caller to clear it once the reply is ready.
+func (bot *Bot) noticeQueuePosition(message Message, request *GenerationRequest) bool {
+	if bot.Status == nil || bot.QueueNoticeDepth <= 0 || request.Priority != PRIORITY_INTERACTIVE {
+		return false
+	}
+	ahead := bot.requests.Position(request)
+	if ahead < bot.QueueNoticeDepth {
+		return false
+	}
+	notice := bot.T(message, "You're #%d in line.", ahead+1)
+	if average, count := bot.generations.Average(); count > 0 {
+		wait := max((time.Duration(ahead+1) * average).Round(time.Second), time.Second) // The generation running now, then the ones ahead.
+		notice = bot.T(message, "You're #%d in line, ~%s.", ahead+1, wait)
+	}
+	bot.Status(message.Channel, notice)
+	return true
+}
+
+// # Status
+//
+// This function handles the `/status` command, showing why the bot may be slow: the requests waiting in the queue,
+// the busy slots of the backend when it lists them, and the average reply time of the last generations.
+func (bot *Bot) status(message Message, _ string) Reply {
+	lines := []string{bot.T(message, "Requests waiting: %d", bot.requests.Len())}
+
+	ctx, cancel := context.WithTimeout(context.Background(), STATUS_TIMEOUT)
+	defer cancel()
+	if slots, err := bot.Client.Slots(ctx); err == nil && len(slots) > 0 {
+		busy := 0
+		for _, slot := range slots {
+			if slot.Busy() {
+				busy++
+			}
+		}
+		lines = append(lines, bot.T(message, "Backend slots busy: %d of %d", busy, len(slots)))
+	} else {
+		lines = append(lines, bot.T(message, "Backend slots busy: unknown"))
+	}
+
+	if average, count := bot.latencies.Average(); count > 0 {
+		lines = append(lines, bot.T(message, "Average reply time: %s over the last %d replies", average.Round(100*time.Millisecond), count))
+	} else {
+		lines = append(lines, bot.T(message, "Average reply time: no reply yet"))
+	}
+	return Reply{Text: strings.Join(lines, "\n")}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STREAM_TOKENS   = 8               // Tokens between two partial reply updates.
+	DEFAULT_STREAM_INTERVAL = 1 * time.Second // Longest delay between two partial reply updates.
+)
+
+// # Stream prompt
+//
+// This function sends the prompt with streaming enabled and calls `on_token` with every token as the
+// server-sent events arrive, until the context is done. It returns the whole text, and the token usage if the backend reports it.
+// Errors reported by the backend are returned as `*BackendError`, and a completion without any text as `*EmptyCompletionError`.
+func StreamPrompt(ctx context.Context, server string, port int, endpoint string, param_with_prompt LlmGenerationParameters, on_token func(token string)) (string, *LlmUsage, error) {
+	param_with_prompt.Stream = true
+	url := fmt.Sprintf("http://%s:%d/%s", server, port, endpoint)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(param_with_prompt.ToJSON()))
+	if err != nil {
+		return "", nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", nil, ParseBackendError(resp.StatusCode, body)
+	}
+
+	var text strings.Builder
+	var usage *LlmUsage
+	finish_reason := ""
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data:")
+		if !found {
+			continue // Blank separators, comments and keep-alives.
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return text.String(), usage, checkCompletion(text.String(), finish_reason)
+		}
+
+		if err := ParseBackendError(http.StatusOK, []byte(data)); err != nil {
+			return text.String(), usage, err
+		}
+		var chunk LlmResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return text.String(), usage, fmt.Errorf("invalid stream chunk %q: %w", data, err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+			finish_reason = chunk.Choices[0].FinishReason
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Text != "" {
+			text.WriteString(chunk.Choices[0].Text)
+			on_token(chunk.Choices[0].Text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return text.String(), usage, err
+	}
+	return text.String(), usage, io.ErrUnexpectedEOF
+}
+
+// # Partial reply throttle
+//
+// This struct forwards the text generated so far to a frontend callback, at most every `Tokens` tokens
+// or `Interval`, whichever comes first, so frontends editing a placeholder message don't hit the rate limits of their platform.
+type PartialReplyThrottle struct {
+	Tokens   int
+	Interval time.Duration
+	Callback func(partial string)
+
+	mu          sync.Mutex
+	text        strings.Builder
+	pending     int
+	last_update time.Time
+}
+
+// # Add token
+//
+// This function appends a token and calls back when an update is due.
+func (throttle *PartialReplyThrottle) Add(token string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	if throttle.last_update.IsZero() {
+		throttle.last_update = time.Now()
+	}
+	throttle.text.WriteString(token)
+	throttle.pending++
+	if throttle.pending >= throttle.Tokens || time.Since(throttle.last_update) >= throttle.Interval {
+		throttle.pending = 0
+		throttle.last_update = time.Now()
+		throttle.Callback(throttle.text.String())
+	}
+}
+
+// # Reset
+//
+// This function forgets the text, when the generation restarts.
+func (throttle *PartialReplyThrottle) Reset() {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.text.Reset()
+	throttle.pending = 0
+}
+
+// # Terminal streamer
+//
+// This struct prints the partial replies in the terminal as they grow, for the typing effect of the CLI.
+type TerminalStreamer struct {
+	printed string
+}
+
+// # Print partial reply
+//
+// This function prints the part of the partial reply not printed yet.
+// When the generation restarted, the reply starts over on a new line.
+func (streamer *TerminalStreamer) Partial(partial string) {
+	if streamer.printed == "" {
+		fmt.Print("Model: ")
+	} else if !strings.HasPrefix(partial, streamer.printed) {
+		fmt.Print("\nModel: ")
+		streamer.printed = ""
+	}
+	fmt.Print(partial[len(streamer.printed):])
+	streamer.printed = partial
+}
+
+// # Finish
+//
+// This function prints the end of the final reply, and returns the reply without the text if it was streamed.
+func (streamer *TerminalStreamer) Finish(reply Reply) Reply {
+	if streamer.printed == "" {
+		return reply
+	}
+	if rest, found := strings.CutPrefix(reply.Text, streamer.printed); found {
+		fmt.Println(rest)
+	} else {
+		fmt.Println()
+		fmt.Println("Model:", reply.Text)
+	}
+	streamer.printed = ""
+	reply.Text = ""
+	return reply
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const STYLE_PROMPT_HEADER = "Instructions for your reply:"
+
+// Instructions of the reply styles picked with `/style`.
+var ResponseStyles = map[string]string{
+	"short":   "Keep it short: one or two sentences.",
+	"long":    "Answer in detail, with examples when useful.",
+	"formal":  "Use a formal, polite tone.",
+	"casual":  "Use a casual, relaxed tone.",
+	"funny":   "Be funny, joke around.",
+	"serious": "Stay serious, no jokes.",
+	"emoji":   "Use plenty of emoji.",
+}
+
+// # Style names
+//
+// This function returns the sorted names of the reply styles.
+func StyleNames() []string {
+	names := make([]string, 0, len(ResponseStyles))
+	for name := range ResponseStyles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// # Style instructions
+//
+// This function returns the instructions of the styles and the reply language, empty when there are none.
+func StyleInstructions(styles []string, language string) []string {
+	instructions := make([]string, 0, len(styles)+1)
+	for _, style := range styles {
+		if instruction, found := ResponseStyles[style]; found {
+			instructions = append(instructions, instruction)
+		}
+	}
+	if language != "" {
+		instructions = append(instructions, fmt.Sprintf("Reply in %s.", languageName(language)))
+	}
+	return instructions
+}
+
+// # Inject style
+//
+// This function prepends the style instructions to the user prompt.
+// The chat template has no system turn, so the instructions become part of the user turn, like the memories.
+func InjectStyle(prompt string, instructions []string) string {
+	if len(instructions) == 0 {
+		return prompt
+	}
+
+	var builder strings.Builder
+	builder.WriteString(STYLE_PROMPT_HEADER)
+	builder.WriteString("\n")
+	for _, instruction := range instructions {
+		builder.WriteString("- ")
+		builder.WriteString(instruction)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	builder.WriteString(prompt)
+	return builder.String()
+}
+
+// # Set style
+//
+// This function handles the `/style` command: without argument it shows the styles of the session,
+// `default` drops them, and style names, e.g. `/style short formal`, replace them.
+func (bot *Bot) setStyle(message Message, args string) Reply {
+	session := bot.Sessions.Get(message.Channel)
+	available := strings.Join(StyleNames(), ", ")
+
+	if args == "" {
+		current := strings.Join(session.Settings().Styles, ", ")
+		if current == "" {
+			current = bot.T(message, "none")
+		}
+		return Reply{Text: bot.T(message, "Style: %s. Available: %s", current, available)}
+	}
+	if strings.EqualFold(args, "default") {
+		session.Update(func(session *Session) { session.Styles = nil })
+		return Reply{Text: bot.T(message, "Back to my usual style.")}
+	}
+
+	styles := strings.Fields(strings.ToLower(args))
+	for _, style := range styles {
+		if _, found := ResponseStyles[style]; !found {
+			return Reply{Text: bot.T(message, "Unknown style %q. Available: %s", style, available)}
+		}
+	}
+	session.Update(func(session *Session) { session.Styles = styles })
+	return Reply{Text: bot.T(message, "Style set to %s.", strings.Join(styles, ", "))}
+}
+
+// # Set reply language
+//
+// This function handles the `/lang` command: without argument it shows the reply language of the session,
+// `default` lets the model pick, and a language code, e.g. `/lang zh`, asks for replies in that language.
+func (bot *Bot) setLanguage(message Message, code string) Reply {
+	session := bot.Sessions.Get(message.Channel)
+	switch {
+	case code == "":
+		current := bot.T(message, "none")
+		if language := session.Settings().Language; language != "" {
+			current = languageName(language)
+		}
+		return Reply{Text: bot.T(message, "Reply language: %s.", current)}
+	case strings.EqualFold(code, "default"):
+		session.Update(func(session *Session) { session.Language = "" })
+		return Reply{Text: bot.T(message, "I'll reply in whatever language fits.")}
+	default:
+		language := normalizeLocale(code)
+		session.Update(func(session *Session) { session.Language = language })
+		return Reply{Text: bot.T(message, "Reply language set to %s.", languageName(language))}
+	}
+}
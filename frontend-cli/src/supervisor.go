@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FRONTEND_MIN_BACKOFF = 1 * time.Second // Delay before restarting a crashed frontend, doubled on every crash in a row.
+	FRONTEND_MAX_BACKOFF = 1 * time.Minute
+	FRONTEND_STABLE      = 5 * time.Minute // Running this long resets the delay.
+)
+
+// # Status frontend
+//
+// This interface is implemented by the frontends showing the progress notices of the bot their own way.
+// The others show their typing indicator instead.
+type StatusFrontend interface {
+	Status(channel string, status string)
+	ClearStatus(channel string)
+}
+
+// # Supervisor
+//
+// This struct runs several frontends at once against one bot, so they share its sessions, settings and backend,
+// e.g. the CLI for the admin next to a chat platform. A frontend which fails or panics is restarted after a delay,
+// without taking the others down; one which stops by itself, like the CLI at the end of its input, is left stopped.
+//
+// The supervisor also routes the unprompted posts and the progress notices of the bot to the frontend of their channel:
+// the one the channel was last heard on, or the one named by the channel prefix, e.g. `telegram:` for `telegram:1234`,
+// or else the first frontend added.
+type Supervisor struct {
+	Bot *Bot
+
+	names     []string
+	frontends map[string]Frontend
+	channels  sync.Map // Frontend names, by channel.
+}
+
+func NewSupervisor(bot *Bot) *Supervisor {
+	return &Supervisor{Bot: bot, frontends: map[string]Frontend{}}
+}
+
+// # Add frontend
+//
+// This function adds a frontend to run, under a unique name.
+func (supervisor *Supervisor) Add(name string, frontend Frontend) error {
+	if _, found := supervisor.frontends[name]; found {
+		return fmt.Errorf("frontend %s added twice", name)
+	}
+	supervisor.names = append(supervisor.names, name)
+	supervisor.frontends[name] = frontend
+	return nil
+}
+
+// # Frontend of channel
+//
+// This function returns the frontend the channel belongs to, nil when no frontend was added.
+func (supervisor *Supervisor) frontendOf(channel string) Frontend {
+	if name, found := supervisor.channels.Load(channel); found {
+		return supervisor.frontends[name.(string)]
+	}
+	if prefix, _, found := strings.Cut(channel, ":"); found && supervisor.frontends[prefix] != nil {
+		return supervisor.frontends[prefix]
+	}
+	if len(supervisor.names) == 0 {
+		return nil
+	}
+	return supervisor.frontends[supervisor.names[0]]
+}
+
+// # Post
+//
+// This function posts a reply in a channel through its frontend, for `Bot.Post`.
+func (supervisor *Supervisor) Post(channel string, reply Reply) {
+	frontend := supervisor.frontendOf(channel)
+	if frontend == nil {
+		log.Printf("no frontend to post to %s\n", channel)
+		return
+	}
+	if _, err := frontend.SendReply(channel, reply); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Status
+//
+// This function shows a progress notice in a channel through its frontend, for `Bot.Status`.
+func (supervisor *Supervisor) Status(channel string, status string) {
+	switch frontend := supervisor.frontendOf(channel).(type) {
+	case nil:
+	case StatusFrontend:
+		frontend.Status(channel, status)
+	default:
+		if err := frontend.Typing(channel); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// # Clear status
+//
+// This function removes the progress notice of a channel, for `Bot.ClearStatus`.
+func (supervisor *Supervisor) ClearStatus(channel string) {
+	if frontend, ok := supervisor.frontendOf(channel).(StatusFrontend); ok {
+		frontend.ClearStatus(channel)
+	}
+}
+
+// # Run
+//
+// This function runs the frontends until they all stop, the context is done, or the bot is shut down.
+func (supervisor *Supervisor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, name := range supervisor.names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			supervisor.supervise(ctx, name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+// # Supervise frontend
+//
+// This function serves a frontend, restarting it with a growing delay while it fails.
+func (supervisor *Supervisor) supervise(ctx context.Context, name string) {
+	backoff := FRONTEND_MIN_BACKOFF
+	for {
+		started_at := time.Now()
+		err := supervisor.serve(ctx, name)
+		if err == nil {
+			log.Printf("frontend %s stopped\n", name)
+			return
+		}
+		if time.Since(started_at) > FRONTEND_STABLE {
+			backoff = FRONTEND_MIN_BACKOFF
+		}
+		log.Printf("frontend %s failed, restarting it in %s: %v\n", name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		case <-supervisor.Bot.Stopped():
+			return
+		}
+		backoff = min(backoff*2, FRONTEND_MAX_BACKOFF)
+	}
+}
+
+// # Serve frontend
+//
+// This function serves a frontend once, turning its panics into errors. Panics in goroutines of the frontend's own
+// can't be recovered, and still crash the process.
+func (supervisor *Supervisor) serve(ctx context.Context, name string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+	return supervisor.Bot.Serve(ctx, &routedFrontend{Frontend: supervisor.frontends[name], name: name, channels: &supervisor.channels})
+}
+
+// # Routed frontend
+//
+// This struct wraps a supervised frontend, noting the channels its messages come from.
+type routedFrontend struct {
+	Frontend
+	name     string
+	channels *sync.Map
+}
+
+func (frontend *routedFrontend) ReceiveMessages(ctx context.Context, handle func(incoming Incoming)) error {
+	return frontend.Frontend.ReceiveMessages(ctx, func(incoming Incoming) {
+		frontend.channels.Store(incoming.Channel, frontend.name)
+		handle(incoming)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const MEME_TEMPLATES_METADATA = "templates.json"
+
+// # Meme template
+//
+// This struct describes a template image of the library.
+// `File` is relative to the library directory; templates without text boxes use the classic top/bottom layout.
+type MemeTemplate struct {
+	Name        string        `json:"name"`
+	File        string        `json:"file"`
+	Description string        `json:"description,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Boxes       []MemeTextBox `json:"boxes,omitempty"`
+}
+
+// # Text boxes
+//
+// This function returns the text boxes of the template, falling back to the classic layout.
+func (meme_template MemeTemplate) TextBoxes() []MemeTextBox {
+	if len(meme_template.Boxes) == 0 {
+		return DefaultMemeTextBoxes
+	}
+	return meme_template.Boxes
+}
+
+// # Meme template library
+//
+// This struct holds the templates of a directory, described by a `templates.json` file:
+//
+//	[
+//	  {"name": "drake", "file": "drake.jpg", "tags": ["choice", "prefer"],
+//	   "boxes": [{"x": 0.5, "y": 0, "width": 0.5, "height": 0.5}, {"x": 0.5, "y": 0.5, "width": 0.5, "height": 0.5}]}
+//	]
+type MemeTemplateLibrary struct {
+	Dir string
+
+	mu        sync.RWMutex
+	templates []MemeTemplate
+}
+
+// # Load meme template library
+//
+// This function reads the template metadata from `dir`.
+func LoadMemeTemplateLibrary(dir string) (*MemeTemplateLibrary, error) {
+	library := &MemeTemplateLibrary{Dir: dir}
+	if err := library.Reload(); err != nil {
+		return nil, err
+	}
+	return library, nil
+}
+
+// # Reload meme template library
+//
+// This function reads the template metadata again, checking the text boxes lie within the images, as fractions of their size.
+// On error, the current templates are kept.
+func (library *MemeTemplateLibrary) Reload() error {
+	data, err := os.ReadFile(filepath.Join(library.Dir, MEME_TEMPLATES_METADATA))
+	if err != nil {
+		return err
+	}
+
+	var templates []MemeTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("invalid %s: %w", MEME_TEMPLATES_METADATA, err)
+	}
+
+	seen := map[string]bool{}
+	for _, meme_template := range templates {
+		if meme_template.Name == "" || meme_template.File == "" {
+			return fmt.Errorf("template without name or file in %s", MEME_TEMPLATES_METADATA)
+		}
+		if seen[strings.ToLower(meme_template.Name)] {
+			return fmt.Errorf("duplicated template %q", meme_template.Name)
+		}
+		for i, box := range meme_template.Boxes {
+			if !box.Inside() {
+				return fmt.Errorf("text box %d of template %q is empty or outside the image", i+1, meme_template.Name)
+			}
+		}
+		seen[strings.ToLower(meme_template.Name)] = true
+	}
+
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+
+	library.mu.Lock()
+	library.templates = templates
+	library.mu.Unlock()
+	return nil
+}
+
+// # List templates
+//
+// This function returns the templates, sorted by name.
+func (library *MemeTemplateLibrary) List() []MemeTemplate {
+	library.mu.RLock()
+	defer library.mu.RUnlock()
+	return library.templates
+}
+
+// # Find template
+//
+// This function returns the template with the given name, ignoring case.
+// A nil library has no templates.
+func (library *MemeTemplateLibrary) Find(name string) (MemeTemplate, bool) {
+	if library == nil {
+		return MemeTemplate{}, false
+	}
+	for _, meme_template := range library.List() {
+		if strings.EqualFold(meme_template.Name, name) {
+			return meme_template, true
+		}
+	}
+	return MemeTemplate{}, false
+}
+
+// # Search templates
+//
+// This function returns the templates matching every word of the query,
+// looking at the name, the tags and the description. Tag and name matches rank first.
+func (library *MemeTemplateLibrary) Search(query string) []MemeTemplate {
+	words := strings.Fields(strings.ToLower(query))
+
+	type ranked struct {
+		meme_template MemeTemplate
+		score         int
+	}
+	var results []ranked
+	for _, meme_template := range library.List() {
+		score := 0
+		for _, word := range words {
+			word_score := 0
+			if strings.Contains(strings.ToLower(meme_template.Name), word) {
+				word_score = 3
+			}
+			for _, tag := range meme_template.Tags {
+				if strings.EqualFold(tag, word) {
+					word_score = max(word_score, 3)
+				} else if strings.Contains(strings.ToLower(tag), word) {
+					word_score = max(word_score, 2)
+				}
+			}
+			if word_score == 0 && strings.Contains(strings.ToLower(meme_template.Description), word) {
+				word_score = 1
+			}
+			if word_score == 0 {
+				score = 0
+				break
+			}
+			score += word_score
+		}
+		if score > 0 {
+			results = append(results, ranked{meme_template, score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].score > results[j].score })
+
+	templates := make([]MemeTemplate, len(results))
+	for i, result := range results {
+		templates[i] = result.meme_template
+	}
+	return templates
+}
+
+// # Load template image
+//
+// This function decodes the image of the template.
+func (library *MemeTemplateLibrary) Image(meme_template MemeTemplate) (image.Image, error) {
+	return LoadTemplateImage(filepath.Join(library.Dir, meme_template.File))
+}
+
+// # Render template
+//
+// This function renders the texts into the text boxes of the template.
+func (library *MemeTemplateLibrary) Render(renderer *MemeRenderer, meme_template MemeTemplate, texts []string) ([]byte, error) {
+	template_image, err := library.Image(meme_template)
+	if err != nil {
+		return nil, err
+	}
+	return renderer.RenderBoxes(template_image, meme_template.TextBoxes(), texts)
+}
+
+// # Preview template
+//
+// This function renders the template with every text box labeled by its number.
+func (library *MemeTemplateLibrary) Preview(renderer *MemeRenderer, meme_template MemeTemplate) ([]byte, error) {
+	boxes := meme_template.TextBoxes()
+	labels := make([]string, len(boxes))
+	for i := range boxes {
+		labels[i] = fmt.Sprintf("text %d", i+1)
+	}
+	return library.Render(renderer, meme_template, labels)
+}
+
+// # Template command
+//
+// This function handles the `templates` subcommand.
+//
+// Usage:
+//
+// - templates list
+// - templates search <query>
+// - templates preview <name> <output png>
+func runTemplatesCommand(library *MemeTemplateLibrary, font_path string, args []string) error {
+	if library == nil {
+		return fmt.Errorf("no template library, set it with -templates")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: templates list | search <query> | preview <name> <output png>")
+	}
+
+	print_templates := func(templates []MemeTemplate) {
+		for _, meme_template := range templates {
+			fmt.Printf("%-24s %d boxes  [%s]  %s\n", meme_template.Name, len(meme_template.TextBoxes()), strings.Join(meme_template.Tags, ", "), meme_template.Description)
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		print_templates(library.List())
+	case "search":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: templates search <query>")
+		}
+		results := library.Search(strings.Join(args[1:], " "))
+		if len(results) == 0 {
+			fmt.Println("No template found.")
+		}
+		print_templates(results)
+	case "preview":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: templates preview <name> <output png>")
+		}
+		meme_template, found := library.Find(args[1])
+		if !found {
+			return fmt.Errorf("no template named %q", args[1])
+		}
+		renderer, err := NewMemeRenderer(font_path)
+		if err != nil {
+			return err
+		}
+		preview, err := library.Preview(renderer, meme_template)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(args[2], preview, 0644)
+	default:
+		return fmt.Errorf("unknown templates command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const DEFAULT_MODEL_LANGUAGE = "en"
+
+const LANGUAGE_DETECT_PROMPT = `Which language is the message below written in? Reply with its ISO 639-1 code only, e.g. en, zh, ja.
+
+Message: %s`
+
+const TRANSLATE_PROMPT = `Translate the message below from %s to %s. Keep the tone, slang and emojis. Reply with the translation only.
+
+Message: %s`
+
+// Names of the common languages, for the translation prompts.
+var LanguageNames = map[string]string{
+	"en": "English", "zh": "Chinese", "ja": "Japanese", "ko": "Korean", "fr": "French", "de": "German",
+	"es": "Spanish", "pt": "Portuguese", "it": "Italian", "ru": "Russian", "ar": "Arabic", "th": "Thai",
+	"vi": "Vietnamese", "id": "Indonesian", "hi": "Hindi", "tr": "Turkish", "nl": "Dutch", "pl": "Polish",
+}
+
+// # Translator
+//
+// This interface abstracts the translation providers. Languages are ISO 639-1 codes.
+type Translator interface {
+	Detect(text string) (string, error)
+	Translate(text string, source string, target string) (string, error)
+}
+
+// # Create a new translator
+//
+// This function creates the translator of the given provider: `llm` uses the chat model through `generate`,
+// `libretranslate` the LibreTranslate server at `url`.
+func NewTranslator(provider string, url string, api_key string, generate func(prompt string) (string, error)) (Translator, error) {
+	switch provider {
+	case "llm":
+		return &LlmTranslator{Generate: generate}, nil
+	case "libretranslate":
+		if url == "" {
+			return nil, fmt.Errorf("the libretranslate provider needs a server URL")
+		}
+		return &LibreTranslateClient{Url: strings.TrimSuffix(url, "/"), ApiKey: api_key, http_client: http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown translation provider %q", provider)
+	}
+}
+
+// # Language base
+//
+// This function reduces a language tag to its base language: `zh-TW` is `zh`.
+func languageBase(language string) string {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(language)), "-")
+	base, _, _ = strings.Cut(base, "_")
+	return base
+}
+
+// # Language name
+//
+// This function returns the English name of a language code, or the code when unknown.
+func languageName(language string) string {
+	if name, found := LanguageNames[languageBase(language)]; found {
+		return name
+	}
+	return language
+}
+
+// # Detect script language
+//
+// This function guesses the language from the writing system, for the scripts used by a single major language.
+// It reports false for Latin text and mixed scripts, which need a real detector.
+func detectScriptLanguage(text string) (string, bool) {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["hi"]++
+		}
+	}
+
+	// Japanese mixes kana and kanji.
+	if counts["ja"] > 0 && counts["ja"]+counts["zh"] > letters/2 {
+		return "ja", true
+	}
+	for language, count := range counts {
+		if count > letters/2 {
+			return language, true
+		}
+	}
+	return "", false
+}
+
+// # LLM translator
+//
+// This struct translates with the chat model itself.
+type LlmTranslator struct {
+	Generate func(prompt string) (string, error)
+}
+
+func (translator *LlmTranslator) Detect(text string) (string, error) {
+	if language, found := detectScriptLanguage(text); found {
+		return language, nil
+	}
+	response, err := translator.Generate(fmt.Sprintf(LANGUAGE_DETECT_PROMPT, text))
+	if err != nil {
+		return "", err
+	}
+	language := languageBase(strings.Trim(strings.TrimSpace(response), ".`'\""))
+	if len(language) < 2 || len(language) > 3 {
+		return "", fmt.Errorf("unexpected language code %q", response)
+	}
+	return language, nil
+}
+
+func (translator *LlmTranslator) Translate(text string, source string, target string) (string, error) {
+	response, err := translator.Generate(fmt.Sprintf(TRANSLATE_PROMPT, languageName(source), languageName(target), text))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// # LibreTranslate client
+//
+// This struct translates with a LibreTranslate server (https://libretranslate.com), which can be self-hosted.
+type LibreTranslateClient struct {
+	Url    string
+	ApiKey string
+
+	http_client http.Client
+}
+
+// # Post JSON
+//
+// This function sends a JSON request to a LibreTranslate endpoint and decodes the JSON response.
+func (client *LibreTranslateClient) postJSON(endpoint string, request map[string]string, data interface{}) error {
+	if client.ApiKey != "" {
+		request["api_key"] = client.ApiKey
+	}
+	request_body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.http_client.Post(client.Url+endpoint, "application/json", bytes.NewReader(request_body))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("translation request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, data)
+}
+
+func (client *LibreTranslateClient) Detect(text string) (string, error) {
+	var detections []struct {
+		Language   string  `json:"language"`
+		Confidence float64 `json:"confidence"`
+	}
+	if err := client.postJSON("/detect", map[string]string{"q": text}, &detections); err != nil {
+		return "", err
+	}
+	if len(detections) == 0 {
+		return "", fmt.Errorf("no language detected")
+	}
+	return languageBase(detections[0].Language), nil
+}
+
+func (client *LibreTranslateClient) Translate(text string, source string, target string) (string, error) {
+	var translation struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	err := client.postJSON("/translate", map[string]string{"q": text, "source": source, "target": target, "format": "text"}, &translation)
+	return translation.TranslatedText, err
+}
+
+// # Translate input
+//
+// This function detects the language of the user input and translates it to the model language.
+// It returns the input unchanged, with an empty language, when it is already in the model language or the translation fails.
+func (bot *Bot) translateInput(user_input string) (string, string) {
+	language, err := bot.Translator.Detect(user_input)
+	if err != nil {
+		log.Println(fmt.Errorf("language detection: %w", err))
+		return user_input, ""
+	}
+	if language == languageBase(bot.ModelLanguage) {
+		return user_input, ""
+	}
+
+	translated, err := bot.Translator.Translate(user_input, language, bot.ModelLanguage)
+	if err != nil || translated == "" {
+		log.Println(fmt.Errorf("translation to %s: %w", bot.ModelLanguage, err))
+		return user_input, ""
+	}
+	return translated, language
+}
+
+// # Translating
+//
+// This function reports whether the messages of the channel are translated.
+func (bot *Bot) translating(channel string) bool {
+	return bot.Translator != nil && bot.Channels.Get(channel).Translate
+}
+
+// # Translate reply
+//
+// This function translates the reply back to the language of the user, keeping the original on failure.
+func (bot *Bot) translateReply(response string, language string) string {
+	if language == "" {
+		return response
+	}
+	translated, err := bot.Translator.Translate(response, bot.ModelLanguage, language)
+	if err != nil || translated == "" {
+		log.Println(fmt.Errorf("translation to %s: %w", language, err))
+		return response
+	}
+	return translated
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// # Trigger
+//
+// This struct describes a spontaneous reply: when a message matches `Pattern` or contains one of `Keywords`,
+// the bot answers with `Reply`, with the model output for `Prompt`, or with a reaction GIF for `GifQuery`.
+// `{message}` in `Prompt` and `GifQuery` is replaced by the triggering message.
+type Trigger struct {
+	Name     string   `json:"name"`
+	Pattern  string   `json:"pattern,omitempty"`  // Regular expression, e.g. `(?i)\bmondays?\b`.
+	Keywords []string `json:"keywords,omitempty"` // Case-insensitive substrings.
+	Channels []string `json:"channels,omitempty"` // Channels the trigger is active in, all if empty.
+	Cooldown int      `json:"cooldown,omitempty"` // Seconds before the trigger fires again in the same channel.
+
+	Reply    string `json:"reply,omitempty"`
+	Prompt   string `json:"prompt,omitempty"`
+	GifQuery string `json:"gif_query,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// # Matches
+//
+// This function reports whether the trigger fires on the message.
+func (trigger *Trigger) Matches(message Message) bool {
+	if len(trigger.Channels) > 0 {
+		active := false
+		for _, channel := range trigger.Channels {
+			active = active || channel == message.Channel
+		}
+		if !active {
+			return false
+		}
+	}
+
+	if trigger.pattern != nil && trigger.pattern.MatchString(message.Text) {
+		return true
+	}
+	text := strings.ToLower(message.Text)
+	for _, keyword := range trigger.Keywords {
+		if keyword != "" && strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// # Expand placeholders
+//
+// This function replaces `{message}` with the triggering message.
+func (trigger *Trigger) expand(text string, message Message) string {
+	return strings.ReplaceAll(text, "{message}", message.Text)
+}
+
+// # Trigger engine
+//
+// This struct holds the triggers loaded from a JSON file, and when each of them last fired in each channel.
+type TriggerEngine struct {
+	path string
+
+	mu        sync.Mutex
+	triggers  []*Trigger
+	last_fire map[string]time.Time // Keyed by trigger name and channel.
+}
+
+// # Load trigger engine
+//
+// This function loads the triggers from the JSON array at `path`.
+func LoadTriggerEngine(path string) (*TriggerEngine, error) {
+	engine := &TriggerEngine{path: path, last_fire: map[string]time.Time{}}
+	if err := engine.Reload(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// # Reload triggers
+//
+// This function reads the trigger file again. Cooldowns in progress are kept; on error, the current triggers are kept.
+func (engine *TriggerEngine) Reload() error {
+	data, err := os.ReadFile(engine.path)
+	if err != nil {
+		return err
+	}
+
+	var triggers []*Trigger
+	if err := json.Unmarshal(data, &triggers); err != nil {
+		return fmt.Errorf("invalid triggers %s: %w", engine.path, err)
+	}
+	for i, trigger := range triggers {
+		if trigger.Name == "" {
+			trigger.Name = fmt.Sprintf("trigger-%d", i+1)
+		}
+		if trigger.Pattern == "" && len(trigger.Keywords) == 0 {
+			return fmt.Errorf("trigger %q has neither pattern nor keywords", trigger.Name)
+		}
+		if trigger.Reply == "" && trigger.Prompt == "" && trigger.GifQuery == "" {
+			return fmt.Errorf("trigger %q has no reply, prompt or gif_query", trigger.Name)
+		}
+		if trigger.Pattern != "" {
+			trigger.pattern, err = regexp.Compile(trigger.Pattern)
+			if err != nil {
+				return fmt.Errorf("trigger %q: %w", trigger.Name, err)
+			}
+		}
+	}
+
+	engine.mu.Lock()
+	engine.triggers = triggers
+	engine.mu.Unlock()
+	return nil
+}
+
+// # Match
+//
+// This function returns the first trigger firing on the message, and starts its cooldown in the channel.
+// Triggers in cooldown are skipped. A nil engine has no triggers.
+func (engine *TriggerEngine) Match(message Message) (*Trigger, bool) {
+	if engine == nil {
+		return nil, false
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	now := time.Now()
+	for _, trigger := range engine.triggers {
+		if !trigger.Matches(message) {
+			continue
+		}
+		key := trigger.Name + "\x00" + message.Channel
+		if now.Sub(engine.last_fire[key]) < time.Duration(trigger.Cooldown)*time.Second {
+			continue
+		}
+		engine.last_fire[key] = now
+		return trigger, true
+	}
+	return nil, false
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const LINKS_PROMPT_HEADER = "Links shared in the message:"
+
+const (
+	UNFURL_MAX_LINKS     = 2    // Links fetched per message, the others are left alone.
+	UNFURL_MAX_TEXT      = 1000 // Runes of page text given to the model per link.
+	UNFURL_MAX_REDIRECTS = 3
+)
+
+const DEFAULT_UNFURL_MAX_BYTES = 512 * 1024
+
+var (
+	url_pattern         = regexp.MustCompile(`https?://[^\s<>"']+`)
+	title_pattern       = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	description_pattern = regexp.MustCompile(`(?is)<meta[^>]+(?:name|property)=["'](?:og:)?description["'][^>]*>`)
+	content_pattern     = regexp.MustCompile(`(?is)content=["']([^"']*)["']`)
+	invisible_pattern   = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head)[^>]*>.*?</(script|style|noscript|svg|head)>`)
+	tag_pattern         = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// # Link
+//
+// This struct is what the bot read of a page linked in a message.
+type Link struct {
+	URL         string
+	Title       string
+	Description string
+	Text        string // Readable text of the page, cut to `UNFURL_MAX_TEXT` runes.
+}
+
+// # Link unfurler
+//
+// This struct fetches the pages linked in the messages, so the model can comment on them.
+// Only hosts passing the allow and deny lists are fetched; a host matches a list entry equal to it or one of its parent domains.
+// Unless explicitly allowed, hosts resolving to loopback, private or link-local addresses are refused,
+// so users can't make the bot probe its own network. A nil unfurler fetches nothing.
+type LinkUnfurler struct {
+	Allow    []string // Hosts allowed, empty for all.
+	Deny     []string // Hosts refused.
+	MaxBytes int64    // Bytes read per page, the rest is ignored.
+
+	public  *http.Client // For the hosts of the internet.
+	allowed *http.Client // For the explicitly allowed hosts, which may be private.
+}
+
+// # Create a new link unfurler
+//
+// This function creates an unfurler from comma-separated allow and deny lists of hosts.
+func NewLinkUnfurler(allow string, deny string, timeout time.Duration, max_bytes int64) *LinkUnfurler {
+	unfurler := &LinkUnfurler{MaxBytes: max_bytes}
+	for _, host := range strings.Split(allow, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			unfurler.Allow = append(unfurler.Allow, host)
+		}
+	}
+	for _, host := range strings.Split(deny, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			unfurler.Deny = append(unfurler.Deny, host)
+		}
+	}
+	public_dialer := &net.Dialer{Timeout: timeout, Control: refusePrivateAddresses}
+	unfurler.public = &http.Client{
+		Timeout:       timeout,
+		Transport:     &http.Transport{DialContext: public_dialer.DialContext, Proxy: nil},
+		CheckRedirect: unfurler.checkRedirect,
+	}
+	unfurler.allowed = &http.Client{Timeout: timeout, CheckRedirect: unfurler.checkRedirect}
+	return unfurler
+}
+
+// # Refuse private addresses
+//
+// This function is the dialer hook refusing connections to the addresses of the local network.
+func refusePrivateAddresses(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to fetch from the local address %s", host)
+	}
+	return nil
+}
+
+// # Match host
+//
+// This function reports whether the host is one of the domains, or a subdomain of one.
+func matchHost(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// # Check host
+//
+// This function returns an error when the host of the URL may not be fetched.
+func (unfurler *LinkUnfurler) checkHost(link *url.URL) error {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return fmt.Errorf("unsupported link scheme %q", link.Scheme)
+	}
+	if matchHost(link.Hostname(), unfurler.Deny) || (len(unfurler.Allow) > 0 && !matchHost(link.Hostname(), unfurler.Allow)) {
+		return fmt.Errorf("links to %s are not allowed", link.Hostname())
+	}
+	return nil
+}
+
+// # Check redirect
+//
+// This function applies the host lists to the redirects. Redirects between allowed and other hosts are refused,
+// since they would go through the wrong client.
+func (unfurler *LinkUnfurler) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > UNFURL_MAX_REDIRECTS {
+		return errors.New("too many redirects")
+	}
+	if matchHost(request.URL.Hostname(), unfurler.Allow) != matchHost(via[0].URL.Hostname(), unfurler.Allow) {
+		return fmt.Errorf("redirect from %s to %s", via[0].URL.Hostname(), request.URL.Hostname())
+	}
+	return unfurler.checkHost(request.URL)
+}
+
+// # Unfurl
+//
+// This function fetches a page and extracts its title, description and readable text.
+// Only HTML and plain text pages are read.
+func (unfurler *LinkUnfurler) Unfurl(ctx context.Context, raw_url string) (Link, error) {
+	link := Link{URL: raw_url}
+	parsed, err := url.Parse(raw_url)
+	if err != nil {
+		return link, err
+	}
+	if err := unfurler.checkHost(parsed); err != nil {
+		return link, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, raw_url, nil)
+	if err != nil {
+		return link, err
+	}
+	request.Header.Set("User-Agent", "meme-chatbot link preview")
+	request.Header.Set("Accept", "text/html, text/plain")
+	client := unfurler.public
+	if matchHost(parsed.Hostname(), unfurler.Allow) {
+		client = unfurler.allowed
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return link, err
+	}
+	defer resp.Body.Close() // Close the response body
+
+	if resp.StatusCode != http.StatusOK {
+		return link, fmt.Errorf("fetching %s: %s", raw_url, resp.Status)
+	}
+	media_type, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if media_type != "text/html" && media_type != "text/plain" {
+		return link, fmt.Errorf("not a page: %s is %s", raw_url, media_type)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, unfurler.MaxBytes))
+	if err != nil {
+		return link, err
+	}
+
+	page := strings.ToValidUTF8(string(body), "")
+	if media_type == "text/plain" {
+		link.Text = cutRunes(strings.Join(strings.Fields(page), " "), UNFURL_MAX_TEXT)
+		return link, nil
+	}
+	if match := title_pattern.FindStringSubmatch(page); match != nil {
+		link.Title = cleanHTMLText(match[1])
+	}
+	if meta := description_pattern.FindString(page); meta != "" {
+		if match := content_pattern.FindStringSubmatch(meta); match != nil {
+			link.Description = cleanHTMLText(match[1])
+		}
+	}
+	link.Text = cutRunes(cleanHTMLText(invisible_pattern.ReplaceAllString(page, " ")), UNFURL_MAX_TEXT)
+	return link, nil
+}
+
+// # Clean HTML text
+//
+// This function strips the tags of an HTML fragment, decodes its entities and collapses its whitespace.
+func cleanHTMLText(fragment string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tag_pattern.ReplaceAllString(fragment, " "))), " ")
+}
+
+// # Cut runes
+//
+// This function cuts the text to `limit` runes, with an ellipsis when it was longer.
+func cutRunes(text string, limit int) string {
+	if runes := []rune(text); len(runes) > limit {
+		return string(runes[:limit]) + "…"
+	}
+	return text
+}
+
+// # Unfurl links
+//
+// This function fetches the first links of the text. Links that can't be fetched are skipped, and logged.
+func (unfurler *LinkUnfurler) UnfurlLinks(ctx context.Context, text string) []Link {
+	if unfurler == nil {
+		return nil
+	}
+	var links []Link
+	for _, raw_url := range url_pattern.FindAllString(text, UNFURL_MAX_LINKS) {
+		raw_url = strings.TrimRight(raw_url, ".,;:!?)]}")
+		link, err := unfurler.Unfurl(ctx, raw_url)
+		if err != nil {
+			log.Println(fmt.Errorf("unfurl: %w", err))
+			continue
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// # Inject links
+//
+// This function prepends what was read of the linked pages to the user prompt.
+func InjectLinks(prompt string, links []Link) string {
+	if len(links) == 0 {
+		return prompt
+	}
+
+	var builder strings.Builder
+	builder.WriteString(LINKS_PROMPT_HEADER)
+	builder.WriteString("\n")
+	for _, link := range links {
+		builder.WriteString("- ")
+		builder.WriteString(link.URL)
+		if link.Title != "" {
+			builder.WriteString(" (")
+			builder.WriteString(link.Title)
+			builder.WriteString(")")
+		}
+		builder.WriteString("\n")
+		for _, detail := range []string{link.Description, link.Text} {
+			if detail != "" && detail != link.Title {
+				builder.WriteString("  ")
+				builder.WriteString(detail)
+				builder.WriteString("\n")
+			}
+		}
+	}
+	builder.WriteString("\n")
+	builder.WriteString(prompt)
+	return builder.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Literal `\uXXXX` and `\UXXXXXXXX` escapes left in generated text, e.g. by models trained on JSON dumps.
+// A surrogate pair is matched as a whole.
+var unicode_escape_pattern = regexp.MustCompile(`\\u[dD][89abAB][0-9a-fA-F]{2}\\u[dD][c-fC-F][0-9a-fA-F]{2}|\\u[0-9a-fA-F]{4}|\\U[0-9a-fA-F]{8}`)
+
+// Bytes 0x80 to 0x9F as decoded by Windows-1252, which most mojibake goes through.
+var windows_1252_bytes = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B,
+	'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99,
+	'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// # Clean response text
+//
+// This function repairs the text generated by the model, so CJK and emoji output renders correctly:
+// it drops invalid UTF-8 (e.g. a character cut by the token limit), decodes literal `\uXXXX` escapes,
+// and undoes mojibake, UTF-8 decoded as Latin-1 or Windows-1252.
+func CleanResponseText(text string) string {
+	text = strings.ReplaceAll(strings.ToValidUTF8(text, ""), string(utf8.RuneError), "")
+	text = unescapeUnicode(text)
+	return fixMojibake(text)
+}
+
+// # Unescape unicode
+//
+// This function replaces literal unicode escapes by the characters, joining UTF-16 surrogate pairs.
+// Escapes that don't make a valid character are kept.
+func unescapeUnicode(text string) string {
+	if !strings.Contains(text, `\u`) && !strings.Contains(text, `\U`) {
+		return text
+	}
+	return unicode_escape_pattern.ReplaceAllStringFunc(text, func(escape string) string {
+		if strings.HasPrefix(escape, `\U`) {
+			code, _ := strconv.ParseUint(escape[2:], 16, 32)
+			if !utf8.ValidRune(rune(code)) {
+				return escape
+			}
+			return string(rune(code))
+		}
+
+		high, _ := strconv.ParseUint(escape[2:6], 16, 16)
+		if len(escape) == 12 {
+			low, _ := strconv.ParseUint(escape[8:12], 16, 16)
+			return string(utf16.DecodeRune(rune(high), rune(low)))
+		}
+		if utf16.IsSurrogate(rune(high)) {
+			return escape // Half of a pair.
+		}
+		return string(rune(high))
+	})
+}
+
+// # Fix mojibake
+//
+// This function re-encodes text whose characters are all single bytes in Latin-1 or Windows-1252,
+// and returns the result if it's valid UTF-8 with multibyte characters, e.g. `å¥½` becomes `好`.
+// Other text is returned unchanged.
+func fixMojibake(text string) string {
+	raw := make([]byte, 0, len(text))
+	multibyte := false
+	for _, char := range text {
+		switch value, found := windows_1252_bytes[char]; {
+		case found:
+			raw = append(raw, value)
+			multibyte = true
+		case char < 0x80:
+			raw = append(raw, byte(char))
+		case char <= 0xFF:
+			raw = append(raw, byte(char))
+			multibyte = true
+		default:
+			return text // A real non-Latin character, the text is not mojibake.
+		}
+	}
+	if !multibyte || !utf8.Valid(raw) {
+		return text
+	}
+	return string(raw)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	CASSETTE_RECORD = "record" // Requests go to the real services, and the traffic is written to the cassette.
+	CASSETTE_REPLAY = "replay" // Requests are answered from the cassette, nothing goes out.
+)
+
+const CASSETTE_REDACTED = "REDACTED"
+
+// Secrets of the request bodies, kept out of the cassettes: JSON fields, then form fields.
+var cassette_secrets = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`("(?:password|api_key|apikey|token)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + CASSETTE_REDACTED + `"`},
+	{regexp.MustCompile(`((?:^|&)(?:password|api_key|apikey|token)=)[^&]*`), "${1}" + CASSETTE_REDACTED},
+}
+
+// # Cassette interaction
+//
+// This struct is a request with its response, as written to a cassette.
+type CassetteInteraction struct {
+	Method string `json:"method"`
+	Url    string `json:"url"`
+	Body   string `json:"body,omitempty"` // Request body, secrets redacted.
+
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	Response string      `json:"response"`
+}
+
+// # Cassette
+//
+// This struct is an HTTP transport recording the traffic of the bot with its backends to a JSON lines file, a cassette,
+// or replaying it from one, VCR-style: integration runs of the pipeline and the frontends then need no model server,
+// and always get the same answers.
+//
+// On replay, a request gets the response recorded for the same method, URL and body, in the order they were recorded;
+// a request recorded with another body, e.g. a prompt with another date, falls back to the next response recorded
+// for its method and URL. Requests not recorded fail, but for the GET requests recorded fewer times, see `find`.
+type Cassette struct {
+	Mode string
+
+	mu           sync.Mutex
+	file         *os.File // Open for appending when recording.
+	interactions []CassetteInteraction
+	used         []bool
+	transport    http.RoundTripper
+}
+
+// # Open cassette
+//
+// This function opens the cassette at `path`: created or appended to when recording, read when replaying.
+// Recording requests go through `transport`.
+func OpenCassette(path string, mode string, transport http.RoundTripper) (*Cassette, error) {
+	cassette := &Cassette{Mode: mode, transport: transport}
+	switch mode {
+	case CASSETTE_RECORD:
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		cassette.file = file
+	case CASSETTE_REPLAY:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		for line_number := 1; scanner.Scan(); line_number++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var interaction CassetteInteraction
+			if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line_number, err)
+			}
+			cassette.interactions = append(cassette.interactions, interaction)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		cassette.used = make([]bool, len(cassette.interactions))
+	default:
+		return nil, fmt.Errorf("cassette mode must be %s or %s", CASSETTE_RECORD, CASSETTE_REPLAY)
+	}
+	return cassette, nil
+}
+
+// # Redact secrets
+//
+// This function replaces the passwords and API keys of a request body.
+func redactSecrets(body string) string {
+	for _, secret := range cassette_secrets {
+		body = secret.pattern.ReplaceAllString(body, secret.replacement)
+	}
+	return body
+}
+
+// # Round trip
+//
+// This function records or replays a request, see `Cassette`.
+func (cassette *Cassette) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	interaction := CassetteInteraction{Method: request.Method, Url: request.URL.String(), Body: redactSecrets(string(body))}
+
+	if cassette.Mode == CASSETTE_REPLAY {
+		recorded, found := cassette.find(interaction)
+		if !found {
+			return nil, fmt.Errorf("no recorded response to %s %s", request.Method, interaction.Url)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+			StatusCode:    recorded.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorded.Header.Clone(),
+			Body:          io.NopCloser(strings.NewReader(recorded.Response)),
+			ContentLength: int64(len(recorded.Response)),
+			Request:       request,
+		}, nil
+	}
+
+	resp, err := cassette.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err // Failed connections aren't recorded, the replay would have nothing to answer with.
+	}
+	response, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(response))
+
+	interaction.Status, interaction.Header, interaction.Response = resp.StatusCode, resp.Header, string(response)
+	cassette.record(interaction)
+	return resp, nil
+}
+
+// # Record interaction
+//
+// This function appends an interaction to the cassette. Failures are logged, the request itself succeeded.
+func (cassette *Cassette) record(interaction CassetteInteraction) {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	if _, err := cassette.file.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+// # Find recorded interaction
+//
+// This function returns the first unused interaction matching the request, exactly, or by method and URL only.
+// GET requests replayed more often than recorded get the last response again.
+func (cassette *Cassette) find(request CassetteInteraction) (CassetteInteraction, bool) {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+
+	for _, exact := range []bool{true, false} {
+		for i, recorded := range cassette.interactions {
+			if cassette.used[i] || recorded.Method != request.Method || recorded.Url != request.Url || (exact && recorded.Body != request.Body) {
+				continue
+			}
+			cassette.used[i] = true
+			return recorded, true
+		}
+	}
+
+	// Polls, like the health checks, get the last response again.
+	if request.Method == http.MethodGet {
+		for i := len(cassette.interactions) - 1; i >= 0; i-- {
+			if recorded := cassette.interactions[i]; recorded.Method == request.Method && recorded.Url == request.Url {
+				return recorded, true
+			}
+		}
+	}
+	return CassetteInteraction{}, false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// # Chat through a cassette
+//
+// This function answers the messages with a bot whose HTTP traffic goes through the cassette at `path`,
+// talking to the backend at `server:port`, and returns the replies.
+func chatThroughCassette(t *testing.T, path string, mode string, server string, port int, messages []Message) []string {
+	cassette, err := OpenCassette(path, mode, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = cassette
+	defer func() { http.DefaultTransport = default_transport }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := NewRequestQueue()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go modelIoHandler(ctx, server, port, COMPLETIONS_ENDPOINT, requests, wg, nil)
+	defer func() {
+		cancel()
+		wg.Wait()
+		if cassette.file != nil {
+			cassette.file.Close()
+		}
+	}()
+
+	bot := NewBot(NewLlmClient(server, port), LlmGenerationParameters{ModelName: MOCK_MODEL, MaxTokens: 64, Temperature: 0.7}, requests)
+	var replies []string
+	for _, message := range messages {
+		replies = append(replies, bot.HandleMessage(message).Text)
+	}
+	return replies
+}
+
+func TestChatReplaysCassette(t *testing.T) {
+	messages := []Message{
+		{ID: "1", Channel: "general", User: "alice", UserName: "Alice", Text: "hello there"},
+		{ID: "2", Channel: "general", User: "bob", UserName: "Bob", Text: "tell me a meme"},
+	}
+	path := filepath.Join(t.TempDir(), "chat.cassette")
+
+	backend := httptest.NewServer((&MockBackend{Echo: true}).Handler())
+	host, port_text, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(port_text)
+	recorded := chatThroughCassette(t, path, CASSETTE_RECORD, host, port, messages)
+	backend.Close()
+
+	for i, reply := range recorded {
+		if reply == "" || reply == GENERATION_ERROR_REPLY {
+			t.Fatalf("recorded reply %d to %q: %q", i, messages[i].Text, reply)
+		}
+	}
+
+	// The backend is gone: the replies can only come from the cassette.
+	replayed := chatThroughCassette(t, path, CASSETTE_REPLAY, host, port, messages)
+	for i := range messages {
+		if replayed[i] != recorded[i] {
+			t.Errorf("replayed reply %d to %q = %q, recorded %q", i, messages[i].Text, replayed[i], recorded[i])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const CHAT_COMPLETIONS_ENDPOINT = "v1/chat/completions"
+
+const IMAGE_DEFAULT_PROMPT = "Roast this meme in one or two sentences."
+
+// # Chat message content part
+//
+// This struct is a part of a multimodal message, as defined by the OpenAI API
+// and implemented by the llama-cpp-python LLaVA chat handlers.
+type LlmContentPart struct {
+	Type     string         `json:"type"`
+	Text     string         `json:"text,omitempty"`
+	ImageUrl *LlmContentUrl `json:"image_url,omitempty"`
+}
+
+type LlmContentUrl struct {
+	Url string `json:"url"`
+}
+
+type LlmChatMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"` // Either a string or a list of `LlmContentPart`.
+}
+
+type LlmChatRequest struct {
+	ModelName     string           `json:"model"`
+	Messages      []LlmChatMessage `json:"messages"`
+	TopK          int              `json:"top_k"`
+	TopP          float64          `json:"top_p"`
+	RepeatPenalty float64          `json:"repeat_penalty"`
+	Temperature   float64          `json:"temperature"`
+	MaxTokens     int              `json:"max_tokens"`
+}
+
+type LlmChatResponse struct {
+	Choices []struct {
+		Index   int `json:"index"`
+		Message struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *LlmUsage `json:"usage"`
+}
+
+// # Image data URL
+//
+// This function encodes an image as a base64 data URL, which LLaVA-style backends accept in place of an image URL.
+// The MIME type is sniffed from the data.
+func ImageDataUrl(image_data []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image_data), base64.StdEncoding.EncodeToString(image_data))
+}
+
+// # Describe image
+//
+// This function sends an image and a prompt to the chat completions endpoint of a vision-capable backend
+// (e.g. llama-cpp-python started with `--chat_format llava-1-5 --clip_model_path ...`).
+//
+// The sampling parameters are taken from `params`; its prompt is ignored.
+func (client *LlmClient) DescribeImage(params LlmGenerationParameters, prompt string, image_data []byte) (string, error) {
+	mime_type := http.DetectContentType(image_data)
+	if !strings.HasPrefix(mime_type, "image/") {
+		return "", fmt.Errorf("unsupported attachment type %s", mime_type)
+	}
+
+	params.CheckAndFix()
+	request := LlmChatRequest{
+		ModelName: params.ModelName,
+		Messages: []LlmChatMessage{{
+			Role: "user",
+			Content: []LlmContentPart{
+				{Type: "image_url", ImageUrl: &LlmContentUrl{Url: ImageDataUrl(image_data)}},
+				{Type: "text", Text: prompt},
+			},
+		}},
+		TopK:          params.TopK,
+		TopP:          params.TopP,
+		RepeatPenalty: params.RepeatPenalty,
+		Temperature:   params.Temperature,
+		MaxTokens:     params.MaxTokens,
+	}
+
+	request_body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Post(client.Url(CHAT_COMPLETIONS_ENDPOINT), "application/json", strings.NewReader(string(request_body)))
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() // Close the response body
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := ParseBackendError(resp.StatusCode, body); err != nil {
+		return "", fmt.Errorf("chat completion failed: %w", err)
+	}
+
+	var chat_response LlmChatResponse
+	if err := json.Unmarshal(body, &chat_response); err != nil {
+		return "", err
+	}
+	if len(chat_response.Choices) == 0 {
+		return "", fmt.Errorf("chat completion returned no choice")
+	}
+	return CleanResponseText(chat_response.Choices[0].Message.Content), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const WARM_UP_PROMPT = "Hi"
+
+const WARM_UP_CHANNEL = "warm-up" // Channel of the warm-up requests, in the logs.
+
+const KEEP_ALIVE_CHECK_INTERVAL = time.Minute // Longest delay between two idleness checks.
+
+// # Warm up
+//
+// This function sends a one-token generation as a background request, so the backend loads the model
+// before someone waits for it, and logs how long it took.
+func (bot *Bot) WarmUp() error {
+	if bot.DryRun {
+		return nil
+	}
+	params := bot.Params().SetPrompt(FormatPrompt(WARM_UP_PROMPT))
+	params.MaxTokens = 1
+
+	result := bot.generateResult(Message{Channel: WARM_UP_CHANNEL, User: WARM_UP_CHANNEL, Background: true}, params)
+	if result.Err != nil {
+		return fmt.Errorf("warm-up: %w", result.Err)
+	}
+	log.Printf("model warmed up in %s\n", result.FinishedAt.Sub(result.SubmittedAt).Round(time.Millisecond))
+	return nil
+}
+
+// # Keep alive
+//
+// This function warms the model up whenever no request was sent for `interval`, until the context is done,
+// so backends unloading idle models (Ollama, llama-swap) keep it loaded and the first message of the day is answered as fast as the others.
+// An interval of 0 disables the pings.
+func (bot *Bot) KeepAlive(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(KEEP_ALIVE_CHECK_INTERVAL, interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(bot.requests.LastPush()) < interval {
+				continue
+			}
+			if err := bot.WarmUp(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}